@@ -0,0 +1,218 @@
+package main
+
+import (
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gocql/gocql"
+)
+
+// The abuse scan looks through the creates in meow_events every
+// ABUSE_SCAN_INTERVAL for actors posting in ways people don't:
+//
+//   - burst: ABUSE_BURST_THRESHOLD or more meows within ABUSE_BURST_WINDOW
+//   - regular: at least ABUSE_REGULAR_MIN_MEOWS meows spaced almost exactly
+//     the same (the intervals' coefficient of variation is under 5%)
+//   - scheduled: at least ABUSE_REGULAR_MIN_MEOWS meows over three or more
+//     hours, and in 80% or more of those hours a meow in the same minute,
+//     like a cron job firing at midnight
+//
+// The findings are only a lead for moderators, nothing acts on them
+// automatically.
+
+type abuseConfig struct {
+	Interval       time.Duration
+	Window         time.Duration
+	BurstWindow    time.Duration
+	BurstThreshold int
+	RegularMin     int
+}
+
+func abuseConfigFromEnv() abuseConfig {
+	return abuseConfig{
+		Interval:       envDuration("ABUSE_SCAN_INTERVAL", time.Hour),
+		Window:         envDuration("ABUSE_SCAN_WINDOW", 24*time.Hour),
+		BurstWindow:    envDuration("ABUSE_BURST_WINDOW", time.Minute),
+		BurstThreshold: envInt("ABUSE_BURST_THRESHOLD", 20),
+		RegularMin:     envInt("ABUSE_REGULAR_MIN_MEOWS", 10),
+	}
+}
+
+type SuspiciousActor struct {
+	DID     string   `json:"did"`
+	Meows   int      `json:"meows"`
+	Signals []string `json:"signals"`
+	// MaxBurst is the most meows seen within one burst window.
+	MaxBurst int `json:"max_burst"`
+	// IntervalCV is the coefficient of variation of the time between
+	// meows, near 0 for clockwork posting.
+	IntervalCV    float64 `json:"interval_cv,omitempty"`
+	Deprioritized bool    `json:"deprioritized"`
+}
+
+type AbuseReport struct {
+	GeneratedAt time.Time         `json:"generated_at"`
+	Since       time.Time         `json:"since"`
+	Actors      []SuspiciousActor `json:"actors"`
+}
+
+var abuseHeuristics = abuseConfigFromEnv()
+
+var abuseScan struct {
+	mu     sync.Mutex
+	report *AbuseReport
+}
+
+// createdTimes reads when each actor created meows since the given time,
+// oldest first.
+func createdTimes(session *gocql.Session, since time.Time) (map[string][]int64, error) {
+	times := map[string][]int64{}
+	for day := since.UTC().Truncate(24 * time.Hour); !day.After(time.Now()); day = day.AddDate(0, 0, 1) {
+		iter := session.Query(`
+			SELECT time_us, did, op FROM meow_events WHERE day = ? AND time_us >= ?`,
+			day.Format("2006-01-02"), since.UnixMicro(),
+		).Iter()
+		var timeUS int64
+		var did, op string
+		for iter.Scan(&timeUS, &did, &op) {
+			if op == "create" {
+				times[did] = append(times[did], timeUS)
+			}
+		}
+		if err := iter.Close(); err != nil {
+			return nil, err
+		}
+	}
+	return times, nil
+}
+
+// analyzeActor applies the heuristics to one actor's sorted create times.
+func analyzeActor(cfg abuseConfig, did string, times []int64) (SuspiciousActor, bool) {
+	a := SuspiciousActor{DID: did, Meows: len(times)}
+
+	window := cfg.BurstWindow.Microseconds()
+	start := 0
+	for end := range times {
+		for times[end]-times[start] > window {
+			start++
+		}
+		a.MaxBurst = max(a.MaxBurst, end-start+1)
+	}
+	if a.MaxBurst >= cfg.BurstThreshold {
+		a.Signals = append(a.Signals, "burst")
+	}
+
+	if len(times) >= cfg.RegularMin {
+		var sum, sumSq float64
+		for i := 1; i < len(times); i++ {
+			d := float64(times[i] - times[i-1])
+			sum += d
+			sumSq += d * d
+		}
+		n := float64(len(times) - 1)
+		mean := sum / n
+		if mean > 0 {
+			a.IntervalCV = math.Sqrt(max(sumSq/n-mean*mean, 0)) / mean
+			if a.IntervalCV < 0.05 {
+				a.Signals = append(a.Signals, "regular")
+			}
+		}
+
+		// counted per hour, so a single burst doesn't look like a schedule
+		hours := map[int64]bool{}
+		minutes := map[int]map[int64]bool{}
+		top := 0
+		for _, t := range times {
+			hour := t / time.Hour.Microseconds()
+			m := time.UnixMicro(t).Minute()
+			if minutes[m] == nil {
+				minutes[m] = map[int64]bool{}
+			}
+			hours[hour] = true
+			minutes[m][hour] = true
+			top = max(top, len(minutes[m]))
+		}
+		if len(hours) >= 3 && float64(top) >= 0.8*float64(len(hours)) {
+			a.Signals = append(a.Signals, "scheduled")
+		}
+	}
+
+	return a, len(a.Signals) > 0
+}
+
+func buildAbuseReport(session *gocql.Session, cfg abuseConfig) (*AbuseReport, error) {
+	report := &AbuseReport{GeneratedAt: time.Now().UTC(), Since: time.Now().UTC().Add(-cfg.Window)}
+	times, err := createdTimes(session, report.Since)
+	if err != nil {
+		return nil, err
+	}
+	report.Actors = []SuspiciousActor{}
+	for did, t := range times {
+		sort.Slice(t, func(i, j int) bool { return t[i] < t[j] })
+		if a, ok := analyzeActor(cfg, did, t); ok {
+			report.Actors = append(report.Actors, a)
+		}
+	}
+	sort.Slice(report.Actors, func(i, j int) bool {
+		if len(report.Actors[i].Signals) != len(report.Actors[j].Signals) {
+			return len(report.Actors[i].Signals) > len(report.Actors[j].Signals)
+		}
+		return report.Actors[i].Meows > report.Actors[j].Meows
+	})
+	return report, nil
+}
+
+func runAbuseScan(session *gocql.Session, cfg abuseConfig) {
+	for {
+		report, err := buildAbuseReport(session, cfg)
+		if err != nil {
+			log.Println("abuse scan error:", err)
+		} else {
+			if len(report.Actors) > 0 {
+				log.Printf("abuse scan found %d suspicious actors", len(report.Actors))
+			}
+			abuseScan.mu.Lock()
+			abuseScan.report = report
+			abuseScan.mu.Unlock()
+		}
+		time.Sleep(cfg.Interval)
+	}
+}
+
+// getAbuseReport returns the latest abuse scan, or runs one right away
+// with ?refresh=true.
+func getAbuseReport(session *gocql.Session) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Query("refresh") == "true" {
+			report, err := buildAbuseReport(session, abuseHeuristics)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			abuseScan.mu.Lock()
+			abuseScan.report = report
+			abuseScan.mu.Unlock()
+		}
+
+		abuseScan.mu.Lock()
+		report := abuseScan.report
+		abuseScan.mu.Unlock()
+		if report == nil {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "no abuse scan has finished yet"})
+			return
+		}
+		// whether an actor is deprioritized may have changed since the scan
+		resp := *report
+		resp.Actors = make([]SuspiciousActor, len(report.Actors))
+		for i, a := range report.Actors {
+			a.Deprioritized = moderation.deprioritized(a.DID)
+			resp.Actors[i] = a
+		}
+		c.JSON(http.StatusOK, resp)
+	}
+}
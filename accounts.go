@@ -0,0 +1,93 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/gocql/gocql"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Jetstream sends an account event when an account's hosting status
+// changes. The meows of an inactive account, deactivated, suspended or
+// taken down, are left out of every read until it is active again, but
+// stay indexed. Those of a deleted account are deleted one by one like
+// delete commits, going through the change feed, the outbox and
+// DELETE_GRACE_PERIOD, and stay left out of reads in case any come back,
+// e.g. from a backfill.
+//
+// Statuses live in account_status, written with the event's time_us as
+// timestamp so that a late event doesn't undo a newer one, and are held
+// in memory with the moderation state.
+
+var accountEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "meowview_account_events_total",
+	Help: "Jetstream account events, by status: active, deactivated, suspended, takendown or deleted.",
+}, []string{"status"})
+
+func createAccountTables(session *gocql.Session) error {
+	return session.Query(`
+		CREATE TABLE IF NOT EXISTS account_status (
+			did TEXT PRIMARY KEY,
+			status TEXT,
+			updated_at TIMESTAMP
+		)`).Exec()
+}
+
+// accountChanged applies an account event.
+func accountChanged(session *gocql.Session, msg WebSocketMessage) {
+	did := msg.DID
+	if validateDID(did) != did {
+		return
+	}
+	status := msg.Account.Status
+	if msg.Account.Active {
+		status = "active"
+	} else if status == "" {
+		status = "deactivated"
+	}
+	accountEvents.WithLabelValues(status).Inc()
+
+	var err error
+	if status == "active" {
+		err = session.Query(`DELETE FROM account_status USING TIMESTAMP ? WHERE did = ?`, msg.TimeUS, did).Exec()
+	} else {
+		err = session.Query(`
+			INSERT INTO account_status (did, status, updated_at) VALUES (?, ?, ?)
+			USING TIMESTAMP ?`,
+			did, status, time.Now(), msg.TimeUS,
+		).Exec()
+	}
+	if err != nil {
+		log.Println("write account_status error:", err)
+	}
+	moderation.setInactive(did, status)
+	purgeCDNLater(cdnAllMeowsKey, cdnActorKey(did))
+
+	if status == "deleted" {
+		purgeAccount(session, did, msg.TimeUS)
+	}
+}
+
+// purgeAccount deletes every meow of a deleted account.
+func purgeAccount(session *gocql.Session, did string, timeUS int64) {
+	iter := session.Query(`SELECT rkey FROM meows_by_actor WHERE did = ?`, did).Iter()
+	var rkeys []string
+	var rkey string
+	for iter.Scan(&rkey) {
+		rkeys = append(rkeys, rkey)
+	}
+	if err := iter.Close(); err != nil {
+		log.Println("read meows_by_actor error:", err)
+		return
+	}
+	for _, rkey := range rkeys {
+		ev := meowEvent{Meow: Meow{DID: did, Rkey: rkey, TimeUS: timeUS}, Op: "delete"}
+		sequence.assign(&ev)
+		ingestEvent(session, ev)
+	}
+	if len(rkeys) > 0 {
+		log.Printf("account %s was deleted, deleted its %d meows", did, len(rkeys))
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sort"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gocql/gocql"
+)
+
+// createActorEmotionTables creates the (did, emotion) counters behind
+// getActorEmotionBreakdown. Meows count under their effective emotion;
+// inferred counts those whose emotion was inferred.
+func createActorEmotionTables(session *gocql.Session) error {
+	return session.Query(`
+		CREATE TABLE IF NOT EXISTS emotion_counts_by_actor (
+			did TEXT,
+			emotion TEXT,
+			meows COUNTER,
+			inferred COUNTER,
+			PRIMARY KEY ((did), emotion)
+		)`).Exec()
+}
+
+// countActorEmotion adds delta to how often m's author meowed with its
+// effective emotion.
+func countActorEmotion(session *gocql.Session, m Meow, delta int64) {
+	emotion, inferred := effectiveEmotion(m)
+	if emotion == "" {
+		return
+	}
+	var inferredDelta int64
+	if inferred {
+		inferredDelta = delta
+	}
+	err := session.Query(`
+		UPDATE emotion_counts_by_actor SET meows = meows + ?, inferred = inferred + ?
+		WHERE did = ? AND emotion = ?`,
+		delta, inferredDelta, m.DID, emotion,
+	).Exec()
+	if err != nil {
+		log.Println("update emotion_counts_by_actor error:", err)
+	}
+}
+
+type ActorEmotion struct {
+	Emotion string `json:"emotion"`
+	Meows   int64  `json:"meows"`
+	// Inferred is how many of Meows had their emotion inferred
+	Inferred int64 `json:"inferred"`
+	// Share is Meows as a fraction of the actor's meows with an emotion
+	Share float64 `json:"share"`
+}
+
+type ActorEmotionBreakdown struct {
+	DID string `json:"did"`
+	// Total counts the actor's meows with an emotion
+	Total int64 `json:"total"`
+	// Dominant is the emotion the actor meows with most, empty without any
+	Dominant string         `json:"dominant,omitempty"`
+	Emotions []ActorEmotion `json:"emotions"`
+}
+
+// getActorEmotionBreakdown returns the histogram of an actor's emotions,
+// most used first, and the dominant one, e.g. for profile pages.
+func getActorEmotionBreakdown(session *gocql.Session) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		did := c.Query("did")
+		if did == "" || validateDID(did) != did {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid did"})
+			return
+		}
+
+		b := ActorEmotionBreakdown{DID: did, Emotions: []ActorEmotion{}}
+		iter := session.Query(`SELECT emotion, meows, inferred FROM cat.emotion_counts_by_actor WHERE did = ?`, did).
+			WithContext(c.Request.Context()).Iter()
+		var e ActorEmotion
+		for iter.Scan(&e.Emotion, &e.Meows, &e.Inferred) {
+			// every meow with it was deleted
+			if e.Meows > 0 {
+				b.Emotions = append(b.Emotions, e)
+				b.Total += e.Meows
+			}
+			e = ActorEmotion{}
+		}
+		if err := iter.Close(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		sort.Slice(b.Emotions, func(i, j int) bool {
+			if b.Emotions[i].Meows != b.Emotions[j].Meows {
+				return b.Emotions[i].Meows > b.Emotions[j].Meows
+			}
+			return b.Emotions[i].Emotion < b.Emotions[j].Emotion
+		})
+		for i := range b.Emotions {
+			b.Emotions[i].Share = float64(b.Emotions[i].Meows) / float64(b.Total)
+		}
+		if len(b.Emotions) > 0 {
+			b.Dominant = b.Emotions[0].Emotion
+		}
+		c.JSON(http.StatusOK, b)
+	}
+}
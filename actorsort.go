@@ -0,0 +1,168 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gocql/gocql"
+)
+
+// getActorMeows takes ?sort=newest (the default), oldest or
+// emotionGrouped. The other orders than newest read meows_by_actor, and
+// take a cursor but no since or until.
+const (
+	actorSortNewest         = "newest"
+	actorSortOldest         = "oldest"
+	actorSortEmotionGrouped = "emotionGrouped"
+)
+
+// emotionGroupScan is how many of an actor's newest meows emotionGrouped
+// groups; older meows aren't in any group.
+var emotionGroupScan = envInt("EMOTION_GROUP_SCAN", 1000)
+
+// getActorMeowsOldest answers getActorMeows?sort=oldest, oldest first.
+// The cursor is a pageCursor of the last meow on the previous page.
+func getActorMeowsOldest(c *gin.Context, session *gocql.Session, did string) {
+	limit, err := actorMeowsGuardrail.parseLimit(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var after *pageCursor
+	if v := c.Query("cursor"); v != "" {
+		cur, err := parsePageCursor(v)
+		if err != nil || cur.DID != did {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid cursor"})
+			return
+		}
+		after = &cur
+	}
+
+	q := `SELECT time_us, rkey, cid, emotion, subject, inferred_emotion FROM meows_by_actor WHERE did = ?`
+	args := []any{did}
+	if after != nil {
+		q += ` AND time_us >= ?`
+		args = append(args, after.TimeUS)
+	}
+	// meows at the cursor's time_us are read again and skipped; rkeys
+	// within a time_us come in descending order. One more than the limit
+	// tells whether there is a next page.
+	iter := session.Query(q+` ORDER BY time_us ASC, rkey DESC`, args...).
+		PageSize(limit + 1).WithContext(c.Request.Context()).Iter()
+	var meows []MeowResponse
+	row := meowRow{DID: did}
+	for len(meows) <= limit && iter.Scan(&row.TimeUS, &row.Rkey, &row.CID, &row.Emotion, &row.Subject, &row.InferredEmotion) {
+		if after == nil || row.TimeUS > after.TimeUS || row.Rkey < after.Rkey {
+			meows = append(meows, row.meow().response())
+		}
+		row = meowRow{DID: did}
+	}
+	if err := iter.Close(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	var cursor string
+	if len(meows) > limit {
+		meows = meows[:limit]
+		last := meows[limit-1]
+		cursor = pageCursor{TimeUS: last.TimeUS, Rkey: last.Rkey, DID: did}.String()
+	}
+	meows = moderation.apply(meows)
+	markPinned(c.Request.Context(), session, did, meows)
+	hydrateRequested(c, meows)
+	if err := embedQuotes(c, session, meows); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	writeMeowList(c, session, meows, cursor, countActor, did)
+}
+
+type EmotionGroup struct {
+	// Emotion is "" for meows without one
+	Emotion string `json:"emotion"`
+	// Count is how many of the scanned meows have the emotion
+	Count int `json:"count"`
+	// Meows are the newest of them, up to the limit
+	Meows []MeowResponse `json:"meows"`
+}
+
+type EmotionGroupedMeows struct {
+	Groups []EmotionGroup `json:"groups"`
+	// Truncated is set when the actor has more meows than were scanned
+	Truncated  bool  `json:"truncated"`
+	IndexLagMs int64 `json:"indexLagMs"`
+}
+
+// getActorMeowsByEmotion answers getActorMeows?sort=emotionGrouped: the
+// actor's newest EMOTION_GROUP_SCAN meows grouped by emotion, the most
+// used first, with the newest limit meows of each. Inferred emotions
+// count for meows without one.
+func getActorMeowsByEmotion(c *gin.Context, session *gocql.Session, did string) {
+	limit, err := actorMeowsGuardrail.parseLimit(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	iter := session.Query(`
+		SELECT time_us, rkey, cid, emotion, subject, inferred_emotion
+		FROM meows_by_actor WHERE did = ? LIMIT ?`,
+		did, emotionGroupScan+1,
+	).WithContext(c.Request.Context()).Iter()
+	var scanned []MeowResponse
+	row := meowRow{DID: did}
+	for iter.Scan(&row.TimeUS, &row.Rkey, &row.CID, &row.Emotion, &row.Subject, &row.InferredEmotion) {
+		scanned = append(scanned, row.meow().response())
+		row = meowRow{DID: did}
+	}
+	if err := iter.Close(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	resp := EmotionGroupedMeows{Groups: []EmotionGroup{}, Truncated: len(scanned) > emotionGroupScan, IndexLagMs: setIndexLag(c)}
+	scanned = moderation.apply(scanned[:min(len(scanned), emotionGroupScan)])
+
+	byEmotion := map[string]*EmotionGroup{}
+	var kept []MeowResponse
+	for _, m := range scanned {
+		emotion := m.Emotion
+		if emotion == "" {
+			emotion = m.InferredEmotion
+		}
+		g := byEmotion[emotion]
+		if g == nil {
+			g = &EmotionGroup{Emotion: emotion}
+			byEmotion[emotion] = g
+		}
+		g.Count++
+		if g.Count <= limit {
+			kept = append(kept, m)
+		}
+	}
+
+	// hydrated together, then dealt out, newest first within each group
+	markPinned(c.Request.Context(), session, did, kept)
+	hydrateRequested(c, kept)
+	if err := embedQuotes(c, session, kept); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	for _, m := range kept {
+		emotion := m.Emotion
+		if emotion == "" {
+			emotion = m.InferredEmotion
+		}
+		byEmotion[emotion].Meows = append(byEmotion[emotion].Meows, m)
+	}
+	for _, g := range byEmotion {
+		resp.Groups = append(resp.Groups, *g)
+	}
+	sort.Slice(resp.Groups, func(i, j int) bool {
+		if resp.Groups[i].Count != resp.Groups[j].Count {
+			return resp.Groups[i].Count > resp.Groups[j].Count
+		}
+		return resp.Groups[i].Emotion < resp.Groups[j].Emotion
+	})
+	c.JSON(http.StatusOK, resp)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sort"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gocql/gocql"
+)
+
+var actorSubjectsGuardrail = newGuardrail("actor_subjects", 100, 1000, 0, 0)
+
+// createActorSubjectTables creates the (did, subject) tables behind
+// getActorSubjects. Counters can't share a table with other columns, so
+// the latest meow time lives next to the counts.
+func createActorSubjectTables(session *gocql.Session) error {
+	err := session.Query(`
+		CREATE TABLE IF NOT EXISTS subjects_by_actor (
+			did TEXT,
+			subject TEXT,
+			last_time_us BIGINT,
+			PRIMARY KEY ((did), subject)
+		)`).Exec()
+	if err != nil {
+		return err
+	}
+	return session.Query(`
+		CREATE TABLE IF NOT EXISTS subject_counts_by_actor (
+			did TEXT,
+			subject TEXT,
+			meows COUNTER,
+			PRIMARY KEY ((did), subject)
+		)`).Exec()
+}
+
+// countActorSubject adds delta to how often m's author meowed at its
+// subject. Adding also records m's time, timestamped with it so an older
+// meow doesn't replace a newer one; a delete leaves the time as it is.
+func countActorSubject(session *gocql.Session, m Meow, delta int64) {
+	if m.Subject == "" {
+		return
+	}
+	err := session.Query(`
+		UPDATE subject_counts_by_actor SET meows = meows + ?
+		WHERE did = ? AND subject = ?`,
+		delta, m.DID, m.Subject,
+	).Exec()
+	if err != nil {
+		log.Println("update subject_counts_by_actor error:", err)
+	}
+	if delta <= 0 {
+		return
+	}
+	err = session.Query(`
+		INSERT INTO subjects_by_actor (did, subject, last_time_us)
+		VALUES (?, ?, ?)
+		USING TIMESTAMP ?`,
+		m.DID, m.Subject, m.TimeUS, m.TimeUS,
+	).Exec()
+	if err != nil {
+		log.Println("insert subjects_by_actor error:", err)
+	}
+}
+
+type ActorSubject struct {
+	Subject    string `json:"subject"`
+	Meows      int64  `json:"meows"`
+	LastTimeUS int64  `json:"last_time_us"`
+	// LastIndexedAt is LastTimeUS as an RFC 3339 UTC timestamp
+	LastIndexedAt string `json:"lastIndexedAt"`
+}
+
+type ActorSubjectsResponse struct {
+	DID      string         `json:"did"`
+	Subjects []ActorSubject `json:"subjects"`
+}
+
+// getActorSubjects lists the subjects an actor has meowed at, most
+// recently meowed at first.
+func getActorSubjects(session *gocql.Session) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		did := c.Query("did")
+		if did == "" || validateDID(did) != did {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid did"})
+			return
+		}
+		limit, err := actorSubjectsGuardrail.parseLimit(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		counts := map[string]int64{}
+		iter := session.Query(`SELECT subject, meows FROM cat.subject_counts_by_actor WHERE did = ?`, did).
+			WithContext(c.Request.Context()).Iter()
+		var subject string
+		var n int64
+		for iter.Scan(&subject, &n) {
+			counts[subject] = n
+		}
+		if err := iter.Close(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		subjects := []ActorSubject{}
+		iter = session.Query(`SELECT subject, last_time_us FROM cat.subjects_by_actor WHERE did = ?`, did).
+			WithContext(c.Request.Context()).Iter()
+		var last int64
+		for iter.Scan(&subject, &last) {
+			// every meow at it was deleted
+			if counts[subject] <= 0 {
+				continue
+			}
+			subjects = append(subjects, ActorSubject{
+				Subject:       subject,
+				Meows:         counts[subject],
+				LastTimeUS:    last,
+				LastIndexedAt: indexedAt(last),
+			})
+		}
+		if err := iter.Close(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		sort.Slice(subjects, func(i, j int) bool {
+			if subjects[i].LastTimeUS != subjects[j].LastTimeUS {
+				return subjects[i].LastTimeUS > subjects[j].LastTimeUS
+			}
+			return subjects[i].Subject < subjects[j].Subject
+		})
+		if len(subjects) > limit {
+			subjects = subjects[:limit]
+		}
+		c.JSON(http.StatusOK, ActorSubjectsResponse{DID: did, Subjects: subjects})
+	}
+}
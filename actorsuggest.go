@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gocql/gocql"
+)
+
+// actorHandleBuckets spreads actor_handles over a fixed number of
+// partitions, like emotion_vocabulary.
+const actorHandleBuckets = 16
+
+var suggestActorsGuardrail = newGuardrail("suggest_actors", 10, 50, 0, 0)
+
+func createActorHandleTables(session *gocql.Session) error {
+	err := session.Query(`
+		CREATE TABLE IF NOT EXISTS actor_handles (
+			bucket INT,
+			did TEXT,
+			handle TEXT,
+			last_time_us BIGINT,
+			resolved_at TIMESTAMP,
+			verified BOOLEAN,
+			PRIMARY KEY ((bucket), did)
+		)`).Exec()
+	if err != nil {
+		return err
+	}
+	// rows from before it only have verified handles, see handleverify.go
+	return addColumn(session, "actor_handles", "verified", "BOOLEAN")
+}
+
+func actorHandleBucket(did string) int {
+	h := fnv.New32a()
+	h.Write([]byte(did))
+	return int(h.Sum32() % actorHandleBuckets)
+}
+
+type ActorSuggestion struct {
+	DID        string `json:"did"`
+	Handle     string `json:"handle"`
+	LastTimeUS int64  `json:"last_time_us"`
+	// LastIndexedAt is LastTimeUS as an RFC 3339 UTC timestamp
+	LastIndexedAt string `json:"lastIndexedAt"`
+}
+
+type SuggestActorsResponse struct {
+	Actors []ActorSuggestion `json:"actors"`
+}
+
+// actorDirectory knows the handles of the actors who have meowed, for
+// suggestActors and hydrate=actors. Handles are resolved in the background
+// when an actor meows and theirs is unknown or older than
+// ACTOR_HANDLE_TTL, and verified again periodically and on identity
+// events, see handleverify.go; only handles that resolve back to the DID
+// are suggested. Suggestions come from a copy sorted by handle, reloaded
+// from actor_handles every ACTOR_SUGGEST_REFRESH so every instance sees
+// the handles the others resolved.
+type actorDirectory struct {
+	ttl time.Duration
+
+	mu       sync.RWMutex
+	resolved map[string]time.Time
+	inflight map[string]bool
+	sem      chan struct{}
+	// byHandle is sorted by handle
+	byHandle []ActorSuggestion
+	// byDID has the handles of byHandle and the unverified ones
+	byDID map[string]actorHandle
+}
+
+var actorHandles = &actorDirectory{
+	ttl:      envDuration("ACTOR_HANDLE_TTL", 24*time.Hour),
+	resolved: map[string]time.Time{},
+	inflight: map[string]bool{},
+	sem:      make(chan struct{}, 4),
+	byDID:    map[string]actorHandle{},
+}
+
+// observe records that did meowed at timeUS, and starts resolving its
+// handle if it isn't known or is stale.
+func (d *actorDirectory) observe(session *gocql.Session, did string, timeUS int64) {
+	d.mu.Lock()
+	resolved, ok := d.resolved[did]
+	if (!ok || time.Since(resolved) > d.ttl) && !d.inflight[did] {
+		d.inflight[did] = true
+		go d.resolve(session, did)
+	}
+	d.mu.Unlock()
+
+	// timestamped with the meow, so a replayed older one doesn't win
+	err := session.Query(`
+		UPDATE actor_handles USING TIMESTAMP ?
+		SET last_time_us = ?
+		WHERE bucket = ? AND did = ?`,
+		timeUS, timeUS, actorHandleBucket(did), did,
+	).Exec()
+	if err != nil {
+		log.Println("update actor_handles error:", err)
+	}
+}
+
+func (d *actorDirectory) resolve(session *gocql.Session, did string) {
+	d.sem <- struct{}{}
+	defer func() { <-d.sem }()
+
+	resolved := time.Now()
+	ctx, cancel := context.WithTimeout(background(context.Background()), 10*time.Second)
+	defer cancel()
+	handle, verified, err := checkHandle(ctx, did)
+	if errors.Is(err, errOutboundDeferred) {
+		// the directory or PDS is busy, try again on a later meow
+		resolved = time.Now().Add(5*time.Minute - d.ttl)
+	} else if err != nil {
+		log.Printf("resolve handle for %s: %v", did, err)
+		// try again on a later meow, but not right away
+		resolved = time.Now().Add(time.Hour - d.ttl)
+	} else {
+		err = session.Query(`
+			UPDATE actor_handles SET handle = ?, verified = ?, resolved_at = ?
+			WHERE bucket = ? AND did = ?`,
+			nullString(handle), verified, resolved, actorHandleBucket(did), did,
+		).Exec()
+		if err != nil {
+			log.Println("store actor handle error:", err)
+		}
+		handlesVerified.WithLabelValues(strconv.FormatBool(verified)).Inc()
+	}
+
+	d.mu.Lock()
+	d.resolved[did] = resolved
+	delete(d.inflight, did)
+	if err == nil {
+		d.setHandle(did, handle, verified)
+	}
+	d.mu.Unlock()
+}
+
+// forget drops a deleted actor_handles row, so the actor's handle is
+// resolved again should they meow.
+func (d *actorDirectory) forget(did string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.resolved, did)
+	delete(d.byDID, did)
+}
+
+func (d *actorDirectory) load(session *gocql.Session) error {
+	var actors []ActorSuggestion
+	byDID := map[string]actorHandle{}
+	resolved := map[string]time.Time{}
+	for bucket := 0; bucket < actorHandleBuckets; bucket++ {
+		iter := session.Query(`
+			SELECT did, handle, last_time_us, resolved_at, verified
+			FROM actor_handles WHERE bucket = ?`,
+			bucket,
+		).Iter()
+		var a ActorSuggestion
+		var at time.Time
+		var verified *bool
+		for iter.Scan(&a.DID, &a.Handle, &a.LastTimeUS, &at, &verified) {
+			if !at.IsZero() {
+				resolved[a.DID] = at
+			}
+			if a.Handle != "" {
+				// rows from before verified only kept verified handles
+				h := actorHandle{handle: a.Handle, verified: verified == nil || *verified}
+				byDID[a.DID] = h
+				if h.verified {
+					actors = append(actors, a)
+				}
+			}
+			a, at, verified = ActorSuggestion{}, time.Time{}, nil
+		}
+		if err := iter.Close(); err != nil {
+			return err
+		}
+	}
+	sort.Slice(actors, func(i, j int) bool { return actors[i].Handle < actors[j].Handle })
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.byHandle = actors
+	d.byDID = byDID
+	for did, at := range resolved {
+		if at.After(d.resolved[did]) {
+			d.resolved[did] = at
+		}
+	}
+	return nil
+}
+
+func (d *actorDirectory) run(session *gocql.Session) {
+	ticker := time.NewTicker(envDuration("ACTOR_SUGGEST_REFRESH", 5*time.Minute))
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := d.load(session); err != nil {
+			log.Println("load actor handles error:", err)
+		}
+		d.verifyStale(session)
+	}
+}
+
+// suggest returns the actors whose handle starts with prefix, most
+// recently active first.
+func (d *actorDirectory) suggest(prefix string, limit int) []ActorSuggestion {
+	d.mu.RLock()
+	i := sort.Search(len(d.byHandle), func(i int) bool { return d.byHandle[i].Handle >= prefix })
+	var matches []ActorSuggestion
+	for ; i < len(d.byHandle) && strings.HasPrefix(d.byHandle[i].Handle, prefix); i++ {
+		if !moderation.deprioritized(d.byHandle[i].DID) {
+			matches = append(matches, d.byHandle[i])
+		}
+	}
+	d.mu.RUnlock()
+
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].LastTimeUS != matches[j].LastTimeUS {
+			return matches[i].LastTimeUS > matches[j].LastTimeUS
+		}
+		return matches[i].Handle < matches[j].Handle
+	})
+	matches = matches[:min(limit, len(matches))]
+	for i := range matches {
+		matches[i].LastIndexedAt = indexedAt(matches[i].LastTimeUS)
+	}
+	return matches
+}
+
+// suggestActors completes a handle prefix, with or without the "@", among
+// the actors who have meowed, most recently active first, for mention
+// typeahead.
+func suggestActors(c *gin.Context) {
+	q := strings.ToLower(strings.TrimPrefix(strings.TrimSpace(c.Query("q")), "@"))
+	if len(q) > 253 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "q is too long"})
+		return
+	}
+	limit, err := suggestActorsGuardrail.parseLimit(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	actors := actorHandles.suggest(q, limit)
+	if actors == nil {
+		actors = []ActorSuggestion{}
+	}
+	c.JSON(http.StatusOK, SuggestActorsResponse{Actors: actors})
+}
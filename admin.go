@@ -0,0 +1,36 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// requireAdmin guards the /_admin routes with the static ADMIN_TOKEN, sent
+// as "Authorization: Bearer <token>", or an API key with the admin scope.
+// Without ADMIN_TOKEN only admin API keys get in.
+func requireAdmin() gin.HandlerFunc {
+	token := envSecret("ADMIN_TOKEN")
+	return func(c *gin.Context) {
+		if k, ok := c.Get("apiKey"); ok {
+			if !k.(*APIKey).hasScope(scopeAdmin) {
+				c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "api key lacks the admin scope"})
+				return
+			}
+			c.Next()
+			return
+		}
+		if token == "" {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "admin api is disabled"})
+			return
+		}
+		given, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid admin token"})
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gocql/gocql"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var alertsFired = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "meowview_emotion_alerts_fired_total",
+	Help: "Emotion alerts fired, by alert name and whether the webhook accepted it.",
+}, []string{"alert", "delivered"})
+
+// emotionAlert fires a webhook when Emotion makes up more than Threshold
+// (0 to 1) of the meows in any Window. Alerts are read from the JSON file
+// in EMOTION_ALERTS_FILE, e.g.
+//
+//	[{"name": "upset cats", "emotion": "angry", "threshold": 0.4,
+//	  "window": "10m", "webhook": "https://example.com/hook"}]
+type emotionAlert struct {
+	Name      string  `json:"name"`
+	Emotion   string  `json:"emotion"`
+	Threshold float64 `json:"threshold"`
+	Window    string  `json:"window"`
+	// MinMeows keeps a quiet window, where one angry meow is 100%, from
+	// firing. Defaults to 10.
+	MinMeows int    `json:"min_meows"`
+	Webhook  string `json:"webhook"`
+	// Secret signs the webhook body like the outbox webhook does.
+	Secret string `json:"secret"`
+	// Cooldown is how long to wait before firing again while the alert
+	// stays over its threshold. Defaults to 1h.
+	Cooldown string `json:"cooldown"`
+
+	window   time.Duration
+	cooldown time.Duration
+}
+
+type alertState struct {
+	Firing    bool      `json:"firing"`
+	Share     float64   `json:"share"`
+	Meows     int       `json:"meows"`
+	Total     int       `json:"total"`
+	LastFired time.Time `json:"last_fired,omitempty"`
+}
+
+// emotionAlerts evaluates the alerts against per minute emotion counters
+// maintained at ingest.
+type emotionAlerts struct {
+	alerts []emotionAlert
+
+	mu     sync.Mutex
+	states map[string]*alertState
+}
+
+func newEmotionAlerts() *emotionAlerts {
+	path := getenv("EMOTION_ALERTS_FILE")
+	if path == "" {
+		return nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		log.Fatal("read emotion alerts:", err)
+	}
+	var alerts []emotionAlert
+	if err := json.Unmarshal(b, &alerts); err != nil {
+		log.Fatal("parse emotion alerts:", err)
+	}
+
+	ea := &emotionAlerts{states: map[string]*alertState{}}
+	for _, a := range alerts {
+		if a.Name == "" || a.Emotion == "" || a.Webhook == "" {
+			log.Fatalf("emotion alert %q: name, emotion and webhook are required", a.Name)
+		}
+		if a.Threshold <= 0 || a.Threshold > 1 {
+			log.Fatalf("emotion alert %q: threshold must be above 0 and at most 1", a.Name)
+		}
+		if a.window, err = time.ParseDuration(a.Window); err != nil || a.window < time.Minute {
+			log.Fatalf("emotion alert %q: window must be a duration of at least 1m", a.Name)
+		}
+		a.cooldown = time.Hour
+		if a.Cooldown != "" {
+			if a.cooldown, err = time.ParseDuration(a.Cooldown); err != nil {
+				log.Fatalf("emotion alert %q: %v", a.Name, err)
+			}
+		}
+		if a.MinMeows == 0 {
+			a.MinMeows = 10
+		}
+		ea.alerts = append(ea.alerts, a)
+		ea.states[a.Name] = &alertState{}
+	}
+	return ea
+}
+
+var alerts = newEmotionAlerts()
+
+func createAlertTables(session *gocql.Session) error {
+	return session.Query(`
+		CREATE TABLE IF NOT EXISTS emotion_counts (
+			day TEXT,
+			minute BIGINT,
+			emotion TEXT,
+			meows COUNTER,
+			PRIMARY KEY ((day), minute, emotion)
+		)`).Exec()
+}
+
+// countEmotion adds a created meow to its minute's counters, under its
+// effective emotion and under "" for the total.
+func (ea *emotionAlerts) countEmotion(session *gocql.Session, m Meow) {
+	minute := m.TimeUS / time.Minute.Microseconds()
+	emotions := []string{""}
+	if emotion, _ := effectiveEmotion(m); emotion != "" {
+		emotions = append(emotions, emotion)
+	}
+	for _, emotion := range emotions {
+		err := session.Query(`
+			UPDATE emotion_counts SET meows = meows + 1
+			WHERE day = ? AND minute = ? AND emotion = ?`,
+			eventDay(m.TimeUS), minute, emotion,
+		).Exec()
+		if err != nil {
+			log.Println("update emotion_counts error:", err)
+		}
+	}
+}
+
+// emotionCounts sums the counters of the minutes in [from, to), for the
+// emotion and in total.
+func emotionCounts(session *gocql.Session, emotion string, from, to time.Time) (int, int, error) {
+	var meows, total int
+	first := from.UnixMicro() / time.Minute.Microseconds()
+	last := to.UnixMicro()/time.Minute.Microseconds() - 1
+	for day := from.UTC().Truncate(24 * time.Hour); day.Before(to); day = day.AddDate(0, 0, 1) {
+		iter := session.Query(`
+			SELECT emotion, meows FROM emotion_counts
+			WHERE day = ? AND minute >= ? AND minute <= ?`,
+			day.Format("2006-01-02"), first, last,
+		).Iter()
+		var e string
+		var n int
+		for iter.Scan(&e, &n) {
+			switch e {
+			case "":
+				total += n
+			case emotion:
+				meows += n
+			}
+		}
+		if err := iter.Close(); err != nil {
+			return 0, 0, err
+		}
+	}
+	return meows, total, nil
+}
+
+func (ea *emotionAlerts) run(session *gocql.Session) {
+	ticker := time.NewTicker(envDuration("EMOTION_ALERTS_INTERVAL", time.Minute))
+	defer ticker.Stop()
+	for range ticker.C {
+		for _, a := range ea.alerts {
+			ea.evaluate(session, a)
+		}
+	}
+}
+
+// evaluate checks one alert over the window ending at the last complete
+// minute, and fires it when it goes over its threshold, or is still over
+// after its cooldown.
+func (ea *emotionAlerts) evaluate(session *gocql.Session, a emotionAlert) {
+	to := time.Now().Truncate(time.Minute)
+	meows, total, err := emotionCounts(session, a.Emotion, to.Add(-a.window), to)
+	if err != nil {
+		log.Printf("evaluate emotion alert %q: %v", a.Name, err)
+		return
+	}
+	var share float64
+	if total > 0 {
+		share = float64(meows) / float64(total)
+	}
+	over := total >= a.MinMeows && share > a.Threshold
+
+	ea.mu.Lock()
+	st := ea.states[a.Name]
+	fire := over && (!st.Firing || time.Since(st.LastFired) >= a.cooldown)
+	st.Firing, st.Share, st.Meows, st.Total = over, share, meows, total
+	if fire {
+		st.LastFired = time.Now()
+	}
+	ea.mu.Unlock()
+
+	if fire {
+		err := ea.fire(a, share, meows, total, to)
+		alertsFired.WithLabelValues(a.Name, boolLabel(err == nil)).Inc()
+		if err != nil {
+			log.Printf("fire emotion alert %q: %v", a.Name, err)
+		}
+	}
+}
+
+type alertPayload struct {
+	Alert     string    `json:"alert"`
+	Emotion   string    `json:"emotion"`
+	Share     float64   `json:"share"`
+	Threshold float64   `json:"threshold"`
+	Window    string    `json:"window"`
+	Meows     int       `json:"meows"`
+	Total     int       `json:"total"`
+	At        time.Time `json:"at"`
+}
+
+func (ea *emotionAlerts) fire(a emotionAlert, share float64, meows, total int, at time.Time) error {
+	body, err := json.Marshal(alertPayload{
+		Alert:     a.Name,
+		Emotion:   a.Emotion,
+		Share:     share,
+		Threshold: a.Threshold,
+		Window:    a.Window,
+		Meows:     meows,
+		Total:     total,
+		At:        at.UTC(),
+	})
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	sink := &webhookSink{url: a.Webhook, secret: a.Secret}
+	if err := sink.Deliver(ctx, outboxEntry{ID: gocql.TimeUUID(), Payload: body}); err != nil {
+		return fmt.Errorf("webhook: %w", err)
+	}
+	return nil
+}
+
+// getEmotionAlerts shows each alert with the result of its last
+// evaluation.
+func getEmotionAlerts(c *gin.Context) {
+	resp := []gin.H{}
+	if alerts != nil {
+		alerts.mu.Lock()
+		for _, a := range alerts.alerts {
+			resp = append(resp, gin.H{
+				"name":      a.Name,
+				"emotion":   a.Emotion,
+				"threshold": a.Threshold,
+				"window":    a.Window,
+				"state":     *alerts.states[a.Name],
+			})
+		}
+		alerts.mu.Unlock()
+	}
+	c.JSON(http.StatusOK, gin.H{"alerts": resp})
+}
@@ -0,0 +1,517 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gocql/gocql"
+)
+
+// API keys let integrators identify themselves instead of sharing
+// ADMIN_TOKEN. Users manage their own keys through endpoints guarded by
+// service auth, which is what an atproto OAuth session presents when the
+// client calls us through its PDS. Callers send a key as X-API-Key.
+//
+// Keys look like "mv_<id>_<secret>". Only the SHA-256 of the whole key is
+// stored, so a key can't be recovered, only rotated.
+
+const (
+	scopeRead  = "read"
+	scopeAdmin = "admin"
+)
+
+// selfServiceScopes are the scopes users may give their own keys. The
+// admin scope can only be granted through the admin API.
+var selfServiceScopes = map[string]bool{scopeRead: true}
+
+// apiKeyTiers are the per-key rate limits, in requests per minute. New keys
+// start on "free"; an admin can move a key to another tier. The limits are
+// reloaded at runtime from CONFIG_FILE.
+var apiKeyTiers = struct {
+	sync.RWMutex
+	rpm map[string]int
+}{rpm: mustLoadAPIKeyTiers()}
+
+func loadAPIKeyTiers() (map[string]int, error) {
+	free, err := lookupInt("API_KEY_TIER_FREE_RPM", 60)
+	if err != nil {
+		return nil, err
+	}
+	partner, err := lookupInt("API_KEY_TIER_PARTNER_RPM", 600)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]int{"free": free, "partner": partner}, nil
+}
+
+func mustLoadAPIKeyTiers() map[string]int {
+	tiers, err := loadAPIKeyTiers()
+	if err != nil {
+		log.Fatal(err)
+	}
+	return tiers
+}
+
+func reloadAPIKeyTiers() (func(), error) {
+	tiers, err := loadAPIKeyTiers()
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		apiKeyTiers.Lock()
+		defer apiKeyTiers.Unlock()
+		apiKeyTiers.rpm = tiers
+	}, nil
+}
+
+// apiKeyTierRPM is the limit of a tier.
+func apiKeyTierRPM(tier string) (int, bool) {
+	apiKeyTiers.RLock()
+	defer apiKeyTiers.RUnlock()
+	rpm, ok := apiKeyTiers.rpm[tier]
+	return rpm, ok
+}
+
+const maxAPIKeysPerOwner = 10
+
+func createAPIKeyTables(session *gocql.Session) error {
+	err := session.Query(`
+		CREATE TABLE IF NOT EXISTS api_keys (
+			owner TEXT,
+			id TEXT,
+			name TEXT,
+			key_hash TEXT,
+			scopes SET<TEXT>,
+			tier TEXT,
+			created_at TIMESTAMP,
+			rotated_at TIMESTAMP,
+			PRIMARY KEY ((owner), id)
+		)`).Exec()
+	if err != nil {
+		return err
+	}
+
+	return session.Query(`
+		CREATE TABLE IF NOT EXISTS api_keys_by_hash (
+			key_hash TEXT PRIMARY KEY,
+			owner TEXT,
+			id TEXT,
+			scopes SET<TEXT>,
+			tier TEXT
+		)`).Exec()
+}
+
+type APIKey struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Scopes    []string  `json:"scopes"`
+	Tier      string    `json:"tier"`
+	CreatedAt time.Time `json:"created_at"`
+	RotatedAt time.Time `json:"rotated_at,omitempty"`
+	// Key is only ever returned by createApiKey and rotateApiKey.
+	Key string `json:"key,omitempty"`
+
+	owner string
+	hash  string
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// newSecret gives k a fresh key and hash.
+func (k *APIKey) newSecret() {
+	k.Key = "mv_" + k.ID + "_" + base64.RawURLEncoding.EncodeToString(randomBytes(32))
+	k.hash = hashAPIKey(k.Key)
+}
+
+func (k *APIKey) hasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// saveAPIKey writes both the owner's row and the lookup by hash, dropping
+// oldHash from the lookup when the key was rotated.
+func saveAPIKey(session *gocql.Session, k *APIKey, oldHash string) error {
+	batch := session.NewBatch(gocql.LoggedBatch)
+	batch.Query(`
+		INSERT INTO api_keys (owner, id, name, key_hash, scopes, tier, created_at, rotated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		k.owner, k.ID, k.Name, k.hash, k.Scopes, k.Tier, k.CreatedAt, k.RotatedAt,
+	)
+	batch.Query(`
+		INSERT INTO api_keys_by_hash (key_hash, owner, id, scopes, tier) VALUES (?, ?, ?, ?, ?)`,
+		k.hash, k.owner, k.ID, k.Scopes, k.Tier,
+	)
+	if oldHash != "" && oldHash != k.hash {
+		batch.Query(`DELETE FROM api_keys_by_hash WHERE key_hash = ?`, oldHash)
+	}
+	return session.ExecuteBatch(batch)
+}
+
+func loadAPIKey(session *gocql.Session, owner, id string) (*APIKey, error) {
+	k := APIKey{owner: owner}
+	err := session.Query(`
+		SELECT id, name, key_hash, scopes, tier, created_at, rotated_at
+		FROM api_keys
+		WHERE owner = ? AND id = ?`,
+		owner, id,
+	).Scan(&k.ID, &k.Name, &k.hash, &k.Scopes, &k.Tier, &k.CreatedAt, &k.RotatedAt)
+	if err == gocql.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &k, nil
+}
+
+type cachedAPIKey struct {
+	key     *APIKey
+	fetched time.Time
+}
+
+type keyWindow struct {
+	start time.Time
+	count int
+}
+
+// apiKeyAuth resolves X-API-Key on every request and applies the key's
+// rate tier. Lookups are cached for a minute, so a revoked key can keep
+// working that long on other instances. Unknown keys aren't cached, so
+// made-up keys can't grow the cache; the janitor drops expired lookups and
+// finished rate windows.
+type apiKeyAuth struct {
+	mu      sync.Mutex
+	cache   map[string]cachedAPIKey
+	windows map[string]*keyWindow
+}
+
+var apiKeys = &apiKeyAuth{cache: map[string]cachedAPIKey{}, windows: map[string]*keyWindow{}}
+
+func (a *apiKeyAuth) lookup(session *gocql.Session, c *gin.Context, hash string) (*APIKey, error) {
+	a.mu.Lock()
+	cached, ok := a.cache[hash]
+	a.mu.Unlock()
+	if ok && time.Since(cached.fetched) < time.Minute {
+		return cached.key, nil
+	}
+
+	k := &APIKey{hash: hash}
+	err := session.Query(`
+		SELECT owner, id, scopes, tier FROM api_keys_by_hash WHERE key_hash = ?`,
+		hash,
+	).WithContext(c.Request.Context()).Scan(&k.owner, &k.ID, &k.Scopes, &k.Tier)
+	if err == gocql.ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	a.mu.Lock()
+	a.cache[hash] = cachedAPIKey{key: k, fetched: time.Now()}
+	a.mu.Unlock()
+	return k, nil
+}
+
+// prune drops expired lookups and rate windows and returns how many it
+// dropped.
+func (a *apiKeyAuth) prune() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	n := 0
+	for hash, cached := range a.cache {
+		if time.Since(cached.fetched) >= time.Minute {
+			delete(a.cache, hash)
+			n++
+		}
+	}
+	for id, w := range a.windows {
+		if time.Since(w.start) >= time.Minute {
+			delete(a.windows, id)
+			n++
+		}
+	}
+	return n
+}
+
+func (a *apiKeyAuth) forget(hash string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.cache, hash)
+}
+
+// allow counts a request against the key's per minute budget and returns
+// how long to wait when it is used up.
+func (a *apiKeyAuth) allow(k *APIKey) (bool, time.Duration) {
+	limit, ok := apiKeyTierRPM(k.Tier)
+	if !ok {
+		limit, _ = apiKeyTierRPM("free")
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := time.Now()
+	w := a.windows[k.ID]
+	if w == nil || now.Sub(w.start) >= time.Minute {
+		w = &keyWindow{start: now}
+		a.windows[k.ID] = w
+	}
+	if w.count >= limit {
+		return false, w.start.Add(time.Minute).Sub(now)
+	}
+	w.count++
+	return true, 0
+}
+
+func (a *apiKeyAuth) middleware(session *gocql.Session) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		raw := c.GetHeader("X-API-Key")
+		if raw == "" {
+			c.Next()
+			return
+		}
+		k, err := a.lookup(session, c, hashAPIKey(raw))
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if k == nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid api key"})
+			return
+		}
+		if ok, wait := a.allow(k); !ok {
+			c.Header("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "rate limit exceeded for tier " + k.Tier})
+			return
+		}
+		c.Set("apiKey", k)
+		c.Next()
+	}
+}
+
+type createAPIKeyRequest struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+}
+
+func validSelfServiceScopes(scopes []string) bool {
+	for _, s := range scopes {
+		if !selfServiceScopes[s] {
+			return false
+		}
+	}
+	return true
+}
+
+func createAPIKey(session *gocql.Session) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		owner := c.GetString("viewer")
+		var req createAPIKeyRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+			return
+		}
+		req.Name = strings.TrimSpace(req.Name)
+		if req.Name == "" || len(req.Name) > 100 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "name must be 1 to 100 characters"})
+			return
+		}
+		if len(req.Scopes) == 0 {
+			req.Scopes = []string{scopeRead}
+		}
+		if !validSelfServiceScopes(req.Scopes) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "scopes not available for self service"})
+			return
+		}
+
+		var count int
+		err := session.Query(`SELECT COUNT(*) FROM api_keys WHERE owner = ?`, owner).
+			WithContext(c.Request.Context()).Scan(&count)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if count >= maxAPIKeysPerOwner {
+			c.JSON(http.StatusConflict, gin.H{"error": "too many api keys"})
+			return
+		}
+
+		now := time.Now().UTC()
+		k := &APIKey{
+			ID:        hex.EncodeToString(randomBytes(8)),
+			Name:      req.Name,
+			Scopes:    req.Scopes,
+			Tier:      "free",
+			CreatedAt: now,
+			RotatedAt: now,
+			owner:     owner,
+		}
+		k.newSecret()
+		if err := saveAPIKey(session, k, ""); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusCreated, k)
+	}
+}
+
+func listAPIKeys(session *gocql.Session) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		iter := session.Query(`
+			SELECT id, name, scopes, tier, created_at, rotated_at
+			FROM api_keys
+			WHERE owner = ?`,
+			c.GetString("viewer"),
+		).WithContext(c.Request.Context()).Iter()
+
+		keys := []APIKey{}
+		var k APIKey
+		for iter.Scan(&k.ID, &k.Name, &k.Scopes, &k.Tier, &k.CreatedAt, &k.RotatedAt) {
+			keys = append(keys, k)
+			k = APIKey{}
+		}
+		if err := iter.Close(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"keys": keys})
+	}
+}
+
+// ownedAPIKey loads the ?id= key of the viewer, answering 404 for keys
+// that don't exist or belong to someone else.
+func ownedAPIKey(c *gin.Context, session *gocql.Session) (*APIKey, bool) {
+	k, err := loadAPIKey(session, c.GetString("viewer"), c.Query("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	if k == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "api key not found"})
+		return nil, false
+	}
+	return k, true
+}
+
+// rotateAPIKey replaces the secret of a key, keeping its id, scopes and
+// tier. The old key stops working immediately on this instance.
+func rotateAPIKey(session *gocql.Session) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		k, ok := ownedAPIKey(c, session)
+		if !ok {
+			return
+		}
+		oldHash := k.hash
+		k.newSecret()
+		k.RotatedAt = time.Now().UTC()
+		if err := saveAPIKey(session, k, oldHash); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		apiKeys.forget(oldHash)
+		c.JSON(http.StatusOK, k)
+	}
+}
+
+func revokeAPIKey(session *gocql.Session) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		k, ok := ownedAPIKey(c, session)
+		if !ok {
+			return
+		}
+		batch := session.NewBatch(gocql.LoggedBatch)
+		batch.Query(`DELETE FROM api_keys WHERE owner = ? AND id = ?`, k.owner, k.ID)
+		batch.Query(`DELETE FROM api_keys_by_hash WHERE key_hash = ?`, k.hash)
+		if err := session.ExecuteBatch(batch); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		apiKeys.forget(k.hash)
+		c.Status(http.StatusNoContent)
+	}
+}
+
+type updateAPIKeyRequest struct {
+	Owner  string   `json:"owner"`
+	ID     string   `json:"id"`
+	Scopes []string `json:"scopes"`
+	Tier   string   `json:"tier"`
+}
+
+// updateAPIKey is the admin side: it can grant any scope, including admin,
+// and move a key between rate tiers.
+func updateAPIKey(session *gocql.Session) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req updateAPIKeyRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+			return
+		}
+		k, err := loadAPIKey(session, req.Owner, req.ID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if k == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "api key not found"})
+			return
+		}
+		if req.Tier != "" {
+			if _, ok := apiKeyTierRPM(req.Tier); !ok {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "unknown tier"})
+				return
+			}
+			k.Tier = req.Tier
+		}
+		if req.Scopes != nil {
+			for _, s := range req.Scopes {
+				if s != scopeRead && s != scopeAdmin {
+					c.JSON(http.StatusBadRequest, gin.H{"error": "unknown scope " + s})
+					return
+				}
+			}
+			k.Scopes = req.Scopes
+		}
+		if err := saveAPIKey(session, k, ""); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		apiKeys.forget(k.hash)
+		c.JSON(http.StatusOK, k)
+	}
+}
+
+// apiKeyRateLimits describes the tiers for describeServer.
+func apiKeyRateLimits() []RateLimitPolicy {
+	apiKeyTiers.RLock()
+	defer apiKeyTiers.RUnlock()
+	policies := make([]RateLimitPolicy, 0, len(apiKeyTiers.rpm))
+	for name, rpm := range apiKeyTiers.rpm {
+		policies = append(policies, RateLimitPolicy{Name: "apiKey:" + name, Limit: rpm, Window: "1m"})
+	}
+	sort.Slice(policies, func(i, j int) bool { return policies[i].Name < policies[j].Name })
+	return policies
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/decred/dcrd/dcrec/secp256k1/v4"
+	secpecdsa "github.com/decred/dcrd/dcrec/secp256k1/v4/ecdsa"
+	"github.com/gin-gonic/gin"
+)
+
+// Callers authenticate with an atproto inter-service token: a JWT their PDS
+// signs with the account's #atproto key, with iss set to the account DID
+// and aud set to our SERVICE_DID. The signing key is looked up in the
+// issuer's DID document.
+
+const authLexiconPrefix = "moe.kasey.meowview."
+
+type serviceAuthClaims struct {
+	Iss string `json:"iss"`
+	Aud string `json:"aud"`
+	Exp int64  `json:"exp"`
+	Lxm string `json:"lxm"`
+	// Jti is a nonce, see replayedToken
+	Jti string `json:"jti"`
+}
+
+// signingKey verifies a JWT signature over the signing input.
+type signingKey func(signingInput, sig []byte) bool
+
+// base58 alphabet used by multibase "z" (base58btc).
+const base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+func decodeBase58(s string) ([]byte, error) {
+	n := new(big.Int)
+	for _, r := range s {
+		i := strings.IndexRune(base58Alphabet, r)
+		if i < 0 {
+			return nil, fmt.Errorf("invalid base58 character %q", r)
+		}
+		n.Mul(n, big.NewInt(58))
+		n.Add(n, big.NewInt(int64(i)))
+	}
+	b := n.Bytes()
+	for _, r := range s {
+		if r != '1' {
+			break
+		}
+		b = append([]byte{0}, b...)
+	}
+	return b, nil
+}
+
+// parseMultikey decodes a did:key style publicKeyMultibase holding a
+// compressed secp256k1 (ES256K) or P-256 (ES256) key.
+func parseMultikey(multibase string) (signingKey, error) {
+	if !strings.HasPrefix(multibase, "z") {
+		return nil, fmt.Errorf("unsupported multibase encoding")
+	}
+	b, err := decodeBase58(multibase[1:])
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < 2 {
+		return nil, fmt.Errorf("key too short")
+	}
+
+	switch {
+	case b[0] == 0xe7 && b[1] == 0x01:
+		pub, err := secp256k1.ParsePubKey(b[2:])
+		if err != nil {
+			return nil, err
+		}
+		return func(signingInput, sig []byte) bool {
+			if len(sig) != 64 {
+				return false
+			}
+			var r, s secp256k1.ModNScalar
+			if r.SetByteSlice(sig[:32]) || s.SetByteSlice(sig[32:]) || s.IsOverHalfOrder() {
+				return false
+			}
+			hash := sha256.Sum256(signingInput)
+			return secpecdsa.NewSignature(&r, &s).Verify(hash[:], pub)
+		}, nil
+
+	case b[0] == 0x80 && b[1] == 0x24:
+		x, y := elliptic.UnmarshalCompressed(elliptic.P256(), b[2:])
+		if x == nil {
+			return nil, fmt.Errorf("invalid p256 key")
+		}
+		pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+		halfOrder := new(big.Int).Rsh(elliptic.P256().Params().N, 1)
+		return func(signingInput, sig []byte) bool {
+			if len(sig) != 64 {
+				return false
+			}
+			r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+			if s.Cmp(halfOrder) > 0 {
+				return false
+			}
+			hash := sha256.Sum256(signingInput)
+			return ecdsa.Verify(pub, hash[:], r, s)
+		}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type")
+}
+
+type cachedSigningKey struct {
+	key     signingKey
+	fetched time.Time
+}
+
+// signingKeys caches each DID's #atproto key for a few minutes so not
+// every authenticated request resolves a DID document.
+var signingKeys = struct {
+	sync.Mutex
+	m map[string]cachedSigningKey
+}{m: map[string]cachedSigningKey{}}
+
+func resolveSigningKey(ctx context.Context, did string, refresh bool) (signingKey, error) {
+	signingKeys.Lock()
+	cached, ok := signingKeys.m[did]
+	signingKeys.Unlock()
+	maxAge := 5 * time.Minute
+	if refresh {
+		// don't let bad signatures hammer the DID directory
+		maxAge = 30 * time.Second
+	}
+	if ok && time.Since(cached.fetched) < maxAge {
+		return cached.key, nil
+	}
+
+	if refresh {
+		didResolver.Forget(did)
+	}
+	doc, err := didResolver.Resolve(ctx, did)
+	if err != nil {
+		return nil, err
+	}
+	for _, vm := range doc.VerificationMethod {
+		if vm.ID != "#atproto" && vm.ID != did+"#atproto" {
+			continue
+		}
+		key, err := parseMultikey(vm.PublicKeyMultibase)
+		if err != nil {
+			return nil, err
+		}
+		signingKeys.Lock()
+		signingKeys.m[did] = cachedSigningKey{key: key, fetched: time.Now()}
+		signingKeys.Unlock()
+		return key, nil
+	}
+	return nil, fmt.Errorf("%s has no atproto signing key", did)
+}
+
+// verifyServiceAuth checks a service auth token and returns the caller DID.
+// lxm is the method the token must be scoped to, if it is scoped at all.
+func verifyServiceAuth(ctx context.Context, token, serviceDID, lxm string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", fmt.Errorf("malformed token")
+	}
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", fmt.Errorf("malformed token header")
+	}
+	claimsJSON, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", fmt.Errorf("malformed token claims")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", fmt.Errorf("malformed token signature")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	var claims serviceAuthClaims
+	if json.Unmarshal(headerJSON, &header) != nil || json.Unmarshal(claimsJSON, &claims) != nil {
+		return "", fmt.Errorf("malformed token")
+	}
+	if header.Alg != "ES256K" && header.Alg != "ES256" {
+		return "", fmt.Errorf("unsupported token algorithm %q", header.Alg)
+	}
+	if claims.Aud != serviceDID {
+		return "", fmt.Errorf("token audience is not this service")
+	}
+	if time.Now().Unix() >= claims.Exp {
+		return "", fmt.Errorf("token expired")
+	}
+	if claims.Lxm != "" && claims.Lxm != lxm {
+		return "", fmt.Errorf("token is not valid for %s", lxm)
+	}
+	did, _, _ := strings.Cut(claims.Iss, "#")
+	if validateDID(did) != did {
+		return "", fmt.Errorf("invalid token issuer")
+	}
+
+	signingInput := []byte(parts[0] + "." + parts[1])
+	key, err := resolveSigningKey(ctx, did, false)
+	if err != nil {
+		return "", err
+	}
+	if !key(signingInput, sig) {
+		// the account may have rotated its key since we cached it
+		if key, err = resolveSigningKey(ctx, did, true); err != nil || !key(signingInput, sig) {
+			return "", fmt.Errorf("invalid token signature")
+		}
+	}
+	if replayedToken(claims.Iss, claims.Jti, claims.Exp) {
+		return "", fmt.Errorf("token was already used")
+	}
+	return did, nil
+}
+
+// requireAuth guards a route with service auth for the given method name
+// (without the moe.kasey.meowview prefix) and stores the caller DID as
+// "viewer". Without SERVICE_DID authenticated routes are switched off.
+func requireAuth(method string) gin.HandlerFunc {
+	serviceDID := getenv("SERVICE_DID")
+	return func(c *gin.Context) {
+		if serviceDID == "" {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "authentication is not configured"})
+			return
+		}
+		token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if !ok {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "missing bearer token"})
+			return
+		}
+		ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+		defer cancel()
+		did, err := verifyServiceAuth(ctx, token, serviceDID, authLexiconPrefix+method)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
+		c.Set("viewer", did)
+		c.Next()
+	}
+}
@@ -0,0 +1,583 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gocql/gocql"
+)
+
+// Backfill reads the meows of repos from their PDSs with
+// com.atproto.repo.listRecords, or getRepo, see backfillsources.go, for
+// history from before we subscribed.
+// Every repo's progress is checkpointed in backfill_repos after each page,
+// so a repo interrupted by a restart continues where it stopped once
+// BACKFILL_STALE_AFTER has passed without a checkpoint, on any instance.
+const (
+	backfillPending = "pending"
+	backfillRunning = "running"
+	backfillDone    = "done"
+	backfillFailed  = "failed"
+)
+
+var (
+	backfillStaleAfter  = envDuration("BACKFILL_STALE_AFTER", 5*time.Minute)
+	backfillMaxAttempts = envInt("BACKFILL_MAX_ATTEMPTS", 3)
+)
+
+// backfillPageSize is the most listRecords returns at once.
+const backfillPageSize = 100
+
+func createBackfillTables(session *gocql.Session) error {
+	err := session.Query(`
+		CREATE TABLE IF NOT EXISTS backfill_repos (
+			did TEXT PRIMARY KEY,
+			state TEXT,
+			cursor TEXT,
+			records INT,
+			attempts INT,
+			error TEXT,
+			updated_at TIMESTAMP
+		)`).Exec()
+	if err != nil {
+		return err
+	}
+	err = session.Query(`
+		CREATE TABLE IF NOT EXISTS backfill_repos_by_state (
+			state TEXT,
+			did TEXT,
+			PRIMARY KEY ((state), did)
+		)`).Exec()
+	if err != nil {
+		return err
+	}
+	return createBackfillEnumerationTable(session)
+}
+
+// backfiller runs up to parallelism repos at a time, claiming pending and
+// stale ones every BACKFILL_POLL_INTERVAL.
+type backfiller struct {
+	mu          sync.Mutex
+	parallelism int
+	running     map[string]bool
+	// enumerating are the hosts this instance lists repos of
+	enumerating map[string]bool
+}
+
+var backfill = &backfiller{
+	parallelism: envInt("BACKFILL_PARALLELISM", 4),
+	running:     map[string]bool{},
+	enumerating: map[string]bool{},
+}
+
+func (b *backfiller) run(session *gocql.Session) {
+	ticker := time.NewTicker(envDuration("BACKFILL_POLL_INTERVAL", 10*time.Second))
+	defer ticker.Stop()
+	for {
+		if err := b.fill(session); err != nil {
+			log.Println("backfill poll error:", err)
+		}
+		if err := b.resumeEnumerations(session); err != nil {
+			log.Println("backfill enumeration poll error:", err)
+		}
+		<-ticker.C
+	}
+}
+
+func (b *backfiller) free() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.parallelism - len(b.running)
+}
+
+func (b *backfiller) isRunning(did string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.running[did]
+}
+
+// fill claims repos up to the parallelism: interrupted ones first, then
+// pending ones.
+func (b *backfiller) fill(session *gocql.Session) error {
+	if b.free() <= 0 {
+		return nil
+	}
+	running, err := backfillReposIn(session, backfillRunning, 0)
+	if err != nil {
+		return err
+	}
+	for _, did := range running {
+		if b.free() <= 0 {
+			return nil
+		}
+		if b.isRunning(did) {
+			continue
+		}
+		var updated time.Time
+		err := session.Query(`SELECT updated_at FROM backfill_repos WHERE did = ?`, did).Scan(&updated)
+		if err != nil || time.Since(updated) < backfillStaleAfter {
+			continue
+		}
+		b.claim(session, did, backfillRunning, updated)
+	}
+
+	free := b.free()
+	if free <= 0 {
+		return nil
+	}
+	pending, err := backfillReposIn(session, backfillPending, free)
+	if err != nil {
+		return err
+	}
+	for _, did := range pending {
+		b.claim(session, did, backfillPending, time.Time{})
+	}
+	return nil
+}
+
+func backfillReposIn(session *gocql.Session, state string, limit int) ([]string, error) {
+	q := `SELECT did FROM backfill_repos_by_state WHERE state = ?`
+	args := []any{state}
+	if limit > 0 {
+		q += ` LIMIT ?`
+		args = append(args, limit)
+	}
+	iter := session.Query(q, args...).Iter()
+	var dids []string
+	var did string
+	for iter.Scan(&did) {
+		dids = append(dids, did)
+	}
+	return dids, iter.Close()
+}
+
+// claim takes a repo over, unless another instance got to it first, and
+// starts it. A running repo is only taken over while its checkpoint is
+// still the stale one seen.
+func (b *backfiller) claim(session *gocql.Session, did, from string, seen time.Time) {
+	now := time.Now()
+	var q *gocql.Query
+	if from == backfillRunning {
+		q = session.Query(`
+			UPDATE backfill_repos SET updated_at = ?
+			WHERE did = ? IF state = ? AND updated_at = ?`,
+			now, did, backfillRunning, seen)
+	} else {
+		q = session.Query(`
+			UPDATE backfill_repos SET state = ?, updated_at = ?
+			WHERE did = ? IF state = ?`,
+			backfillRunning, now, did, from)
+	}
+	applied, err := q.MapScanCAS(map[string]interface{}{})
+	if err != nil {
+		log.Printf("claim backfill of %s: %v", did, err)
+		return
+	}
+	if !applied {
+		return
+	}
+	if from != backfillRunning {
+		if err := moveBackfillState(session, did, from, backfillRunning); err != nil {
+			log.Printf("claim backfill of %s: %v", did, err)
+		}
+	}
+
+	b.mu.Lock()
+	b.running[did] = true
+	b.mu.Unlock()
+	go func() {
+		defer func() {
+			b.mu.Lock()
+			delete(b.running, did)
+			b.mu.Unlock()
+		}()
+		backfillRepo(session, did)
+	}()
+}
+
+func moveBackfillState(session *gocql.Session, did, from, to string) error {
+	batch := session.NewBatch(gocql.LoggedBatch)
+	batch.Query(`DELETE FROM backfill_repos_by_state WHERE state = ? AND did = ?`, from, did)
+	batch.Query(`INSERT INTO backfill_repos_by_state (state, did) VALUES (?, ?)`, to, did)
+	return session.ExecuteBatch(batch)
+}
+
+// backfillRepo pages through a repo's meows from its checkpoint on. A
+// failed repo goes back to pending until BACKFILL_MAX_ATTEMPTS.
+func backfillRepo(session *gocql.Session, did string) {
+	var cursor string
+	var records, attempts int
+	err := session.Query(`SELECT cursor, records, attempts FROM backfill_repos WHERE did = ?`, did).
+		Scan(&cursor, &records, &attempts)
+	if err == nil {
+		err = backfillPages(session, did, cursor, records)
+	}
+	if err == nil {
+		err = finishBackfill(session, did, backfillDone, "", attempts)
+		if err != nil {
+			log.Printf("finish backfill of %s: %v", did, err)
+		}
+		return
+	}
+
+	log.Printf("backfill %s: %v", did, err)
+	attempts++
+	state := backfillPending
+	if attempts >= backfillMaxAttempts {
+		state = backfillFailed
+	}
+	if err := finishBackfill(session, did, state, err.Error(), attempts); err != nil {
+		log.Printf("finish backfill of %s: %v", did, err)
+	}
+}
+
+func finishBackfill(session *gocql.Session, did, state, msg string, attempts int) error {
+	err := session.Query(`
+		UPDATE backfill_repos SET state = ?, error = ?, attempts = ?, updated_at = ?
+		WHERE did = ?`,
+		state, msg, attempts, time.Now(), did,
+	).Exec()
+	if err != nil {
+		return err
+	}
+	return moveBackfillState(session, did, backfillRunning, state)
+}
+
+type listRecordsPage struct {
+	Cursor  string       `json:"cursor"`
+	Records []repoRecord `json:"records"`
+}
+
+func backfillPages(session *gocql.Session, did, cursor string, records int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	doc, err := didResolver.Resolve(ctx, did)
+	cancel()
+	if err != nil {
+		return err
+	}
+	pds, err := pdsEndpoint(doc)
+	if err != nil {
+		return err
+	}
+	if backfillFetch == backfillFetchGetRepo {
+		return backfillFromRepo(session, pds, did, records)
+	}
+
+	for {
+		page, err := listMeowRecords(pds, did, cursor)
+		if err != nil {
+			return err
+		}
+		for _, rec := range page.Records {
+			written, err := backfillRecord(session, did, rec)
+			if err != nil {
+				return err
+			}
+			if written {
+				records++
+			}
+		}
+		cursor = page.Cursor
+		err = session.Query(`
+			UPDATE backfill_repos SET cursor = ?, records = ?, updated_at = ?
+			WHERE did = ?`,
+			cursor, records, time.Now(), did,
+		).Exec()
+		if err != nil {
+			return err
+		}
+		if cursor == "" || len(page.Records) == 0 {
+			return nil
+		}
+	}
+}
+
+func listMeowRecords(pds, did, cursor string) (*listRecordsPage, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	q := url.Values{"repo": {did}, "collection": {meowNSID}, "limit": {fmt.Sprint(backfillPageSize)}}
+	if cursor != "" {
+		q.Set("cursor", cursor)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, pds+"/xrpc/com.atproto.repo.listRecords?"+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := outbound.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("listRecords returned %s", resp.Status)
+	}
+	var page listRecordsPage
+	if err := json.NewDecoder(resp.Body).Decode(&page); err != nil {
+		return nil, err
+	}
+	return &page, nil
+}
+
+// backfillRecord writes a listed meow like a create from the firehose,
+// timed by its rkey. Meows we already have are left alone, so a resumed
+// page isn't counted twice.
+func backfillRecord(session *gocql.Session, did string, rec repoRecord) (bool, error) {
+	rkey := rec.URI[strings.LastIndex(rec.URI, "/")+1:]
+	if !rkeyRegex.MatchString(rkey) {
+		recordRejection(session, did, RejectedMeow{Rkey: rkey, CID: rec.CID, Source: "backfill", Reason: rejectInvalidRkey})
+		return false, nil
+	}
+	var cid string
+	err := session.Query(`SELECT cid FROM meows WHERE id = ?`, meowID(did, rkey)).Scan(&cid)
+	if err == nil {
+		return false, nil
+	}
+	if err != gocql.ErrNotFound {
+		return false, err
+	}
+	record, version, err := decodeRecord(meowNSID, rec.Value)
+	if err != nil {
+		recordRejection(session, did, RejectedMeow{Rkey: rkey, CID: rec.CID, Source: "backfill", Reason: rejectionReason(err), Detail: err.Error()})
+		return false, nil
+	}
+
+	timeUS, ok := revTimestamp(rkey)
+	if !ok {
+		timeUS = time.Now().UnixMicro()
+	}
+	ev := meowEvent{
+		Meow:   Meow{DID: did, Rkey: rkey, CID: rec.CID, TimeUS: timeUS},
+		Op:     "create",
+		Record: string(rec.Value),
+	}
+	if err := ev.setRecord(record, version); err != nil {
+		recordRejection(session, did, RejectedMeow{Rkey: rkey, CID: rec.CID, Source: "backfill", Reason: rejectionReason(err), Detail: err.Error()})
+		return false, nil
+	}
+	// after live events, see lanes.go
+	release := lanes.backfill()
+	defer release()
+	sequence.assign(&ev)
+	if err := appendEvent(session, ev); err != nil {
+		log.Println("append event error:", err)
+	}
+	_, err = applyEvent(session, ev, false)
+	return true, err
+}
+
+type startBackfillRequest struct {
+	DIDs []string `json:"dids"`
+	// KnownActors queues every actor in actor_handles
+	KnownActors bool `json:"known_actors"`
+	// RetryFailed puts failed repos back to pending
+	RetryFailed bool `json:"retry_failed"`
+	// ListRepos queues every active repo this relay or PDS lists
+	ListRepos string `json:"list_repos"`
+	// Parallelism, when set, changes how many repos run at once; 0 pauses
+	Parallelism *int `json:"parallelism"`
+}
+
+// startBackfill queues repos for backfill and adjusts the parallelism.
+// Repos backfilled before are not queued again.
+func startBackfill(session *gocql.Session) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req startBackfillRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		for _, did := range req.DIDs {
+			if validateDID(did) != did {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid did " + did})
+				return
+			}
+		}
+		if req.ListRepos != "" {
+			if _, err := backfillHostURL(req.ListRepos); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "list_repos: " + err.Error()})
+				return
+			}
+		}
+		if req.Parallelism != nil {
+			if *req.Parallelism < 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "parallelism must not be negative"})
+				return
+			}
+			backfill.mu.Lock()
+			backfill.parallelism = *req.Parallelism
+			backfill.mu.Unlock()
+		}
+
+		dids := req.DIDs
+		if req.KnownActors {
+			for bucket := 0; bucket < actorHandleBuckets; bucket++ {
+				iter := session.Query(`SELECT did FROM actor_handles WHERE bucket = ?`, bucket).
+					WithContext(c.Request.Context()).Iter()
+				var did string
+				for iter.Scan(&did) {
+					dids = append(dids, did)
+				}
+				if err := iter.Close(); err != nil {
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					return
+				}
+			}
+		}
+
+		queued := 0
+		for _, did := range dids {
+			applied, err := queueBackfill(c.Request.Context(), session, did)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			if applied {
+				queued++
+			}
+		}
+
+		requeued := 0
+		if req.RetryFailed {
+			failed, err := backfillReposIn(session, backfillFailed, 0)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			for _, did := range failed {
+				err := session.Query(`UPDATE backfill_repos SET state = ?, attempts = 0 WHERE did = ?`, backfillPending, did).Exec()
+				if err == nil {
+					err = moveBackfillState(session, did, backfillFailed, backfillPending)
+				}
+				if err != nil {
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					return
+				}
+				requeued++
+			}
+		}
+
+		enumerating := false
+		if req.ListRepos != "" {
+			start, err := startEnumeration(c.Request.Context(), session, req.ListRepos)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			if start {
+				go backfill.enumerate(session, req.ListRepos)
+			}
+			enumerating = true
+		}
+
+		backfill.mu.Lock()
+		parallelism := backfill.parallelism
+		backfill.mu.Unlock()
+		c.JSON(http.StatusOK, gin.H{"queued": queued, "requeued": requeued, "enumerating": enumerating, "parallelism": parallelism})
+	}
+}
+
+// queueBackfill adds a repo as pending, unless it was queued before.
+func queueBackfill(ctx context.Context, session *gocql.Session, did string) (bool, error) {
+	applied, err := session.Query(`
+		INSERT INTO backfill_repos (did, state, records, attempts, updated_at)
+		VALUES (?, ?, 0, 0, ?)
+		IF NOT EXISTS`,
+		did, backfillPending, time.Now(),
+	).WithContext(ctx).MapScanCAS(map[string]interface{}{})
+	if err != nil || !applied {
+		return false, err
+	}
+	err = session.Query(`INSERT INTO backfill_repos_by_state (state, did) VALUES (?, ?)`, backfillPending, did).Exec()
+	return err == nil, err
+}
+
+type BackfillRepo struct {
+	DID       string    `json:"did"`
+	Records   int       `json:"records"`
+	Attempts  int       `json:"attempts"`
+	Error     string    `json:"error,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type BackfillStatus struct {
+	Parallelism int `json:"parallelism"`
+	Done        int `json:"done"`
+	// Remaining are the pending and running repos
+	Remaining int `json:"remaining"`
+	Running   int `json:"running"`
+	Failed    int `json:"failed"`
+	// Active are the repos this instance is backfilling
+	Active   []string       `json:"active"`
+	Failures []BackfillRepo `json:"failures"`
+	// Enumerations are the listRepos runs queueing repos
+	Enumerations []BackfillEnumeration `json:"enumerations"`
+}
+
+// maxListedBackfillFailures caps the failures getBackfillStatus lists.
+const maxListedBackfillFailures = 100
+
+// getBackfillStatus reports how many repos are done, remaining and
+// failed, across instances, and why the failed ones failed.
+func getBackfillStatus(session *gocql.Session) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		counts := map[string]int{}
+		for _, state := range []string{backfillPending, backfillRunning, backfillDone, backfillFailed} {
+			var n int
+			err := session.Query(`SELECT COUNT(*) FROM backfill_repos_by_state WHERE state = ?`, state).
+				WithContext(c.Request.Context()).Scan(&n)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			counts[state] = n
+		}
+
+		failed, err := backfillReposIn(session, backfillFailed, maxListedBackfillFailures)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		failures := []BackfillRepo{}
+		for _, did := range failed {
+			r := BackfillRepo{DID: did}
+			err := session.Query(`SELECT records, attempts, error, updated_at FROM backfill_repos WHERE did = ?`, did).
+				WithContext(c.Request.Context()).Scan(&r.Records, &r.Attempts, &r.Error, &r.UpdatedAt)
+			if err != nil && err != gocql.ErrNotFound {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			failures = append(failures, r)
+		}
+
+		enumerations, err := listEnumerations(c.Request.Context(), session)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		backfill.mu.Lock()
+		st := BackfillStatus{
+			Parallelism:  backfill.parallelism,
+			Done:         counts[backfillDone],
+			Remaining:    counts[backfillPending] + counts[backfillRunning],
+			Running:      counts[backfillRunning],
+			Failed:       counts[backfillFailed],
+			Active:       []string{},
+			Failures:     failures,
+			Enumerations: enumerations,
+		}
+		for did := range backfill.running {
+			st.Active = append(st.Active, did)
+		}
+		backfill.mu.Unlock()
+		c.JSON(http.StatusOK, st)
+	}
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/baphotex/meowview/repostream"
+	"github.com/gocql/gocql"
+)
+
+// BACKFILL_FETCH=getRepo reads each repo's meows from its CAR, exported by
+// com.atproto.sync.getRepo, instead of paging through listRecords: one
+// request per repo, but the whole repo is downloaded, up to
+// BACKFILL_MAX_REPO_BYTES. A repo interrupted midway is fetched again and
+// the meows already written are skipped.
+//
+// Besides DIDs given to startBackfill, repos are queued by enumerating a
+// relay or PDS with com.atproto.sync.listRepos. An enumeration's cursor is
+// checkpointed in backfill_enumerations after every page and, like a repo,
+// resumed by any instance once BACKFILL_STALE_AFTER passed without one.
+const (
+	backfillFetchListRecords = "listRecords"
+	backfillFetchGetRepo     = "getRepo"
+)
+
+var backfillFetch = backfillFetchFromEnv()
+
+var backfillMaxRepoBytes = envInt("BACKFILL_MAX_REPO_BYTES", 256<<20)
+
+// listReposPageSize is the most listRepos returns at once.
+const listReposPageSize = 1000
+
+func backfillFetchFromEnv() string {
+	fetch := envString("BACKFILL_FETCH", backfillFetchListRecords)
+	if fetch != backfillFetchListRecords && fetch != backfillFetchGetRepo {
+		log.Fatalf("BACKFILL_FETCH must be %s or %s, not %q", backfillFetchListRecords, backfillFetchGetRepo, fetch)
+	}
+	return fetch
+}
+
+func createBackfillEnumerationTable(session *gocql.Session) error {
+	return session.Query(`
+		CREATE TABLE IF NOT EXISTS backfill_enumerations (
+			host TEXT PRIMARY KEY,
+			cursor TEXT,
+			repos INT,
+			done BOOLEAN,
+			updated_at TIMESTAMP
+		)`).Exec()
+}
+
+// backfillFromRepo writes the meows of a repo's CAR, checkpointing the
+// count every page worth of them so the repo doesn't look stale.
+func backfillFromRepo(session *gocql.Session, pds, did string, records int) error {
+	car, err := fetchRepo(pds, did)
+	if err != nil {
+		return err
+	}
+	repo, err := repostream.ParseRepo(car)
+	if err != nil {
+		return err
+	}
+	if repo.DID != did {
+		return fmt.Errorf("getRepo returned the repo of %s", repo.DID)
+	}
+	meows, err := repo.Records(meowNSID)
+	if err != nil {
+		return err
+	}
+	checkpoint := func() error {
+		return session.Query(`UPDATE backfill_repos SET records = ?, updated_at = ? WHERE did = ?`,
+			records, time.Now(), did).Exec()
+	}
+	for i, m := range meows {
+		rec := repoRecord{URI: meowURI(did, m.Rkey), CID: m.CID.String(), Value: m.Value}
+		written, err := backfillRecord(session, did, rec)
+		if err != nil {
+			return err
+		}
+		if written {
+			records++
+		}
+		if (i+1)%backfillPageSize == 0 {
+			if err := checkpoint(); err != nil {
+				return err
+			}
+		}
+	}
+	return checkpoint()
+}
+
+func fetchRepo(pds, did string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+	q := url.Values{"did": {did}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, pds+"/xrpc/com.atproto.sync.getRepo?"+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := outbound.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("getRepo returned %s", resp.Status)
+	}
+	car, err := io.ReadAll(io.LimitReader(resp.Body, int64(backfillMaxRepoBytes)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(car) > backfillMaxRepoBytes {
+		return nil, fmt.Errorf("repo larger than BACKFILL_MAX_REPO_BYTES")
+	}
+	return car, nil
+}
+
+// backfillHostURL is the XRPC base of a host given as a hostname or URL.
+func backfillHostURL(host string) (string, error) {
+	if !strings.Contains(host, "://") {
+		host = "https://" + host
+	}
+	u, err := url.Parse(host)
+	if err != nil {
+		return "", err
+	}
+	if u.Host == "" || (u.Scheme != "https" && u.Scheme != "http") {
+		return "", fmt.Errorf("not an http(s) host")
+	}
+	return u.Scheme + "://" + u.Host, nil
+}
+
+// startEnumeration records an enumeration of host, or restarts a finished
+// one, and reports whether it should be run. One still in progress is left
+// to whichever instance runs it.
+func startEnumeration(ctx context.Context, session *gocql.Session, host string) (bool, error) {
+	applied, err := session.Query(`
+		INSERT INTO backfill_enumerations (host, repos, done, updated_at)
+		VALUES (?, 0, false, ?)
+		IF NOT EXISTS`,
+		host, time.Now(),
+	).WithContext(ctx).MapScanCAS(map[string]interface{}{})
+	if err != nil || applied {
+		return applied, err
+	}
+	return session.Query(`
+		UPDATE backfill_enumerations SET cursor = null, repos = 0, done = false, updated_at = ?
+		WHERE host = ? IF done = true`,
+		time.Now(), host,
+	).WithContext(ctx).MapScanCAS(map[string]interface{}{})
+}
+
+// resumeEnumerations takes over enumerations whose checkpoint went stale.
+func (b *backfiller) resumeEnumerations(session *gocql.Session) error {
+	iter := session.Query(`SELECT host, done, updated_at FROM backfill_enumerations`).Iter()
+	var host string
+	var done bool
+	var updated time.Time
+	for iter.Scan(&host, &done, &updated) {
+		if done || b.isEnumerating(host) || time.Since(updated) < backfillStaleAfter {
+			continue
+		}
+		applied, err := session.Query(`
+			UPDATE backfill_enumerations SET updated_at = ?
+			WHERE host = ? IF updated_at = ?`,
+			time.Now(), host, updated,
+		).MapScanCAS(map[string]interface{}{})
+		if err != nil {
+			log.Printf("claim enumeration of %s: %v", host, err)
+			continue
+		}
+		if applied {
+			go b.enumerate(session, host)
+		}
+	}
+	return iter.Close()
+}
+
+func (b *backfiller) isEnumerating(host string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.enumerating[host]
+}
+
+type listReposPage struct {
+	Cursor string `json:"cursor"`
+	Repos  []struct {
+		DID    string `json:"did"`
+		Active *bool  `json:"active"`
+	} `json:"repos"`
+}
+
+// enumerate queues the active repos host lists, from its checkpoint on.
+// On an error it stops, and the checkpoint goes stale to be resumed.
+func (b *backfiller) enumerate(session *gocql.Session, host string) {
+	b.mu.Lock()
+	if b.enumerating[host] {
+		b.mu.Unlock()
+		return
+	}
+	b.enumerating[host] = true
+	b.mu.Unlock()
+	defer func() {
+		b.mu.Lock()
+		delete(b.enumerating, host)
+		b.mu.Unlock()
+	}()
+
+	if err := enumerateRepos(session, host); err != nil {
+		log.Printf("enumerate %s: %v", host, err)
+	}
+}
+
+func enumerateRepos(session *gocql.Session, host string) error {
+	base, err := backfillHostURL(host)
+	if err != nil {
+		return err
+	}
+	var cursor *string
+	var repos int
+	err = session.Query(`SELECT cursor, repos FROM backfill_enumerations WHERE host = ?`, host).Scan(&cursor, &repos)
+	if err != nil {
+		return err
+	}
+	log.Printf("enumerating repos of %s from %d", host, repos)
+
+	for {
+		page, err := listRepos(base, derefString(cursor))
+		if err != nil {
+			return err
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		for _, r := range page.Repos {
+			if (r.Active != nil && !*r.Active) || validateDID(r.DID) != r.DID {
+				continue
+			}
+			if _, err := queueBackfill(ctx, session, r.DID); err != nil {
+				cancel()
+				return err
+			}
+		}
+		cancel()
+		repos += len(page.Repos)
+		done := page.Cursor == "" || len(page.Repos) == 0
+		cursor = &page.Cursor
+		err = session.Query(`
+			UPDATE backfill_enumerations SET cursor = ?, repos = ?, done = ?, updated_at = ?
+			WHERE host = ?`,
+			page.Cursor, repos, done, time.Now(), host,
+		).Exec()
+		if err != nil {
+			return err
+		}
+		if done {
+			log.Printf("enumerated %d repos of %s", repos, host)
+			return nil
+		}
+	}
+}
+
+func listRepos(base, cursor string) (*listReposPage, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	q := url.Values{"limit": {fmt.Sprint(listReposPageSize)}}
+	if cursor != "" {
+		q.Set("cursor", cursor)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, base+"/xrpc/com.atproto.sync.listRepos?"+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := outbound.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("listRepos returned %s", resp.Status)
+	}
+	var page listReposPage
+	if err := json.NewDecoder(resp.Body).Decode(&page); err != nil {
+		return nil, err
+	}
+	return &page, nil
+}
+
+type BackfillEnumeration struct {
+	Host      string    `json:"host"`
+	Repos     int       `json:"repos"`
+	Done      bool      `json:"done"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func listEnumerations(ctx context.Context, session *gocql.Session) ([]BackfillEnumeration, error) {
+	iter := session.Query(`SELECT host, repos, done, updated_at FROM backfill_enumerations`).WithContext(ctx).Iter()
+	out := []BackfillEnumeration{}
+	var e BackfillEnumeration
+	for iter.Scan(&e.Host, &e.Repos, &e.Done, &e.UpdatedAt) {
+		out = append(out, e)
+	}
+	return out, iter.Close()
+}
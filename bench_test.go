@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gocql/gocql"
+)
+
+// Micro benchmarks of the ingest path and the query handlers' in-memory
+// work; make bench compares them with bench/baseline.txt. Writes through
+// the database are not covered; those are dominated by Cassandra and show
+// in meowview_cassandra_query_duration_seconds instead.
+
+var benchJetstreamCommit = []byte(`{"did":"did:plc:4xq7bnbd6mfxdmkd4w6wrq7u","time_us":1725911162329308,"kind":"commit",` +
+	`"commit":{"rev":"3l3qo2vutsw2b","operation":"create","collection":"moe.kasey.meow","rkey":"3l3qo2vuowo2b",` +
+	`"record":{"$type":"moe.kasey.meow","emotion":"sleepy","subject":"at://did:plc:4xq7bnbd6mfxdmkd4w6wrq7u/app.bsky.feed.post/3l3qo2vuowo2b"},` +
+	`"cid":"bafyreidwaivazkwu67xztlmuobx35hs2lnfh3kolmgfmucldvhd3sgzcqi"}}`)
+
+// benchMeows is a full page of meows as the list endpoints return them.
+func benchMeows() []MeowResponse {
+	meows := make([]MeowResponse, 100)
+	for i := range meows {
+		meows[i] = MeowResponse{
+			Rkey:    fmt.Sprintf("3l3qo2vuo%04d", i),
+			TimeUS:  1725911162329308 + int64(i),
+			CID:     "bafyreidwaivazkwu67xztlmuobx35hs2lnfh3kolmgfmucldvhd3sgzcqi",
+			DID:     fmt.Sprintf("did:plc:4xq7bnbd6mfxdmkd4w6w%04d", i),
+			Emotion: "sleepy",
+		}
+	}
+	return meows
+}
+
+func BenchmarkDecode(b *testing.B) {
+	b.Run("jetstream_commit", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			var msg WebSocketMessage
+			if err := json.Unmarshal(benchJetstreamCommit, &msg); err != nil {
+				b.Fatal(err)
+			}
+			if _, _, err := decodeRecord(meowNSID, msg.Commit.Record); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkValidate(b *testing.B) {
+	b.Run("rkey", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			rkeyRegex.MatchString("3l3qo2vuowo2b")
+		}
+	})
+	b.Run("did_syntax", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			didSyntax.MatchString("did:plc:4xq7bnbd6mfxdmkd4w6wrq7u")
+		}
+	})
+	b.Run("rev_timestamp", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			revTimestamp("3l3qo2vutsw2b")
+		}
+	})
+	b.Run("emotion", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := normalizeEmotion("Sleepy"); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+type benchSink struct{}
+
+func (benchSink) Name() string                               { return "bench" }
+func (benchSink) Deliver(context.Context, outboxEntry) error { return nil }
+
+// BenchmarkInsert covers what applyEvent does in memory before the batch
+// goes to Cassandra. The record has no subject, whose validation resolves
+// DIDs over the network.
+func BenchmarkInsert(b *testing.B) {
+	var msg WebSocketMessage
+	if err := json.Unmarshal(benchJetstreamCommit, &msg); err != nil {
+		b.Fatal(err)
+	}
+	msg.Commit.Record = json.RawMessage(`{"$type":"moe.kasey.meow","emotion":"Sleepy"}`)
+	record, version, err := decodeRecord(meowNSID, msg.Commit.Record)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.Run("event", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			ev := eventFromMessage(msg)
+			if err := ev.setRecord(record, version); err != nil {
+				b.Fatal(err)
+			}
+			m := ev.Meow
+			m.TimeUS = derivedTimeUS(ev)
+			effectiveEmotion(m)
+		}
+	})
+	b.Run("outbox_entry", func(b *testing.B) {
+		sinks := outboxSinks
+		outboxSinks = []outboxSink{benchSink{}}
+		defer func() { outboxSinks = sinks }()
+		ev := eventFromMessage(msg)
+		if err := ev.setRecord(record, version); err != nil {
+			b.Fatal(err)
+		}
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if err := addOutboxEntries(&gocql.Batch{Type: gocql.LoggedBatch}, ev); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkHandler(b *testing.B) {
+	b.Run("moderation_filter", func(b *testing.B) {
+		m := &moderationState{meows: map[string]meowModeration{}, actors: map[string]bool{}}
+		page := benchMeows()
+		for i, meow := range page {
+			if i%10 == 0 {
+				m.meows[meowURI(meow.DID, meow.Rkey)] = meowModeration{labels: []string{"spam"}}
+			}
+		}
+		m.actors[page[1].DID] = true
+		meows := make([]MeowResponse, len(page))
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			copy(meows, page)
+			m.applyGlobal(meows)
+		}
+	})
+	b.Run("serialize_page", func(b *testing.B) {
+		gin.SetMode(gin.ReleaseMode)
+		r := gin.New()
+		page := benchMeows()
+		r.GET("/meows", func(c *gin.Context) {
+			c.JSON(http.StatusOK, gin.H{"meows": page, "cursor": "1725911162329308/3l3qo2vuowo2b/did:plc:4xq7bnbd6mfxdmkd4w6wrq7u"})
+		})
+		req := httptest.NewRequest(http.MethodGet, "/meows", nil)
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+		}
+	})
+}
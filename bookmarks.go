@@ -0,0 +1,193 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gocql/gocql"
+)
+
+// maxBookmarks caps how many meows one viewer can bookmark.
+var maxBookmarks = envInt("MAX_BOOKMARKS", 1000)
+
+var bookmarksGuardrail = newGuardrail("bookmarks", 50, 100, 0, 0)
+
+func createBookmarkTables(session *gocql.Session) error {
+	return session.Query(`
+		CREATE TABLE IF NOT EXISTS bookmarks (
+			viewer TEXT,
+			did TEXT,
+			rkey TEXT,
+			bookmarked_at TIMESTAMP,
+			PRIMARY KEY ((viewer), did, rkey)
+		)`).Exec()
+}
+
+type Bookmark struct {
+	DID          string    `json:"did"`
+	Rkey         string    `json:"rkey"`
+	BookmarkedAt time.Time `json:"bookmarked_at"`
+	// Meow is nil once the bookmarked meow has been deleted.
+	Meow *MeowResponse `json:"meow"`
+}
+
+type BookmarksResponse struct {
+	Bookmarks []Bookmark `json:"bookmarks"`
+	Cursor    string     `json:"cursor,omitempty"`
+}
+
+// bookmarkTarget reads and validates the did and rkey of the meow to
+// (un)bookmark.
+func bookmarkTarget(c *gin.Context) (string, string, bool) {
+	did, rkey := c.Query("did"), c.Query("rkey")
+	if did == "" || validateDID(did) != did {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid did"})
+		return "", "", false
+	}
+	if !rkeyRegex.MatchString(rkey) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid rkey"})
+		return "", "", false
+	}
+	return did, rkey, true
+}
+
+func lookupMeow(c *gin.Context, session *gocql.Session, did, rkey string) (*MeowResponse, error) {
+	var row meowRow
+	err := session.Query(`
+		SELECT `+meowColumns+`
+		FROM cat.meows
+		WHERE id = ?`,
+		meowID(did, rkey),
+	).WithContext(c.Request.Context()).Scan(row.dest()...)
+	if err == gocql.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	m := row.meow().response()
+	return &m, nil
+}
+
+func bookmarkMeow(session *gocql.Session) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		viewer := c.GetString("viewer")
+		did, rkey, ok := bookmarkTarget(c)
+		if !ok {
+			return
+		}
+
+		m, err := lookupMeow(c, session, did, rkey)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if m == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "meow not found"})
+			return
+		}
+
+		var count int
+		err = session.Query(`SELECT COUNT(*) FROM bookmarks WHERE viewer = ?`, viewer).
+			WithContext(c.Request.Context()).Scan(&count)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if count >= maxBookmarks {
+			c.JSON(http.StatusConflict, gin.H{"error": "too many bookmarks"})
+			return
+		}
+
+		err = session.Query(`
+			INSERT INTO bookmarks (viewer, did, rkey, bookmarked_at) VALUES (?, ?, ?, ?)`,
+			viewer, did, rkey, time.Now(),
+		).WithContext(c.Request.Context()).Exec()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.Status(http.StatusNoContent)
+	}
+}
+
+func unbookmarkMeow(session *gocql.Session) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		did, rkey, ok := bookmarkTarget(c)
+		if !ok {
+			return
+		}
+		err := session.Query(`DELETE FROM bookmarks WHERE viewer = ? AND did = ? AND rkey = ?`,
+			c.GetString("viewer"), did, rkey,
+		).WithContext(c.Request.Context()).Exec()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.Status(http.StatusNoContent)
+	}
+}
+
+// getBookmarks lists the viewer's bookmarks, newest first, with the
+// bookmarked meows attached. The cursor is the bookmarked_at of the last
+// bookmark on the previous page.
+func getBookmarks(session *gocql.Session) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		limit, err := bookmarksGuardrail.parseLimit(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		var before time.Time
+		if v := c.Query("cursor"); v != "" {
+			if before, err = time.Parse(time.RFC3339Nano, v); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid cursor"})
+				return
+			}
+		}
+
+		iter := session.Query(`
+			SELECT did, rkey, bookmarked_at
+			FROM bookmarks
+			WHERE viewer = ?`,
+			c.GetString("viewer"),
+		).WithContext(c.Request.Context()).Iter()
+
+		bookmarks := []Bookmark{}
+		var b Bookmark
+		for iter.Scan(&b.DID, &b.Rkey, &b.BookmarkedAt) {
+			bookmarks = append(bookmarks, b)
+			b = Bookmark{}
+		}
+		if err := iter.Close(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		sort.Slice(bookmarks, func(i, j int) bool {
+			return bookmarks[i].BookmarkedAt.After(bookmarks[j].BookmarkedAt)
+		})
+		if !before.IsZero() {
+			i := sort.Search(len(bookmarks), func(i int) bool {
+				return bookmarks[i].BookmarkedAt.Before(before)
+			})
+			bookmarks = bookmarks[i:]
+		}
+		var cursor string
+		if len(bookmarks) > limit {
+			bookmarks = bookmarks[:limit]
+			cursor = bookmarks[limit-1].BookmarkedAt.Format(time.RFC3339Nano)
+		}
+
+		for i := range bookmarks {
+			m, err := lookupMeow(c, session, bookmarks[i].DID, bookmarks[i].Rkey)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			bookmarks[i].Meow = m
+		}
+		c.JSON(http.StatusOK, BookmarksResponse{Bookmarks: bookmarks, Cursor: cursor})
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"html"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gocql/gocql"
+	"golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+// cardSizes are the supported card dimensions; large is the size most
+// unfurlers expect for og:image.
+var cardSizes = map[string]image.Point{
+	"small": {600, 315},
+	"large": {1200, 630},
+}
+
+var emotionEmoji = map[string]string{
+	"happy":   "😸",
+	"sad":     "😿",
+	"angry":   "😾",
+	"sleepy":  "😴",
+	"hungry":  "🍽️",
+	"playful": "😺",
+	"love":    "😻",
+	"scared":  "🙀",
+	"smug":    "😼",
+}
+
+var emotionColors = map[string]color.RGBA{
+	"happy":   {0xff, 0xd1, 0x66, 0xff},
+	"sad":     {0x7a, 0x9c, 0xc6, 0xff},
+	"angry":   {0xe0, 0x5a, 0x47, 0xff},
+	"sleepy":  {0x9d, 0x8c, 0xd6, 0xff},
+	"hungry":  {0xf2, 0xa6, 0x5a, 0xff},
+	"playful": {0x6c, 0xc5, 0x8a, 0xff},
+	"love":    {0xf2, 0x8d, 0xb2, 0xff},
+}
+
+var defaultCardColor = color.RGBA{0xe8, 0xe2, 0xd6, 0xff}
+
+func cardEmoji(emotion string) string {
+	if e, ok := emotionEmoji[emotion]; ok {
+		return e
+	}
+	return "🐱"
+}
+
+func cardColor(emotion string) color.RGBA {
+	if c, ok := emotionColors[emotion]; ok {
+		return c
+	}
+	return defaultCardColor
+}
+
+type meowCard struct {
+	Handle  string
+	Emotion string
+	Time    time.Time
+	Size    image.Point
+}
+
+func (card meowCard) lines() []string {
+	emotion := card.Emotion
+	if emotion == "" {
+		emotion = "meow"
+	}
+	return []string{
+		"@" + card.Handle,
+		"is feeling " + emotion,
+		card.Time.UTC().Format("2006-01-02 15:04 UTC"),
+	}
+}
+
+func renderCardSVG(card meowCard) []byte {
+	w, h := card.Size.X, card.Size.Y
+	bg := cardColor(card.Emotion)
+	lines := card.lines()
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d">`, w, h, w, h)
+	fmt.Fprintf(&b, `<rect width="100%%" height="100%%" fill="#%02x%02x%02x"/>`, bg.R, bg.G, bg.B)
+	fmt.Fprintf(&b, `<text x="%d" y="%d" font-size="%d" text-anchor="middle">%s</text>`,
+		w/2, h*9/20, h/3, cardEmoji(card.Emotion))
+	fmt.Fprintf(&b, `<text x="%d" y="%d" font-family="sans-serif" font-size="%d" font-weight="bold" text-anchor="middle">%s</text>`,
+		w/2, h*13/20, h/12, html.EscapeString(lines[0]))
+	fmt.Fprintf(&b, `<text x="%d" y="%d" font-family="sans-serif" font-size="%d" text-anchor="middle">%s</text>`,
+		w/2, h*15/20, h/16, html.EscapeString(lines[1]))
+	fmt.Fprintf(&b, `<text x="%d" y="%d" font-family="sans-serif" font-size="%d" fill="#444" text-anchor="middle">%s</text>`,
+		w/2, h*18/20, h/20, html.EscapeString(lines[2]))
+	b.WriteString(`</svg>`)
+	return b.Bytes()
+}
+
+// renderCardPNG draws the card with the built-in bitmap font on a small
+// canvas and scales it up, since there is no emoji font to rasterize with.
+func renderCardPNG(card meowCard) ([]byte, error) {
+	const scale = 4
+	small := image.NewRGBA(image.Rect(0, 0, card.Size.X/scale, card.Size.Y/scale))
+	draw.Draw(small, small.Bounds(), image.NewUniform(cardColor(card.Emotion)), image.Point{}, draw.Src)
+
+	face := basicfont.Face7x13
+	d := &font.Drawer{Dst: small, Src: image.Black, Face: face}
+	lines := card.lines()
+	lineHeight := face.Metrics().Height.Ceil() + 4
+	y := (small.Bounds().Dy() - lineHeight*len(lines)) / 2
+	for _, line := range lines {
+		y += lineHeight
+		width := d.MeasureString(line).Ceil()
+		d.Dot = fixed.P((small.Bounds().Dx()-width)/2, y)
+		d.DrawString(line)
+	}
+
+	big := image.NewRGBA(image.Rect(0, 0, card.Size.X, card.Size.Y))
+	draw.NearestNeighbor.Scale(big, big.Bounds(), small, small.Bounds(), draw.Src, nil)
+
+	var b bytes.Buffer
+	if err := png.Encode(&b, big); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+type cachedCard struct {
+	body    []byte
+	etag    string
+	created time.Time
+}
+
+// cardCache keeps rendered cards in memory. Cards are keyed by CID so an
+// edited meow gets a fresh card.
+type cardCache struct {
+	mu      sync.Mutex
+	entries map[string]cachedCard
+	order   []string
+	max     int
+	ttl     time.Duration
+}
+
+func newCardCache(max int, ttl time.Duration) *cardCache {
+	return &cardCache{entries: map[string]cachedCard{}, max: max, ttl: ttl}
+}
+
+func (cc *cardCache) get(key string) (cachedCard, bool) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	card, ok := cc.entries[key]
+	if !ok || time.Since(card.created) > cc.ttl {
+		return cachedCard{}, false
+	}
+	return card, true
+}
+
+func (cc *cardCache) put(key string, card cachedCard) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if _, ok := cc.entries[key]; !ok {
+		cc.order = append(cc.order, key)
+	}
+	cc.entries[key] = card
+	for len(cc.order) > cc.max {
+		delete(cc.entries, cc.order[0])
+		cc.order = cc.order[1:]
+	}
+}
+
+// resolveHandle returns the handle from the DID document's alsoKnownAs,
+// falling back to the DID itself.
+func resolveHandle(ctx context.Context, did string) string {
+	doc, err := didResolver.Resolve(ctx, did)
+	if err != nil || doc.Handle() == "" {
+		return did
+	}
+	return doc.Handle()
+}
+
+func getMeowCard(session *gocql.Session) gin.HandlerFunc {
+	cache := newCardCache(1000, time.Hour)
+	return func(c *gin.Context) {
+		rkey := c.Query("rkey")
+		did := c.Query("did")
+		validatedDid := validateDID(did)
+		if validatedDid != did {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid did"})
+			return
+		}
+		if !rkeyRegex.MatchString(rkey) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid rkey"})
+			return
+		}
+		format := c.DefaultQuery("format", "png")
+		if format != "png" && format != "svg" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "format must be png or svg"})
+			return
+		}
+		sizeName := c.DefaultQuery("size", "large")
+		size, ok := cardSizes[sizeName]
+		if !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "size must be small or large"})
+			return
+		}
+
+		var row meowRow
+		err := session.Query(`
+			SELECT `+meowColumns+`
+			FROM cat.meows
+			WHERE id = ?`,
+			meowID(validatedDid, rkey),
+		).WithContext(c.Request.Context()).Scan(row.dest()...)
+		if err != nil {
+			if err == gocql.ErrNotFound {
+				c.JSON(http.StatusNotFound, gin.H{"error": "meow not found"})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		m := row.meow()
+
+		contentType := "image/png"
+		if format == "svg" {
+			contentType = "image/svg+xml"
+		}
+		key := strings.Join([]string{m.CID, format, sizeName}, "/")
+
+		card, ok := cache.get(key)
+		if !ok {
+			ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+			defer cancel()
+			emotion, _ := effectiveEmotion(m)
+			mc := meowCard{
+				Handle:  resolveHandle(ctx, m.DID),
+				Emotion: emotion,
+				Time:    time.UnixMicro(m.TimeUS),
+				Size:    size,
+			}
+
+			var body []byte
+			if format == "svg" {
+				body = renderCardSVG(mc)
+			} else if body, err = renderCardPNG(mc); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			card = cachedCard{body: body, etag: `"` + key + `"`, created: time.Now()}
+			cache.put(key, card)
+		}
+
+		c.Header("Cache-Control", "public, max-age=3600")
+		c.Header("ETag", card.etag)
+		if c.GetHeader("If-None-Match") == card.etag {
+			c.Status(http.StatusNotModified)
+			return
+		}
+		c.Data(http.StatusOK, contentType, card.body)
+	}
+}
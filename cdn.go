@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The public read endpoints can be put behind a CDN. With CACHE_MAX_AGE set
+// they answer with Cache-Control, and with the surrogate keys of what they
+// list, as Surrogate-Key for Fastly and Cache-Tag for Cloudflare:
+//
+//	meows             getLastMeows
+//	actor:<did>       getActorMeows, getActorPinnedMeow and getMeow
+//	subject:<did>     getSubjectMeows
+//	meow:<did>/<rkey> getMeow
+//
+// CDN_MAX_AGE lets the CDN keep responses longer than browsers, as
+// Surrogate-Control and CDN-Cache-Control, since with CDN_PURGE set every
+// change is purged by key through the outbox. Only successful responses
+// are cacheable.
+var (
+	cacheMaxAge = envDuration("CACHE_MAX_AGE", 0)
+	cdnMaxAge   = envDuration("CDN_MAX_AGE", 0)
+	cdn         = cdnPurgerFromEnv()
+)
+
+const cdnAllMeowsKey = "meows"
+
+func cdnActorKey(did string) string       { return "actor:" + did }
+func cdnSubjectKey(subject string) string { return "subject:" + subject }
+func cdnMeowKey(did, rkey string) string  { return "meow:" + did + "/" + rkey }
+
+// cdnKeysOf are the keys to purge when m changes.
+func cdnKeysOf(m MeowResponse) []string {
+	keys := []string{cdnAllMeowsKey, cdnActorKey(m.DID), cdnMeowKey(m.DID, m.Rkey)}
+	if m.Subject != "" {
+		keys = append(keys, cdnSubjectKey(m.Subject))
+	}
+	return keys
+}
+
+// cacheable marks a read endpoint's successful responses as cacheable,
+// tagged with the keys keysOf returns for the request.
+func cacheable(keysOf func(c *gin.Context) []string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if cacheMaxAge <= 0 {
+			c.Next()
+			return
+		}
+		h := c.Writer.Header()
+		h.Set("Cache-Control", "public, max-age="+strconv.Itoa(int(cacheMaxAge.Seconds())))
+		if cdnMaxAge > 0 {
+			v := "max-age=" + strconv.Itoa(int(cdnMaxAge.Seconds()))
+			h.Set("Surrogate-Control", v)
+			h.Set("CDN-Cache-Control", v)
+		}
+		if keys := keysOf(c); len(keys) > 0 {
+			h.Set("Surrogate-Key", strings.Join(keys, " "))
+			h.Set("Cache-Tag", strings.Join(keys, ","))
+		}
+		c.Writer = &cacheHeaderWriter{ResponseWriter: c.Writer}
+		c.Next()
+	}
+}
+
+// cacheHeaderWriter makes responses other than 200 uncacheable.
+type cacheHeaderWriter struct {
+	gin.ResponseWriter
+}
+
+func (w *cacheHeaderWriter) WriteHeader(code int) {
+	if code != http.StatusOK {
+		h := w.Header()
+		h.Set("Cache-Control", "no-store")
+		for _, k := range []string{"Surrogate-Control", "CDN-Cache-Control", "Surrogate-Key", "Cache-Tag"} {
+			h.Del(k)
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func cdnQueryKey(param string, key func(string) string) func(*gin.Context) []string {
+	return func(c *gin.Context) []string {
+		if v := c.Query(param); v != "" {
+			return []string{key(v)}
+		}
+		return nil
+	}
+}
+
+func cdnMeowKeys(c *gin.Context) []string {
+	did, rkey := c.Query("did"), c.Query("rkey")
+	return []string{cdnActorKey(did), cdnMeowKey(did, rkey)}
+}
+
+func cdnAllMeowsKeys(*gin.Context) []string { return []string{cdnAllMeowsKey} }
+
+// cdnPurger invalidates cached responses by surrogate key.
+type cdnPurger interface {
+	Name() string
+	Purge(ctx context.Context, keys []string) error
+	// maxKeys is how many keys one purge request may carry
+	maxKeys() int
+}
+
+// CDN_PURGE picks the CDN: fastly (FASTLY_SERVICE_ID, FASTLY_API_TOKEN) or
+// cloudflare (CLOUDFLARE_ZONE_ID, CLOUDFLARE_API_TOKEN).
+func cdnPurgerFromEnv() cdnPurger {
+	switch p := envString("CDN_PURGE", ""); p {
+	case "":
+		return nil
+	case "fastly":
+		return &fastlyPurger{service: envString("FASTLY_SERVICE_ID", ""), token: envSecret("FASTLY_API_TOKEN")}
+	case "cloudflare":
+		return &cloudflarePurger{zone: envString("CLOUDFLARE_ZONE_ID", ""), token: envSecret("CLOUDFLARE_API_TOKEN")}
+	default:
+		log.Fatalf("CDN_PURGE must be fastly or cloudflare, not %q", p)
+		return nil
+	}
+}
+
+type fastlyPurger struct {
+	service, token string
+}
+
+func (p *fastlyPurger) Name() string { return "fastly" }
+func (p *fastlyPurger) maxKeys() int { return 256 }
+
+func (p *fastlyPurger) Purge(ctx context.Context, keys []string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://api.fastly.com/service/"+p.service+"/purge", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Fastly-Key", p.token)
+	req.Header.Set("Surrogate-Key", strings.Join(keys, " "))
+	return doPurge(req)
+}
+
+type cloudflarePurger struct {
+	zone, token string
+}
+
+func (p *cloudflarePurger) Name() string { return "cloudflare" }
+func (p *cloudflarePurger) maxKeys() int { return 30 }
+
+func (p *cloudflarePurger) Purge(ctx context.Context, keys []string) error {
+	body, err := json.Marshal(map[string][]string{"tags": keys})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost,
+		"https://api.cloudflare.com/client/v4/zones/"+p.zone+"/purge_cache", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+p.token)
+	req.Header.Set("Content-Type", "application/json")
+	return doPurge(req)
+}
+
+func doPurge(req *http.Request) error {
+	resp, err := outbound.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("purge returned %s", resp.Status)
+	}
+	return nil
+}
+
+// purgeCDN purges keys in as few requests as the CDN allows.
+func purgeCDN(ctx context.Context, keys []string) error {
+	if cdn == nil {
+		return nil
+	}
+	for len(keys) > 0 {
+		n := min(len(keys), cdn.maxKeys())
+		if err := cdn.Purge(ctx, keys[:n]); err != nil {
+			return err
+		}
+		keys = keys[n:]
+	}
+	return nil
+}
+
+// purgeCDNLater purges keys in the background, for changes that don't go
+// through the outbox, like moderation. A failed purge only leaves the
+// responses cached until CDN_MAX_AGE.
+func purgeCDNLater(keys ...string) {
+	if cdn == nil {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := purgeCDN(ctx, keys); err != nil {
+			log.Println("cdn purge error:", err)
+		}
+	}()
+}
+
+// cdnSink is the outbox sink purging the keys of every change.
+type cdnSink struct{}
+
+func (cdnSink) Name() string { return "cdn" }
+
+func (cdnSink) Deliver(ctx context.Context, entry outboxEntry) error {
+	var p outboxPayload
+	if err := json.Unmarshal(entry.Payload, &p); err != nil {
+		return err
+	}
+	return purgeCDN(ctx, cdnKeysOf(p.MeowResponse))
+}
+
+type purgeCacheRequest struct {
+	Keys []string `json:"keys"`
+	// DIDs purges the actor key of each
+	DIDs []string `json:"dids"`
+}
+
+// purgeCache purges surrogate keys on demand, e.g. after changing how
+// responses render.
+func purgeCache(c *gin.Context) {
+	if cdn == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "CDN_PURGE is not configured"})
+		return
+	}
+	var req purgeCacheRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+		return
+	}
+	keys := req.Keys
+	for _, did := range req.DIDs {
+		if validateDID(did) != did {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid did " + did})
+			return
+		}
+		keys = append(keys, cdnActorKey(did))
+	}
+	if len(keys) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "give keys or dids"})
+		return
+	}
+	if err := purgeCDN(c.Request.Context(), keys); err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"cdn": cdn.Name(), "purged": len(keys)})
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gocql/gocql"
+)
+
+// changeRetention is how far back the change feed may be read. Clients
+// whose cursor is older than that have to resync from scratch.
+var changeRetention = envDuration("CHANGE_FEED_RETENTION", 30*24*time.Hour)
+
+var changesGuardrail = newGuardrail("changes", 100, 1000, 0, 0)
+
+type MeowChange struct {
+	Op string `json:"op"`
+	MeowResponse
+	// rev and record are kept for the jetstream rebroadcast
+	rev    string
+	record string
+}
+
+// MeowChangesResponse is what getMeowsSince streams.
+type MeowChangesResponse struct {
+	Changes []MeowChange `json:"changes"`
+	// Cursor is passed back on the next call; it stays the same when
+	// nothing changed.
+	Cursor string `json:"cursor"`
+	More   bool   `json:"more"`
+}
+
+// parseChangeCursor reads a change feed cursor: a pageCursor, or a bare
+// time_us or RFC 3339 time meaning everything after it.
+func parseChangeCursor(v string) (pageCursor, error) {
+	if strings.Contains(v, "/") {
+		return parsePageCursor(v)
+	}
+	timeUS, err := parseTimeParam(v)
+	if err != nil {
+		return pageCursor{}, fmt.Errorf("invalid cursor")
+	}
+	return pageCursor{TimeUS: timeUS}, nil
+}
+
+// getMeowsSince returns creates, updates and deletes after cursor, oldest
+// first, read from meow_events. Deletes come back as tombstones carrying
+// only did and rkey. Creates and updates are moderated like the global
+// lists: hidden meows and those of inactive accounts and deprioritized
+// actors are left out, the others carry their labels. The cursor is either
+// one returned by a previous call or a plain time_us or RFC 3339 time, e.g.
+// of the newest meow a client already has. The response has the shape of
+// MeowChangesResponse, or is NDJSON, see listStream.
+func getMeowsSince(session *gocql.Session) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		v := c.Query("cursor")
+		if v == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "cursor is required"})
+			return
+		}
+		cur, err := parseChangeCursor(v)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		limit, err := changesGuardrail.parseLimit(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		now := time.Now()
+		if now.Sub(time.UnixMicro(cur.TimeUS)) > changeRetention {
+			c.JSON(http.StatusGone, gin.H{"error": "cursor is older than the change feed retention, resync"})
+			return
+		}
+
+		// streamed, as up to GUARDRAIL_CHANGES_MAX_LIMIT changes may be
+		// asked for
+		stream := newListStream(c, "changes")
+		cursor, n, more := v, 0, false
+		today := eventDay(now.UnixMicro())
+		for day := time.UnixMicro(cur.TimeUS).UTC(); ; day = day.AddDate(0, 0, 1) {
+			bucket := day.Format("2006-01-02")
+			query := `
+				SELECT op, ` + meowColumns + `
+				FROM cat.meow_events
+				WHERE day = ?`
+			args := []any{bucket}
+			if cur.DID != "" {
+				query += ` AND (time_us, did, rkey) > (?, ?, ?)`
+				args = append(args, cur.TimeUS, cur.DID, cur.Rkey)
+			} else {
+				query += ` AND time_us > ?`
+				args = append(args, cur.TimeUS)
+			}
+			query += ` LIMIT ?`
+			args = append(args, limit-n)
+
+			iter := session.Query(query, args...).WithContext(c.Request.Context()).Iter()
+			var op string
+			var row meowRow
+			dest := append([]any{&op}, row.dest()...)
+			for iter.Scan(dest...) {
+				ch := MeowChange{Op: op, MeowResponse: row.meow().response()}
+				n++
+				cursor = pageCursor{TimeUS: ch.TimeUS, Rkey: ch.Rkey, DID: ch.DID}.String()
+				op, row = "", meowRow{}
+				// the cursor moves past moderated changes too, so a page
+				// of them doesn't stall the client
+				if ch.Op != "delete" {
+					kept := moderation.applyGlobal([]MeowResponse{ch.MeowResponse})
+					if len(kept) == 0 {
+						continue
+					}
+					ch.MeowResponse = kept[0]
+				}
+				if err := stream.add(ch); err != nil {
+					iter.Close()
+					stream.fail(http.StatusInternalServerError, err)
+					return
+				}
+			}
+			if err := iter.Close(); err != nil {
+				stream.fail(http.StatusInternalServerError, err)
+				return
+			}
+
+			if n == limit {
+				more = true
+				break
+			}
+			if bucket >= today {
+				break
+			}
+		}
+		stream.finish(gin.H{"cursor": cursor, "more": more})
+	}
+}
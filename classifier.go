@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// EmotionClassifier infers an emotion for records that were published
+// without one. Inferred values are stored in the inferred_emotion column
+// and never overwrite the emotion the author chose.
+type EmotionClassifier interface {
+	Classify(ctx context.Context, did string, record json.RawMessage) (string, error)
+}
+
+// newEmotionClassifier picks a classifier from EMOTION_CLASSIFIER
+// ("keyword" or "http"). Inference is disabled when it is unset.
+func newEmotionClassifier() EmotionClassifier {
+	switch getenv("EMOTION_CLASSIFIER") {
+	case "":
+		return nil
+	case "keyword":
+		return keywordClassifier{keywords: defaultEmotionKeywords}
+	case "http":
+		url := getenv("EMOTION_CLASSIFIER_URL")
+		if url == "" {
+			log.Fatal("EMOTION_CLASSIFIER=http requires EMOTION_CLASSIFIER_URL")
+		}
+		return &httpClassifier{url: url}
+	default:
+		log.Fatalf("unknown EMOTION_CLASSIFIER %q", getenv("EMOTION_CLASSIFIER"))
+	}
+	return nil
+}
+
+var defaultEmotionKeywords = map[string][]string{
+	"happy":   {"purr", "happy", "yay", ":3", "joy"},
+	"sad":     {"sad", "cry", "mew", ":("},
+	"angry":   {"hiss", "angry", "grr", "mad"},
+	"sleepy":  {"zzz", "sleep", "nap", "tired", "yawn"},
+	"hungry":  {"hungry", "food", "treat", "snack", "feed"},
+	"playful": {"play", "zoom", "pounce", "toy"},
+}
+
+// keywordClassifier matches free-text fields of the record against a fixed
+// keyword list and returns the emotion with the most hits.
+type keywordClassifier struct {
+	keywords map[string][]string
+}
+
+func (k keywordClassifier) Classify(ctx context.Context, did string, record json.RawMessage) (string, error) {
+	var fields map[string]any
+	if err := json.Unmarshal(record, &fields); err != nil {
+		return "", err
+	}
+
+	var text strings.Builder
+	for name, value := range fields {
+		// skip identifiers and the (absent) emotion, only free text counts
+		if name == "$type" || name == "subject" || name == "emotion" {
+			continue
+		}
+		if s, ok := value.(string); ok {
+			text.WriteString(strings.ToLower(s))
+			text.WriteString(" ")
+		}
+	}
+	if text.Len() == 0 {
+		return "", nil
+	}
+
+	best, bestHits := "", 0
+	for emotion, words := range k.keywords {
+		hits := 0
+		for _, w := range words {
+			hits += strings.Count(text.String(), w)
+		}
+		if hits > bestHits || (hits == bestHits && hits > 0 && emotion < best) {
+			best, bestHits = emotion, hits
+		}
+	}
+	return best, nil
+}
+
+// httpClassifier posts the record to an external model endpoint which
+// answers with {"emotion": "..."}.
+type httpClassifier struct {
+	url string
+}
+
+func (h *httpClassifier) Classify(ctx context.Context, did string, record json.RawMessage) (string, error) {
+	body, err := json.Marshal(map[string]any{
+		"did":    did,
+		"record": record,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", h.url, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := outbound.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("classifier returned %s", resp.Status)
+	}
+
+	var out struct {
+		Emotion string `json:"emotion"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return "", err
+	}
+	return out.Emotion, nil
+}
+
+// inferEmotion runs the classifier and normalizes its answer with
+// normalizeEmotion, like author supplied emotions, once surrounding
+// whitespace is trimmed. It returns nil when nothing could be inferred or
+// the answer is refused.
+func inferEmotion(classifier EmotionClassifier, did string, record json.RawMessage) *string {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	emotion, err := classifier.Classify(ctx, did, record)
+	if err != nil {
+		log.Printf("emotion classifier error: %v", err)
+		return nil
+	}
+
+	emotion, err = normalizeEmotion(strings.TrimSpace(emotion))
+	if err != nil {
+		log.Printf("emotion classifier answer refused: %v", err)
+		return nil
+	}
+	if emotion == "" {
+		return nil
+	}
+	return &emotion
+}
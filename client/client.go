@@ -0,0 +1,263 @@
+// Package client is a typed client for the meowview HTTP API.
+//
+//	c := client.New("https://meowview.example.com", client.WithAPIKey(key))
+//	meows, err := c.GetActorMeows(ctx, "did:plc:...", client.ListOptions{Limit: 50})
+//
+// Requests that fail with a network error, 429 or a 5xx that means the
+// server is overloaded or in maintenance are retried with exponential
+// backoff, honouring Retry-After. POST requests are only retried when the
+// server rejected them before doing anything (429 and 503), except for
+// CreateReport, EchoMeow and CreateDraft, which send an Idempotency-Key so
+// that a retry doesn't run twice.
+// Errors answered by the server are returned as *Error.
+//
+// The admin API under /_admin is not covered.
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// authLexiconPrefix prefixes the method names service auth tokens are
+// scoped to.
+const authLexiconPrefix = "moe.kasey.meowview."
+
+// TokenSource returns an atproto service auth token for the method lxm,
+// e.g. "moe.kasey.meowview.getBookmarks", signed by the viewer with the
+// meowview service DID as audience. It is called for every authenticated
+// request.
+type TokenSource func(ctx context.Context, lxm string) (string, error)
+
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+	apiKey     string
+	tokens     TokenSource
+	retries    int
+	maxBackoff time.Duration
+}
+
+type Option func(*Client)
+
+// WithHTTPClient replaces http.DefaultClient.
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) { c.httpClient = hc }
+}
+
+// WithAPIKey sends key as X-API-Key with every request.
+func WithAPIKey(key string) Option {
+	return func(c *Client) { c.apiKey = key }
+}
+
+// WithTokenSource enables the endpoints that act on behalf of a viewer.
+func WithTokenSource(ts TokenSource) Option {
+	return func(c *Client) { c.tokens = ts }
+}
+
+// WithRetries sets how often a failed request is retried (default 3) and
+// the longest wait between two attempts (default 30s).
+func WithRetries(retries int, maxBackoff time.Duration) Option {
+	return func(c *Client) { c.retries, c.maxBackoff = retries, maxBackoff }
+}
+
+func New(baseURL string, opts ...Option) *Client {
+	c := &Client{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		httpClient: http.DefaultClient,
+		retries:    3,
+		maxBackoff: 30 * time.Second,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Error is an error response of the server.
+type Error struct {
+	StatusCode int
+	Message    string
+	// RetryAfter is the wait the server asked for, if any.
+	RetryAfter time.Duration
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("meowview: %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("meowview: %d %s", e.StatusCode, e.Message)
+}
+
+// IsNotFound reports whether err is a 404 of the server.
+func IsNotFound(err error) bool {
+	var e *Error
+	return errors.As(err, &e) && e.StatusCode == http.StatusNotFound
+}
+
+// IsConflict reports whether err is a 409 of the server, a write on top
+// of a version that has changed since.
+func IsConflict(err error) bool {
+	var e *Error
+	return errors.As(err, &e) && e.StatusCode == http.StatusConflict
+}
+
+type request struct {
+	method string
+	path   string
+	query  url.Values
+	body   any
+	// auth is the service auth method the request needs a token for,
+	// without authLexiconPrefix
+	auth   string
+	accept string
+	// idempotent sends an Idempotency-Key, the same on every attempt, so
+	// the request can be retried like a GET
+	idempotent bool
+	key        string
+}
+
+// do sends req, retrying as described in the package comment, and returns
+// the response with a 2xx status. The caller closes its body.
+func (c *Client) do(ctx context.Context, req request) (*http.Response, error) {
+	if req.method == "" {
+		req.method = http.MethodGet
+	}
+	var body []byte
+	if req.body != nil {
+		b, err := json.Marshal(req.body)
+		if err != nil {
+			return nil, err
+		}
+		body = b
+	}
+	if req.idempotent {
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		req.key = hex.EncodeToString(b)
+	}
+	u := c.baseURL + req.path
+	if len(req.query) > 0 {
+		u += "?" + req.query.Encode()
+	}
+
+	backoff := 500 * time.Millisecond
+	for attempt := 0; ; attempt++ {
+		resp, err := c.send(ctx, req, u, body)
+		if err == nil && resp.StatusCode < 300 {
+			return resp, nil
+		}
+		if err == nil {
+			err = responseError(resp)
+		}
+		if attempt >= c.retries || !retryable(req, err) {
+			return nil, err
+		}
+		wait := backoff
+		var e *Error
+		if errors.As(err, &e) && e.RetryAfter > 0 {
+			wait = e.RetryAfter
+		}
+		select {
+		case <-time.After(min(wait, c.maxBackoff)):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+func (c *Client) send(ctx context.Context, req request, u string, body []byte) (*http.Response, error) {
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	hr, err := http.NewRequestWithContext(ctx, req.method, u, r)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		hr.Header.Set("Content-Type", "application/json")
+	}
+	if req.accept != "" {
+		hr.Header.Set("Accept", req.accept)
+	}
+	if req.key != "" {
+		hr.Header.Set("Idempotency-Key", req.key)
+	}
+	if c.apiKey != "" {
+		hr.Header.Set("X-API-Key", c.apiKey)
+	}
+	if req.auth != "" {
+		if c.tokens == nil {
+			return nil, errors.New("meowview: authenticated endpoint needs WithTokenSource")
+		}
+		token, err := c.tokens(ctx, authLexiconPrefix+req.auth)
+		if err != nil {
+			return nil, fmt.Errorf("meowview: service auth token: %w", err)
+		}
+		hr.Header.Set("Authorization", "Bearer "+token)
+	}
+	return c.httpClient.Do(hr)
+}
+
+func responseError(resp *http.Response) error {
+	defer resp.Body.Close()
+	e := &Error{StatusCode: resp.StatusCode}
+	if v := resp.Header.Get("Retry-After"); v != "" {
+		if secs, err := strconv.Atoi(v); err == nil {
+			e.RetryAfter = time.Duration(secs) * time.Second
+		}
+	}
+	var body struct {
+		Error string `json:"error"`
+	}
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if json.Unmarshal(b, &body) == nil {
+		e.Message = body.Error
+	}
+	return e
+}
+
+func retryable(req request, err error) bool {
+	post := req.method == http.MethodPost && !req.idempotent
+	var e *Error
+	if !errors.As(err, &e) {
+		var netErr net.Error
+		return !post && errors.As(err, &netErr)
+	}
+	switch e.StatusCode {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		return true
+	case http.StatusBadGateway, http.StatusGatewayTimeout:
+		return !post
+	}
+	return false
+}
+
+// call sends req and decodes the response into v, unless v is nil.
+func (c *Client) call(ctx context.Context, req request, v any) error {
+	resp, err := c.do(ctx, req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
@@ -0,0 +1,406 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ListOptions are the paging and hydration parameters of the meow list
+// endpoints. Zero values leave the server defaults.
+type ListOptions struct {
+	Limit int
+	// Since and Until bound the meows' time, Until exclusive. The server
+	// caps how wide and how far back the range may be.
+	Since time.Time
+	Until time.Time
+	// Cursor continues after a MeowPage, in place of Until.
+	Cursor string
+	// HydratePosts embeds the postView of post subjects.
+	HydratePosts bool
+	// HydrateActors sets the author's handle on meows.
+	HydrateActors bool
+	// QuoteDepth is how many levels of quoted meows are embedded; nil
+	// leaves the server default of one.
+	QuoteDepth *int
+	// Oldest lists GetActorMeows oldest first. It can't be combined with
+	// Since and Until.
+	Oldest bool
+}
+
+func (o ListOptions) values() url.Values {
+	q := url.Values{}
+	if o.Limit > 0 {
+		q.Set("limit", strconv.Itoa(o.Limit))
+	}
+	if !o.Since.IsZero() {
+		q.Set("since", strconv.FormatInt(o.Since.UnixMicro(), 10))
+	}
+	if !o.Until.IsZero() {
+		q.Set("until", strconv.FormatInt(o.Until.UnixMicro(), 10))
+	}
+	if o.Cursor != "" {
+		q.Set("cursor", o.Cursor)
+	}
+	var hydrate []string
+	if o.HydratePosts {
+		hydrate = append(hydrate, "posts")
+	}
+	if o.HydrateActors {
+		hydrate = append(hydrate, "actors")
+	}
+	if len(hydrate) > 0 {
+		q.Set("hydrate", strings.Join(hydrate, ","))
+	}
+	if o.QuoteDepth != nil {
+		q.Set("depth", strconv.Itoa(*o.QuoteDepth))
+	}
+	if o.Oldest {
+		q.Set("sort", "oldest")
+	}
+	return q
+}
+
+// listMeows reads a page of a list endpoint. Servers running with
+// LEGACY_LIST_RESPONSES answer with a bare array, which becomes a page
+// without cursor or total.
+func (c *Client) listMeows(ctx context.Context, path string, q url.Values, opts ListOptions) (*MeowPage, error) {
+	for k, v := range opts.values() {
+		q[k] = v
+	}
+	var raw json.RawMessage
+	if err := c.call(ctx, request{path: path, query: q}, &raw); err != nil {
+		return nil, err
+	}
+	var page MeowPage
+	if bytes.HasPrefix(bytes.TrimSpace(raw), []byte("[")) {
+		err := json.Unmarshal(raw, &page.Meows)
+		return &page, err
+	}
+	err := json.Unmarshal(raw, &page)
+	return &page, err
+}
+
+func meowsOf(page *MeowPage, err error) ([]Meow, error) {
+	if err != nil {
+		return nil, err
+	}
+	return page.Meows, nil
+}
+
+// GetLastMeows returns the latest meows.
+func (c *Client) GetLastMeows(ctx context.Context, opts ListOptions) ([]Meow, error) {
+	return meowsOf(c.GetLastMeowsPage(ctx, opts))
+}
+
+// GetLastMeowsPage is GetLastMeows with the cursor and total.
+func (c *Client) GetLastMeowsPage(ctx context.Context, opts ListOptions) (*MeowPage, error) {
+	return c.listMeows(ctx, "/_endpoints/getLastMeows", url.Values{}, opts)
+}
+
+// GetActorMeows returns the meows by did.
+func (c *Client) GetActorMeows(ctx context.Context, did string, opts ListOptions) ([]Meow, error) {
+	return meowsOf(c.GetActorMeowsPage(ctx, did, opts))
+}
+
+// GetActorMeowsPage is GetActorMeows with the cursor and total.
+func (c *Client) GetActorMeowsPage(ctx context.Context, did string, opts ListOptions) (*MeowPage, error) {
+	return c.listMeows(ctx, "/_endpoints/getActorMeows", url.Values{"did": {did}}, opts)
+}
+
+// GetActorMeowsByEmotion returns the actor's newest meows grouped by
+// emotion, the most used first, with up to opts.Limit meows in each.
+// Cursor, Since, Until and Oldest don't apply.
+func (c *Client) GetActorMeowsByEmotion(ctx context.Context, did string, opts ListOptions) (*EmotionGroups, error) {
+	q := opts.values()
+	q.Set("did", did)
+	q.Set("sort", "emotionGrouped")
+	var g EmotionGroups
+	if err := c.call(ctx, request{path: "/_endpoints/getActorMeows", query: q}, &g); err != nil {
+		return nil, err
+	}
+	return &g, nil
+}
+
+// GetActorPinnedMeow returns the meow did pinned.
+func (c *Client) GetActorPinnedMeow(ctx context.Context, did string) (*PinnedMeow, error) {
+	var p PinnedMeow
+	if err := c.call(ctx, request{path: "/_endpoints/getActorPinnedMeow", query: url.Values{"did": {did}}}, &p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// GetSubjectMeows returns the meows about did.
+func (c *Client) GetSubjectMeows(ctx context.Context, did string, opts ListOptions) ([]Meow, error) {
+	return meowsOf(c.GetSubjectMeowsPage(ctx, did, opts))
+}
+
+// GetSubjectMeowsPage is GetSubjectMeows with the cursor and total.
+func (c *Client) GetSubjectMeowsPage(ctx context.Context, did string, opts ListOptions) (*MeowPage, error) {
+	return c.listMeows(ctx, "/_endpoints/getSubjectMeows", url.Values{"did": {did}}, opts)
+}
+
+// GetMeow returns a single meow; IsNotFound tells whether it doesn't exist.
+func (c *Client) GetMeow(ctx context.Context, did, rkey string, opts ListOptions) (*Meow, error) {
+	q := opts.values()
+	q.Set("did", did)
+	q.Set("rkey", rkey)
+	var m Meow
+	if err := c.call(ctx, request{path: "/_endpoints/getMeow", query: q}, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// GetRelatedMeows returns meows sharing the subject or emotion of a meow,
+// best match first. A limit of 0 leaves the server default.
+func (c *Client) GetRelatedMeows(ctx context.Context, did, rkey string, limit int) ([]RelatedMeow, error) {
+	q := url.Values{"did": {did}, "rkey": {rkey}}
+	if limit > 0 {
+		q.Set("limit", strconv.Itoa(limit))
+	}
+	var related []RelatedMeow
+	err := c.call(ctx, request{path: "/_endpoints/getRelatedMeows", query: q}, &related)
+	return related, err
+}
+
+func (c *Client) GetEmotionTransitions(ctx context.Context, did string) (*EmotionTransitions, error) {
+	var t EmotionTransitions
+	if err := c.call(ctx, request{path: "/_endpoints/getEmotionTransitions", query: url.Values{"did": {did}}}, &t); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// GetActorSubjects returns the subjects did has meowed at, most recently
+// meowed at first. A zero limit leaves the server default.
+func (c *Client) GetActorSubjects(ctx context.Context, did string, limit int) (*ActorSubjects, error) {
+	q := url.Values{"did": {did}}
+	if limit > 0 {
+		q.Set("limit", strconv.Itoa(limit))
+	}
+	var s ActorSubjects
+	if err := c.call(ctx, request{path: "/_endpoints/getActorSubjects", query: q}, &s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// GetActorEmotionBreakdown returns how often did meows with each emotion,
+// most used first, and their dominant one.
+func (c *Client) GetActorEmotionBreakdown(ctx context.Context, did string) (*ActorEmotionBreakdown, error) {
+	var b ActorEmotionBreakdown
+	if err := c.call(ctx, request{path: "/_endpoints/getActorEmotionBreakdown", query: url.Values{"did": {did}}}, &b); err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+// GetEmotionHistogram returns how many meows carried each emotion per
+// bucket, like "1d" or "6h", between since and until. Zero times and an
+// empty bucket leave the server defaults: the last week by day.
+func (c *Client) GetEmotionHistogram(ctx context.Context, since, until time.Time, bucket string) (*EmotionHistogram, error) {
+	return c.GetEmotionHistogramIn(ctx, since, until, bucket, nil)
+}
+
+// GetEmotionHistogramIn is GetEmotionHistogram with buckets of days
+// starting at midnight in loc, which must be an IANA zone a whole number
+// of hours from UTC. A nil loc means UTC.
+func (c *Client) GetEmotionHistogramIn(ctx context.Context, since, until time.Time, bucket string, loc *time.Location) (*EmotionHistogram, error) {
+	q := url.Values{}
+	if loc != nil {
+		q.Set("tz", loc.String())
+	}
+	if !since.IsZero() {
+		q.Set("since", strconv.FormatInt(since.UnixMicro(), 10))
+	}
+	if !until.IsZero() {
+		q.Set("until", strconv.FormatInt(until.UnixMicro(), 10))
+	}
+	if bucket != "" {
+		q.Set("bucket", bucket)
+	}
+	var h EmotionHistogram
+	if err := c.call(ctx, request{path: "/_endpoints/getEmotionHistogram", query: q}, &h); err != nil {
+		return nil, err
+	}
+	return &h, nil
+}
+
+// ResolveHandle returns the DID of handle.
+func (c *Client) ResolveHandle(ctx context.Context, handle string) (*Identity, error) {
+	var id Identity
+	if err := c.call(ctx, request{path: "/_endpoints/getIdentity", query: url.Values{"handle": {handle}}}, &id); err != nil {
+		return nil, err
+	}
+	return &id, nil
+}
+
+// GetIdentity returns the current handle of did, empty when it has no
+// valid one.
+func (c *Client) GetIdentity(ctx context.Context, did string) (*Identity, error) {
+	var id Identity
+	if err := c.call(ctx, request{path: "/_endpoints/getIdentity", query: url.Values{"did": {did}}}, &id); err != nil {
+		return nil, err
+	}
+	return &id, nil
+}
+
+// SuggestEmotions completes an emotion prefix, most used first. A zero
+// limit leaves the server default.
+func (c *Client) SuggestEmotions(ctx context.Context, prefix string, limit int) (*EmotionSuggestions, error) {
+	q := url.Values{"q": {prefix}}
+	if limit > 0 {
+		q.Set("limit", strconv.Itoa(limit))
+	}
+	var s EmotionSuggestions
+	if err := c.call(ctx, request{path: "/_endpoints/suggestEmotions", query: q}, &s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// SuggestActors completes a handle prefix among the actors who have
+// meowed, most recently active first. A zero limit leaves the server
+// default.
+func (c *Client) SuggestActors(ctx context.Context, prefix string, limit int) (*ActorSuggestions, error) {
+	q := url.Values{"q": {prefix}}
+	if limit > 0 {
+		q.Set("limit", strconv.Itoa(limit))
+	}
+	var s ActorSuggestions
+	if err := c.call(ctx, request{path: "/_endpoints/suggestActors", query: q}, &s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// GetActorsByEmotion returns the actors who expressed emotion within
+// window, most recent first. Zero window and limit leave the server
+// defaults.
+func (c *Client) GetActorsByEmotion(ctx context.Context, emotion string, window time.Duration, limit int) (*ActorsByEmotion, error) {
+	q := url.Values{"emotion": {emotion}}
+	if window > 0 {
+		q.Set("window", window.String())
+	}
+	if limit > 0 {
+		q.Set("limit", strconv.Itoa(limit))
+	}
+	var a ActorsByEmotion
+	if err := c.call(ctx, request{path: "/_endpoints/getActorsByEmotion", query: q}, &a); err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+// GetConversation returns a page of the meows a and b sent about each
+// other, oldest first. Pass the returned Cursor to get the next page; it
+// is empty on the last one.
+func (c *Client) GetConversation(ctx context.Context, a, b string, limit int, cursor string) (*Conversation, error) {
+	q := url.Values{"a": {a}, "b": {b}}
+	if limit > 0 {
+		q.Set("limit", strconv.Itoa(limit))
+	}
+	if cursor != "" {
+		q.Set("cursor", cursor)
+	}
+	var conv Conversation
+	if err := c.call(ctx, request{path: "/_endpoints/getConversation", query: q}, &conv); err != nil {
+		return nil, err
+	}
+	return &conv, nil
+}
+
+// GetMeowsSince returns the changes after cursor, oldest first. cursor is
+// one returned by a previous call, or a time_us as a string.
+func (c *Client) GetMeowsSince(ctx context.Context, cursor string, limit int) (*MeowChanges, error) {
+	q := url.Values{"cursor": {cursor}}
+	if limit > 0 {
+		q.Set("limit", strconv.Itoa(limit))
+	}
+	var changes MeowChanges
+	if err := c.call(ctx, request{path: "/_endpoints/getMeowsSince", query: q}, &changes); err != nil {
+		return nil, err
+	}
+	return &changes, nil
+}
+
+// GetActivityByTimezone returns meow counts per UTC offset over the last
+// days days, 0 for the server default. Only with timezone enrichment.
+func (c *Client) GetActivityByTimezone(ctx context.Context, days int) ([]TimezoneActivity, error) {
+	q := url.Values{}
+	if days > 0 {
+		q.Set("days", strconv.Itoa(days))
+	}
+	var resp struct {
+		Activity []TimezoneActivity `json:"activity"`
+	}
+	err := c.call(ctx, request{path: "/_endpoints/getActivityByTimezone", query: q}, &resp)
+	return resp.Activity, err
+}
+
+// GetMeowCard returns the og:image card of a meow and its content type.
+// format is png or svg and size small or large; empty leaves the
+// defaults.
+func (c *Client) GetMeowCard(ctx context.Context, did, rkey, format, size string) ([]byte, string, error) {
+	q := url.Values{"did": {did}, "rkey": {rkey}}
+	if format != "" {
+		q.Set("format", format)
+	}
+	if size != "" {
+		q.Set("size", size)
+	}
+	resp, err := c.do(ctx, request{path: "/_endpoints/getMeowCard", query: q})
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	return b, resp.Header.Get("Content-Type"), err
+}
+
+// UnsubscribeDigest follows the unsubscribe link of a digest email.
+func (c *Client) UnsubscribeDigest(ctx context.Context, email, token string) error {
+	return c.call(ctx, request{path: "/_endpoints/unsubscribeDigest", query: url.Values{"email": {email}, "token": {token}}}, nil)
+}
+
+func (c *Client) GetServerInfo(ctx context.Context) (*ServerInfo, error) {
+	var info ServerInfo
+	if err := c.call(ctx, request{path: "/_endpoints/getServerInfo"}, &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+func (c *Client) GetSLOStatus(ctx context.Context) (*SLOStatus, error) {
+	var st SLOStatus
+	if err := c.call(ctx, request{path: "/_endpoints/getSLOStatus"}, &st); err != nil {
+		return nil, err
+	}
+	return &st, nil
+}
+
+// GetSLOAlertRules returns the Prometheus alerting rules as YAML.
+func (c *Client) GetSLOAlertRules(ctx context.Context) ([]byte, error) {
+	resp, err := c.do(ctx, request{path: "/_endpoints/getSLOAlertRules"})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(resp.Body)
+}
+
+// DescribeServer returns the XRPC self description.
+func (c *Client) DescribeServer(ctx context.Context) (*ServerDescription, error) {
+	var d ServerDescription
+	if err := c.call(ctx, request{path: "/xrpc/moe.kasey.meowview.describeServer"}, &d); err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
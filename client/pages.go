@@ -0,0 +1,133 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrStop ends a walk started by one of the Each helpers without error.
+var ErrStop = errors.New("stop")
+
+// EachActorMeow calls fn for every meow by did in [opts.Since, opts.Until),
+// newest window first. See eachInRange.
+func (c *Client) EachActorMeow(ctx context.Context, did string, opts ListOptions, window time.Duration, fn func(Meow) error) error {
+	return c.eachInRange(ctx, opts, window, fn, func(opts ListOptions) ([]Meow, error) {
+		return c.GetActorMeows(ctx, did, opts)
+	})
+}
+
+// EachSubjectMeow calls fn for every meow about did in [opts.Since,
+// opts.Until), newest window first. See eachInRange.
+func (c *Client) EachSubjectMeow(ctx context.Context, did string, opts ListOptions, window time.Duration, fn func(Meow) error) error {
+	return c.eachInRange(ctx, opts, window, fn, func(opts ListOptions) ([]Meow, error) {
+		return c.GetSubjectMeows(ctx, did, opts)
+	})
+}
+
+// eachInRange pages through a time range of a list endpoint. Which meows
+// of a range fill a full page is arbitrary, so following the page cursor
+// could skip some; instead the range is walked backwards in windows of window (default one
+// hour, and no wider than the server's range guardrail), and a window
+// coming back full is split in halves until none is. opts.Until defaults
+// to now and opts.Since to one window before it.
+func (c *Client) eachInRange(ctx context.Context, opts ListOptions, window time.Duration, fn func(Meow) error, list func(ListOptions) ([]Meow, error)) error {
+	if window <= 0 {
+		window = time.Hour
+	}
+	if opts.Limit <= 0 {
+		opts.Limit = 100
+	}
+	until := opts.Until
+	if until.IsZero() {
+		until = time.Now()
+	}
+	since := opts.Since
+	if since.IsZero() {
+		since = until.Add(-window)
+	}
+
+	var walk func(since, until time.Time) error
+	walk = func(since, until time.Time) error {
+		page := opts
+		page.Since, page.Until = since, until
+		meows, err := list(page)
+		if err != nil {
+			return err
+		}
+		if len(meows) >= opts.Limit && until.Sub(since) > time.Microsecond {
+			mid := since.Add(until.Sub(since) / 2).Truncate(time.Microsecond)
+			if err := walk(mid, until); err != nil {
+				return err
+			}
+			return walk(since, mid)
+		}
+		for _, m := range meows {
+			if err := fn(m); err != nil {
+				return err
+			}
+		}
+		return ctx.Err()
+	}
+
+	for end := until; end.After(since); end = end.Add(-window) {
+		start := end.Add(-window)
+		if start.Before(since) {
+			start = since
+		}
+		if err := walk(start, end); err != nil {
+			if errors.Is(err, ErrStop) {
+				return nil
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// EachConversationMeow calls fn for every meow between a and b, oldest
+// first.
+func (c *Client) EachConversationMeow(ctx context.Context, a, b string, fn func(Meow) error) error {
+	cursor := ""
+	for {
+		conv, err := c.GetConversation(ctx, a, b, 0, cursor)
+		if err != nil {
+			return err
+		}
+		for _, m := range conv.Meows {
+			if err := fn(m); err != nil {
+				if errors.Is(err, ErrStop) {
+					return nil
+				}
+				return err
+			}
+		}
+		if conv.Cursor == "" {
+			return nil
+		}
+		cursor = conv.Cursor
+	}
+}
+
+// EachBookmark calls fn for every bookmark of the viewer, newest first.
+func (c *Client) EachBookmark(ctx context.Context, fn func(Bookmark) error) error {
+	cursor := ""
+	for {
+		page, err := c.GetBookmarks(ctx, 0, cursor)
+		if err != nil {
+			return err
+		}
+		for _, b := range page.Bookmarks {
+			if err := fn(b); err != nil {
+				if errors.Is(err, ErrStop) {
+					return nil
+				}
+				return err
+			}
+		}
+		if page.Cursor == "" {
+			return nil
+		}
+		cursor = page.Cursor
+	}
+}
@@ -0,0 +1,72 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+)
+
+// StreamOptions configure StreamMeows.
+type StreamOptions struct {
+	// Cursor is where the stream starts, as returned by GetMeowsSince or
+	// passed to fn; empty starts at the time of the call.
+	Cursor string
+	// PollInterval is how long to wait for new changes once caught up,
+	// default 2s.
+	PollInterval time.Duration
+	// Limit is the page size, 0 for the server default.
+	Limit int
+}
+
+// StreamMeows calls fn with every change to the meows, oldest first, until
+// ctx is done or fn returns an error. Along with each change fn gets the
+// cursor to resume after it. Returning ErrStop from fn ends the stream
+// without error.
+//
+// meowview has no websocket endpoint of its own, so the stream follows the
+// getMeowsSince change feed, which unlike the firehose also carries
+// moderation and validation as the list endpoints apply them: hidden meows
+// and those of inactive accounts and deprioritized actors are left out,
+// while their deletes still come through. Transient
+// errors are retried like any request; a cursor older than the change
+// feed's retention fails with a 410 *Error.
+func (c *Client) StreamMeows(ctx context.Context, opts StreamOptions, fn func(change MeowChange, cursor string) error) error {
+	cursor := opts.Cursor
+	if cursor == "" {
+		cursor = strconv.FormatInt(time.Now().UnixMicro(), 10)
+	}
+	interval := opts.PollInterval
+	if interval <= 0 {
+		interval = 2 * time.Second
+	}
+	for {
+		page, err := c.GetMeowsSince(ctx, cursor, opts.Limit)
+		if err != nil {
+			return err
+		}
+		for _, ch := range page.Changes {
+			if err := fn(ch, changeCursor(ch)); err != nil {
+				if errors.Is(err, ErrStop) {
+					return nil
+				}
+				return err
+			}
+		}
+		cursor = page.Cursor
+		if page.More {
+			continue
+		}
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// changeCursor is the getMeowsSince cursor right after ch, in the format
+// the server uses.
+func changeCursor(ch MeowChange) string {
+	return strconv.FormatInt(ch.TimeUS, 10) + "/" + ch.Rkey + "/" + ch.DID
+}
@@ -0,0 +1,356 @@
+package client
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// The types mirror the server's responses, see the handlers of the same
+// names in the meowview package.
+
+type Meow struct {
+	Rkey   string `json:"rkey"`
+	TimeUS int64  `json:"time_us"`
+	// IndexedAt is TimeUS as an RFC 3339 UTC timestamp
+	IndexedAt string `json:"indexedAt,omitempty"`
+	CID       string `json:"cid"`
+	DID       string `json:"did"`
+	Emotion   string `json:"emotion"`
+	Subject   string `json:"subject"`
+	// InferredEmotion is set by the classifier when the record had no emotion
+	InferredEmotion string `json:"inferred_emotion,omitempty"`
+	// Post is the app.bsky.feed.defs#postView of a post subject, only
+	// present with ListOptions.HydratePosts
+	Post json.RawMessage `json:"post,omitempty"`
+	// Quoted is the meow a meow's subject points to
+	Quoted *Meow    `json:"quoted,omitempty"`
+	Labels []string `json:"labels,omitempty"`
+	// Pinned is set on the meow its author pinned
+	Pinned bool `json:"pinned,omitempty"`
+	// Handle is the author's handle and HandleVerified whether it resolves
+	// back to them, present with ListOptions.HydrateActors
+	Handle         string `json:"handle,omitempty"`
+	HandleVerified *bool  `json:"handleVerified,omitempty"`
+	// LexiconVersion is the revision of the meow lexicon the record was
+	// decoded as, 0 when unknown
+	LexiconVersion int `json:"lexicon_version,omitempty"`
+}
+
+// Time is when the meow was indexed.
+func (m Meow) Time() time.Time {
+	return time.UnixMicro(m.TimeUS)
+}
+
+// MeowPage is a page of a meow list, newest first.
+type MeowPage struct {
+	Meows []Meow `json:"meows"`
+	// Cursor goes into ListOptions.Cursor for the next page; empty on the
+	// last one
+	Cursor string `json:"cursor,omitempty"`
+	// ApproxTotal is how many meows the list has over all time
+	ApproxTotal int64 `json:"approxTotal"`
+	// IndexLagMs is how far the server's index is behind the network,
+	// for showing that data may be delayed
+	IndexLagMs int64 `json:"indexLagMs"`
+}
+
+type RelatedMeow struct {
+	Meow
+	Score int `json:"score"`
+}
+
+// MeowChange is a create, update or delete from the change feed. Deletes
+// only carry DID and Rkey.
+type MeowChange struct {
+	Op string `json:"op"`
+	Meow
+}
+
+type MeowChanges struct {
+	Changes []MeowChange `json:"changes"`
+	// Cursor is passed back on the next call; it stays the same when
+	// nothing changed.
+	Cursor string `json:"cursor"`
+	More   bool   `json:"more"`
+}
+
+type Conversation struct {
+	A      string `json:"a"`
+	B      string `json:"b"`
+	Meows  []Meow `json:"meows"`
+	Cursor string `json:"cursor,omitempty"`
+}
+
+type EmotionTransition struct {
+	From        string  `json:"from"`
+	To          string  `json:"to"`
+	Count       int     `json:"count"`
+	Probability float64 `json:"probability"`
+}
+
+type EmotionTransitions struct {
+	DID         string              `json:"did"`
+	Meows       int                 `json:"meows"`
+	Transitions []EmotionTransition `json:"transitions"`
+}
+
+type EmotionActor struct {
+	DID       string `json:"did"`
+	TimeUS    int64  `json:"time_us"`
+	IndexedAt string `json:"indexedAt"`
+	Rkey      string `json:"rkey"`
+	Inferred  bool   `json:"inferred,omitempty"`
+}
+
+type ActorsByEmotion struct {
+	Emotion string         `json:"emotion"`
+	Window  string         `json:"window"`
+	Actors  []EmotionActor `json:"actors"`
+}
+
+type ActorSubject struct {
+	Subject       string `json:"subject"`
+	Meows         int64  `json:"meows"`
+	LastTimeUS    int64  `json:"last_time_us"`
+	LastIndexedAt string `json:"lastIndexedAt"`
+}
+
+type ActorSubjects struct {
+	DID      string         `json:"did"`
+	Subjects []ActorSubject `json:"subjects"`
+}
+
+type ActorEmotion struct {
+	Emotion  string  `json:"emotion"`
+	Meows    int64   `json:"meows"`
+	Inferred int64   `json:"inferred"`
+	Share    float64 `json:"share"`
+}
+
+type ActorEmotionBreakdown struct {
+	DID      string         `json:"did"`
+	Total    int64          `json:"total"`
+	Dominant string         `json:"dominant,omitempty"`
+	Emotions []ActorEmotion `json:"emotions"`
+}
+
+type EmotionHistogramBucket struct {
+	Start    string           `json:"start"`
+	Total    int64            `json:"total"`
+	Emotions map[string]int64 `json:"emotions"`
+}
+
+type EmotionHistogram struct {
+	Since    string                   `json:"since"`
+	Until    string                   `json:"until"`
+	Bucket   string                   `json:"bucket"`
+	TZ       string                   `json:"tz"`
+	Total    int64                    `json:"total"`
+	Emotions map[string]int64         `json:"emotions"`
+	Buckets  []EmotionHistogramBucket `json:"buckets"`
+}
+
+type Identity struct {
+	DID    string `json:"did"`
+	Handle string `json:"handle,omitempty"`
+}
+
+type EmotionSuggestion struct {
+	Emotion string `json:"emotion"`
+	Meows   int64  `json:"meows"`
+}
+
+type EmotionSuggestions struct {
+	Emotions []EmotionSuggestion `json:"emotions"`
+}
+
+type ActorSuggestion struct {
+	DID           string `json:"did"`
+	Handle        string `json:"handle"`
+	LastTimeUS    int64  `json:"last_time_us"`
+	LastIndexedAt string `json:"lastIndexedAt"`
+}
+
+type ActorSuggestions struct {
+	Actors []ActorSuggestion `json:"actors"`
+}
+
+type TimezoneActivity struct {
+	UTCOffset int `json:"utc_offset"`
+	Meows     int `json:"meows"`
+}
+
+type ServerInfo struct {
+	Build struct {
+		Version   string `json:"version"`
+		Commit    string `json:"commit"`
+		BuildDate string `json:"buildDate"`
+		GoVersion string `json:"goVersion"`
+	} `json:"build"`
+	Features []string `json:"features"`
+	// Flags are the server's feature flags and whether each is on
+	Flags    map[string]bool `json:"flags"`
+	Lexicons []string        `json:"lexicons"`
+	Limits   struct {
+		DefaultLimit           int `json:"defaultLimit"`
+		MaxLimit               int `json:"maxLimit"`
+		RelatedCandidates      int `json:"relatedCandidates"`
+		TransitionHistoryLimit int `json:"transitionHistoryLimit"`
+		EmotionMaxLength       int `json:"emotionMaxLength"`
+	} `json:"limits"`
+}
+
+// HasFeature reports whether the server has an optional feature enabled.
+func (s ServerInfo) HasFeature(name string) bool {
+	for _, f := range s.Features {
+		if f == name {
+			return true
+		}
+	}
+	return false
+}
+
+type ServerDescription struct {
+	DID         string   `json:"did,omitempty"`
+	Collections []string `json:"collections"`
+	Endpoints   []struct {
+		Path        string `json:"path"`
+		Method      string `json:"method"`
+		Description string `json:"description"`
+		Params      []struct {
+			Name        string `json:"name"`
+			Type        string `json:"type"`
+			Required    bool   `json:"required,omitempty"`
+			Default     string `json:"default,omitempty"`
+			Max         int    `json:"max,omitempty"`
+			Description string `json:"description,omitempty"`
+		} `json:"params,omitempty"`
+		Cursor bool   `json:"cursor"`
+		Auth   bool   `json:"auth,omitempty"`
+		Output string `json:"output,omitempty"`
+	} `json:"endpoints"`
+	RateLimits []struct {
+		Name   string `json:"name"`
+		Limit  int    `json:"limit"`
+		Window string `json:"window"`
+	} `json:"rateLimits"`
+	Features []string `json:"features"`
+}
+
+type SLOObjective struct {
+	Name                 string  `json:"name"`
+	Description          string  `json:"description"`
+	Target               float64 `json:"target"`
+	Threshold            string  `json:"threshold,omitempty"`
+	Good                 uint64  `json:"good"`
+	Total                uint64  `json:"total"`
+	Ratio                float64 `json:"ratio"`
+	ErrorBudgetRemaining float64 `json:"errorBudgetRemaining"`
+	Met                  bool    `json:"met"`
+}
+
+type SLOStatus struct {
+	Window          string         `json:"window"`
+	Objectives      []SLOObjective `json:"objectives"`
+	APILatencyP99Ms float64        `json:"apiLatencyP99Ms"`
+	AllMet          bool           `json:"allMet"`
+}
+
+type Bookmark struct {
+	DID          string    `json:"did"`
+	Rkey         string    `json:"rkey"`
+	BookmarkedAt time.Time `json:"bookmarked_at"`
+	// Meow is nil once the bookmarked meow has been deleted.
+	Meow *Meow `json:"meow"`
+}
+
+type Bookmarks struct {
+	Bookmarks []Bookmark `json:"bookmarks"`
+	Cursor    string     `json:"cursor,omitempty"`
+}
+
+type EmotionGroup struct {
+	// Emotion is "" for meows without one
+	Emotion string `json:"emotion"`
+	Count   int    `json:"count"`
+	Meows   []Meow `json:"meows"`
+}
+
+// EmotionGroups are an actor's meows by emotion. Truncated is set when
+// the actor has more meows than the server grouped.
+type EmotionGroups struct {
+	Groups     []EmotionGroup `json:"groups"`
+	Truncated  bool           `json:"truncated"`
+	IndexLagMs int64          `json:"indexLagMs"`
+}
+
+// PinnedMeow is an actor's pin. Meow is nil without a pin or once the
+// pinned meow has been deleted.
+type PinnedMeow struct {
+	Meow     *Meow      `json:"meow"`
+	PinnedAt *time.Time `json:"pinned_at,omitempty"`
+}
+
+type Preferences struct {
+	HiddenEmotions []string  `json:"hidden_emotions"`
+	MutedDIDs      []string  `json:"muted_dids"`
+	DefaultSort    string    `json:"default_sort"`
+	UpdatedAt      time.Time `json:"updated_at,omitempty"`
+	// Version makes PutPreferences fail with a conflict, see IsConflict,
+	// if the preferences changed since they were read; 0 saves regardless.
+	Version int `json:"version,omitempty"`
+}
+
+type Draft struct {
+	ID        string    `json:"id"`
+	Emotion   string    `json:"emotion"`
+	Subject   string    `json:"subject"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// Version makes UpdateDraft fail with a conflict, see IsConflict, if
+	// the draft changed since it was read; 0 saves regardless.
+	Version int `json:"version"`
+}
+
+// RejectedMeow is a record of the viewer's that was turned away at ingest.
+type RejectedMeow struct {
+	Rkey   string `json:"rkey"`
+	CID    string `json:"cid,omitempty"`
+	TimeUS int64  `json:"time_us"`
+	// Source is where the record came from: jetstream, pds or backfill
+	Source string `json:"source"`
+	// Reason is invalid, schema, invalid_rkey or policy
+	Reason string `json:"reason"`
+	Detail string `json:"detail,omitempty"`
+}
+
+type RejectedMeows struct {
+	Rejected []RejectedMeow `json:"rejected"`
+	Cursor   string         `json:"cursor,omitempty"`
+}
+
+type APIKey struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Scopes    []string  `json:"scopes"`
+	Tier      string    `json:"tier"`
+	CreatedAt time.Time `json:"created_at"`
+	RotatedAt time.Time `json:"rotated_at,omitempty"`
+	// Key is only returned by CreateAPIKey and RotateAPIKey.
+	Key string `json:"key,omitempty"`
+}
+
+type Report struct {
+	ID        string    `json:"id"`
+	DID       string    `json:"did"`
+	Rkey      string    `json:"rkey"`
+	Reporter  string    `json:"reporter"`
+	Reason    string    `json:"reason"`
+	Comment   string    `json:"comment,omitempty"`
+	State     string    `json:"state"`
+	Note      string    `json:"note,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// Meow is nil once the reported meow has been deleted.
+	Meow *Meow `json:"meow,omitempty"`
+}
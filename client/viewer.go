@@ -0,0 +1,195 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// The endpoints in this file act on behalf of a viewer and need
+// WithTokenSource.
+
+func (c *Client) BookmarkMeow(ctx context.Context, did, rkey string) error {
+	return c.call(ctx, request{method: http.MethodPost, path: "/_endpoints/bookmarkMeow",
+		query: url.Values{"did": {did}, "rkey": {rkey}}, auth: "bookmarkMeow"}, nil)
+}
+
+func (c *Client) UnbookmarkMeow(ctx context.Context, did, rkey string) error {
+	return c.call(ctx, request{method: http.MethodDelete, path: "/_endpoints/bookmarkMeow",
+		query: url.Values{"did": {did}, "rkey": {rkey}}, auth: "bookmarkMeow"}, nil)
+}
+
+// GetBookmarks returns a page of the viewer's bookmarks, newest first.
+// Pass the returned Cursor to get the next page; it is empty on the last
+// one.
+func (c *Client) GetBookmarks(ctx context.Context, limit int, cursor string) (*Bookmarks, error) {
+	q := url.Values{}
+	if limit > 0 {
+		q.Set("limit", strconv.Itoa(limit))
+	}
+	if cursor != "" {
+		q.Set("cursor", cursor)
+	}
+	var b Bookmarks
+	if err := c.call(ctx, request{path: "/_endpoints/getBookmarks", query: q, auth: "getBookmarks"}, &b); err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+// PinMeow pins one of the viewer's own meows, replacing their pin.
+func (c *Client) PinMeow(ctx context.Context, rkey string) error {
+	return c.call(ctx, request{method: http.MethodPost, path: "/_endpoints/pinMeow",
+		query: url.Values{"rkey": {rkey}}, auth: "pinMeow"}, nil)
+}
+
+func (c *Client) UnpinMeow(ctx context.Context) error {
+	return c.call(ctx, request{method: http.MethodDelete, path: "/_endpoints/pinMeow", auth: "pinMeow"}, nil)
+}
+
+func (c *Client) GetPreferences(ctx context.Context) (*Preferences, error) {
+	var p Preferences
+	if err := c.call(ctx, request{path: "/_endpoints/getPreferences", auth: "getPreferences"}, &p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// PutPreferences replaces the viewer's preferences and returns them as
+// stored.
+func (c *Client) PutPreferences(ctx context.Context, prefs Preferences) (*Preferences, error) {
+	var p Preferences
+	err := c.call(ctx, request{method: http.MethodPut, path: "/_endpoints/putPreferences", body: prefs, auth: "putPreferences"}, &p)
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// CreateAPIKey returns the new key with its secret in Key, which is never
+// shown again.
+func (c *Client) CreateAPIKey(ctx context.Context, name string, scopes []string) (*APIKey, error) {
+	body := struct {
+		Name   string   `json:"name"`
+		Scopes []string `json:"scopes"`
+	}{name, scopes}
+	var k APIKey
+	if err := c.call(ctx, request{method: http.MethodPost, path: "/_endpoints/createApiKey", body: body, auth: "createApiKey"}, &k); err != nil {
+		return nil, err
+	}
+	return &k, nil
+}
+
+func (c *Client) ListAPIKeys(ctx context.Context) ([]APIKey, error) {
+	var resp struct {
+		Keys []APIKey `json:"keys"`
+	}
+	err := c.call(ctx, request{path: "/_endpoints/listApiKeys", auth: "listApiKeys"}, &resp)
+	return resp.Keys, err
+}
+
+// RotateAPIKey replaces the secret of a key, returned in Key.
+func (c *Client) RotateAPIKey(ctx context.Context, id string) (*APIKey, error) {
+	var k APIKey
+	if err := c.call(ctx, request{method: http.MethodPost, path: "/_endpoints/rotateApiKey", query: url.Values{"id": {id}}, auth: "rotateApiKey"}, &k); err != nil {
+		return nil, err
+	}
+	return &k, nil
+}
+
+func (c *Client) RevokeAPIKey(ctx context.Context, id string) error {
+	return c.call(ctx, request{method: http.MethodPost, path: "/_endpoints/revokeApiKey", query: url.Values{"id": {id}}, auth: "revokeApiKey"}, nil)
+}
+
+// CreateReport reports a meow to the moderators. reason is one of spam,
+// violation, misleading, sexual, rude or other.
+func (c *Client) CreateReport(ctx context.Context, did, rkey, reason, comment string) (*Report, error) {
+	body := struct {
+		DID     string `json:"did"`
+		Rkey    string `json:"rkey"`
+		Reason  string `json:"reason"`
+		Comment string `json:"comment"`
+	}{did, rkey, reason, comment}
+	var r Report
+	if err := c.call(ctx, request{method: http.MethodPost, path: "/_endpoints/createReport", body: body, auth: "createReport", idempotent: true}, &r); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// EchoMeow shows the viewer's just created meow rkey in the API before the
+// firehose delivers it.
+func (c *Client) EchoMeow(ctx context.Context, rkey string) (*Meow, error) {
+	var m Meow
+	if err := c.call(ctx, request{method: http.MethodPost, path: "/_endpoints/echoMeow", query: url.Values{"rkey": {rkey}}, auth: "echoMeow", idempotent: true}, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+type draftBody struct {
+	Emotion string `json:"emotion"`
+	Subject string `json:"subject"`
+	Version *int   `json:"version,omitempty"`
+}
+
+// CreateDraft keeps an unposted meow for the viewer's other devices.
+func (c *Client) CreateDraft(ctx context.Context, emotion, subject string) (*Draft, error) {
+	var d Draft
+	err := c.call(ctx, request{method: http.MethodPost, path: "/_endpoints/createDraft",
+		body: draftBody{Emotion: emotion, Subject: subject}, auth: "createDraft", idempotent: true}, &d)
+	if err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+// GetDrafts returns the viewer's drafts, most recently updated first.
+func (c *Client) GetDrafts(ctx context.Context) ([]Draft, error) {
+	var body struct {
+		Drafts []Draft `json:"drafts"`
+	}
+	if err := c.call(ctx, request{path: "/_endpoints/getDrafts", auth: "getDrafts"}, &body); err != nil {
+		return nil, err
+	}
+	return body.Drafts, nil
+}
+
+// UpdateDraft saves d's emotion and subject, on top of d.Version when set,
+// and returns the draft as stored.
+func (c *Client) UpdateDraft(ctx context.Context, d Draft) (*Draft, error) {
+	body := draftBody{Emotion: d.Emotion, Subject: d.Subject}
+	if d.Version != 0 {
+		body.Version = &d.Version
+	}
+	var out Draft
+	err := c.call(ctx, request{method: http.MethodPut, path: "/_endpoints/updateDraft",
+		query: url.Values{"id": {d.ID}}, body: body, auth: "updateDraft"}, &out)
+	if err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+func (c *Client) DeleteDraft(ctx context.Context, id string) error {
+	return c.call(ctx, request{method: http.MethodDelete, path: "/_endpoints/deleteDraft",
+		query: url.Values{"id": {id}}, auth: "deleteDraft"}, nil)
+}
+
+// GetMyRejectedMeows returns a page of the viewer's records turned away at
+// ingest, newest first, to find out why a meow never showed up.
+func (c *Client) GetMyRejectedMeows(ctx context.Context, limit int, cursor string) (*RejectedMeows, error) {
+	q := url.Values{}
+	if limit > 0 {
+		q.Set("limit", strconv.Itoa(limit))
+	}
+	if cursor != "" {
+		q.Set("cursor", cursor)
+	}
+	var r RejectedMeows
+	if err := c.call(ctx, request{path: "/_endpoints/getMyRejectedMeows", query: q, auth: "getMyRejectedMeows"}, &r); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
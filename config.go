@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CONFIG_FILE names an optional file of KEY=VALUE lines, in the same format
+// as a docker env_file, whose variables take precedence over the
+// environment. Unlike the environment it can be reloaded at runtime, see
+// reload.go.
+var configFile = struct {
+	sync.RWMutex
+	vars map[string]string
+}{vars: mustReadConfigFile()}
+
+func mustReadConfigFile() map[string]string {
+	vars, err := readConfigFile(os.Getenv("CONFIG_FILE"))
+	if err != nil {
+		log.Fatal("read config file: ", err)
+	}
+	return vars
+}
+
+func readConfigFile(path string) (map[string]string, error) {
+	vars := map[string]string{}
+	if path == "" {
+		return vars, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok || strings.TrimSpace(key) == "" {
+			return nil, fmt.Errorf("%s:%d: want KEY=VALUE", path, n)
+		}
+		vars[strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+	return vars, scanner.Err()
+}
+
+// getenv reads a variable from CONFIG_FILE, or the environment when the
+// file doesn't set it.
+func getenv(key string) string {
+	configFile.RLock()
+	defer configFile.RUnlock()
+	if v, ok := configFile.vars[key]; ok {
+		return v
+	}
+	return os.Getenv(key)
+}
+
+// envString returns the environment variable or the fallback when unset.
+func envString(key, fallback string) string {
+	if v := getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+func envInt(key string, fallback int) int {
+	n, err := lookupInt(key, fallback)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return n
+}
+
+// lookupInt is envInt returning the parse error, for settings reloaded at
+// runtime where a typo mustn't stop the server.
+func lookupInt(key string, fallback int) (int, error) {
+	v := getenv(key)
+	if v == "" {
+		return fallback, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %v", key, err)
+	}
+	return n, nil
+}
+
+func envFloat(key string, fallback float64) float64 {
+	f, err := lookupFloat(key, fallback)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return f
+}
+
+func lookupFloat(key string, fallback float64) (float64, error) {
+	v := getenv(key)
+	if v == "" {
+		return fallback, nil
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %v", key, err)
+	}
+	return f, nil
+}
+
+func envDuration(key string, fallback time.Duration) time.Duration {
+	d, err := lookupDuration(key, fallback)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return d
+}
+
+func lookupDuration(key string, fallback time.Duration) (time.Duration, error) {
+	v := getenv(key)
+	if v == "" {
+		return fallback, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %v", key, err)
+	}
+	return d, nil
+}
+
+func envBool(key string, fallback bool) bool {
+	v := getenv(key)
+	if v == "" {
+		return fallback
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Fatalf("%s: %v", key, err)
+	}
+	return b
+}
+
+// envList splits a comma separated variable, dropping empty entries.
+func envList(key string) []string {
+	var out []string
+	for _, v := range strings.Split(getenv(key), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
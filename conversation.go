@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gocql/gocql"
+)
+
+type ConversationResponse struct {
+	A      string         `json:"a"`
+	B      string         `json:"b"`
+	Meows  []MeowResponse `json:"meows"`
+	Cursor string         `json:"cursor,omitempty"`
+}
+
+// getConversation interleaves the meows a sent about b and b sent about a,
+// oldest first, from the pair-keyed meows_by_pair table.
+func getConversation(session *gocql.Session) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		a, b := c.Query("a"), c.Query("b")
+		if a == "" || validateDID(a) != a {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid a"})
+			return
+		}
+		if b == "" || validateDID(b) != b {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid b"})
+			return
+		}
+		if a == b {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "a and b must differ"})
+			return
+		}
+		limit, err := conversationGuardrail.parseLimit(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		query := `
+			SELECT ` + meowColumns + `
+			FROM cat.meows_by_pair
+			WHERE pair = ?`
+		args := []any{pairKey(a, b)}
+		if v := c.Query("cursor"); v != "" {
+			cur, err := parsePageCursor(v)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			query += ` AND (time_us, did, rkey) > (?, ?, ?)`
+			args = append(args, cur.TimeUS, cur.DID, cur.Rkey)
+		}
+		query += ` LIMIT ?`
+		args = append(args, limit)
+
+		iter := session.Query(query, args...).WithContext(c.Request.Context()).Iter()
+
+		meows := []MeowResponse{}
+		var row meowRow
+		for iter.Scan(row.dest()...) {
+			meows = append(meows, row.meow().response())
+			row = meowRow{}
+		}
+		if err := iter.Close(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		resp := ConversationResponse{A: a, B: b, Meows: meows}
+		if len(meows) == limit {
+			last := meows[len(meows)-1]
+			resp.Cursor = pageCursor{TimeUS: last.TimeUS, Rkey: last.Rkey, DID: last.DID}.String()
+		}
+		// after the cursor, so a page of hidden meows doesn't end paging
+		resp.Meows = moderation.apply(meows)
+		c.JSON(http.StatusOK, resp)
+	}
+}
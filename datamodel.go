@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/baphotex/meowview/repostream"
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// JSON responses to GET requests can also be had as DAG-CBOR, with Accept:
+// application/cbor or application/vnd.ipld.dag-cbor, or as DAG-JSON, with
+// Accept: application/vnd.ipld.dag-json, for clients in the IPLD
+// ecosystem. The JSON a handler writes is read in the atproto data model,
+// where {"$link"} objects are links and {"$bytes"} ones bytes, and
+// encoded again. Integers stay integers and other numbers become floats,
+// which atproto records don't have but some responses, like shares, do.
+//
+// The Accept type with the highest q wins, the first on a tie; JSON stays
+// the default. Responses say Vary: Accept so caches keep them apart.
+
+const (
+	mimeCBOR    = "application/cbor"
+	mimeDAGCBOR = "application/vnd.ipld.dag-cbor"
+	mimeDAGJSON = "application/vnd.ipld.dag-json"
+)
+
+var dataModelResponses = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "meowview_data_model_responses_total",
+	Help: "JSON responses sent re-encoded, by content type.",
+}, []string{"format"})
+
+// negotiateDataModel returns the content type a response should be
+// encoded as, or "" for JSON.
+func negotiateDataModel(accept string) string {
+	best, bestQ := "", 0.0
+	for _, part := range strings.Split(accept, ",") {
+		mime, params, _ := strings.Cut(part, ";")
+		mime = strings.ToLower(strings.TrimSpace(mime))
+		q := 1.0
+		for _, p := range strings.Split(params, ";") {
+			if v, ok := strings.CutPrefix(strings.TrimSpace(p), "q="); ok {
+				if f, err := strconv.ParseFloat(v, 64); err == nil {
+					q = f
+				}
+			}
+		}
+		switch mime {
+		case "application/json", mimeCBOR, mimeDAGCBOR, mimeDAGJSON:
+			if q > bestQ {
+				best, bestQ = mime, q
+			}
+		}
+	}
+	if best == "application/json" {
+		return ""
+	}
+	return best
+}
+
+// dataModelEncoding re-encodes JSON responses to GET requests that ask
+// for DAG-CBOR or DAG-JSON.
+func dataModelEncoding() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.Method != http.MethodGet {
+			c.Next()
+			return
+		}
+		c.Writer.Header().Add("Vary", "Accept")
+		format := negotiateDataModel(c.GetHeader("Accept"))
+		if format == "" {
+			c.Next()
+			return
+		}
+
+		w := &dataModelWriter{ResponseWriter: c.Writer}
+		c.Writer = w
+		c.Next()
+		c.Writer = w.ResponseWriter
+		if !w.buffering {
+			return
+		}
+
+		body := w.body.Bytes()
+		v, err := repostream.FromJSON(body)
+		var out []byte
+		if err == nil {
+			if format == mimeDAGJSON {
+				out, err = repostream.MarshalDAGJSON(v)
+			} else {
+				out, err = repostream.MarshalCBOR(v)
+			}
+		}
+		if err != nil {
+			// e.g. a list stream cut short, see jsonstream.go; it is
+			// passed on as is, as it is to JSON clients
+			w.ResponseWriter.Write(body)
+			return
+		}
+		dataModelResponses.WithLabelValues(format).Inc()
+		w.Header().Set("Content-Type", format)
+		w.ResponseWriter.Write(out)
+	}
+}
+
+// dataModelWriter holds back a JSON response to encode it again, and
+// passes any other through.
+type dataModelWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+	// decided is set by the first write, buffering if it was JSON
+	decided, buffering bool
+}
+
+func (w *dataModelWriter) Write(b []byte) (int, error) {
+	if !w.decided {
+		w.decided = true
+		w.buffering = strings.HasPrefix(w.Header().Get("Content-Type"), "application/json")
+	}
+	if w.buffering {
+		return w.body.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *dataModelWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+func (w *dataModelWriter) Flush() {
+	if !w.buffering {
+		w.ResponseWriter.Flush()
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"hash/fnv"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gocql/gocql"
+)
+
+// With DELETE_GRACE_PERIOD set, a deleted meow's row is moved to
+// pending_deletes instead of being dropped, and kept there for the grace
+// period. It is gone from every public read right away, as without it, but
+// an admin can list the pending deletes and undo them, e.g. after a
+// client bug deleted an actor's meows en masse. Undoing restores the index
+// only; the records are still gone from the author's PDS.
+var deleteGracePeriod = envDuration("DELETE_GRACE_PERIOD", 0)
+
+// pendingDeleteBuckets spreads pending_deletes over a fixed number of
+// partitions, like actor_handles.
+const pendingDeleteBuckets = 16
+
+// maxUndoDeletes caps the meows one undoDeletes restores.
+const maxUndoDeletes = 10000
+
+func createPendingDeleteTables(session *gocql.Session) error {
+	return session.Query(`
+		CREATE TABLE IF NOT EXISTS pending_deletes (
+			bucket INT,
+			did TEXT,
+			rkey TEXT,
+			deleted_at TIMESTAMP,
+			time_us BIGINT,
+			cid TEXT,
+			emotion TEXT,
+			subject TEXT,
+			inferred_emotion TEXT,
+			PRIMARY KEY ((bucket), did, rkey)
+		)`).Exec()
+}
+
+func pendingDeleteBucket(did string) int {
+	h := fnv.New32a()
+	h.Write([]byte(did))
+	return int(h.Sum32() % pendingDeleteBuckets)
+}
+
+// holdDeletedMeow adds the move of a meow about to be deleted into
+// pending_deletes to batch, when there is a grace period and the meow is
+// indexed.
+func holdDeletedMeow(session *gocql.Session, batch *gocql.Batch, did, rkey string) error {
+	if deleteGracePeriod <= 0 {
+		return nil
+	}
+	var row meowRow
+	err := session.Query(`SELECT `+meowColumns+` FROM meows WHERE id = ?`, meowID(did, rkey)).Scan(row.dest()...)
+	if err == gocql.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	batch.Query(`
+		INSERT INTO pending_deletes (bucket, did, rkey, deleted_at, time_us, cid, emotion, subject, inferred_emotion)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		USING TTL ?`,
+		pendingDeleteBucket(did), did, rkey, time.Now(), row.TimeUS, row.CID,
+		nullString(row.Emotion), nullString(row.Subject), nullString(row.InferredEmotion),
+		int(deleteGracePeriod.Seconds()),
+	)
+	return nil
+}
+
+type PendingDelete struct {
+	MeowResponse
+	DeletedAt time.Time `json:"deleted_at"`
+}
+
+// pendingDeletes reads the pending deletes of did, or of everyone when did
+// is "", up to limit.
+func pendingDeletes(c *gin.Context, session *gocql.Session, did string, limit int) ([]PendingDelete, error) {
+	buckets := []int{}
+	if did != "" {
+		buckets = append(buckets, pendingDeleteBucket(did))
+	} else {
+		for b := 0; b < pendingDeleteBuckets; b++ {
+			buckets = append(buckets, b)
+		}
+	}
+	var out []PendingDelete
+	for _, bucket := range buckets {
+		q := `SELECT ` + meowColumns + `, deleted_at FROM pending_deletes WHERE bucket = ?`
+		args := []any{bucket}
+		if did != "" {
+			q += ` AND did = ?`
+			args = append(args, did)
+		}
+		iter := session.Query(q+` LIMIT ?`, append(args, limit-len(out))...).
+			WithContext(c.Request.Context()).Iter()
+		var row meowRow
+		var deletedAt time.Time
+		for iter.Scan(append(row.dest(), &deletedAt)...) {
+			out = append(out, PendingDelete{MeowResponse: row.meow().response(), DeletedAt: deletedAt})
+			row, deletedAt = meowRow{}, time.Time{}
+		}
+		if err := iter.Close(); err != nil {
+			return nil, err
+		}
+		if len(out) >= limit {
+			break
+		}
+	}
+	return out, nil
+}
+
+// getPendingDeletes lists the meows deleted within the grace period,
+// optionally of one actor.
+func getPendingDeletes(session *gocql.Session) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		did := c.Query("did")
+		if did != "" && validateDID(did) != did {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid did"})
+			return
+		}
+		limit := 100
+		if v := c.Query("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 || n > maxUndoDeletes {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and " + strconv.Itoa(maxUndoDeletes)})
+				return
+			}
+			limit = n
+		}
+		meows, err := pendingDeletes(c, session, did, limit)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if meows == nil {
+			meows = []PendingDelete{}
+		}
+		c.JSON(http.StatusOK, gin.H{"grace_period": deleteGracePeriod.String(), "meows": meows})
+	}
+}
+
+type undoDeletesRequest struct {
+	DID string `json:"did"`
+	// Meows restores just these; all of DID's pending deletes otherwise
+	Meows []struct {
+		DID  string `json:"did"`
+		Rkey string `json:"rkey"`
+	} `json:"meows"`
+	// Since restores only meows deleted at or after it
+	Since time.Time `json:"since"`
+}
+
+// undoDeletes restores pending deletes into the index, as new creates so
+// sinks and streams see them again. Meows created again since are left
+// alone.
+func undoDeletes(session *gocql.Session) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req undoDeletesRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+			return
+		}
+		if (req.DID == "") == (len(req.Meows) == 0) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "give either did or meows"})
+			return
+		}
+		if req.DID != "" && validateDID(req.DID) != req.DID {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid did"})
+			return
+		}
+		if len(req.Meows) > maxUndoDeletes {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "meows must list at most " + strconv.Itoa(maxUndoDeletes) + " meows"})
+			return
+		}
+
+		var pending []PendingDelete
+		if req.DID != "" {
+			var err error
+			if pending, err = pendingDeletes(c, session, req.DID, maxUndoDeletes); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+		}
+		for _, m := range req.Meows {
+			if validateDID(m.DID) != m.DID || !rkeyRegex.MatchString(m.Rkey) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid meow " + m.DID + "/" + m.Rkey})
+				return
+			}
+			var row meowRow
+			var deletedAt time.Time
+			err := session.Query(`
+				SELECT `+meowColumns+`, deleted_at FROM pending_deletes
+				WHERE bucket = ? AND did = ? AND rkey = ?`,
+				pendingDeleteBucket(m.DID), m.DID, m.Rkey,
+			).WithContext(c.Request.Context()).Scan(append(row.dest(), &deletedAt)...)
+			if err == gocql.ErrNotFound {
+				continue
+			}
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			pending = append(pending, PendingDelete{MeowResponse: row.meow().response(), DeletedAt: deletedAt})
+		}
+
+		restored, skipped := 0, 0
+		for _, p := range pending {
+			if p.DeletedAt.Before(req.Since) {
+				continue
+			}
+			ok, err := restoreDeletedMeow(session, p)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "restored": restored})
+				return
+			}
+			if ok {
+				restored++
+			} else {
+				skipped++
+			}
+		}
+		log.Printf("undid %d deletes, %d created again since", restored, skipped)
+		c.JSON(http.StatusOK, gin.H{"restored": restored, "skipped": skipped})
+	}
+}
+
+func restoreDeletedMeow(session *gocql.Session, p PendingDelete) (bool, error) {
+	var cid string
+	err := session.Query(`SELECT cid FROM meows WHERE id = ?`, meowID(p.DID, p.Rkey)).Scan(&cid)
+	if err != nil && err != gocql.ErrNotFound {
+		return false, err
+	}
+	restored := err == gocql.ErrNotFound
+	if restored {
+		ev := meowEvent{
+			Meow: Meow{
+				DID:             p.DID,
+				Rkey:            p.Rkey,
+				CID:             p.CID,
+				TimeUS:          p.TimeUS,
+				Emotion:         p.Emotion,
+				Subject:         p.Subject,
+				InferredEmotion: p.InferredEmotion,
+			},
+			Op: "create",
+		}
+		sequence.assign(&ev)
+		if err := processEvent(session, ev); err != nil {
+			return false, err
+		}
+	}
+	err = session.Query(`DELETE FROM pending_deletes WHERE bucket = ? AND did = ? AND rkey = ?`,
+		pendingDeleteBucket(p.DID), p.DID, p.Rkey).Exec()
+	return restored, err
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"log"
+	"strings"
+
+	"github.com/gocql/gocql"
+)
+
+// createDerivedTables creates the query tables maintained next to meows at
+// ingest, so reads by subject, emotion or actor don't need to scan the
+// whole meows table with ALLOW FILTERING.
+func createDerivedTables(session *gocql.Session) error {
+	err := session.Query(`
+		CREATE TABLE IF NOT EXISTS meows_by_subject (
+			subject TEXT,
+			time_us BIGINT,
+			did TEXT,
+			rkey TEXT,
+			cid TEXT,
+			emotion TEXT,
+			inferred_emotion TEXT,
+			PRIMARY KEY ((subject), time_us, did, rkey)
+		) WITH CLUSTERING ORDER BY (time_us DESC, did ASC, rkey ASC)`).Exec()
+	if err != nil {
+		return err
+	}
+
+	err = session.Query(`
+		CREATE TABLE IF NOT EXISTS meows_by_emotion (
+			emotion TEXT,
+			time_us BIGINT,
+			did TEXT,
+			rkey TEXT,
+			cid TEXT,
+			subject TEXT,
+			inferred BOOLEAN,
+			PRIMARY KEY ((emotion), time_us, did, rkey)
+		) WITH CLUSTERING ORDER BY (time_us DESC, did ASC, rkey ASC)`).Exec()
+	if err != nil {
+		return err
+	}
+
+	err = session.Query(`
+		CREATE TABLE IF NOT EXISTS meows_by_actor (
+			did TEXT,
+			time_us BIGINT,
+			rkey TEXT,
+			cid TEXT,
+			emotion TEXT,
+			subject TEXT,
+			inferred_emotion TEXT,
+			PRIMARY KEY ((did), time_us, rkey)
+		) WITH CLUSTERING ORDER BY (time_us DESC, rkey ASC)`).Exec()
+	if err != nil {
+		return err
+	}
+
+	// conversations are read oldest first, so this one clusters ascending
+	return session.Query(`
+		CREATE TABLE IF NOT EXISTS meows_by_pair (
+			pair TEXT,
+			time_us BIGINT,
+			did TEXT,
+			rkey TEXT,
+			cid TEXT,
+			emotion TEXT,
+			subject TEXT,
+			inferred_emotion TEXT,
+			PRIMARY KEY ((pair), time_us, did, rkey)
+		) WITH CLUSTERING ORDER BY (time_us ASC, did ASC, rkey ASC)`).Exec()
+}
+
+// pairKey is the meows_by_pair partition for two DIDs, the same whichever
+// of them is the author.
+func pairKey(a, b string) string {
+	if b < a {
+		a, b = b, a
+	}
+	return a + " " + b
+}
+
+// effectiveEmotion is the emotion used for grouping: the author's choice,
+// falling back to the inferred one.
+func effectiveEmotion(m Meow) (string, bool) {
+	if m.Emotion != "" {
+		return m.Emotion, false
+	}
+	return m.InferredEmotion, m.InferredEmotion != ""
+}
+
+// derivedTimeUS is the time_us a meow is indexed under in the derived
+// tables: its rev's timestamp, which is the same whichever region or
+// jetstream instance delivered it, so every region writes the same rows.
+// Records without a rev, and revs ahead of the event, keep the event's
+// own time_us.
+func derivedTimeUS(ev meowEvent) int64 {
+	if ts, ok := revTimestamp(ev.Rev); ok && ts < ev.TimeUS {
+		return ts
+	}
+	return ev.TimeUS
+}
+
+// indexDerivedMeow writes a freshly ingested meow into the derived tables
+// and counts it, unless it was counted already. It reports whether it
+// counted the meow.
+func indexDerivedMeow(session *gocql.Session, m Meow) bool {
+	if m.Subject != "" {
+		err := session.Query(`
+			INSERT INTO meows_by_subject (subject, time_us, did, rkey, cid, emotion, inferred_emotion)
+			VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			m.Subject, m.TimeUS, m.DID, m.Rkey, m.CID, m.Emotion, m.InferredEmotion,
+		).Exec()
+		if err != nil {
+			log.Println("insert meows_by_subject error:", err)
+		}
+	}
+
+	if emotion, inferred := effectiveEmotion(m); emotion != "" {
+		err := session.Query(`
+			INSERT INTO meows_by_emotion (emotion, time_us, did, rkey, cid, subject, inferred)
+			VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			emotion, m.TimeUS, m.DID, m.Rkey, m.CID, m.Subject, inferred,
+		).Exec()
+		if err != nil {
+			log.Println("insert meows_by_emotion error:", err)
+		}
+	}
+
+	if strings.HasPrefix(m.Subject, "did:") && m.Subject != m.DID {
+		err := session.Query(`
+			INSERT INTO meows_by_pair (pair, time_us, did, rkey, cid, emotion, subject, inferred_emotion)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+			pairKey(m.DID, m.Subject), m.TimeUS, m.DID, m.Rkey, m.CID, m.Emotion, m.Subject, m.InferredEmotion,
+		).Exec()
+		if err != nil {
+			log.Println("insert meows_by_pair error:", err)
+		}
+	}
+
+	err := session.Query(`
+		INSERT INTO meows_by_actor (did, time_us, rkey, cid, emotion, subject, inferred_emotion)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		m.DID, m.TimeUS, m.Rkey, m.CID, m.Emotion, m.Subject, m.InferredEmotion,
+	).Exec()
+	if err != nil {
+		log.Println("insert meows_by_actor error:", err)
+	}
+	indexEmotionActor(session, m)
+	return claimCount(session, m)
+}
+
+// removeDerivedMeows drops every derived row for did/rkey. It finds them
+// through meows_by_actor, which carries the subject and emotion a delete
+// event doesn't, and which holds every row indexed for the record whatever
+// time_us each was indexed under. It returns the time_us of the last row
+// it dropped, 0 if there was none.
+func removeDerivedMeows(session *gocql.Session, did, rkey string) int64 {
+	iter := session.Query(`
+		SELECT time_us, emotion, subject, inferred_emotion
+		FROM meows_by_actor
+		WHERE did = ? AND rkey = ?
+		ALLOW FILTERING`,
+		did, rkey,
+	).Iter()
+
+	var row meowRow
+	var removed int64
+	var found []Meow
+	for iter.Scan(&row.TimeUS, &row.Emotion, &row.Subject, &row.InferredEmotion) {
+		m := row.meow()
+		if m.Subject != "" {
+			err := session.Query(`
+				DELETE FROM meows_by_subject
+				WHERE subject = ? AND time_us = ? AND did = ? AND rkey = ?`,
+				m.Subject, m.TimeUS, did, rkey,
+			).Exec()
+			if err != nil {
+				log.Println("delete meows_by_subject error:", err)
+			}
+		}
+		if strings.HasPrefix(m.Subject, "did:") && m.Subject != did {
+			err := session.Query(`
+				DELETE FROM meows_by_pair
+				WHERE pair = ? AND time_us = ? AND did = ? AND rkey = ?`,
+				pairKey(did, m.Subject), m.TimeUS, did, rkey,
+			).Exec()
+			if err != nil {
+				log.Println("delete meows_by_pair error:", err)
+			}
+		}
+		if emotion, _ := effectiveEmotion(m); emotion != "" {
+			err := session.Query(`
+				DELETE FROM meows_by_emotion
+				WHERE emotion = ? AND time_us = ? AND did = ? AND rkey = ?`,
+				emotion, m.TimeUS, did, rkey,
+			).Exec()
+			if err != nil {
+				log.Println("delete meows_by_emotion error:", err)
+			}
+		}
+		err := session.Query(`
+			DELETE FROM meows_by_actor
+			WHERE did = ? AND time_us = ? AND rkey = ?`,
+			did, m.TimeUS, rkey,
+		).Exec()
+		if err != nil {
+			log.Println("delete meows_by_actor error:", err)
+		}
+		m.DID = did
+		m.Rkey = rkey
+		found = append(found, m)
+		removed = m.TimeUS
+		row = meowRow{}
+	}
+	if err := iter.Close(); err != nil {
+		log.Println("derived lookup error:", err)
+	}
+	releaseCount(session, did, rkey, found)
+	return removed
+}
+
+// Every region, and every delivery of an event, indexes it, but a meow is
+// counted only once: counted_meows remembers the version of each meow the
+// counters hold, and it is claimed and released with lightweight
+// transactions, so whichever instance gets there first counts and the
+// others leave the counters alone.
+
+// countMeowEverywhere adds delta to every counter m is in.
+func countMeowEverywhere(session *gocql.Session, m Meow, delta int64) {
+	countActorSubject(session, m, delta)
+	countActorEmotion(session, m, delta)
+	countEmotionHistogram(session, m, delta)
+	countEmotionVocabulary(session, m, delta)
+	countMeow(session, m, delta)
+}
+
+// claimCount counts m unless counted_meows already holds a version of it,
+// and reports whether it did.
+func claimCount(session *gocql.Session, m Meow) bool {
+	applied, err := session.Query(`
+		INSERT INTO counted_meows (did, rkey, cid, time_us, emotion, subject, inferred_emotion)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		IF NOT EXISTS`,
+		m.DID, m.Rkey, m.CID, m.TimeUS, m.Emotion, m.Subject, m.InferredEmotion,
+	).MapScanCAS(map[string]interface{}{})
+	if err != nil {
+		log.Println("claim meow count error:", err)
+		return false
+	}
+	if applied {
+		countMeowEverywhere(session, m, 1)
+	}
+	return applied
+}
+
+// releaseCount takes did/rkey out of the counters, as the version
+// counted_meows says they hold. Meows counted before counted_meows existed
+// have no row there; they are taken out as the derived rows found for them
+// say, by whichever instance dropped those rows.
+func releaseCount(session *gocql.Session, did, rkey string, found []Meow) {
+	m := Meow{DID: did, Rkey: rkey}
+	err := session.Query(`
+		SELECT cid, time_us, emotion, subject, inferred_emotion
+		FROM counted_meows
+		WHERE did = ? AND rkey = ?`,
+		did, rkey,
+	).Scan(&m.CID, &m.TimeUS, &m.Emotion, &m.Subject, &m.InferredEmotion)
+	switch {
+	case err == gocql.ErrNotFound:
+		for _, f := range found {
+			countMeowEverywhere(session, f, -1)
+		}
+		return
+	case err != nil:
+		log.Println("read meow count error:", err)
+		return
+	}
+	applied, err := session.Query(`
+		DELETE FROM counted_meows
+		WHERE did = ? AND rkey = ?
+		IF cid = ?`,
+		did, rkey, m.CID,
+	).MapScanCAS(map[string]interface{}{})
+	if err != nil {
+		log.Println("release meow count error:", err)
+		return
+	}
+	if applied {
+		countMeowEverywhere(session, m, -1)
+	}
+}
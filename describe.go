@@ -0,0 +1,366 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+type EndpointParam struct {
+	Name        string `json:"name"`
+	Type        string `json:"type"`
+	Required    bool   `json:"required,omitempty"`
+	Default     string `json:"default,omitempty"`
+	Min         int    `json:"min,omitempty"`
+	Max         int    `json:"max,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+type EndpointDescription struct {
+	Path        string          `json:"path"`
+	Method      string          `json:"method"`
+	Description string          `json:"description"`
+	Params      []EndpointParam `json:"params,omitempty"`
+	Cursor      bool            `json:"cursor"`
+	// Auth marks endpoints that need an atproto service auth token
+	Auth   bool   `json:"auth,omitempty"`
+	Output string `json:"output,omitempty"`
+}
+
+var (
+	didParam    = EndpointParam{Name: "did", Type: "did", Required: true}
+	rkeyParam   = EndpointParam{Name: "rkey", Type: "record-key", Required: true}
+	sinceParam  = EndpointParam{Name: "since", Type: "integer", Description: "time_us or RFC 3339 lower bound, inclusive"}
+	untilParam  = EndpointParam{Name: "until", Type: "integer", Description: "time_us or RFC 3339 upper bound, exclusive"}
+	cursorParam = EndpointParam{Name: "cursor", Type: "string", Description: "cursor of the previous page, instead of until"}
+
+	hydrateParam = EndpointParam{Name: "hydrate", Type: "string", Description: "posts to embed referenced Bluesky posts, actors for authors' handles; comma separated"}
+	depthParam   = EndpointParam{Name: "depth", Type: "integer", Default: "1", Max: maxQuoteDepth, Description: "levels of quoted meows to embed"}
+)
+
+// limitParamFor describes the page size a guardrail accepts.
+func limitParamFor(g *guardrail) EndpointParam {
+	return EndpointParam{Name: "limit", Type: "integer", Default: strconv.Itoa(g.DefaultLimit), Min: g.MinLimit, Max: g.MaxLimit}
+}
+
+// pageParamsFor describes the paging parameters a guardrail accepts.
+func pageParamsFor(g *guardrail) []EndpointParam {
+	return []EndpointParam{limitParamFor(g), sinceParam, untilParam, cursorParam}
+}
+
+// queryEndpoints describes the public read API. Keep in sync with
+// setupRouter when adding endpoints.
+var queryEndpoints = []EndpointDescription{
+	{
+		Path: "/_endpoints/getLastMeows", Method: "GET",
+		Description: "Most recent meows.",
+		Params:      append(pageParamsFor(lastMeowsGuardrail), hydrateParam, depthParam),
+		Output:      "application/json",
+		Cursor:      true,
+	},
+	{
+		Path: "/_endpoints/getActorMeows", Method: "GET",
+		Description: "Meows published by an actor. sort=oldest lists them oldest first; sort=emotionGrouped groups the newest ones by emotion, most used first, with up to limit meows each and no cursor. Both take no since or until.",
+		Params: append(append([]EndpointParam{didParam}, pageParamsFor(actorMeowsGuardrail)...), hydrateParam, depthParam,
+			EndpointParam{Name: "sort", Type: "string", Description: "newest (default), oldest or emotionGrouped"}),
+		Output: "application/json",
+		Cursor: true,
+	},
+	{
+		Path: "/_endpoints/getSubjectMeows", Method: "GET",
+		Description: "Meows whose subject is the given DID.",
+		Params: append([]EndpointParam{{Name: "did", Type: "did", Required: true, Description: "subject DID"}},
+			append(pageParamsFor(subjectMeowsGuardrail), hydrateParam, depthParam)...),
+		Output: "application/json",
+		Cursor: true,
+	},
+	{
+		Path: "/_endpoints/getMeow", Method: "GET",
+		Description: "A single meow.",
+		Params:      []EndpointParam{didParam, rkeyParam, hydrateParam, depthParam},
+		Output:      "application/json",
+	},
+	{
+		Path: "/_endpoints/getRelatedMeows", Method: "GET",
+		Description: "Recent meows sharing a meow's subject or emotion.",
+		Params:      []EndpointParam{didParam, rkeyParam, limitParamFor(relatedGuardrail)},
+		Output:      "application/json",
+	},
+	{
+		Path: "/_endpoints/getEmotionTransitions", Method: "GET",
+		Description: "Which emotion tends to follow which for an actor.",
+		Params:      []EndpointParam{didParam},
+		Output:      "application/json",
+	},
+	{
+		Path: "/_endpoints/getIdentity", Method: "GET",
+		Description: "The DID of a handle, or the handle of a DID, as of the latest identity event for it, or resolved when none was seen.",
+		Params: []EndpointParam{
+			{Name: "did", Type: "did"},
+			{Name: "handle", Type: "handle", Description: "with or without @, instead of did"},
+		},
+		Output: "application/json",
+	},
+	{
+		Path: "/_endpoints/getEmotionHistogram", Method: "GET",
+		Description: "How many meows carried each emotion, the inferred one for meows without, per time bucket, oldest first. The range is rounded out to whole hours, or days for buckets of days.",
+		Params: []EndpointParam{
+			{Name: "since", Type: "integer", Default: "a week before until", Description: "time_us or RFC 3339 lower bound, inclusive"},
+			{Name: "until", Type: "integer", Default: "now", Description: "time_us or RFC 3339 upper bound, exclusive"},
+			{Name: "bucket", Type: "duration", Default: "1d", Description: "bucket size in whole hours, e.g. 1h, 6h, 1d or 7d"},
+			{Name: "tz", Type: "string", Default: "UTC", Description: "IANA zone whose midnights start buckets of days, e.g. America/New_York; it must be a whole number of hours from UTC"},
+		},
+		Output: "application/json",
+	},
+	{
+		Path: "/_endpoints/getActorsByEmotion", Method: "GET",
+		Description: "Distinct actors who expressed an emotion recently, most recent first.",
+		Params: []EndpointParam{
+			{Name: "emotion", Type: "string", Required: true},
+			{Name: "window", Type: "duration", Default: "24h", Description: "how far back, e.g. 30m or 24h"},
+			limitParamFor(actorsByEmotionGuardrail),
+		},
+		Output: "application/json",
+	},
+	{
+		Path: "/_endpoints/getActorSubjects", Method: "GET",
+		Description: "Subjects an actor has meowed at, with counts, most recently meowed at first.",
+		Params:      []EndpointParam{didParam, limitParamFor(actorSubjectsGuardrail)},
+		Output:      "application/json",
+	},
+	{
+		Path: "/_endpoints/getActorEmotionBreakdown", Method: "GET",
+		Description: "How often an actor meows with each emotion, the inferred one for meows without, most used first, and their dominant emotion.",
+		Params:      []EndpointParam{didParam},
+		Output:      "application/json",
+	},
+	{
+		Path: "/_endpoints/suggestEmotions", Method: "GET",
+		Description: "Emotions starting with a prefix, with meow counts, most used first. Refreshed every few minutes.",
+		Params: []EndpointParam{
+			{Name: "q", Type: "string", Description: "prefix; empty lists the most used"},
+			limitParamFor(suggestEmotionsGuardrail),
+		},
+		Output: "application/json",
+	},
+	{
+		Path: "/_endpoints/suggestActors", Method: "GET",
+		Description: "Actors who have meowed whose handle starts with a prefix, most recently active first. Refreshed every few minutes.",
+		Params: []EndpointParam{
+			{Name: "q", Type: "string", Description: "handle prefix, with or without @"},
+			limitParamFor(suggestActorsGuardrail),
+		},
+		Output: "application/json",
+	},
+	{
+		Path: "/_endpoints/subscribeMeows", Method: "GET",
+		Description: "Live creates, updates and deletes as server-sent \"change\" events. Falling behind ends the stream with an \"evicted\" event, or under drop-oldest loses changes counted by a \"dropped\" event; a cursor older than the replay buffer gets a \"resync\" event. Catch up with getMeowsSince.",
+		Params: []EndpointParam{
+			{Name: "did", Type: "did", Description: "only meows by this actor"},
+			{Name: "subject", Type: "string", Description: "only meows about this subject"},
+			{Name: "emotion", Type: "string", Description: "only meows with this emotion, the inferred one for meows without"},
+			{Name: "cursor", Type: "string", Description: "replay buffered changes after this getMeowsSince cursor or event id first; Last-Event-ID works too"},
+			{Name: "encoding", Type: "string", Default: "json", Description: "compact for changes as arrays of values, in the order of a \"fields\" event"},
+		},
+		Output: "text/event-stream",
+	},
+	{
+		Path: "/subscribe", Method: "GET",
+		Description: "Jetstream-compatible websocket of the meow collection. Compression and requireHello are not supported.",
+		Params: []EndpointParam{
+			{Name: "wantedCollections", Type: "string", Description: "repeatable; must include " + meowNSID},
+			{Name: "wantedDids", Type: "did", Description: "repeatable; only commits by these repos"},
+			{Name: "cursor", Type: "integer", Description: "time_us to replay buffered commits from"},
+			{Name: "encoding", Type: "string", Default: "json", Description: "compact for commits as arrays of values, in the order of a first \"fields\" message"},
+		},
+		Output: "websocket",
+	},
+	{
+		Path: "/_endpoints/getMeowCard", Method: "GET",
+		Description: "og:image card for a meow.",
+		Params: []EndpointParam{didParam, rkeyParam,
+			{Name: "format", Type: "string", Default: "png", Description: "png or svg"},
+			{Name: "size", Type: "string", Default: "large", Description: "small or large"},
+		},
+		Output: "image/png",
+	},
+	{
+		Path: "/_endpoints/getConversation", Method: "GET",
+		Description: "Meows two actors sent about each other, oldest first.",
+		Params: []EndpointParam{
+			{Name: "a", Type: "did", Required: true},
+			{Name: "b", Type: "did", Required: true},
+			limitParamFor(conversationGuardrail),
+			{Name: "cursor", Type: "string"},
+		},
+		Cursor: true,
+		Output: "application/json",
+	},
+	{
+		Path: "/_endpoints/getMeowsSince", Method: "GET",
+		Description: "Creates, updates and delete tombstones after a cursor, oldest first, moderated like getLastMeows. Streamed, as NDJSON with Accept: application/x-ndjson.",
+		Params: []EndpointParam{
+			{Name: "cursor", Type: "string", Required: true, Description: "cursor from a previous call, or a time_us or RFC 3339 time"},
+			limitParamFor(changesGuardrail),
+		},
+		Cursor: true,
+		Output: "application/json",
+	},
+	{
+		Path: "/_endpoints/bookmarkMeow", Method: "POST",
+		Description: "Bookmark a meow for the authenticated viewer.",
+		Params:      []EndpointParam{didParam, rkeyParam},
+		Auth:        true,
+	},
+	{
+		Path: "/_endpoints/bookmarkMeow", Method: "DELETE",
+		Description: "Remove a bookmark.",
+		Params:      []EndpointParam{didParam, rkeyParam},
+		Auth:        true,
+	},
+	{
+		Path: "/_endpoints/getBookmarks", Method: "GET",
+		Description: "The authenticated viewer's bookmarks, newest first.",
+		Params: []EndpointParam{
+			limitParamFor(bookmarksGuardrail),
+			{Name: "cursor", Type: "string"},
+		},
+		Cursor: true,
+		Auth:   true,
+		Output: "application/json",
+	},
+	{
+		Path: "/_endpoints/pinMeow", Method: "POST",
+		Description: "Pin one of the authenticated viewer's meows, replacing their pin. Pinned meows have pinned: true.",
+		Params:      []EndpointParam{rkeyParam},
+		Auth:        true,
+	},
+	{
+		Path: "/_endpoints/pinMeow", Method: "DELETE",
+		Description: "Remove the authenticated viewer's pin.",
+		Auth:        true,
+	},
+	{
+		Path: "/_endpoints/getActorPinnedMeow", Method: "GET",
+		Description: "The meow an actor pinned; meow is null without a pin or when the pinned meow was deleted.",
+		Params:      []EndpointParam{didParam},
+		Output:      "application/json",
+	},
+	{
+		Path: "/_endpoints/getPreferences", Method: "GET",
+		Description: "The authenticated viewer's view preferences.",
+		Auth:        true,
+		Output:      "application/json",
+	},
+	{
+		Path: "/_endpoints/putPreferences", Method: "PUT",
+		Description: "Replace the authenticated viewer's view preferences (hidden_emotions, muted_dids, default_sort).",
+		Auth:        true,
+		Output:      "application/json",
+	},
+	{
+		Path: "/_endpoints/getActivityByTimezone", Method: "GET",
+		Description: "Meow counts per UTC offset actors declared in their profile. Only with timezone enrichment enabled.",
+		Params:      []EndpointParam{{Name: "days", Type: "integer", Default: "7", Max: 30}},
+		Output:      "application/json",
+	},
+	{
+		Path: "/_endpoints/createApiKey", Method: "POST",
+		Description: "Create an API key for the authenticated viewer. The key is only shown once.",
+		Auth:        true,
+		Output:      "application/json",
+	},
+	{
+		Path: "/_endpoints/listApiKeys", Method: "GET",
+		Description: "The authenticated viewer's API keys, without secrets.",
+		Auth:        true,
+		Output:      "application/json",
+	},
+	{
+		Path: "/_endpoints/rotateApiKey", Method: "POST",
+		Description: "Replace an API key's secret.",
+		Params:      []EndpointParam{{Name: "id", Type: "string", Required: true}},
+		Auth:        true,
+		Output:      "application/json",
+	},
+	{
+		Path: "/_endpoints/revokeApiKey", Method: "POST",
+		Description: "Delete an API key.",
+		Params:      []EndpointParam{{Name: "id", Type: "string", Required: true}},
+		Auth:        true,
+	},
+	{
+		Path: "/_endpoints/createReport", Method: "POST",
+		Description: "Report a meow to the moderators. Takes JSON with did, rkey, a reason (spam, violation, misleading, sexual, rude or other) and an optional comment.",
+		Auth:        true,
+		Output:      "application/json",
+	},
+	{
+		Path: "/_endpoints/echoMeow", Method: "POST",
+		Description: "Call after creating a meow record on your PDS, so it shows up in getActorMeows before the firehose delivers it.",
+		Params:      []EndpointParam{{Name: "rkey", Type: "string", Required: true}},
+		Auth:        true,
+		Output:      "application/json",
+	},
+	{
+		Path: "/_endpoints/getMyRejectedMeows", Method: "GET",
+		Description: "The authenticated viewer's meow records turned away at ingest in the last few days, newest first, with why: invalid, schema, invalid_rkey or policy.",
+		Params: []EndpointParam{
+			limitParamFor(rejectionsGuardrail),
+			{Name: "cursor", Type: "string"},
+		},
+		Cursor: true,
+		Auth:   true,
+		Output: "application/json",
+	},
+	{
+		Path: "/_endpoints/getSLOStatus", Method: "GET",
+		Description: "Service level objective status.",
+		Output:      "application/json",
+	},
+	{
+		Path: "/_endpoints/getServerInfo", Method: "GET",
+		Description: "Build info, enabled features, feature flags and limits.",
+		Output:      "application/json",
+	},
+	{
+		Path: "/lexicons/{nsid}", Method: "GET",
+		Description: "Lexicon document of an indexed record collection, e.g. /lexicons/moe.kasey.meow.",
+		Output:      "application/json",
+	},
+	{
+		Path: "/status", Method: "GET",
+		Description: "Service health.",
+		Params:      []EndpointParam{{Name: "format", Type: "string", Description: "json for a JSON response"}},
+		Output:      "text/html",
+	},
+}
+
+type DescribeServerResponse struct {
+	DID         string                `json:"did,omitempty"`
+	Collections []string              `json:"collections"`
+	Endpoints   []EndpointDescription `json:"endpoints"`
+	RateLimits  []RateLimitPolicy     `json:"rateLimits"`
+	Features    []string              `json:"features"`
+}
+
+// RateLimitPolicy describes a limit applied to callers. Only requests with
+// an API key are rate limited, by the key's tier.
+type RateLimitPolicy struct {
+	Name   string `json:"name"`
+	Limit  int    `json:"limit"`
+	Window string `json:"window"`
+}
+
+// describeServer is the XRPC style self description of this AppView,
+// served at /xrpc/moe.kasey.meowview.describeServer.
+func describeServer(c *gin.Context) {
+	c.JSON(http.StatusOK, DescribeServerResponse{
+		DID:         getenv("SERVICE_DID"),
+		Collections: indexedLexicons,
+		Endpoints:   queryEndpoints,
+		RateLimits:  apiKeyRateLimits(),
+		Features:    enabledFeatures(),
+	})
+}
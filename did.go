@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/baphotex/meowview/didresolve"
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// didResolver resolves DID documents through the outbound client, for
+// subject validation, handles, PDS lookups and service auth. Documents
+// and unknown DIDs are cached for DID_CACHE_TTL.
+var didResolver = didresolve.NewCache(
+	didResolverBackend,
+	envDuration("DID_CACHE_TTL", 10*time.Minute),
+	envInt("DID_CACHE_SIZE", 10000),
+)
+
+var (
+	didResolutions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "meowview_did_resolutions_total",
+		Help: "DID documents fetched past the cache, by method (plc, web or other) and result (ok, not_found, unsupported, invalid_document, upstream_status, timeout, network or deferred).",
+	}, []string{"method", "result"})
+
+	didResolutionDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "meowview_did_resolution_duration_seconds",
+		Help:    "DID document fetch latency, by method.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method"})
+
+	_ = promauto.NewCounterFunc(prometheus.CounterOpts{
+		Name:        "meowview_did_cache_lookups_total",
+		Help:        "DID lookups, by whether the cache answered them.",
+		ConstLabels: prometheus.Labels{"result": "hit"},
+	}, func() float64 { return float64(didResolver.Stats().Hits) })
+
+	_ = promauto.NewCounterFunc(prometheus.CounterOpts{
+		Name:        "meowview_did_cache_lookups_total",
+		Help:        "DID lookups, by whether the cache answered them.",
+		ConstLabels: prometheus.Labels{"result": "miss"},
+	}, func() float64 { return float64(didResolver.Stats().Misses) })
+)
+
+// didMethod is the metric label of a DID's method.
+func didMethod(did string) string {
+	switch {
+	case strings.HasPrefix(did, "did:plc:"):
+		return "plc"
+	case strings.HasPrefix(did, "did:web:"):
+		return "web"
+	}
+	return "other"
+}
+
+// resolutionResult sorts a resolution error into what it likely means:
+// not_found and invalid_document are bad data, upstream_status, timeout
+// and network point at the directory or host.
+func resolutionResult(err error) string {
+	switch {
+	case err == nil:
+		return "ok"
+	case errors.Is(err, didresolve.ErrNotFound):
+		return "not_found"
+	case errors.Is(err, didresolve.ErrUnsupportedMethod):
+		return "unsupported"
+	case errors.Is(err, didresolve.ErrInvalidDocument):
+		return "invalid_document"
+	case errors.Is(err, didresolve.ErrUpstream):
+		return "upstream_status"
+	case errors.Is(err, errOutboundDeferred):
+		return "deferred"
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, context.Canceled):
+		return "timeout"
+	}
+	return "network"
+}
+
+// DIDResolutionFailure is a failed fetch, as listed by
+// getDIDResolutionFailures.
+type DIDResolutionFailure struct {
+	DID        string    `json:"did"`
+	Method     string    `json:"method"`
+	Result     string    `json:"result"`
+	Error      string    `json:"error"`
+	At         time.Time `json:"at"`
+	DurationMS int64     `json:"duration_ms"`
+}
+
+// observedResolver sits behind the cache, so it sees every fetch, and
+// keeps the last DID_FAILURE_LOG_SIZE failures.
+type observedResolver struct {
+	next didresolve.Resolver
+
+	mu       sync.Mutex
+	failures []DIDResolutionFailure
+}
+
+var (
+	didResolverBackend = &observedResolver{next: didresolve.New(outbound, envString("PLC_DIRECTORY", didresolve.DefaultPLCDirectory))}
+	didFailureLogSize  = envInt("DID_FAILURE_LOG_SIZE", 200)
+)
+
+func (r *observedResolver) Resolve(ctx context.Context, did string) (*didresolve.Document, error) {
+	start := time.Now()
+	doc, err := r.next.Resolve(ctx, did)
+	elapsed := time.Since(start)
+	method, result := didMethod(did), resolutionResult(err)
+	didResolutions.WithLabelValues(method, result).Inc()
+	didResolutionDuration.WithLabelValues(method).Observe(elapsed.Seconds())
+	// deferred background work isn't a failure of the directory or host
+	if err != nil && result != "deferred" {
+		r.mu.Lock()
+		r.failures = append(r.failures, DIDResolutionFailure{
+			DID: did, Method: method, Result: result, Error: err.Error(),
+			At: start, DurationMS: elapsed.Milliseconds(),
+		})
+		if len(r.failures) > didFailureLogSize {
+			r.failures = r.failures[len(r.failures)-didFailureLogSize:]
+		}
+		r.mu.Unlock()
+	}
+	return doc, err
+}
+
+// recentFailures returns the logged failures, newest first.
+func (r *observedResolver) recentFailures() []DIDResolutionFailure {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	out := make([]DIDResolutionFailure, len(r.failures))
+	for i, f := range r.failures {
+		out[len(out)-1-i] = f
+	}
+	return out
+}
+
+// getDIDResolutionFailures lists the recent failed DID resolutions, newest
+// first, with counts by method and result: many upstream_status or timeout
+// failures for plc at once suggest a plc.directory outage, scattered
+// not_found or invalid_document ones bad data.
+func getDIDResolutionFailures(c *gin.Context) {
+	failures := didResolverBackend.recentFailures()
+	counts := map[string]map[string]int{}
+	for _, f := range failures {
+		if counts[f.Method] == nil {
+			counts[f.Method] = map[string]int{}
+		}
+		counts[f.Method][f.Result]++
+	}
+	c.JSON(http.StatusOK, gin.H{"failures": failures, "counts": counts, "cache": didResolver.Stats()})
+}
+
+// resolvedDID returns did when it resolves to a DID document, and ""
+// otherwise.
+func resolvedDID(ctx context.Context, did string) string {
+	if _, err := didResolver.Resolve(ctx, did); err != nil {
+		log.Printf("resolve %s: %v", did, err)
+		return ""
+	}
+	return did
+}
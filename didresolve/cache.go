@@ -0,0 +1,111 @@
+package didresolve
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Cache is a Resolver remembering what another one resolved, including
+// DIDs that don't exist, for a TTL. Other errors aren't cached. When full,
+// the oldest entry is evicted.
+type Cache struct {
+	next Resolver
+	ttl  time.Duration
+	max  int
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	// order holds the cacheEntry of every DID, oldest first
+	order *list.List
+
+	hits, misses atomic.Uint64
+}
+
+// CacheStats counts lookups answered from the cache and passed on.
+type CacheStats struct {
+	Hits   uint64 `json:"hits"`
+	Misses uint64 `json:"misses"`
+}
+
+func (c *Cache) Stats() CacheStats {
+	return CacheStats{Hits: c.hits.Load(), Misses: c.misses.Load()}
+}
+
+type cacheEntry struct {
+	did      string
+	doc      *Document
+	err      error
+	resolved time.Time
+}
+
+func NewCache(next Resolver, ttl time.Duration, max int) *Cache {
+	return &Cache{next: next, ttl: ttl, max: max, entries: map[string]*list.Element{}, order: list.New()}
+}
+
+func (c *Cache) Resolve(ctx context.Context, did string) (*Document, error) {
+	c.mu.Lock()
+	var e cacheEntry
+	el, ok := c.entries[did]
+	if ok {
+		e = *el.Value.(*cacheEntry)
+	}
+	c.mu.Unlock()
+	if ok && time.Since(e.resolved) < c.ttl {
+		c.hits.Add(1)
+		return e.doc, e.err
+	}
+	c.misses.Add(1)
+
+	doc, err := c.next.Resolve(ctx, did)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[did]; ok {
+		c.order.Remove(el)
+	}
+	c.entries[did] = c.order.PushBack(&cacheEntry{did: did, doc: doc, err: err, resolved: time.Now()})
+	for c.order.Len() > c.max {
+		c.remove(c.order.Front())
+	}
+	return doc, err
+}
+
+// remove drops an entry; c.mu is held.
+func (c *Cache) remove(el *list.Element) {
+	delete(c.entries, el.Value.(*cacheEntry).did)
+	c.order.Remove(el)
+}
+
+// Forget drops did from the cache, e.g. after its signing key failed to
+// verify a signature.
+func (c *Cache) Forget(did string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[did]; ok {
+		c.remove(el)
+	}
+}
+
+// Prune drops the entries older than the TTL and returns how many it
+// dropped. Expired entries are otherwise only replaced when looked up
+// again, or evicted when the cache is full.
+func (c *Cache) Prune() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for el := c.order.Front(); el != nil; {
+		next := el.Next()
+		if time.Since(el.Value.(*cacheEntry).resolved) >= c.ttl {
+			c.remove(el)
+			n++
+		}
+		el = next
+	}
+	return n
+}
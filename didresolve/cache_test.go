@@ -0,0 +1,138 @@
+package didresolve
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+const (
+	didA = "did:plc:aaaaaaaaaaaaaaaaaaaaaaaa"
+	didB = "did:plc:bbbbbbbbbbbbbbbbbbbbbbbb"
+	didC = "did:plc:cccccccccccccccccccccccc"
+)
+
+func newTestCache(max int) (*Cache, *Mock) {
+	m := NewMock(&Document{ID: didA}, &Document{ID: didB}, &Document{ID: didC})
+	return NewCache(m, time.Hour, max), m
+}
+
+// age moves did's entry back in time.
+func age(c *Cache, did string, d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[did].Value.(*cacheEntry).resolved = time.Now().Add(-d)
+}
+
+// resolve resolves the DIDs in turn and returns the calls they made to
+// the mock.
+func resolve(t *testing.T, c *Cache, m *Mock, dids ...string) []int {
+	t.Helper()
+	calls := make([]int, len(dids))
+	for i, did := range dids {
+		n := m.Calls(did)
+		if _, err := c.Resolve(context.Background(), did); err != nil {
+			t.Fatalf("Resolve(%s): %v", did, err)
+		}
+		calls[i] = m.Calls(did) - n
+	}
+	return calls
+}
+
+func TestCacheHit(t *testing.T) {
+	c, m := newTestCache(10)
+	calls := resolve(t, c, m, didA, didA, didB)
+	if calls[0] != 1 || calls[1] != 0 || calls[2] != 1 {
+		t.Errorf("calls = %v, want [1 0 1]", calls)
+	}
+	if got, want := c.Stats(), (CacheStats{Hits: 1, Misses: 2}); got != want {
+		t.Errorf("Stats = %+v, want %+v", got, want)
+	}
+}
+
+func TestCacheTTL(t *testing.T) {
+	c, m := newTestCache(10)
+	resolve(t, c, m, didA, didB)
+	age(c, didA, 2*time.Hour)
+
+	if calls := resolve(t, c, m, didA, didB); calls[0] != 1 || calls[1] != 0 {
+		t.Errorf("after expiry calls = %v, want [1 0]", calls)
+	}
+
+	age(c, didB, 2*time.Hour)
+	if n := c.Prune(); n != 1 {
+		t.Errorf("Prune = %d, want 1", n)
+	}
+	if _, ok := c.entries[didB]; ok || c.order.Len() != 1 {
+		t.Errorf("after Prune entries = %v, order has %d", c.entries, c.order.Len())
+	}
+}
+
+func TestCacheErrors(t *testing.T) {
+	c, m := newTestCache(10)
+	unknown := "did:plc:dddddddddddddddddddddddd"
+	for i := 0; i < 2; i++ {
+		if _, err := c.Resolve(context.Background(), unknown); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("Resolve error = %v, want %v", err, ErrNotFound)
+		}
+	}
+	if n := m.Calls(unknown); n != 1 {
+		t.Errorf("unknown DID resolved %d times, want once", n)
+	}
+
+	failure := errors.New("plc directory down")
+	m.Fail(didA, failure)
+	for i := 0; i < 2; i++ {
+		if _, err := c.Resolve(context.Background(), didA); err != failure {
+			t.Fatalf("Resolve error = %v, want %v", err, failure)
+		}
+	}
+	if n := m.Calls(didA); n != 2 {
+		t.Errorf("failing DID resolved %d times, want twice", n)
+	}
+}
+
+func TestCacheForget(t *testing.T) {
+	c, m := newTestCache(10)
+	resolve(t, c, m, didA, didB)
+	c.Forget(didA)
+	c.Forget(didC)
+
+	if len(c.entries) != 1 || c.order.Len() != 1 {
+		t.Fatalf("after Forget entries = %d, order = %d, want 1", len(c.entries), c.order.Len())
+	}
+	if calls := resolve(t, c, m, didA, didB); calls[0] != 1 || calls[1] != 0 {
+		t.Errorf("after Forget calls = %v, want [1 0]", calls)
+	}
+}
+
+func TestCacheEviction(t *testing.T) {
+	tests := []struct {
+		name string
+		// fill is resolved first, then each of check once more
+		fill  []string
+		check []string
+		calls []int
+	}{
+		{name: "oldest evicted", fill: []string{didA, didB, didC}, check: []string{didB, didC, didA}, calls: []int{0, 0, 1}},
+		{name: "hits don't refresh", fill: []string{didA, didB, didA, didC}, check: []string{didA}, calls: []int{1}},
+		{name: "re-resolved moves back", fill: []string{didA, didB, didC, didA}, check: []string{didC, didA, didB}, calls: []int{0, 0, 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, m := newTestCache(2)
+			resolve(t, c, m, tt.fill...)
+			if len(c.entries) != 2 || c.order.Len() != 2 {
+				t.Fatalf("entries = %d, order = %d, want 2", len(c.entries), c.order.Len())
+			}
+			calls := resolve(t, c, m, tt.check...)
+			for i := range calls {
+				if calls[i] != tt.calls[i] {
+					t.Errorf("calls = %v, want %v", calls, tt.calls)
+					break
+				}
+			}
+		})
+	}
+}
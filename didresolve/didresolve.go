@@ -0,0 +1,157 @@
+// Package didresolve resolves did:plc and did:web DIDs to their DID
+// documents.
+//
+//	r := didresolve.NewCache(didresolve.New(http.DefaultClient, ""), 10*time.Minute, 10000)
+//	doc, err := r.Resolve(ctx, "did:plc:...")
+//
+// Every Resolver checks that the document it returns is the one of the DID
+// asked for. Tests use Mock instead of the network. ResolveHandle maps a
+// handle to its DID.
+package didresolve
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// DefaultPLCDirectory is where did:plc documents are looked up by default.
+const DefaultPLCDirectory = "https://plc.directory"
+
+var (
+	// ErrUnsupportedMethod is returned for DIDs other than did:plc and
+	// did:web.
+	ErrUnsupportedMethod = errors.New("unsupported did method")
+	// ErrNotFound is returned when the DID has no document.
+	ErrNotFound = errors.New("did not found")
+	// ErrUpstream is returned when the directory or host answered with an
+	// unexpected status, e.g. during an outage.
+	ErrUpstream = errors.New("did document fetch failed")
+	// ErrInvalidDocument is returned for a document that doesn't parse or
+	// is of another DID.
+	ErrInvalidDocument = errors.New("invalid did document")
+)
+
+type Document struct {
+	ID                 string               `json:"id"`
+	AlsoKnownAs        []string             `json:"alsoKnownAs"`
+	VerificationMethod []VerificationMethod `json:"verificationMethod"`
+	Service            []Service            `json:"service"`
+}
+
+type VerificationMethod struct {
+	ID                 string `json:"id"`
+	Type               string `json:"type"`
+	Controller         string `json:"controller"`
+	PublicKeyMultibase string `json:"publicKeyMultibase"`
+}
+
+type Service struct {
+	ID              string `json:"id"`
+	Type            string `json:"type"`
+	ServiceEndpoint string `json:"serviceEndpoint"`
+}
+
+// Handle is the handle the document claims in alsoKnownAs, or "".
+func (d *Document) Handle() string {
+	for _, aka := range d.AlsoKnownAs {
+		if h, ok := strings.CutPrefix(aka, "at://"); ok {
+			return h
+		}
+	}
+	return ""
+}
+
+type Resolver interface {
+	Resolve(ctx context.Context, did string) (*Document, error)
+}
+
+// Doer sends HTTP requests; *http.Client is one.
+type Doer interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+// PLC resolves did:plc DIDs from a PLC directory.
+type PLC struct {
+	Client Doer
+	// Directory is the directory's base URL, DefaultPLCDirectory if empty
+	Directory string
+}
+
+func (p PLC) Resolve(ctx context.Context, did string) (*Document, error) {
+	if !strings.HasPrefix(did, "did:plc:") {
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedMethod, did)
+	}
+	dir := p.Directory
+	if dir == "" {
+		dir = DefaultPLCDirectory
+	}
+	return fetch(ctx, p.Client, strings.TrimSuffix(dir, "/")+"/"+did, did)
+}
+
+// Web resolves did:web DIDs from the domain's /.well-known/did.json. DIDs
+// with a path are not supported, as atproto doesn't allow them.
+type Web struct {
+	Client Doer
+}
+
+func (w Web) Resolve(ctx context.Context, did string) (*Document, error) {
+	host, ok := strings.CutPrefix(did, "did:web:")
+	if !ok || host == "" || strings.Contains(host, ":") {
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedMethod, did)
+	}
+	return fetch(ctx, w.Client, "https://"+host+"/.well-known/did.json", did)
+}
+
+// New returns a Resolver for did:plc and did:web, sending requests with
+// client. plcDirectory may be empty for DefaultPLCDirectory.
+func New(client Doer, plcDirectory string) Resolver {
+	return methods{plc: PLC{Client: client, Directory: plcDirectory}, web: Web{Client: client}}
+}
+
+type methods struct {
+	plc PLC
+	web Web
+}
+
+func (m methods) Resolve(ctx context.Context, did string) (*Document, error) {
+	switch {
+	case strings.HasPrefix(did, "did:plc:"):
+		return m.plc.Resolve(ctx, did)
+	case strings.HasPrefix(did, "did:web:"):
+		return m.web.Resolve(ctx, did)
+	}
+	return nil, fmt.Errorf("%w: %s", ErrUnsupportedMethod, did)
+}
+
+func fetch(ctx context.Context, client Doer, url, did string) (*Document, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, did)
+	case resp.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("%w: %s returned %s", ErrUpstream, did, resp.Status)
+	}
+
+	var doc Document
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&doc); err != nil {
+		return nil, fmt.Errorf("%w: decode: %v", ErrInvalidDocument, err)
+	}
+	if doc.ID != did {
+		return nil, fmt.Errorf("%w: id %q does not match %q", ErrInvalidDocument, doc.ID, did)
+	}
+	return &doc, nil
+}
@@ -0,0 +1,54 @@
+package didresolve
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ResolveHandle returns the DID a handle points to, from its _atproto DNS
+// TXT record or else https://<handle>/.well-known/atproto-did. It doesn't
+// check that the DID's document claims the handle back; callers that rely
+// on the handle should compare Document.Handle.
+func ResolveHandle(ctx context.Context, client Doer, handle string) (string, error) {
+	handle = strings.ToLower(handle)
+	records, err := net.DefaultResolver.LookupTXT(ctx, "_atproto."+handle)
+	var dnsErr *net.DNSError
+	if err != nil && !(errors.As(err, &dnsErr) && dnsErr.IsNotFound) {
+		return "", fmt.Errorf("handle dns lookup: %w", err)
+	}
+	for _, r := range records {
+		if did, ok := strings.CutPrefix(r, "did="); ok && strings.HasPrefix(did, "did:") {
+			return did, nil
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://"+handle+"/.well-known/atproto-did", nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return "", fmt.Errorf("%w: %s", ErrNotFound, handle)
+	case resp.StatusCode != http.StatusOK:
+		return "", fmt.Errorf("atproto-did fetch returned %s", resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 2048))
+	if err != nil {
+		return "", err
+	}
+	did := strings.TrimSpace(string(body))
+	if !strings.HasPrefix(did, "did:") {
+		return "", fmt.Errorf("%w: %s", ErrNotFound, handle)
+	}
+	return did, nil
+}
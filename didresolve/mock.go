@@ -0,0 +1,59 @@
+package didresolve
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// Mock is a Resolver serving fixed documents, for tests.
+type Mock struct {
+	mu   sync.Mutex
+	docs map[string]*Document
+	errs map[string]error
+	// calls counts Resolve calls per DID
+	calls map[string]int
+}
+
+func NewMock(docs ...*Document) *Mock {
+	m := &Mock{docs: map[string]*Document{}, errs: map[string]error{}, calls: map[string]int{}}
+	for _, d := range docs {
+		m.Add(d)
+	}
+	return m
+}
+
+// Add serves doc for its ID.
+func (m *Mock) Add(doc *Document) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.docs[doc.ID] = doc
+	delete(m.errs, doc.ID)
+}
+
+// Fail makes resolving did return err.
+func (m *Mock) Fail(did string, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.errs[did] = err
+}
+
+// Calls returns how often did was resolved.
+func (m *Mock) Calls(did string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.calls[did]
+}
+
+func (m *Mock) Resolve(ctx context.Context, did string) (*Document, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.calls[did]++
+	if err, ok := m.errs[did]; ok {
+		return nil, err
+	}
+	if doc, ok := m.docs[did]; ok {
+		return doc, nil
+	}
+	return nil, fmt.Errorf("%w: %s", ErrNotFound, did)
+}
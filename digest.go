@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gocql/gocql"
+)
+
+// digestConfig is read from DIGEST_* environment variables. The digest is
+// disabled unless DIGEST_SMTP_HOST and DIGEST_RECIPIENTS are both set.
+type digestConfig struct {
+	SMTPHost   string
+	SMTPPort   string
+	SMTPUser   string
+	SMTPPass   string
+	From       string
+	Recipients []string
+	// Interval is "daily" or "weekly"
+	Interval string
+	// BaseURL is the public address of this server, used for unsubscribe links
+	BaseURL  string
+	Secret   string
+	Template string
+}
+
+func digestConfigFromEnv() *digestConfig {
+	cfg := &digestConfig{
+		SMTPHost: getenv("DIGEST_SMTP_HOST"),
+		SMTPPort: getenv("DIGEST_SMTP_PORT"),
+		SMTPUser: getenv("DIGEST_SMTP_USER"),
+		SMTPPass: envSecret("DIGEST_SMTP_PASSWORD"),
+		From:     getenv("DIGEST_FROM"),
+		Interval: getenv("DIGEST_INTERVAL"),
+		BaseURL:  strings.TrimSuffix(getenv("DIGEST_BASE_URL"), "/"),
+		Secret:   envSecret("DIGEST_SECRET"),
+		Template: defaultDigestTemplate,
+	}
+	for _, r := range strings.Split(getenv("DIGEST_RECIPIENTS"), ",") {
+		if r = strings.TrimSpace(r); r != "" {
+			cfg.Recipients = append(cfg.Recipients, strings.ToLower(r))
+		}
+	}
+	if cfg.SMTPHost == "" || len(cfg.Recipients) == 0 {
+		return nil
+	}
+
+	if cfg.SMTPPort == "" {
+		cfg.SMTPPort = "587"
+	}
+	if cfg.Interval == "" {
+		cfg.Interval = "daily"
+	}
+	if cfg.Interval != "daily" && cfg.Interval != "weekly" {
+		log.Fatalf("DIGEST_INTERVAL must be daily or weekly, got %q", cfg.Interval)
+	}
+	if cfg.From == "" {
+		log.Fatal("DIGEST_FROM is required when the digest is enabled")
+	}
+	if cfg.Secret == "" {
+		log.Fatal("DIGEST_SECRET is required when the digest is enabled")
+	}
+	if path := getenv("DIGEST_TEMPLATE"); path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			log.Fatal("read digest template:", err)
+		}
+		cfg.Template = string(b)
+	}
+	return cfg
+}
+
+func (cfg *digestConfig) period() time.Duration {
+	if cfg.Interval == "weekly" {
+		return 7 * 24 * time.Hour
+	}
+	return 24 * time.Hour
+}
+
+// unsubscribeToken signs an address so unsubscribe links can't be forged
+// for someone else.
+func (cfg *digestConfig) unsubscribeToken(email string) string {
+	mac := hmac.New(sha256.New, []byte(cfg.Secret))
+	mac.Write([]byte(strings.ToLower(email)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (cfg *digestConfig) unsubscribeURL(email string) string {
+	q := url.Values{}
+	q.Set("email", email)
+	q.Set("token", cfg.unsubscribeToken(email))
+	return cfg.BaseURL + "/_endpoints/unsubscribeDigest?" + q.Encode()
+}
+
+const defaultDigestTemplate = `Subject: Your {{.Interval}} meow digest
+
+Meows since {{.Since.Format "2006-01-02 15:04 MST"}}: {{.Total}} from {{.Actors}} actors
+
+Top emotions:
+{{range .TopEmotions}}  {{.Emotion}}: {{.Count}}
+{{else}}  (none)
+{{end}}
+Notable meows:
+{{range .Notable}}  {{.DID}} meowed {{if .Emotion}}{{.Emotion}} {{end}}at {{.Subject}} ({{.Count}} meows at this subject)
+{{else}}  (none)
+{{end}}
+--
+Unsubscribe: {{.UnsubscribeURL}}
+`
+
+type digestEmotionCount struct {
+	Emotion string
+	Count   int
+}
+
+type digestNotable struct {
+	MeowResponse
+	Count int
+}
+
+type digestData struct {
+	Interval       string
+	Since          time.Time
+	Total          int
+	Actors         int
+	TopEmotions    []digestEmotionCount
+	Notable        []digestNotable
+	UnsubscribeURL string
+}
+
+// buildDigest summarizes the meows since the given time. Notable meows are
+// the latest meow at each of the most meowed-at subjects. Hidden meows and
+// deprioritized actors are left out.
+func buildDigest(session *gocql.Session, since time.Time) (digestData, error) {
+	data := digestData{Since: since}
+
+	iter := session.Query(`
+		SELECT rkey, time_us, did, emotion, subject, inferred_emotion
+		FROM cat.meows
+		WHERE time_us >= ?
+		ALLOW FILTERING`,
+		since.UnixMicro(),
+	).Iter()
+
+	actors := map[string]bool{}
+	emotions := map[string]int{}
+	subjects := map[string]*digestNotable{}
+	var row meowRow
+	for iter.Scan(&row.Rkey, &row.TimeUS, &row.DID, &row.Emotion, &row.Subject, &row.InferredEmotion) {
+		m := row.meow()
+		row = meowRow{}
+		if moderation.deprioritized(m.DID) || moderation.get(m.DID, m.Rkey).hidden {
+			continue
+		}
+		data.Total++
+		actors[m.DID] = true
+		if emotion, _ := effectiveEmotion(m); emotion != "" {
+			emotions[emotion]++
+		}
+		if m.Subject != "" {
+			n, ok := subjects[m.Subject]
+			if !ok {
+				n = &digestNotable{}
+				subjects[m.Subject] = n
+			}
+			n.Count++
+			if m.TimeUS > n.TimeUS {
+				n.MeowResponse = m.response()
+			}
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return data, err
+	}
+
+	data.Actors = len(actors)
+	for emotion, n := range emotions {
+		data.TopEmotions = append(data.TopEmotions, digestEmotionCount{emotion, n})
+	}
+	sort.Slice(data.TopEmotions, func(i, j int) bool {
+		if data.TopEmotions[i].Count != data.TopEmotions[j].Count {
+			return data.TopEmotions[i].Count > data.TopEmotions[j].Count
+		}
+		return data.TopEmotions[i].Emotion < data.TopEmotions[j].Emotion
+	})
+	if len(data.TopEmotions) > 5 {
+		data.TopEmotions = data.TopEmotions[:5]
+	}
+
+	for _, n := range subjects {
+		data.Notable = append(data.Notable, *n)
+	}
+	sort.Slice(data.Notable, func(i, j int) bool {
+		if data.Notable[i].Count != data.Notable[j].Count {
+			return data.Notable[i].Count > data.Notable[j].Count
+		}
+		return data.Notable[i].TimeUS > data.Notable[j].TimeUS
+	})
+	if len(data.Notable) > 5 {
+		data.Notable = data.Notable[:5]
+	}
+
+	return data, nil
+}
+
+func isUnsubscribed(session *gocql.Session, email string) (bool, error) {
+	var unsubscribedAt time.Time
+	err := session.Query(`
+		SELECT unsubscribed_at FROM digest_unsubscribes WHERE email = ?`,
+		email,
+	).Scan(&unsubscribedAt)
+	if err == gocql.ErrNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func sendDigest(session *gocql.Session, cfg *digestConfig, tmpl *template.Template) error {
+	data, err := buildDigest(session, time.Now().Add(-cfg.period()))
+	if err != nil {
+		return err
+	}
+	data.Interval = cfg.Interval
+
+	var auth smtp.Auth
+	if cfg.SMTPUser != "" {
+		auth = smtp.PlainAuth("", cfg.SMTPUser, cfg.SMTPPass, cfg.SMTPHost)
+	}
+
+	for _, to := range cfg.Recipients {
+		unsubscribed, err := isUnsubscribed(session, to)
+		if err != nil {
+			log.Printf("digest unsubscribe lookup for %s: %v", to, err)
+			continue
+		}
+		if unsubscribed {
+			continue
+		}
+
+		data.UnsubscribeURL = cfg.unsubscribeURL(to)
+		var body bytes.Buffer
+		if err := tmpl.Execute(&body, data); err != nil {
+			return err
+		}
+
+		// the template starts with its own Subject header
+		var msg bytes.Buffer
+		fmt.Fprintf(&msg, "From: %s\r\n", cfg.From)
+		fmt.Fprintf(&msg, "To: %s\r\n", to)
+		fmt.Fprintf(&msg, "List-Unsubscribe: <%s>\r\n", data.UnsubscribeURL)
+		msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+		msg.Write(body.Bytes())
+
+		addr := cfg.SMTPHost + ":" + cfg.SMTPPort
+		if err := smtp.SendMail(addr, auth, cfg.From, []string{to}, msg.Bytes()); err != nil {
+			log.Printf("digest send to %s: %v", to, err)
+			continue
+		}
+		log.Printf("sent %s digest to %s", cfg.Interval, to)
+	}
+	return nil
+}
+
+func createDigestTables(session *gocql.Session) error {
+	return session.Query(`
+		CREATE TABLE IF NOT EXISTS digest_unsubscribes (
+			email TEXT PRIMARY KEY,
+			unsubscribed_at TIMESTAMP
+		)`).Exec()
+}
+
+// runDigest sends a digest every period, starting one period from now.
+func runDigest(session *gocql.Session, cfg *digestConfig) {
+	tmpl, err := template.New("digest").Parse(cfg.Template)
+	if err != nil {
+		log.Fatal("parse digest template:", err)
+	}
+
+	ticker := time.NewTicker(cfg.period())
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := sendDigest(session, cfg, tmpl); err != nil {
+			log.Println("digest error:", err)
+		}
+	}
+}
+
+func unsubscribeDigest(session *gocql.Session) gin.HandlerFunc {
+	cfg := digestConfigFromEnv()
+	return func(c *gin.Context) {
+		if cfg == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "digest is not enabled"})
+			return
+		}
+
+		email := strings.ToLower(c.Query("email"))
+		token := c.Query("token")
+		if email == "" || !hmac.Equal([]byte(token), []byte(cfg.unsubscribeToken(email))) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid unsubscribe link"})
+			return
+		}
+
+		err := session.Query(`
+			INSERT INTO digest_unsubscribes (email, unsubscribed_at) VALUES (?, ?)`,
+			email, time.Now(),
+		).Exec()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.String(http.StatusOK, "%s will no longer receive the meow digest.\n", email)
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gocql/gocql"
+)
+
+// Drafts are meows a viewer is still composing, stored server side so they
+// follow them across devices until they post them to their PDS. A draft is
+// only the record's fields, emotion and subject, unchecked beyond their
+// length since it may well be half written. Updates carry a version like
+// preferences, see versioned.go, so two devices editing the same draft
+// don't overwrite each other unnoticed.
+
+const (
+	// maxDraftSubjectLength bounds a draft's subject, which can be a URL
+	maxDraftSubjectLength = 2048
+)
+
+// maxDrafts caps how many drafts one viewer can keep.
+var maxDrafts = envInt("MAX_DRAFTS", 100)
+
+func createDraftTables(session *gocql.Session) error {
+	return session.Query(`
+		CREATE TABLE IF NOT EXISTS drafts (
+			viewer TEXT,
+			id TIMEUUID,
+			emotion TEXT,
+			subject TEXT,
+			created_at TIMESTAMP,
+			updated_at TIMESTAMP,
+			version INT,
+			PRIMARY KEY ((viewer), id)
+		)`).Exec()
+}
+
+type Draft struct {
+	ID        gocql.UUID `json:"id"`
+	Emotion   string     `json:"emotion"`
+	Subject   string     `json:"subject"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	// Version is bumped by every update, see versioned.go
+	Version int `json:"version"`
+}
+
+type draftRequest struct {
+	Emotion string `json:"emotion"`
+	Subject string `json:"subject"`
+	// Version, when set on an update, is the version the draft was edited
+	// from; saving fails with 409 if it has changed since.
+	Version *int `json:"version"`
+}
+
+func (req draftRequest) validate() error {
+	if len(req.Emotion) > emotionMaxLength {
+		return fmt.Errorf("emotion may be at most %d characters", emotionMaxLength)
+	}
+	if len(req.Subject) > maxDraftSubjectLength {
+		return fmt.Errorf("subject may be at most %d characters", maxDraftSubjectLength)
+	}
+	return nil
+}
+
+// draftID reads the id of the draft to update or delete.
+func draftID(c *gin.Context) (gocql.UUID, bool) {
+	id, err := gocql.ParseUUID(c.Query("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return gocql.UUID{}, false
+	}
+	return id, true
+}
+
+func createDraft(session *gocql.Session) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req draftRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid draft"})
+			return
+		}
+		if err := req.validate(); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		viewer := c.GetString("viewer")
+		var count int
+		err := session.Query(`SELECT COUNT(*) FROM drafts WHERE viewer = ?`, viewer).
+			WithContext(c.Request.Context()).Scan(&count)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if count >= maxDrafts {
+			c.JSON(http.StatusConflict, gin.H{"error": "too many drafts"})
+			return
+		}
+
+		now := time.Now().UTC()
+		d := Draft{ID: gocql.TimeUUID(), Emotion: req.Emotion, Subject: req.Subject, CreatedAt: now, UpdatedAt: now, Version: 1}
+		err = session.Query(`
+			INSERT INTO drafts (viewer, id, emotion, subject, created_at, updated_at, version)
+			VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			viewer, d.ID, d.Emotion, d.Subject, d.CreatedAt, d.UpdatedAt, d.Version,
+		).WithContext(c.Request.Context()).Exec()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, d)
+	}
+}
+
+// getDrafts lists the viewer's drafts, most recently updated first.
+func getDrafts(session *gocql.Session) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		iter := session.Query(`
+			SELECT id, emotion, subject, created_at, updated_at, version
+			FROM drafts
+			WHERE viewer = ?`,
+			c.GetString("viewer"),
+		).WithContext(c.Request.Context()).Iter()
+		drafts := []Draft{}
+		var d Draft
+		for iter.Scan(&d.ID, &d.Emotion, &d.Subject, &d.CreatedAt, &d.UpdatedAt, &d.Version) {
+			drafts = append(drafts, d)
+			d = Draft{}
+		}
+		if err := iter.Close(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		sort.Slice(drafts, func(i, j int) bool {
+			return drafts[i].UpdatedAt.After(drafts[j].UpdatedAt)
+		})
+		c.JSON(http.StatusOK, gin.H{"drafts": drafts})
+	}
+}
+
+// updateDraft replaces a draft's fields.
+func updateDraft(session *gocql.Session) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, ok := draftID(c)
+		if !ok {
+			return
+		}
+		var req draftRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid draft"})
+			return
+		}
+		if err := req.validate(); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		viewer := c.GetString("viewer")
+		var d Draft
+		read := func() error {
+			return session.Query(`
+				SELECT id, emotion, subject, created_at, updated_at, version
+				FROM drafts
+				WHERE viewer = ? AND id = ?`,
+				viewer, id,
+			).WithContext(c.Request.Context()).Scan(&d.ID, &d.Emotion, &d.Subject, &d.CreatedAt, &d.UpdatedAt, &d.Version)
+		}
+
+		now := time.Now().UTC()
+		version, err := versionedWrite(req.Version,
+			func() (int, error) {
+				err := read()
+				return d.Version, err
+			},
+			func(current int) (bool, error) {
+				cond, args := versionCondition(current)
+				return casExec(session.Query(`
+					UPDATE drafts SET emotion = ?, subject = ?, updated_at = ?, version = ?
+					WHERE viewer = ? AND id = ?`+cond,
+					append([]any{req.Emotion, req.Subject, now, current + 1, viewer, id}, args...)...,
+				).WithContext(c.Request.Context()))
+			})
+		if err == gocql.ErrNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "draft not found"})
+			return
+		}
+		if err != nil {
+			respondWriteError(c, err, nil)
+			return
+		}
+		d.Emotion, d.Subject, d.UpdatedAt, d.Version = req.Emotion, req.Subject, now, version
+		c.JSON(http.StatusOK, d)
+	}
+}
+
+// deleteDraft drops a draft, typically once it has been posted.
+func deleteDraft(session *gocql.Session) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, ok := draftID(c)
+		if !ok {
+			return
+		}
+		err := session.Query(`DELETE FROM drafts WHERE viewer = ? AND id = ?`, c.GetString("viewer"), id).
+			WithContext(c.Request.Context()).Exec()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.Status(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/baphotex/meowview/didresolve"
+	"github.com/gin-gonic/gin"
+	"github.com/gocql/gocql"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Meows are written to the author's own PDS and only reach us through the
+// firehose, usually seconds later. So that authors see their new meow in
+// getActorMeows right away, a client can call echoMeow after creating the
+// record: we read the record back from the author's PDS and insert it into
+// meows optimistically, as a local echo. When the firehose event arrives it
+// overwrites the echo and the echo is marked confirmed.
+//
+// Echoes are written with echoWriteTimestamp, older than any real write,
+// so the firehose version of a meow, or its delete, always wins even if it
+// was applied before the echo.
+const echoWriteTimestamp = 1
+
+var localEchoes = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "meowview_local_echoes_total",
+	Help: "Local echoes reconciled, by result (confirmed, purged, flagged).",
+}, []string{"result"})
+
+func createEchoTables(session *gocql.Session) error {
+	err := session.Query(`
+		CREATE TABLE IF NOT EXISTS local_echoes (
+			did TEXT,
+			rkey TEXT,
+			cid TEXT,
+			echoed_at TIMESTAMP,
+			PRIMARY KEY ((did), rkey)
+		)`).Exec()
+	if err != nil {
+		return err
+	}
+
+	// unconfirmed echoes are flagged instead of purged with
+	// ECHO_PURGE_UNCONFIRMED=false
+	return addColumn(session, "local_echoes", "flagged", "BOOLEAN")
+}
+
+// pdsEndpoint returns the base URL of the PDS hosting a DID's repo.
+func pdsEndpoint(doc *didresolve.Document) (string, error) {
+	for _, s := range doc.Service {
+		if strings.HasSuffix(s.ID, "#atproto_pds") && s.Type == "AtprotoPersonalDataServer" {
+			return strings.TrimSuffix(s.ServiceEndpoint, "/"), nil
+		}
+	}
+	return "", fmt.Errorf("%s has no atproto_pds service", doc.ID)
+}
+
+type repoRecord struct {
+	URI   string          `json:"uri"`
+	CID   string          `json:"cid"`
+	Value json.RawMessage `json:"value"`
+}
+
+// fetchMeowRecord reads a meow record straight from the author's PDS.
+// It returns nil when the record doesn't exist.
+func fetchMeowRecord(ctx context.Context, did, rkey string) (*repoRecord, error) {
+	doc, err := didResolver.Resolve(ctx, did)
+	if err != nil {
+		return nil, err
+	}
+	pds, err := pdsEndpoint(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	q := url.Values{"repo": {did}, "collection": {meowNSID}, "rkey": {rkey}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, pds+"/xrpc/com.atproto.repo.getRecord?"+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := outbound.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusBadRequest || resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("getRecord returned %s", resp.Status)
+	}
+	var rec repoRecord
+	if err := json.NewDecoder(resp.Body).Decode(&rec); err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}
+
+// echoMeow inserts the viewer's meow ?rkey= as a local echo and returns
+// it.
+func echoMeow(session *gocql.Session) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		did := c.GetString("viewer")
+		rkey := c.Query("rkey")
+		if !rkeyRegex.MatchString(rkey) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid rkey"})
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(c.Request.Context(), 10*time.Second)
+		defer cancel()
+		rec, err := fetchMeowRecord(ctx, did, rkey)
+		if err != nil {
+			c.JSON(http.StatusBadGateway, gin.H{"error": "read record from pds: " + err.Error()})
+			return
+		}
+		if rec == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "record not found on pds"})
+			return
+		}
+		record, version, err := decodeRecord(meowNSID, rec.Value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "not a meow record"})
+			return
+		}
+
+		m := Meow{DID: did, Rkey: rkey, CID: rec.CID, TimeUS: time.Now().UnixMicro(), LexiconVersion: version}
+		if record.Emotion != nil {
+			if m.Emotion, err = normalizeEmotion(*record.Emotion); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+		}
+		if record.Subject != nil {
+			m.Subject = validateSubject(*record.Subject)
+		}
+
+		batch := session.NewBatch(gocql.LoggedBatch).WithContext(c.Request.Context())
+		batch.Query(`
+			INSERT INTO meows (id, rkey, time_us, cid, did, emotion, subject, lexicon_version)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+			USING TIMESTAMP ?`,
+			meowID(did, rkey), rkey, m.TimeUS, m.CID, did, nullString(m.Emotion), nullString(m.Subject), nullInt(version),
+			echoWriteTimestamp,
+		)
+		batch.Query(`INSERT INTO local_echoes (did, rkey, cid, echoed_at) VALUES (?, ?, ?, ?)`,
+			did, rkey, m.CID, time.Now())
+		if err := session.ExecuteBatch(batch); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, m.response())
+	}
+}
+
+// confirmEcho drops the pending echo of a meow the firehose delivered.
+func confirmEcho(session *gocql.Session, did, rkey string) {
+	err := session.Query(`DELETE FROM local_echoes WHERE did = ? AND rkey = ?`, did, rkey).Exec()
+	if err != nil {
+		log.Println("confirm local echo error:", err)
+	}
+}
+
+type LocalEcho struct {
+	DID      string    `json:"did"`
+	Rkey     string    `json:"rkey"`
+	CID      string    `json:"cid"`
+	EchoedAt time.Time `json:"echoed_at"`
+	Flagged  bool      `json:"flagged"`
+}
+
+func listEchoes(ctx context.Context, session *gocql.Session) ([]LocalEcho, error) {
+	iter := session.Query(`SELECT did, rkey, cid, echoed_at, flagged FROM local_echoes`).WithContext(ctx).Iter()
+	echoes := []LocalEcho{}
+	var e LocalEcho
+	for iter.Scan(&e.DID, &e.Rkey, &e.CID, &e.EchoedAt, &e.Flagged) {
+		echoes = append(echoes, e)
+		e = LocalEcho{}
+	}
+	return echoes, iter.Close()
+}
+
+// runEchoReconciler settles echoes older than ECHO_CONFIRM_TIMEOUT every
+// ECHO_RECONCILE_INTERVAL. An echo counts as confirmed once its meows row
+// was written by anything but the echo itself, which also covers firehose
+// events that arrived before the echo. Unconfirmed echoes are purged, or
+// only flagged with ECHO_PURGE_UNCONFIRMED=false.
+func runEchoReconciler(session *gocql.Session) {
+	timeout := envDuration("ECHO_CONFIRM_TIMEOUT", 5*time.Minute)
+	purge := envBool("ECHO_PURGE_UNCONFIRMED", true)
+	ticker := time.NewTicker(envDuration("ECHO_RECONCILE_INTERVAL", time.Minute))
+	defer ticker.Stop()
+	for range ticker.C {
+		echoes, err := listEchoes(context.Background(), session)
+		if err != nil {
+			log.Println("list local echoes error:", err)
+			continue
+		}
+		for _, e := range echoes {
+			if e.Flagged || time.Since(e.EchoedAt) < timeout {
+				continue
+			}
+			if err := reconcileEcho(session, e, purge); err != nil {
+				log.Printf("reconcile local echo %s/%s: %v", e.DID, e.Rkey, err)
+			}
+		}
+	}
+}
+
+func reconcileEcho(session *gocql.Session, e LocalEcho, purge bool) error {
+	var written int64
+	err := session.Query(`SELECT WRITETIME(cid) FROM meows WHERE id = ?`, meowID(e.DID, e.Rkey)).Scan(&written)
+	if err != nil && err != gocql.ErrNotFound {
+		return err
+	}
+	// a missing row was deleted by the firehose, so it was confirmed too
+	if err == gocql.ErrNotFound || written > echoWriteTimestamp {
+		localEchoes.WithLabelValues("confirmed").Inc()
+		confirmEcho(session, e.DID, e.Rkey)
+		return nil
+	}
+
+	log.Printf("local echo %s/%s was never confirmed by the firehose", e.DID, e.Rkey)
+	if !purge {
+		localEchoes.WithLabelValues("flagged").Inc()
+		return session.Query(`UPDATE local_echoes SET flagged = true WHERE did = ? AND rkey = ?`, e.DID, e.Rkey).Exec()
+	}
+	localEchoes.WithLabelValues("purged").Inc()
+	batch := session.NewBatch(gocql.LoggedBatch)
+	// at the echo's own timestamp, so a late firehose write still wins
+	batch.Query(`DELETE FROM meows USING TIMESTAMP ? WHERE id = ?`, echoWriteTimestamp, meowID(e.DID, e.Rkey))
+	batch.Query(`DELETE FROM local_echoes WHERE did = ? AND rkey = ?`, e.DID, e.Rkey)
+	return session.ExecuteBatch(batch)
+}
+
+// getLocalEchoes lists echoes still waiting for the firehose, and flagged
+// ones. It reads the whole table, so the list is streamed.
+func getLocalEchoes(session *gocql.Session) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		stream := newListStream(c, "echoes")
+		iter := session.Query(`SELECT did, rkey, cid, echoed_at, flagged FROM local_echoes`).
+			WithContext(c.Request.Context()).Iter()
+		var e LocalEcho
+		for iter.Scan(&e.DID, &e.Rkey, &e.CID, &e.EchoedAt, &e.Flagged) {
+			if err := stream.add(e); err != nil {
+				iter.Close()
+				stream.fail(http.StatusInternalServerError, err)
+				return
+			}
+			e = LocalEcho{}
+		}
+		if err := iter.Close(); err != nil {
+			stream.fail(http.StatusInternalServerError, err)
+			return
+		}
+		stream.finish(nil)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gocql/gocql"
+)
+
+// actorsByEmotionMaxWindow is the widest ?window= of getActorsByEmotion.
+// Rows expire a day after it.
+var actorsByEmotionMaxWindow = envDuration("ACTORS_BY_EMOTION_MAX_WINDOW", 7*24*time.Hour)
+
+var actorsByEmotionGuardrail = newGuardrail("actors_by_emotion", 50, 500, 0, 0)
+
+// createEmotionActorTables creates actors_by_emotion, one row per actor
+// and day an emotion was expressed on, holding the actor's latest meow
+// with it. Partitioning by day keeps a popular emotion's partitions small
+// and lets a window read only the days it covers.
+func createEmotionActorTables(session *gocql.Session) error {
+	return session.Query(`
+		CREATE TABLE IF NOT EXISTS actors_by_emotion (
+			emotion TEXT,
+			day TEXT,
+			did TEXT,
+			time_us BIGINT,
+			rkey TEXT,
+			inferred BOOLEAN,
+			PRIMARY KEY ((emotion, day), did)
+		)`).Exec()
+}
+
+// indexEmotionActor records that m's author expressed its effective
+// emotion. The write is timestamped with the meow's time, so a replayed
+// older meow doesn't replace a newer one.
+func indexEmotionActor(session *gocql.Session, m Meow) {
+	emotion, inferred := effectiveEmotion(m)
+	if emotion == "" {
+		return
+	}
+	ttl := int((actorsByEmotionMaxWindow + 24*time.Hour).Seconds())
+	err := session.Query(`
+		INSERT INTO actors_by_emotion (emotion, day, did, time_us, rkey, inferred)
+		VALUES (?, ?, ?, ?, ?, ?)
+		USING TTL ? AND TIMESTAMP ?`,
+		emotion, eventDay(m.TimeUS), m.DID, m.TimeUS, m.Rkey, inferred, ttl, m.TimeUS,
+	).Exec()
+	if err != nil {
+		log.Println("insert actors_by_emotion error:", err)
+	}
+}
+
+type EmotionActor struct {
+	DID string `json:"did"`
+	// TimeUS and Rkey are of the actor's latest meow with the emotion
+	TimeUS    int64  `json:"time_us"`
+	IndexedAt string `json:"indexedAt"`
+	Rkey      string `json:"rkey"`
+	Inferred  bool   `json:"inferred,omitempty"`
+}
+
+type ActorsByEmotionResponse struct {
+	Emotion string         `json:"emotion"`
+	Window  string         `json:"window"`
+	Actors  []EmotionActor `json:"actors"`
+}
+
+// getActorsByEmotion lists the distinct actors who expressed an emotion
+// within the window, most recent first. Deprioritized actors are left out
+// as on the other global endpoints.
+func getActorsByEmotion(session *gocql.Session) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		emotion := strings.ToLower(strings.TrimSpace(c.Query("emotion")))
+		if emotion == "" || len(emotion) > emotionMaxLength {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid emotion"})
+			return
+		}
+		window, err := time.ParseDuration(c.DefaultQuery("window", "24h"))
+		if err != nil || window <= 0 || window > actorsByEmotionMaxWindow {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("window must be a duration up to %s", actorsByEmotionMaxWindow)})
+			return
+		}
+		limit, err := actorsByEmotionGuardrail.parseLimit(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		now := time.Now()
+		since := now.Add(-window)
+		latest := map[string]EmotionActor{}
+		for day := since.UTC().Truncate(24 * time.Hour); !day.After(now); day = day.AddDate(0, 0, 1) {
+			iter := session.Query(`
+				SELECT did, time_us, rkey, inferred
+				FROM cat.actors_by_emotion
+				WHERE emotion = ? AND day = ?`,
+				emotion, day.Format("2006-01-02"),
+			).WithContext(c.Request.Context()).Iter()
+			var a EmotionActor
+			for iter.Scan(&a.DID, &a.TimeUS, &a.Rkey, &a.Inferred) {
+				if a.TimeUS >= since.UnixMicro() && a.TimeUS > latest[a.DID].TimeUS && !moderation.deprioritized(a.DID) {
+					latest[a.DID] = a
+				}
+				a = EmotionActor{}
+			}
+			if err := iter.Close(); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+		}
+
+		actors := make([]EmotionActor, 0, len(latest))
+		for _, a := range latest {
+			a.IndexedAt = indexedAt(a.TimeUS)
+			actors = append(actors, a)
+		}
+		sort.Slice(actors, func(i, j int) bool {
+			if actors[i].TimeUS != actors[j].TimeUS {
+				return actors[i].TimeUS > actors[j].TimeUS
+			}
+			return actors[i].DID < actors[j].DID
+		})
+		if len(actors) > limit {
+			actors = actors[:limit]
+		}
+		c.JSON(http.StatusOK, ActorsByEmotionResponse{Emotion: emotion, Window: window.String(), Actors: actors})
+	}
+}
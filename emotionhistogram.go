@@ -0,0 +1,261 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	// tz names are resolved without the system's zoneinfo, which the
+	// image doesn't have
+	_ "time/tzdata"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gocql/gocql"
+)
+
+// The global emotion histogram is pre-aggregated at ingest into counters
+// per UTC hour and per UTC day, each a partition of emotion_histogram keyed
+// by its period: "2006-01-02" for a day, "2006-01-02T15" for an hour.
+// getEmotionHistogram merges them into buckets of any whole number of
+// hours, reading a day's counters where a bucket covers the whole day and
+// hourly ones at its edges.
+//
+// With tz, an IANA zone like America/New_York, buckets of days start at
+// midnight there and last from one midnight to the next across DST
+// changes. They are merged from the hourly counters, and the UTC days
+// they cover whole, so the zone has to be a whole number of hours from
+// UTC.
+
+var (
+	// emotionHistogramMaxRange is the widest since/until window
+	emotionHistogramMaxRange = envDuration("EMOTION_HISTOGRAM_MAX_RANGE", 366*24*time.Hour)
+	// emotionHistogramMaxBuckets caps how many buckets one request returns
+	emotionHistogramMaxBuckets = envInt("EMOTION_HISTOGRAM_MAX_BUCKETS", 1000)
+)
+
+// histogramPeriodsPerQuery bounds the IN list of one counter read.
+const histogramPeriodsPerQuery = 100
+
+func createEmotionHistogramTables(session *gocql.Session) error {
+	return session.Query(`
+		CREATE TABLE IF NOT EXISTS emotion_histogram (
+			period TEXT,
+			emotion TEXT,
+			meows COUNTER,
+			PRIMARY KEY ((period), emotion)
+		)`).Exec()
+}
+
+func histogramDay(t time.Time) string  { return t.UTC().Format("2006-01-02") }
+func histogramHour(t time.Time) string { return t.UTC().Format("2006-01-02T15") }
+
+// countEmotionHistogram adds delta to the hour and the day of m under its
+// effective emotion.
+func countEmotionHistogram(session *gocql.Session, m Meow, delta int64) {
+	emotion, _ := effectiveEmotion(m)
+	if emotion == "" {
+		return
+	}
+	t := time.UnixMicro(m.TimeUS)
+	for _, period := range []string{histogramHour(t), histogramDay(t)} {
+		err := session.Query(`
+			UPDATE emotion_histogram SET meows = meows + ?
+			WHERE period = ? AND emotion = ?`,
+			delta, period, emotion,
+		).Exec()
+		if err != nil {
+			log.Println("update emotion_histogram error:", err)
+		}
+	}
+}
+
+// parseHistogramBucket reads a bucket size: a Go duration or a number of
+// days like 1d, in whole hours.
+func parseHistogramBucket(v string) (time.Duration, error) {
+	var d time.Duration
+	if days, ok := strings.CutSuffix(v, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, fmt.Errorf("invalid bucket")
+		}
+		d = time.Duration(n) * 24 * time.Hour
+	} else {
+		var err error
+		if d, err = time.ParseDuration(v); err != nil {
+			return 0, fmt.Errorf("invalid bucket")
+		}
+	}
+	if d < time.Hour || d%time.Hour != 0 {
+		return 0, fmt.Errorf("bucket must be a whole number of hours, e.g. 1h, 6h or 1d")
+	}
+	return d, nil
+}
+
+type EmotionHistogramBucket struct {
+	// Start is the bucket's start as an RFC 3339 timestamp in the
+	// requested tz, UTC by default
+	Start    string           `json:"start"`
+	Total    int64            `json:"total"`
+	Emotions map[string]int64 `json:"emotions"`
+}
+
+type EmotionHistogram struct {
+	// Since and Until are the requested range rounded out to whole hours,
+	// or whole days in TZ for buckets of days
+	Since  string `json:"since"`
+	Until  string `json:"until"`
+	Bucket string `json:"bucket"`
+	TZ     string `json:"tz"`
+	// Total and Emotions sum up every bucket
+	Total    int64                    `json:"total"`
+	Emotions map[string]int64         `json:"emotions"`
+	Buckets  []EmotionHistogramBucket `json:"buckets"`
+}
+
+// getEmotionHistogram returns how many meows carried each emotion, the
+// inferred one for meows without, per bucket between since (default a
+// week before until) and until (default now), oldest bucket first. The
+// last bucket is cut short at until.
+func getEmotionHistogram(session *gocql.Session) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		bucket, err := parseHistogramBucket(c.DefaultQuery("bucket", "1d"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		since, hasSince, err := parseTimeUS(c, "since")
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		until, hasUntil, err := parseTimeUS(c, "until")
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if !hasUntil {
+			until = time.Now().UnixMicro()
+		}
+		if !hasSince {
+			since = until - (7 * 24 * time.Hour).Microseconds()
+		}
+		loc := time.UTC
+		if v := c.Query("tz"); v != "" {
+			if loc, err = time.LoadLocation(v); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "unknown tz " + v})
+				return
+			}
+		}
+
+		days := int(bucket / (24 * time.Hour))
+		if bucket%(24*time.Hour) != 0 {
+			days = 0
+		}
+		from := time.UnixMicro(since).In(loc).Truncate(time.Hour)
+		to := time.UnixMicro(until).In(loc)
+		if days > 0 {
+			from = localMidnight(from)
+			if midnight := localMidnight(to); !midnight.Equal(to) {
+				to = midnight.AddDate(0, 0, 1)
+			}
+		} else if aligned := to.Truncate(time.Hour); !aligned.Equal(to) {
+			to = aligned.Add(time.Hour)
+		}
+		if !wholeHourOffset(from) || !wholeHourOffset(to) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "tz must be a whole number of hours from UTC"})
+			return
+		}
+		if !from.Before(to) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "since must be before until"})
+			return
+		}
+		if to.Sub(from) > emotionHistogramMaxRange {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("time range may span at most %s", emotionHistogramMaxRange)})
+			return
+		}
+		if n := (to.Sub(from) + bucket - 1) / bucket; int(n) > emotionHistogramMaxBuckets {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("at most %d buckets, use a larger bucket", emotionHistogramMaxBuckets)})
+			return
+		}
+
+		h := EmotionHistogram{
+			Since:    from.Format(time.RFC3339),
+			Until:    to.Format(time.RFC3339),
+			Bucket:   c.DefaultQuery("bucket", "1d"),
+			TZ:       loc.String(),
+			Emotions: map[string]int64{},
+			Buckets:  []EmotionHistogramBucket{},
+		}
+		for start := from; start.Before(to); {
+			end := start.Add(bucket)
+			if days > 0 {
+				// a day in tz isn't always 24 hours
+				end = start.AddDate(0, 0, days)
+			}
+			if end.After(to) {
+				end = to
+			}
+			b := EmotionHistogramBucket{Start: start.Format(time.RFC3339), Emotions: map[string]int64{}}
+			var periods []string
+			for t := start.UTC(); t.Before(end); {
+				period, step := histogramHour(t), time.Hour
+				if t.Equal(t.Truncate(24*time.Hour)) && !t.Add(24*time.Hour).After(end) {
+					period, step = histogramDay(t), 24*time.Hour
+				}
+				periods = append(periods, period)
+				t = t.Add(step)
+			}
+			if err := readHistogramPeriods(c, session, periods, b.Emotions); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			for emotion, n := range b.Emotions {
+				// every meow with it was deleted
+				if n <= 0 {
+					delete(b.Emotions, emotion)
+					continue
+				}
+				b.Total += n
+				h.Emotions[emotion] += n
+			}
+			h.Total += b.Total
+			h.Buckets = append(h.Buckets, b)
+			start = end
+		}
+		c.JSON(http.StatusOK, h)
+	}
+}
+
+// readHistogramPeriods adds the counters of hours and days to into.
+func readHistogramPeriods(c *gin.Context, session *gocql.Session, periods []string, into map[string]int64) error {
+	for len(periods) > 0 {
+		n := min(len(periods), histogramPeriodsPerQuery)
+		iter := session.Query(`SELECT emotion, meows FROM cat.emotion_histogram WHERE period IN ?`, periods[:n]).
+			WithContext(c.Request.Context()).Iter()
+		var emotion string
+		var meows int64
+		for iter.Scan(&emotion, &meows) {
+			into[emotion] += meows
+		}
+		if err := iter.Close(); err != nil {
+			return err
+		}
+		periods = periods[n:]
+	}
+	return nil
+}
+
+// localMidnight is the start of t's day in its location.
+func localMidnight(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+}
+
+// wholeHourOffset reports whether t's zone is a whole number of hours from
+// UTC there, so its hours line up with the hourly counters.
+func wholeHourOffset(t time.Time) bool {
+	_, offset := t.Zone()
+	return offset%3600 == 0
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"hash/fnv"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gocql/gocql"
+)
+
+// emotionBuckets spreads emotion_vocabulary over a fixed number of
+// partitions, so none grows with the vocabulary and a refresh knows
+// which to read.
+const emotionBuckets = 16
+
+var suggestEmotionsGuardrail = newGuardrail("suggest_emotions", 10, emotionTrieTop, 0, 0)
+
+func createEmotionVocabularyTables(session *gocql.Session) error {
+	return session.Query(`
+		CREATE TABLE IF NOT EXISTS emotion_vocabulary (
+			bucket INT,
+			emotion TEXT,
+			meows COUNTER,
+			PRIMARY KEY ((bucket), emotion)
+		)`).Exec()
+}
+
+func emotionBucket(emotion string) int {
+	h := fnv.New32a()
+	h.Write([]byte(emotion))
+	return int(h.Sum32() % emotionBuckets)
+}
+
+// countEmotionVocabulary adds delta to the meows with m's effective
+// emotion.
+func countEmotionVocabulary(session *gocql.Session, m Meow, delta int64) {
+	emotion, _ := effectiveEmotion(m)
+	if emotion == "" {
+		return
+	}
+	err := session.Query(`
+		UPDATE emotion_vocabulary SET meows = meows + ?
+		WHERE bucket = ? AND emotion = ?`,
+		delta, emotionBucket(emotion), emotion,
+	).Exec()
+	if err != nil {
+		log.Println("update emotion_vocabulary error:", err)
+	}
+}
+
+type EmotionSuggestion struct {
+	Emotion string `json:"emotion"`
+	Meows   int64  `json:"meows"`
+}
+
+type SuggestEmotionsResponse struct {
+	Emotions []EmotionSuggestion `json:"emotions"`
+}
+
+// emotionTrie holds the vocabulary by prefix. Every node keeps its
+// subtree's emotions, most used first, so a lookup is a walk down the
+// prefix.
+type emotionTrie struct {
+	children map[rune]*emotionTrie
+	top      []EmotionSuggestion
+}
+
+// emotionTrieTop is how many emotions a node keeps. A suggestEmotions
+// limit above it gets no more.
+const emotionTrieTop = 50
+
+func buildEmotionTrie(vocabulary []EmotionSuggestion) *emotionTrie {
+	sort.Slice(vocabulary, func(i, j int) bool {
+		if vocabulary[i].Meows != vocabulary[j].Meows {
+			return vocabulary[i].Meows > vocabulary[j].Meows
+		}
+		return vocabulary[i].Emotion < vocabulary[j].Emotion
+	})
+	root := &emotionTrie{children: map[rune]*emotionTrie{}}
+	for _, s := range vocabulary {
+		// most used first, so a full node has seen everything it keeps
+		node := root
+		if len(node.top) < emotionTrieTop {
+			node.top = append(node.top, s)
+		}
+		for _, r := range s.Emotion {
+			child := node.children[r]
+			if child == nil {
+				child = &emotionTrie{children: map[rune]*emotionTrie{}}
+				node.children[r] = child
+			}
+			node = child
+			if len(node.top) < emotionTrieTop {
+				node.top = append(node.top, s)
+			}
+		}
+	}
+	return root
+}
+
+func (t *emotionTrie) lookup(prefix string) []EmotionSuggestion {
+	node := t
+	for _, r := range prefix {
+		if node = node.children[r]; node == nil {
+			return nil
+		}
+	}
+	return node.top
+}
+
+// emotionVocabulary is the in-memory trie behind suggestEmotions,
+// rebuilt from emotion_vocabulary every EMOTION_SUGGEST_REFRESH.
+type emotionVocabulary struct {
+	mu   sync.RWMutex
+	trie *emotionTrie
+}
+
+var emotionSuggestions = &emotionVocabulary{trie: buildEmotionTrie(nil)}
+
+func (v *emotionVocabulary) load(session *gocql.Session) error {
+	var vocabulary []EmotionSuggestion
+	for bucket := 0; bucket < emotionBuckets; bucket++ {
+		iter := session.Query(`SELECT emotion, meows FROM emotion_vocabulary WHERE bucket = ?`, bucket).Iter()
+		var s EmotionSuggestion
+		for iter.Scan(&s.Emotion, &s.Meows) {
+			// every meow with it was deleted
+			if s.Meows > 0 {
+				vocabulary = append(vocabulary, s)
+			}
+		}
+		if err := iter.Close(); err != nil {
+			return err
+		}
+	}
+	trie := buildEmotionTrie(vocabulary)
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.trie = trie
+	return nil
+}
+
+func (v *emotionVocabulary) run(session *gocql.Session) {
+	ticker := time.NewTicker(envDuration("EMOTION_SUGGEST_REFRESH", 5*time.Minute))
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := v.load(session); err != nil {
+			log.Println("load emotion vocabulary error:", err)
+		}
+	}
+}
+
+func (v *emotionVocabulary) suggest(prefix string, limit int) []EmotionSuggestion {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	top := v.trie.lookup(prefix)
+	return append([]EmotionSuggestion{}, top[:min(limit, len(top))]...)
+}
+
+// suggestEmotions completes an emotion prefix from the emotions meows
+// have been indexed with, most used first. An empty prefix lists the most
+// used overall. The vocabulary is refreshed in the background, so a new
+// emotion shows up after a few minutes.
+func suggestEmotions(c *gin.Context) {
+	q := strings.ToLower(strings.TrimSpace(c.Query("q")))
+	if len(q) > emotionMaxLength {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "q is too long"})
+		return
+	}
+	limit, err := suggestEmotionsGuardrail.parseLimit(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, SuggestEmotionsResponse{Emotions: emotionSuggestions.suggest(q, limit)})
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/gocql/gocql"
+	"github.com/google/uuid"
+)
+
+// meowEvent is one ingested operation as stored in meow_events. It keeps
+// the raw record next to the values resolved at ingest (validated subject,
+// inferred emotion), so replaying events doesn't depend on the classifier
+// or on DID documents that may have changed since.
+type meowEvent struct {
+	Meow
+	Op     string
+	Rev    string
+	Record string
+	// Source is empty for events from jetstream, else the cursor name of
+	// the subscription that read it, e.g. "pds:<host>", see pdsstream.go.
+	// Only jetstream's time_us is a jetstream cursor.
+	Source string `json:",omitempty"`
+}
+
+// createEventTables creates the append-only operation log. Events are
+// bucketed by UTC day of their jetstream time_us and ordered within a day
+// by (time_us, did, rkey), the order jetstream delivered them in.
+func createEventTables(session *gocql.Session) error {
+	err := session.Query(`
+		CREATE TABLE IF NOT EXISTS meow_events (
+			day TEXT,
+			time_us BIGINT,
+			did TEXT,
+			rkey TEXT,
+			op TEXT,
+			rev TEXT,
+			cid TEXT,
+			record TEXT,
+			emotion TEXT,
+			subject TEXT,
+			inferred_emotion TEXT,
+			ingested_at TIMESTAMP,
+			seq BIGINT,
+			PRIMARY KEY ((day), time_us, did, rkey)
+		) WITH CLUSTERING ORDER BY (time_us ASC, did ASC, rkey ASC)`).Exec()
+	if err != nil {
+		return err
+	}
+
+	// tables created before sequence numbers existed lack the column
+	if err := addColumn(session, "meow_events", "seq", "BIGINT"); err != nil {
+		return err
+	}
+	if err := addColumn(session, "meow_events", "lexicon_version", "INT"); err != nil {
+		return err
+	}
+
+	// the rev of the latest operation applied to each record, deletes
+	// included, see alreadyApplied
+	return session.Query(`
+		CREATE TABLE IF NOT EXISTS meow_revs (
+			did TEXT,
+			rkey TEXT,
+			rev TEXT,
+			PRIMARY KEY ((did, rkey))
+		)`).Exec()
+}
+
+func eventDay(timeUS int64) string {
+	return time.UnixMicro(timeUS).UTC().Format("2006-01-02")
+}
+
+// appendEvent logs an operation before it is applied, so a failed write to
+// meows can be repaired by reprocessing.
+func appendEvent(session *gocql.Session, ev meowEvent) error {
+	return session.Query(`
+		INSERT INTO meow_events (day, time_us, did, rkey, op, rev, cid, record, emotion, subject, inferred_emotion, ingested_at, seq, lexicon_version)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		eventDay(ev.TimeUS), ev.TimeUS, ev.DID, ev.Rkey, ev.Op, ev.Rev, ev.CID, ev.Record,
+		ev.Emotion, ev.Subject, ev.InferredEmotion, time.Now(), ev.Seq, nullInt(ev.LexiconVersion),
+	).Exec()
+}
+
+// meowID is the meows primary key for a record: a UUIDv5 of the record's
+// AT URI. An update overwrites the row, replaying or re-delivering an event
+// is idempotent, and a single meow is read by its key instead of through
+// the secondary indexes. Rows written before it are moved by rekeyMeows.
+func meowID(did, rkey string) gocql.UUID {
+	return gocql.UUID(uuid.NewSHA1(uuid.NameSpaceURL, []byte(meowURI(did, rkey))))
+}
+
+func nullString(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
+func nullInt(n int) *int {
+	if n == 0 {
+		return nil
+	}
+	return &n
+}
+
+// applyEvent writes an operation into meows and the derived tables. With
+// notify set it also queues the operation in the outbox, atomically with
+// the meows write. It reports whether this call counted the meow, which
+// only one region and one delivery of a create or update does, see
+// claimCount.
+func applyEvent(session *gocql.Session, ev meowEvent, notify bool) (bool, error) {
+	batch := session.NewBatch(gocql.LoggedBatch)
+	// the rev orders writes from several regions, see region.go. A rev from
+	// a skewed clock in the future would outlive the outbox delete.
+	if ts, ok := revTimestamp(ev.Rev); ok {
+		batch.WithTimestamp(min(ts, time.Now().UnixMicro()))
+	}
+	if notify {
+		if err := addOutboxEntries(batch, ev); err != nil {
+			return false, fmt.Errorf("outbox: %w", err)
+		}
+	}
+
+	// written with the rev's timestamp, so it only ever moves forward
+	if ev.Rev != "" {
+		batch.Query(`INSERT INTO meow_revs (did, rkey, rev) VALUES (?, ?, ?)`, ev.DID, ev.Rkey, ev.Rev)
+	}
+
+	switch ev.Op {
+	case "create", "update":
+		if ev.Op == "update" {
+			removeDerivedMeows(session, ev.DID, ev.Rkey)
+		}
+		batch.Query(`
+			INSERT INTO meows (id, rkey, time_us, cid, did, emotion, subject, inferred_emotion, seq, lexicon_version)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			meowID(ev.DID, ev.Rkey),
+			ev.Rkey,
+			ev.TimeUS,
+			ev.CID,
+			ev.DID,
+			nullString(ev.Emotion),
+			nullString(ev.Subject),
+			nullString(ev.InferredEmotion),
+			ev.Seq,
+			nullInt(ev.LexiconVersion),
+		)
+		if err := session.ExecuteBatch(batch); err != nil {
+			return false, fmt.Errorf("insert: %w", err)
+		}
+		m := ev.Meow
+		m.TimeUS = derivedTimeUS(ev)
+		return indexDerivedMeow(session, m), nil
+
+	case "delete":
+		// see deletegrace.go
+		if err := holdDeletedMeow(session, batch, ev.DID, ev.Rkey); err != nil {
+			return false, fmt.Errorf("hold delete: %w", err)
+		}
+		removeDerivedMeows(session, ev.DID, ev.Rkey)
+		batch.Query(`DELETE FROM meows WHERE id = ?`, meowID(ev.DID, ev.Rkey))
+		if err := session.ExecuteBatch(batch); err != nil {
+			return false, fmt.Errorf("delete: %w", err)
+		}
+
+	default:
+		return false, fmt.Errorf("unknown operation: %s", ev.Op)
+	}
+	return false, nil
+}
+
+// alreadyApplied reports whether meows already reflects ev, for events
+// that may be delivered again: an operation at ev's rev or a later one was
+// applied to the record, see meow_revs. Events without a rev, and records
+// last written before meow_revs, fall back to the CID: the meow has ev's
+// CID, or is gone for a delete. Applying those again would count them
+// twice, or write a deleted meow's derived rows back.
+func alreadyApplied(session *gocql.Session, ev meowEvent) bool {
+	if ev.Rev != "" {
+		var rev string
+		err := session.Query(`SELECT rev FROM meow_revs WHERE did = ? AND rkey = ?`, ev.DID, ev.Rkey).Scan(&rev)
+		switch {
+		case err == nil:
+			// revs are TIDs, which sort as strings
+			return ev.Rev <= rev
+		case err != gocql.ErrNotFound:
+			log.Println("read meow_revs:", err)
+			return false
+		}
+	}
+
+	var cid string
+	err := session.Query(`SELECT cid FROM meows WHERE id = ?`, meowID(ev.DID, ev.Rkey)).Scan(&cid)
+	switch {
+	case err == nil:
+		return ev.Op != "delete" && cid == ev.CID
+	case err == gocql.ErrNotFound:
+		return ev.Op == "delete"
+	}
+	log.Println("read replayed meow:", err)
+	return false
+}
+
+// runReprocess replays meow_events from a given day onwards into meows and
+// the derived tables, e.g. after changing how derived tables are built.
+// Replayed events are not sent to the outbox again. Events from before
+// lexicon versions were stored get the revision their record decodes as.
+func runReprocess(args []string) {
+	fs := flag.NewFlagSet("reprocess", flag.ExitOnError)
+	from := fs.String("from", "", "first day to replay, as YYYY-MM-DD (UTC)")
+	fs.Parse(args)
+	start, err := time.Parse("2006-01-02", *from)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "usage: meowview reprocess --from=YYYY-MM-DD")
+		os.Exit(2)
+	}
+
+	cassandraHost := getenv("CASSANDRA_HOST")
+	if cassandraHost == "" {
+		cassandraHost = "127.0.0.1"
+	}
+	cluster := gocql.NewCluster(cassandraHost)
+	cluster.Timeout = 10 * time.Second
+	cluster.ProtoVersion = 4
+	configureAuth(cluster)
+	cluster.Keyspace = "cat"
+	session, err := cluster.CreateSession()
+	if err != nil {
+		log.Fatal("cassandra session:", err)
+	}
+	defer session.Close()
+
+	today := eventDay(time.Now().UnixMicro())
+	var applied, failed int
+	for day := start; day.Format("2006-01-02") <= today; day = day.AddDate(0, 0, 1) {
+		iter := session.Query(`
+			SELECT time_us, did, rkey, op, rev, cid, record, emotion, subject, inferred_emotion, lexicon_version
+			FROM meow_events
+			WHERE day = ?`,
+			day.Format("2006-01-02"),
+		).Iter()
+
+		var ev meowEvent
+		for iter.Scan(&ev.TimeUS, &ev.DID, &ev.Rkey, &ev.Op, &ev.Rev, &ev.CID, &ev.Record, &ev.Emotion, &ev.Subject, &ev.InferredEmotion, &ev.LexiconVersion) {
+			if ev.LexiconVersion == 0 && ev.Record != "" {
+				_, ev.LexiconVersion, _ = decodeRecord(meowNSID, []byte(ev.Record))
+			}
+			if _, err := applyEvent(session, ev, false); err != nil {
+				log.Printf("reprocess %s/%s at %d: %v", ev.DID, ev.Rkey, ev.TimeUS, err)
+				failed++
+			} else {
+				applied++
+			}
+			ev = meowEvent{}
+		}
+		if err := iter.Close(); err != nil {
+			log.Fatal("read meow_events:", err)
+		}
+	}
+	log.Printf("reprocessed %d events, %d failed", applied, failed)
+}
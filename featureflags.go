@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Experimental subsystems sit behind feature flags, so a deployment can
+// switch them on gradually and off again without a redeploy. FEATURE_FLAGS
+// sets them, e.g. "streaming=false,meowCards=true", and is reloaded with
+// the rest of the config, see reload.go. POST /_admin/setFeatureFlag
+// overrides a flag on this instance until the override is cleared or the
+// process restarts. The routes of a flag that is off answer 404, and
+// getServerInfo lists the flags and only the features that are on.
+type featureFlag struct {
+	name        string
+	description string
+	def         bool
+}
+
+var featureFlags = []featureFlag{
+	{"streaming", "live changes as server-sent events, subscribeMeows", true},
+	{"rebroadcast", "jetstream-compatible rebroadcast at /subscribe", true},
+	{"relatedMeows", "getRelatedMeows", true},
+	{"emotionTransitions", "getEmotionTransitions", true},
+	{"meowCards", "og:image cards, getMeowCard", true},
+}
+
+var flags = struct {
+	sync.Mutex
+	configured map[string]bool
+	overrides  map[string]bool
+}{configured: map[string]bool{}, overrides: map[string]bool{}}
+
+func lookupFeatureFlag(name string) (featureFlag, bool) {
+	for _, f := range featureFlags {
+		if f.name == name {
+			return f, true
+		}
+	}
+	return featureFlag{}, false
+}
+
+// featureEnabled reports whether a flag is on: its override, else its
+// configured value, else its default. Features without a flag are on.
+func featureEnabled(name string) bool {
+	f, ok := lookupFeatureFlag(name)
+	if !ok {
+		return true
+	}
+	flags.Lock()
+	defer flags.Unlock()
+	if on, ok := flags.overrides[name]; ok {
+		return on
+	}
+	if on, ok := flags.configured[name]; ok {
+		return on
+	}
+	return f.def
+}
+
+// requireFeature answers 404 while the flag is off.
+func requireFeature(name string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !featureEnabled(name) {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": name + " is switched off"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// parseFeatureFlags reads "name=bool" entries.
+func parseFeatureFlags(entries []string) (map[string]bool, error) {
+	out := map[string]bool{}
+	for _, e := range entries {
+		name, value, ok := strings.Cut(e, "=")
+		if !ok {
+			return nil, fmt.Errorf("FEATURE_FLAGS: %q is not name=true or name=false", e)
+		}
+		if _, ok := lookupFeatureFlag(name); !ok {
+			return nil, fmt.Errorf("FEATURE_FLAGS: unknown flag %q", name)
+		}
+		on, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("FEATURE_FLAGS: %s: %v", name, err)
+		}
+		out[name] = on
+	}
+	return out, nil
+}
+
+func reloadFeatureFlags() (func(), error) {
+	configured, err := parseFeatureFlags(envList("FEATURE_FLAGS"))
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		flags.Lock()
+		defer flags.Unlock()
+		flags.configured = configured
+	}, nil
+}
+
+// featureFlagStates maps every flag to whether it is on.
+func featureFlagStates() map[string]bool {
+	out := make(map[string]bool, len(featureFlags))
+	for _, f := range featureFlags {
+		out[f.name] = featureEnabled(f.name)
+	}
+	return out
+}
+
+type FeatureFlag struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Enabled     bool   `json:"enabled"`
+	Default     bool   `json:"default"`
+	// Configured is set by FEATURE_FLAGS, Override by setFeatureFlag
+	Configured *bool `json:"configured,omitempty"`
+	Override   *bool `json:"override,omitempty"`
+}
+
+func listFeatureFlags() []FeatureFlag {
+	out := make([]FeatureFlag, 0, len(featureFlags))
+	for _, f := range featureFlags {
+		flag := FeatureFlag{Name: f.name, Description: f.description, Enabled: featureEnabled(f.name), Default: f.def}
+		flags.Lock()
+		if on, ok := flags.configured[f.name]; ok {
+			flag.Configured = &on
+		}
+		if on, ok := flags.overrides[f.name]; ok {
+			flag.Override = &on
+		}
+		flags.Unlock()
+		out = append(out, flag)
+	}
+	return out
+}
+
+func getFeatureFlags(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"flags": listFeatureFlags()})
+}
+
+// setFeatureFlag overrides a flag on this instance, or with an empty
+// enabled clears the override.
+func setFeatureFlag(c *gin.Context) {
+	name := c.Query("name")
+	if _, ok := lookupFeatureFlag(name); !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "unknown flag " + name})
+		return
+	}
+	value := c.Query("enabled")
+	var on bool
+	if value != "" {
+		var err error
+		if on, err = strconv.ParseBool(value); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "enabled must be true, false or empty"})
+			return
+		}
+	}
+
+	flags.Lock()
+	if value == "" {
+		delete(flags.overrides, name)
+	} else {
+		flags.overrides[name] = on
+	}
+	flags.Unlock()
+	c.JSON(http.StatusOK, gin.H{"flags": listFeatureFlags()})
+}
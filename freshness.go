@@ -0,0 +1,40 @@
+package main
+
+import (
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// List responses say how far the index is behind the network, as
+// indexLagMs and the X-Index-Lag-Ms header, so clients can show that data
+// may be delayed. Responses cached by a CDN carry the lag of when they
+// were made.
+
+// lastIndexedUS is the time_us of the last event processEvent applied.
+var lastIndexedUS atomic.Int64
+
+// indexLag is the time from now back to the newest time_us up to which
+// everything read from jetstream is indexed. That is the ingest cursor,
+// which also moves on events that aren't meows so a quiet collection
+// doesn't look delayed, unless spooled events wait to be applied; then it
+// is the last one applied. It is 0 until the first event is read.
+func indexLag() time.Duration {
+	watermark := ingest.state().Cursor
+	if spool != nil && spool.backlogged() {
+		watermark = lastIndexedUS.Load()
+	}
+	if watermark == 0 {
+		return 0
+	}
+	return max(time.Since(time.UnixMicro(watermark)), 0)
+}
+
+// setIndexLag sets the X-Index-Lag-Ms header and returns the lag in ms.
+func setIndexLag(c *gin.Context) int64 {
+	ms := indexLag().Milliseconds()
+	c.Header("X-Index-Lag-Ms", strconv.FormatInt(ms, 10))
+	return ms
+}
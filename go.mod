@@ -2,11 +2,21 @@ module github.com/baphotex/meowview
 
 go 1.21
 
+require (
+	github.com/decred/dcrd/dcrec/secp256k1/v4 v4.3.0
+	github.com/klauspost/compress v1.15.9
+	github.com/prometheus/client_golang v1.19.1
+	github.com/segmentio/kafka-go v0.4.47
+	golang.org/x/image v0.18.0
+	golang.org/x/sys v0.17.0
+)
+
 require (
 	github.com/gocql/gocql v1.7.0 // indirect
 	github.com/golang/snappy v0.0.3 // indirect
 	github.com/google/uuid v1.3.0 // indirect
 	github.com/gorilla/websocket v1.5.3 // indirect
 	github.com/hailocab/go-hostpool v0.0.0-20160125115350-e80d13ce29ed // indirect
+	github.com/pierrec/lz4/v4 v4.1.15 // indirect
 	gopkg.in/inf.v0 v0.9.1 // indirect
 )
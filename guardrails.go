@@ -0,0 +1,262 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// guardrail caps what a single list request may ask for, so one curious
+// client can't start a multi-second ALLOW FILTERING scan:
+//
+//   - DefaultLimit is the page size when the request has no limit
+//   - MinLimit and MaxLimit are the smallest and largest page size
+//   - MaxRange is the widest since/until window
+//   - MaxDepth is how far back from now since/until may reach
+//
+// Each can be overridden per endpoint with GUARDRAIL_<NAME>_DEFAULT_LIMIT,
+// GUARDRAIL_<NAME>_MIN_LIMIT, GUARDRAIL_<NAME>_MAX_LIMIT,
+// GUARDRAIL_<NAME>_MAX_RANGE and GUARDRAIL_<NAME>_MAX_DEPTH, and reloaded
+// at runtime from CONFIG_FILE.
+type guardrail struct {
+	Name         string
+	DefaultLimit int
+	MinLimit     int
+	MaxLimit     int
+	MaxRange     time.Duration
+	MaxDepth     time.Duration
+
+	// the caps before overrides
+	defaultLimit int
+	maxLimit     int
+	maxRange     time.Duration
+	maxDepth     time.Duration
+}
+
+var guardrails struct {
+	sync.RWMutex
+	all []*guardrail
+}
+
+func newGuardrail(name string, defaultLimit, maxLimit int, maxRange, maxDepth time.Duration) *guardrail {
+	g := &guardrail{Name: name, defaultLimit: defaultLimit, maxLimit: maxLimit, maxRange: maxRange, maxDepth: maxDepth}
+	caps, err := g.overridden()
+	if err != nil {
+		log.Fatal(err)
+	}
+	*g = caps
+	guardrails.Lock()
+	defer guardrails.Unlock()
+	guardrails.all = append(guardrails.all, g)
+	return g
+}
+
+// overridden returns the guardrail with the caps currently configured.
+func (g *guardrail) overridden() (guardrail, error) {
+	prefix := "GUARDRAIL_" + strings.ToUpper(g.Name) + "_"
+	caps := *g
+	var err error
+	if caps.DefaultLimit, err = lookupInt(prefix+"DEFAULT_LIMIT", g.defaultLimit); err != nil {
+		return caps, err
+	}
+	if caps.MinLimit, err = lookupInt(prefix+"MIN_LIMIT", 1); err != nil {
+		return caps, err
+	}
+	if caps.MaxLimit, err = lookupInt(prefix+"MAX_LIMIT", g.maxLimit); err != nil {
+		return caps, err
+	}
+	if caps.MinLimit < 1 || caps.MinLimit > caps.DefaultLimit || caps.DefaultLimit > caps.MaxLimit {
+		return caps, fmt.Errorf("%s limits must satisfy 1 <= MIN_LIMIT (%d) <= DEFAULT_LIMIT (%d) <= MAX_LIMIT (%d)",
+			prefix, caps.MinLimit, caps.DefaultLimit, caps.MaxLimit)
+	}
+	if caps.MaxRange, err = lookupDuration(prefix+"MAX_RANGE", g.maxRange); err != nil {
+		return caps, err
+	}
+	if caps.MaxDepth, err = lookupDuration(prefix+"MAX_DEPTH", g.maxDepth); err != nil {
+		return caps, err
+	}
+	return caps, nil
+}
+
+// current is a snapshot of the guardrail, safe against a concurrent
+// reload.
+func (g *guardrail) current() guardrail {
+	guardrails.RLock()
+	defer guardrails.RUnlock()
+	return *g
+}
+
+// reloadGuardrails rereads the caps of every guardrail. Nothing changes
+// unless all of them parse.
+func reloadGuardrails() (func(), error) {
+	guardrails.RLock()
+	all := guardrails.all
+	updated := make([]guardrail, len(all))
+	for i, g := range all {
+		caps, err := g.overridden()
+		if err != nil {
+			guardrails.RUnlock()
+			return nil, err
+		}
+		updated[i] = caps
+	}
+	guardrails.RUnlock()
+	return func() {
+		guardrails.Lock()
+		defer guardrails.Unlock()
+		for i, g := range all {
+			*g = updated[i]
+		}
+	}, nil
+}
+
+var (
+	lastMeowsGuardrail    = newGuardrail("last_meows", 10, 100, 7*24*time.Hour, 30*24*time.Hour)
+	actorMeowsGuardrail   = newGuardrail("actor_meows", 100, 100, 90*24*time.Hour, 365*24*time.Hour)
+	subjectMeowsGuardrail = newGuardrail("subject_meows", 100, 100, 30*24*time.Hour, 365*24*time.Hour)
+	conversationGuardrail = newGuardrail("conversation", 50, 100, 0, 0)
+	relatedGuardrail      = newGuardrail("related", 10, 100, 0, 0)
+)
+
+// pageParams is a validated page request. Since and Until are time_us
+// bounds, only set when the caller asked for a time range.
+type pageParams struct {
+	Limit    int
+	Since    int64
+	Until    int64
+	HasRange bool
+	// Cursor is the MeowPage cursor the page continues after, if any
+	Cursor *listCursor
+}
+
+func parseTimeUS(c *gin.Context, name string) (int64, bool, error) {
+	v := c.Query(name)
+	if v == "" {
+		return 0, false, nil
+	}
+	us, err := parseTimeParam(v)
+	if err != nil {
+		return 0, false, fmt.Errorf("%s must be microseconds since the epoch or an RFC 3339 time", name)
+	}
+	return us, true, nil
+}
+
+// parseLimit validates just the page size, for endpoints paged by cursor
+// rather than time range.
+func (g *guardrail) parseLimit(c *gin.Context) (int, error) {
+	return g.current().limit(c)
+}
+
+func (g guardrail) limit(c *gin.Context) (int, error) {
+	v := c.Query("limit")
+	if v == "" {
+		return g.DefaultLimit, nil
+	}
+	limit, err := strconv.Atoi(v)
+	if err != nil || limit < g.MinLimit || limit > g.MaxLimit {
+		return 0, fmt.Errorf("limit must be an integer between %d and %d", g.MinLimit, g.MaxLimit)
+	}
+	return limit, nil
+}
+
+// parse validates limit, since and until against the guardrail and returns
+// an error meant to be sent back to the client as a 400.
+func (g *guardrail) parse(c *gin.Context) (pageParams, error) {
+	return g.current().page(c)
+}
+
+func (g guardrail) page(c *gin.Context) (pageParams, error) {
+	limit, err := g.limit(c)
+	if err != nil {
+		return pageParams{}, err
+	}
+	p := pageParams{Limit: limit}
+
+	since, hasSince, err := parseTimeUS(c, "since")
+	if err != nil {
+		return p, err
+	}
+	until, hasUntil, err := parseTimeUS(c, "until")
+	if err != nil {
+		return p, err
+	}
+	if v := c.Query("cursor"); v != "" && !hasUntil {
+		cur, err := parseListCursor(v)
+		if err != nil {
+			return p, err
+		}
+		// the meows at the cursor's time_us are read again, see seen
+		until, hasUntil, p.Cursor = cur.TimeUS+1, true, &cur
+	}
+	if !hasSince && !hasUntil {
+		return p, nil
+	}
+
+	now := time.Now()
+	if !hasUntil {
+		until = now.UnixMicro()
+	}
+	if !hasSince {
+		since = until - g.MaxRange.Microseconds()
+	}
+	if since >= until {
+		return p, fmt.Errorf("since must be before until")
+	}
+	if time.Duration(until-since)*time.Microsecond > g.MaxRange {
+		return p, fmt.Errorf("time range may span at most %s", g.MaxRange)
+	}
+	if now.Sub(time.UnixMicro(since)) > g.MaxDepth {
+		return p, fmt.Errorf("time range may reach back at most %s", g.MaxDepth)
+	}
+
+	p.Since, p.Until, p.HasRange = since, until, true
+	return p, nil
+}
+
+// seen tells whether a meow was on the pages before p.Cursor.
+func (p pageParams) seen(timeUS, seq int64) bool {
+	return p.Cursor != nil && timeUS == p.Cursor.TimeUS && seq >= p.Cursor.Seq
+}
+
+// timeFilter is the CQL condition and arguments for the requested range,
+// prefixed with "AND" when it extends an existing WHERE clause.
+func (p pageParams) timeFilter(and bool) (string, []any) {
+	if !p.HasRange {
+		return "", nil
+	}
+	cond := " WHERE time_us >= ? AND time_us < ?"
+	if and {
+		cond = " AND time_us >= ? AND time_us < ?"
+	}
+	return cond, []any{p.Since, p.Until}
+}
+
+// pageCursor points at the last row of a cursor paged list, as
+// "<time_us>/<rkey>/<did>". The DID goes last since it may contain
+// anything but a slash.
+type pageCursor struct {
+	TimeUS int64
+	Rkey   string
+	DID    string
+}
+
+func (cur pageCursor) String() string {
+	return fmt.Sprintf("%d/%s/%s", cur.TimeUS, cur.Rkey, cur.DID)
+}
+
+func parsePageCursor(s string) (pageCursor, error) {
+	parts := strings.SplitN(s, "/", 3)
+	if len(parts) != 3 {
+		return pageCursor{}, fmt.Errorf("invalid cursor")
+	}
+	timeUS, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || !rkeyRegex.MatchString(parts[1]) || validateDID(parts[2]) != parts[2] {
+		return pageCursor{}, fmt.Errorf("invalid cursor")
+	}
+	return pageCursor{TimeUS: timeUS, Rkey: parts[1], DID: parts[2]}, nil
+}
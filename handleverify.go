@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/baphotex/meowview/didresolve"
+	"github.com/gocql/gocql"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// A handle is verified when the DID document claims it and it resolves
+// back to the DID, through DNS or its .well-known, so nobody can pass as a
+// domain they don't control. Handles change and domains lapse, so the
+// actor directory verifies every known handle again once it is older than
+// ACTOR_HANDLE_TTL, up to HANDLE_VERIFY_BATCH per ACTOR_SUGGEST_REFRESH,
+// and right away on jetstream identity events. With hydrate=actors, meows
+// carry their author's handle and whether it is verified.
+
+var handleVerifyBatch = envInt("HANDLE_VERIFY_BATCH", 100)
+
+var handlesVerified = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "meowview_handle_verifications_total",
+	Help: "Handles checked against their DID, by whether they resolved back to it.",
+}, []string{"verified"})
+
+type actorHandle struct {
+	handle   string
+	verified bool
+}
+
+// checkHandle returns the handle did's document claims, "" without a
+// valid one, and whether it resolves back to did.
+func checkHandle(ctx context.Context, did string) (string, bool, error) {
+	doc, err := didResolver.Resolve(ctx, did)
+	if err != nil {
+		return "", false, err
+	}
+	handle := strings.ToLower(doc.Handle())
+	if !handleRegex.MatchString(handle) {
+		return "", false, nil
+	}
+	back, err := didresolve.ResolveHandle(ctx, outbound, handle)
+	if errors.Is(err, errOutboundDeferred) {
+		return "", false, err
+	}
+	return handle, err == nil && back == did, nil
+}
+
+// setHandle records a resolved handle; d.mu must be held.
+func (d *actorDirectory) setHandle(did, handle string, verified bool) {
+	if handle == "" {
+		delete(d.byDID, did)
+		return
+	}
+	d.byDID[did] = actorHandle{handle: handle, verified: verified}
+}
+
+// verifyStale resolves again the handles older than the TTL, at most
+// HANDLE_VERIFY_BATCH at a time, even of actors who haven't meowed since.
+func (d *actorDirectory) verifyStale(session *gocql.Session) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	started := 0
+	for did, at := range d.resolved {
+		if started >= handleVerifyBatch {
+			return
+		}
+		if d.inflight[did] || time.Since(at) <= d.ttl {
+			continue
+		}
+		d.inflight[did] = true
+		started++
+		go d.resolve(session, did)
+	}
+}
+
+// identityChanged verifies the handle of a known actor again after an
+// identity event, which jetstream sends when an account's handle or DID
+// document changes.
+func (d *actorDirectory) identityChanged(session *gocql.Session, did string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, known := d.resolved[did]; !known || d.inflight[did] {
+		return
+	}
+	didResolver.Forget(did)
+	d.inflight[did] = true
+	go d.resolve(session, did)
+}
+
+// hydrate sets the author's handle on meows, for hydrate=actors.
+func (d *actorDirectory) hydrate(meows []MeowResponse) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	for i := range meows {
+		if h, ok := d.byDID[meows[i].DID]; ok {
+			verified := h.verified
+			meows[i].Handle, meows[i].HandleVerified = h.handle, &verified
+		}
+	}
+}
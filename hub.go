@@ -0,0 +1,384 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	streamSubscribers = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "meowview_stream_subscribers",
+		Help: "Clients currently subscribed to the meow stream.",
+	})
+
+	streamEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "meowview_stream_events_total",
+		Help: "Changes published to the stream hub, by result: published, or duplicate when suppressed.",
+	}, []string{"result"})
+
+	streamEvictions = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "meowview_stream_evictions_total",
+		Help: "Subscribers disconnected for not keeping up.",
+	})
+
+	streamDropped = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "meowview_stream_dropped_total",
+		Help: "Changes dropped from the buffers of subscribers not keeping up, under the drop-oldest policy.",
+	})
+
+	streamRejected = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "meowview_stream_rejected_total",
+		Help: "Subscriptions refused because STREAM_MAX_SUBSCRIBERS were connected.",
+	})
+)
+
+var (
+	errHubClosed          = errors.New("shutting down")
+	errTooManySubscribers = errors.New("too many subscribers")
+)
+
+// streamHub fans ingested changes out to the subscribeMeows streams. The
+// ingest path only hands a change to publish, which never blocks: every
+// subscriber has its own buffer, and one whose buffer is full either is
+// evicted or loses its oldest buffered change, depending on dropOldest,
+// rather than holding up ingestion or the other subscribers.
+//
+// A change seen again, from a spool replay or a re-delivered event, is
+// suppressed, so a subscriber gets each change once.
+//
+// The last changes are kept in a ring for subscribers resuming from a
+// cursor, see subscribe.
+type streamHub struct {
+	buffer     int
+	maxSubs    int
+	dropOldest bool
+
+	mu     sync.Mutex
+	subs   map[*subscriber]struct{}
+	closed bool
+	// recent are the keys of the last published changes, oldest first
+	recent      map[string]struct{}
+	recentOrder []string
+	recentMax   int
+	// replay are the last published changes, oldest first. floor is the
+	// newest position no longer in it: a cursor at or past it can be
+	// resumed from replay alone.
+	replay    []bufferedChange
+	replayMax int
+	floor     *pageCursor
+}
+
+type bufferedChange struct {
+	cursor pageCursor
+	change MeowChange
+}
+
+// after orders positions like meow_events: by time_us, did, then rkey.
+func (cur pageCursor) after(other pageCursor) bool {
+	if cur.TimeUS != other.TimeUS {
+		return cur.TimeUS > other.TimeUS
+	}
+	if cur.DID != other.DID {
+		return cur.DID > other.DID
+	}
+	return cur.Rkey > other.Rkey
+}
+
+type subscriber struct {
+	changes chan bufferedChange
+	filter  func(MeowChange) bool
+	// evicted is closed along with changes when the hub dropped the
+	// subscriber for falling behind
+	evicted chan struct{}
+	// dropped counts the changes lost to drop-oldest since the subscriber
+	// was last told
+	dropped atomic.Int64
+}
+
+func newStreamHub() *streamHub {
+	h := &streamHub{
+		buffer:    envInt("STREAM_BUFFER", 256),
+		maxSubs:   envInt("STREAM_MAX_SUBSCRIBERS", 1000),
+		subs:      map[*subscriber]struct{}{},
+		recent:    map[string]struct{}{},
+		recentMax: envInt("STREAM_DEDUPE_WINDOW", 10000),
+		replayMax: envInt("STREAM_REPLAY_BUFFER", 1000),
+	}
+	switch policy := envString("STREAM_SLOW_CONSUMER", "disconnect"); policy {
+	case "disconnect":
+	case "drop-oldest":
+		h.dropOldest = true
+	default:
+		log.Fatalf("STREAM_SLOW_CONSUMER must be disconnect or drop-oldest, got %q", policy)
+	}
+	return h
+}
+
+var hub = newStreamHub()
+
+// subscribe registers a subscriber for the changes filter accepts, or all
+// with a nil filter. With a cursor it also returns the buffered changes
+// after it, to be sent before the live ones, and whether they are all the
+// changes after it. It fails once the hub is closed or, with maxSubs set,
+// full.
+func (h *streamHub) subscribe(filter func(MeowChange) bool, from *pageCursor) (*subscriber, []bufferedChange, bool, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return nil, nil, false, errHubClosed
+	}
+	if h.maxSubs > 0 && len(h.subs) >= h.maxSubs {
+		streamRejected.Inc()
+		return nil, nil, false, errTooManySubscribers
+	}
+	s := &subscriber{changes: make(chan bufferedChange, h.buffer), filter: filter, evicted: make(chan struct{})}
+	h.subs[s] = struct{}{}
+	streamSubscribers.Inc()
+	if from == nil {
+		return s, nil, true, nil
+	}
+
+	var missed []bufferedChange
+	for _, b := range h.replay {
+		if b.cursor.after(*from) && (filter == nil || filter(b.change)) {
+			missed = append(missed, b)
+		}
+	}
+	complete := h.floor != nil && !h.floor.after(*from)
+	return s, missed, complete, nil
+}
+
+func (h *streamHub) unsubscribe(s *subscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.remove(s)
+}
+
+// remove closes a subscriber's channel; h.mu is held.
+func (h *streamHub) remove(s *subscriber) {
+	if _, ok := h.subs[s]; !ok {
+		return
+	}
+	delete(h.subs, s)
+	close(s.changes)
+	streamSubscribers.Dec()
+}
+
+func changeKey(ch MeowChange) string {
+	return fmt.Sprintf("%s %s %s %d %s", ch.Op, ch.DID, ch.Rkey, ch.TimeUS, ch.CID)
+}
+
+// publish hands ch to every matching subscriber.
+func (h *streamHub) publish(ch MeowChange) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	key := changeKey(ch)
+	if _, dup := h.recent[key]; dup {
+		streamEvents.WithLabelValues("duplicate").Inc()
+		return
+	}
+	h.recent[key] = struct{}{}
+	h.recentOrder = append(h.recentOrder, key)
+	if len(h.recentOrder) > h.recentMax {
+		delete(h.recent, h.recentOrder[0])
+		h.recentOrder = h.recentOrder[1:]
+	}
+	streamEvents.WithLabelValues("published").Inc()
+
+	b := bufferedChange{cursor: pageCursor{TimeUS: ch.TimeUS, Rkey: ch.Rkey, DID: ch.DID}, change: ch}
+	if h.floor == nil {
+		// nothing before the first change went through this hub
+		h.floor = &pageCursor{TimeUS: ch.TimeUS - 1}
+	}
+	h.replay = append(h.replay, b)
+	if len(h.replay) > h.replayMax {
+		if h.replay[0].cursor.after(*h.floor) {
+			h.floor = &h.replay[0].cursor
+		}
+		h.replay = h.replay[1:]
+	}
+
+	for s := range h.subs {
+		if s.filter != nil && !s.filter(ch) {
+			continue
+		}
+		select {
+		case s.changes <- b:
+		default:
+			if h.dropOldest {
+				h.dropFirst(s, b)
+				continue
+			}
+			close(s.evicted)
+			h.remove(s)
+			streamEvictions.Inc()
+		}
+	}
+}
+
+// dropFirst makes room for b in a full buffer by dropping its oldest
+// change; h.mu is held. Should the subscriber have drained the buffer in
+// between, nothing is dropped.
+func (h *streamHub) dropFirst(s *subscriber, b bufferedChange) {
+	select {
+	case <-s.changes:
+		s.dropped.Add(1)
+		streamDropped.Inc()
+	default:
+	}
+	select {
+	case s.changes <- b:
+	default:
+		// the subscriber can't have refilled it, only publish sends
+		s.dropped.Add(1)
+		streamDropped.Inc()
+	}
+}
+
+// close ends every stream, so they don't hold up a graceful shutdown.
+func (h *streamHub) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	for s := range h.subs {
+		h.remove(s)
+	}
+}
+
+// subscribeMeows streams changes as server-sent events, optionally only
+// those by an actor (did), about a subject, or with an emotion, matched
+// like meows_by_emotion: the author's, else the inferred one. Deletes
+// carry only the did and rkey and pass the subject and emotion filters, so
+// a client drops the meows it has whatever they were. Each change is a
+// "change" event shaped like a getMeowsSince change, with its cursor
+// as the event id; hidden meows are left out. A subscriber that falls
+// behind gets an "evicted" event and should reconnect from its last cursor.
+//
+// Under the drop-oldest policy a subscriber that falls behind instead loses
+// its oldest buffered changes, and a "dropped" event with their number
+// comes before the next change.
+//
+// A cursor, as ?cursor= or the Last-Event-ID header browsers send when
+// reconnecting, first replays the buffered changes after it. When the
+// buffer doesn't reach back that far a "resync" event says so, and the
+// gap has to be filled from getMeowsSince.
+//
+// With encoding=compact changes are arrays, see streamencoding.go.
+func subscribeMeows(c *gin.Context) {
+	did := c.Query("did")
+	subject := normalizeSubject(c.Request.Context(), c.Query("subject"))
+	emotion := strings.ToLower(c.Query("emotion"))
+	if did != "" && validateDID(did) != did {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid did"})
+		return
+	}
+	encoding, err := parseStreamEncoding(c.Query("encoding"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var filter func(MeowChange) bool
+	if did != "" || subject != "" || emotion != "" {
+		filter = func(ch MeowChange) bool {
+			if did != "" && ch.DID != did {
+				return false
+			}
+			// a delete only has the did and rkey, so it can't be matched
+			// on the subject or emotion of the meow it removes
+			if ch.Op == "delete" {
+				return true
+			}
+			return (subject == "" || ch.Subject == subject) &&
+				(emotion == "" || ch.Emotion == emotion || (ch.Emotion == "" && ch.InferredEmotion == emotion))
+		}
+	}
+	var from *pageCursor
+	if v := c.DefaultQuery("cursor", c.GetHeader("Last-Event-ID")); v != "" {
+		cur, err := parseChangeCursor(v)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		from = &cur
+	}
+
+	// without an actor the stream is global, like the all-meows lists
+	moderate := moderation.applyGlobal
+	if did != "" {
+		moderate = moderation.apply
+	}
+	s, missed, complete, err := hub.subscribe(filter, from)
+	if err != nil {
+		c.Header("Retry-After", "30")
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	defer hub.unsubscribe(s)
+
+	send := func(w io.Writer, b bufferedChange) {
+		// deletes go out regardless, e.g. those of a deleted account, so
+		// clients drop what they have
+		if b.change.Op != "delete" {
+			kept := moderate([]MeowResponse{b.change.MeowResponse})
+			if len(kept) == 0 {
+				return
+			}
+			b.change.MeowResponse = kept[0]
+		}
+		fmt.Fprintf(w, "id: %s\n", b.cursor)
+		if encoding == streamEncodingCompact {
+			c.SSEvent("change", compactChange(b.change))
+		} else {
+			c.SSEvent("change", b.change)
+		}
+	}
+
+	ping := time.NewTicker(30 * time.Second)
+	defer ping.Stop()
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	if encoding == streamEncodingCompact {
+		c.SSEvent("fields", gin.H{"change": changeFields})
+	}
+	if !complete {
+		c.SSEvent("resync", gin.H{"error": "cursor is older than the replay buffer, catch up with getMeowsSince"})
+	}
+	for _, b := range missed {
+		send(c.Writer, b)
+	}
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case b, ok := <-s.changes:
+			if !ok {
+				select {
+				case <-s.evicted:
+					c.SSEvent("evicted", gin.H{"error": "subscriber fell behind"})
+				default:
+				}
+				return false
+			}
+			if n := s.dropped.Swap(0); n > 0 {
+				c.SSEvent("dropped", gin.H{"dropped": n})
+			}
+			send(w, b)
+			return true
+		case <-ping.C:
+			// keeps proxies from closing an idle stream
+			fmt.Fprint(w, ": ping\n\n")
+			return true
+		case <-c.Request.Context().Done():
+			return false
+		}
+	})
+}
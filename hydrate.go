@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// subjectURIRegex matches the AT-URIs we accept as a subject besides a
+// DID: a Bluesky post or another meow.
+var subjectURIRegex = regexp.MustCompile(`^at://(did:[a-z]+:[a-zA-Z0-9._:%-]+)/(app\.bsky\.feed\.post|moe\.kasey\.meow)/([a-zA-Z0-9._~:-]{1,512})$`)
+
+func isPostURI(uri string) bool {
+	match := subjectURIRegex.FindStringSubmatch(uri)
+	return match != nil && match[2] == "app.bsky.feed.post"
+}
+
+// validateSubjectURI checks that a record subject's author DID resolves
+// and returns the URI, or "" when it doesn't.
+func validateSubjectURI(ctx context.Context, uri string) string {
+	match := subjectURIRegex.FindStringSubmatch(uri)
+	if match == nil {
+		return ""
+	}
+	if resolvedDID(ctx, match[1]) == "" {
+		return ""
+	}
+	return uri
+}
+
+// getPostsBatch is the most URIs app.bsky.feed.getPosts accepts at once.
+const getPostsBatch = 25
+
+// postHydrator fetches the posts meows refer to from the public AppView,
+// caching them, including misses, so popular posts aren't refetched for
+// every page.
+type postHydrator struct {
+	appview string
+	ttl     time.Duration
+
+	mu    sync.Mutex
+	cache map[string]cachedPost
+}
+
+type cachedPost struct {
+	post    json.RawMessage
+	fetched time.Time
+}
+
+func newPostHydrator() *postHydrator {
+	if !envBool("POST_HYDRATION", true) {
+		return nil
+	}
+	return &postHydrator{
+		appview: strings.TrimSuffix(envString("POST_HYDRATION_APPVIEW", "https://public.api.bsky.app"), "/"),
+		ttl:     envDuration("POST_HYDRATION_CACHE_TTL", 5*time.Minute),
+		cache:   map[string]cachedPost{},
+	}
+}
+
+var posts = newPostHydrator()
+
+func (h *postHydrator) cached(uri string) (json.RawMessage, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	p, ok := h.cache[uri]
+	if !ok || time.Since(p.fetched) > h.ttl {
+		return nil, false
+	}
+	return p.post, true
+}
+
+func (h *postHydrator) store(uri string, post json.RawMessage) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := time.Now()
+	if len(h.cache) >= 10000 {
+		for k, p := range h.cache {
+			if now.Sub(p.fetched) > h.ttl {
+				delete(h.cache, k)
+			}
+		}
+	}
+	h.cache[uri] = cachedPost{post: post, fetched: now}
+}
+
+// prune drops the expired posts and returns how many it dropped.
+func (h *postHydrator) prune() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	n := 0
+	for k, p := range h.cache {
+		if time.Since(p.fetched) > h.ttl {
+			delete(h.cache, k)
+			n++
+		}
+	}
+	return n
+}
+
+// fetch calls app.bsky.feed.getPosts for up to getPostsBatch URIs and
+// returns the post views keyed by URI.
+func (h *postHydrator) fetch(ctx context.Context, uris []string) (map[string]json.RawMessage, error) {
+	q := url.Values{}
+	for _, uri := range uris {
+		q.Add("uris", uri)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, h.appview+"/xrpc/app.bsky.feed.getPosts?"+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := outbound.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("getPosts returned %s", resp.Status)
+	}
+
+	var body struct {
+		Posts []json.RawMessage `json:"posts"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	found := map[string]json.RawMessage{}
+	for _, post := range body.Posts {
+		var view struct {
+			URI string `json:"uri"`
+		}
+		if json.Unmarshal(post, &view) == nil {
+			found[view.URI] = post
+		}
+	}
+	return found, nil
+}
+
+// hydrate sets Post on every meow whose subject is a post. Posts that
+// can't be fetched are left out rather than failing the request.
+func (h *postHydrator) hydrate(ctx context.Context, meows []MeowResponse) {
+	var missing []string
+	seen := map[string]bool{}
+	for _, m := range meows {
+		if !isPostURI(m.Subject) || seen[m.Subject] {
+			continue
+		}
+		seen[m.Subject] = true
+		if _, ok := h.cached(m.Subject); !ok {
+			missing = append(missing, m.Subject)
+		}
+	}
+
+	for start := 0; start < len(missing); start += getPostsBatch {
+		batch := missing[start:min(start+getPostsBatch, len(missing))]
+		found, err := h.fetch(ctx, batch)
+		if err != nil {
+			log.Println("hydrate posts error:", err)
+			break
+		}
+		for _, uri := range batch {
+			// deleted or blocked posts are cached as nil
+			h.store(uri, found[uri])
+		}
+	}
+
+	for i := range meows {
+		if !isPostURI(meows[i].Subject) {
+			continue
+		}
+		if post, ok := h.cached(meows[i].Subject); ok && post != nil {
+			meows[i].Post = post
+		}
+	}
+}
+
+// hydrateRequested embeds referenced posts when the caller asked for them
+// with hydrate=posts, and authors' handles with hydrate=actors; both are
+// asked for with hydrate=posts,actors.
+func hydrateRequested(c *gin.Context, meows []MeowResponse) {
+	wanted := map[string]bool{}
+	for _, v := range strings.Split(c.Query("hydrate"), ",") {
+		wanted[strings.TrimSpace(v)] = true
+	}
+	if wanted["actors"] {
+		actorHandles.hydrate(meows)
+	}
+	if posts == nil || !wanted["posts"] {
+		return
+	}
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+	posts.hydrate(ctx, meows)
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gocql/gocql"
+)
+
+// Writes that shouldn't happen twice, echoMeow, createReport, createDraft
+// and the admin mutations, take an Idempotency-Key header so a client can
+// retry them safely. The first request with a key runs and its response is
+// kept for IDEMPOTENCY_KEY_TTL (24h); a retry with the same key and the
+// same request gets that response again, marked Idempotent-Replayed: true,
+// without running. Keys are scoped to the caller: the viewer, the admin
+// API key, or the admin token.
+//
+// Reusing a key for a different request fails with 422, and a retry while
+// the first request is still running with 409. Responses with a 5xx
+// status, or too large to keep, aren't kept, nor are requests whose handler
+// panicked, so a retry runs again. The claim is a lightweight transaction,
+// and so are the writes that save or release it: Cassandra doesn't order
+// plain writes after conditional ones on the same row.
+
+const (
+	idempotencyKeyHeader = "Idempotency-Key"
+	maxIdempotencyKeyLen = 255
+	// maxIdempotentBody bounds the responses kept for replay
+	maxIdempotentBody = 64 << 10
+)
+
+var idempotencyKeyTTL = envDuration("IDEMPOTENCY_KEY_TTL", 24*time.Hour)
+
+func createIdempotencyTables(session *gocql.Session) error {
+	return session.Query(`
+		CREATE TABLE IF NOT EXISTS idempotency_keys (
+			scope TEXT,
+			key TEXT,
+			request_hash TEXT,
+			status INT,
+			content_type TEXT,
+			body BLOB,
+			PRIMARY KEY ((scope, key))
+		)`).Exec()
+}
+
+// idempotencyScope is whom a key belongs to.
+func idempotencyScope(c *gin.Context) string {
+	if viewer := c.GetString("viewer"); viewer != "" {
+		return viewer
+	}
+	if k, ok := c.Get("apiKey"); ok {
+		return "apikey:" + k.(*APIKey).ID
+	}
+	return "admin"
+}
+
+// idempotencyHash identifies a request by its method, path, query and body.
+func idempotencyHash(c *gin.Context, body []byte) string {
+	h := sha256.New()
+	io.WriteString(h, c.Request.Method+" "+c.Request.URL.Path+"?"+c.Request.URL.RawQuery+"\n")
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// idempotent runs the writes of a route at most once per Idempotency-Key.
+// It goes after the route's authentication. Requests without the header,
+// and reads, pass through.
+func idempotent(session *gocql.Session) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.GetHeader(idempotencyKeyHeader)
+		if key == "" || c.Request.Method == http.MethodGet || c.Request.Method == http.MethodHead {
+			c.Next()
+			return
+		}
+		if len(key) > maxIdempotencyKeyLen {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Idempotency-Key may be at most 255 characters"})
+			return
+		}
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+		scope, hash := idempotencyScope(c), idempotencyHash(c, body)
+
+		existing := map[string]interface{}{}
+		applied, err := session.Query(`
+			INSERT INTO idempotency_keys (scope, key, request_hash, status)
+			VALUES (?, ?, ?, 0)
+			IF NOT EXISTS
+			USING TTL ?`,
+			scope, key, hash, int(idempotencyKeyTTL.Seconds()),
+		).WithContext(c.Request.Context()).MapScanCAS(existing)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if !applied {
+			replayIdempotent(c, existing, hash)
+			return
+		}
+
+		// a panicking handler would otherwise leave the key claimed, and
+		// every retry a 409, until the TTL
+		defer func() {
+			if r := recover(); r != nil {
+				releaseIdempotencyKey(session, scope, key, hash)
+				panic(r)
+			}
+		}()
+		w := &capturingWriter{ResponseWriter: c.Writer}
+		c.Writer = w
+		c.Next()
+
+		status := w.Status()
+		if status >= 500 || w.overflow {
+			releaseIdempotencyKey(session, scope, key, hash)
+			return
+		}
+		// conditional like the claim, so it is ordered after it
+		applied, err = session.Query(`
+			UPDATE idempotency_keys USING TTL ?
+			SET status = ?, content_type = ?, body = ?
+			WHERE scope = ? AND key = ?
+			IF request_hash = ?`,
+			int(idempotencyKeyTTL.Seconds()), status, w.Header().Get("Content-Type"), w.body.Bytes(), scope, key, hash,
+		).MapScanCAS(map[string]interface{}{})
+		if err != nil {
+			log.Println("save idempotency key error:", err)
+		} else if !applied {
+			log.Printf("idempotency key %q of %s expired before its response was saved", key, scope)
+		}
+	}
+}
+
+// releaseIdempotencyKey drops the claim of a request whose response isn't
+// kept, so a retry runs again.
+func releaseIdempotencyKey(session *gocql.Session, scope, key, hash string) {
+	_, err := session.Query(`
+		DELETE FROM idempotency_keys
+		WHERE scope = ? AND key = ?
+		IF request_hash = ?`,
+		scope, key, hash,
+	).MapScanCAS(map[string]interface{}{})
+	if err != nil {
+		log.Println("release idempotency key error:", err)
+	}
+}
+
+// replayIdempotent answers a retry with the kept response.
+func replayIdempotent(c *gin.Context, row map[string]interface{}, hash string) {
+	if h, _ := row["request_hash"].(string); h != hash {
+		c.AbortWithStatusJSON(http.StatusUnprocessableEntity, gin.H{"error": "Idempotency-Key was used for a different request"})
+		return
+	}
+	status, _ := row["status"].(int)
+	if status == 0 {
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "a request with this Idempotency-Key is in progress"})
+		return
+	}
+	contentType, _ := row["content_type"].(string)
+	body, _ := row["body"].([]byte)
+	c.Header("Idempotent-Replayed", "true")
+	c.Data(status, contentType, body)
+	c.Abort()
+}
+
+// capturingWriter keeps a copy of the response for replay.
+type capturingWriter struct {
+	gin.ResponseWriter
+	body     bytes.Buffer
+	overflow bool
+}
+
+func (w *capturingWriter) Write(b []byte) (int, error) {
+	if !w.overflow {
+		if w.body.Len()+len(b) > maxIdempotentBody {
+			w.overflow = true
+			w.body.Reset()
+		} else {
+			w.body.Write(b)
+		}
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *capturingWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
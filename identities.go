@@ -0,0 +1,170 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gocql/gocql"
+)
+
+// Jetstream sends an identity event whenever an account's handle or DID
+// document changes, for every account on the network. The handle they
+// carry is the relay's, which has checked it resolves back to the DID, or
+// handle.invalid when it didn't. identities keeps the current handle of
+// every DID seen in one, and identities_by_handle the other way round for
+// handle-based queries. Rows are written with the event's time_us as
+// timestamp, so a late event doesn't undo a rename.
+//
+// The actor directory, see actorsuggest.go, verifies the handles of actors
+// who meowed by itself; this mapping covers everyone, without lookups.
+
+// invalidHandle is what the relay reports for a handle that doesn't verify.
+const invalidHandle = "handle.invalid"
+
+func createIdentityTables(session *gocql.Session) error {
+	err := session.Query(`
+		CREATE TABLE IF NOT EXISTS identities (
+			did TEXT PRIMARY KEY,
+			handle TEXT,
+			updated_at TIMESTAMP
+		)`).Exec()
+	if err != nil {
+		return err
+	}
+	return session.Query(`
+		CREATE TABLE IF NOT EXISTS identities_by_handle (
+			handle TEXT PRIMARY KEY,
+			did TEXT
+		)`).Exec()
+}
+
+// recordIdentity applies an identity event to the mapping.
+func recordIdentity(session *gocql.Session, msg WebSocketMessage) {
+	did := msg.DID
+	if validateDID(did) != did {
+		return
+	}
+	handle := strings.ToLower(msg.Identity.Handle)
+	if handle == invalidHandle || !handleRegex.MatchString(handle) {
+		handle = ""
+	}
+
+	var previous string
+	err := session.Query(`SELECT handle FROM identities WHERE did = ?`, did).Scan(&previous)
+	if err != nil && err != gocql.ErrNotFound {
+		log.Println("read identities error:", err)
+	}
+	if previous != "" && previous != handle {
+		// unless someone else took the handle over meanwhile
+		var owner string
+		err := session.Query(`SELECT did FROM identities_by_handle WHERE handle = ?`, previous).Scan(&owner)
+		if err == nil && owner == did {
+			err = session.Query(`DELETE FROM identities_by_handle USING TIMESTAMP ? WHERE handle = ?`, msg.TimeUS, previous).Exec()
+		}
+		if err != nil && err != gocql.ErrNotFound {
+			log.Println("delete identities_by_handle error:", err)
+		}
+	}
+
+	err = session.Query(`
+		INSERT INTO identities (did, handle, updated_at) VALUES (?, ?, ?)
+		USING TIMESTAMP ?`,
+		did, nullString(handle), time.Now(), msg.TimeUS,
+	).Exec()
+	if err != nil {
+		log.Println("insert identities error:", err)
+	}
+	if handle == "" {
+		return
+	}
+	err = session.Query(`
+		INSERT INTO identities_by_handle (handle, did) VALUES (?, ?)
+		USING TIMESTAMP ?`,
+		handle, did, msg.TimeUS,
+	).Exec()
+	if err != nil {
+		log.Println("insert identities_by_handle error:", err)
+	}
+}
+
+// lookupHandle returns the DID currently holding handle according to the
+// identity events seen, or "".
+func lookupHandle(c *gin.Context, session *gocql.Session, handle string) (string, error) {
+	var did string
+	err := session.Query(`SELECT did FROM cat.identities_by_handle WHERE handle = ?`, handle).
+		WithContext(c.Request.Context()).Scan(&did)
+	if err == gocql.ErrNotFound {
+		return "", nil
+	}
+	return did, err
+}
+
+// lookupIdentity returns did's current handle according to the identity
+// events seen, "" without a valid one, and whether any was seen.
+func lookupIdentity(c *gin.Context, session *gocql.Session, did string) (string, bool, error) {
+	var handle *string
+	err := session.Query(`SELECT handle FROM cat.identities WHERE did = ?`, did).
+		WithContext(c.Request.Context()).Scan(&handle)
+	if err == gocql.ErrNotFound {
+		return "", false, nil
+	}
+	return derefString(handle), err == nil, err
+}
+
+type Identity struct {
+	DID string `json:"did"`
+	// Handle is empty when the DID has no valid handle
+	Handle string `json:"handle,omitempty"`
+}
+
+// getIdentity maps a handle to its DID, or a DID to its handle, from
+// identity events when one has been seen and by resolving otherwise.
+func getIdentity(session *gocql.Session) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if did := c.Query("did"); did != "" {
+			if validateDID(did) != did {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid did"})
+				return
+			}
+			handle, seen, err := lookupIdentity(c, session, did)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			if !seen {
+				var verified bool
+				if handle, verified, err = checkHandle(c.Request.Context(), did); err != nil {
+					c.JSON(http.StatusNotFound, gin.H{"error": "did not found"})
+					return
+				}
+				if !verified {
+					handle = ""
+				}
+			}
+			c.JSON(http.StatusOK, Identity{DID: did, Handle: handle})
+			return
+		}
+
+		handle := strings.ToLower(strings.TrimPrefix(c.Query("handle"), "@"))
+		if !handleRegex.MatchString(handle) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "give a did or a valid handle"})
+			return
+		}
+		did, err := lookupHandle(c, session, handle)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if did == "" {
+			did = normalizeActor(c.Request.Context(), handle)
+		}
+		if did == "" {
+			c.JSON(http.StatusNotFound, gin.H{"error": "handle not found"})
+			return
+		}
+		c.JSON(http.StatusOK, Identity{DID: did, Handle: handle})
+	}
+}
@@ -0,0 +1,438 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gocql/gocql"
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// jetstreamURL can point each region at its nearest jetstream instance,
+// JETSTREAM_URLS at several to fail over between, see jetstreamfailover.go.
+var jetstreamURL = envString("JETSTREAM_URL", "wss://jetstream2.us-east.bsky.network/subscribe?wantedCollections=moe.kasey.meow")
+
+// jetstreamFilters narrow the subscription. JETSTREAM_WANTED_COLLECTIONS
+// replaces the wantedCollections of JETSTREAM_URL and JETSTREAM_WANTED_DIDS
+// limits ingestion to those repos. Both are reloaded at runtime and sent to
+// jetstream as an options_update, without reconnecting.
+type jetstreamFilters struct {
+	Collections []string `json:"wantedCollections"`
+	DIDs        []string `json:"wantedDids"`
+}
+
+func (f jetstreamFilters) equal(o jetstreamFilters) bool {
+	return slices.Equal(f.Collections, o.Collections) && slices.Equal(f.DIDs, o.DIDs)
+}
+
+func loadJetstreamFilters() (jetstreamFilters, error) {
+	u, err := url.Parse(jetstreams.urls[0])
+	if err != nil {
+		return jetstreamFilters{}, fmt.Errorf("JETSTREAM_URL: %v", err)
+	}
+	f := jetstreamFilters{
+		Collections: envList("JETSTREAM_WANTED_COLLECTIONS"),
+		DIDs:        envList("JETSTREAM_WANTED_DIDS"),
+	}
+	if len(f.Collections) == 0 {
+		f.Collections = u.Query()["wantedCollections"]
+	}
+	for _, did := range f.DIDs {
+		if validateDID(did) != did {
+			return f, fmt.Errorf("JETSTREAM_WANTED_DIDS: invalid did %q", did)
+		}
+	}
+	return f, nil
+}
+
+func reloadJetstreamFilters() (func(), error) {
+	f, err := loadJetstreamFilters()
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		if err := ingest.setFilters(f); err != nil {
+			// a reconnect subscribes with the new filters anyway
+			log.Println("update jetstream filters:", err)
+		}
+	}, nil
+}
+
+// dialJetstream connects to jetstream, replaying from cursor (a time_us)
+// when it is non zero. A failed dial moves on to the next of JETSTREAM_URLS
+// for the retry.
+func dialJetstream(cursor int64) (*websocket.Conn, error) {
+	u, err := url.Parse(jetstreams.url())
+	if err != nil {
+		return nil, err
+	}
+	cursor = jetstreams.dialCursor(cursor)
+	f := ingest.subscription()
+	q := u.Query()
+	q.Del("wantedCollections")
+	q.Del("wantedDids")
+	for _, c := range f.Collections {
+		q.Add("wantedCollections", c)
+	}
+	for _, did := range f.DIDs {
+		q.Add("wantedDids", did)
+	}
+	if cursor > 0 {
+		q.Set("cursor", strconv.FormatInt(cursor, 10))
+	}
+	if jetstreamCompress {
+		q.Set("compress", "true")
+	}
+	u.RawQuery = q.Encode()
+	conn, _, err := jetstreamDialer.Dial(u.String(), http.Header{"User-Agent": {outbound.userAgent}})
+	if err != nil {
+		jetstreams.failover("unreachable", ingest.state().Cursor)
+		return nil, err
+	}
+	jetstreams.connected()
+	keepAlive(conn)
+	firehose.setConnected()
+	return conn, nil
+}
+
+// A connection that silently died, e.g. behind a NAT that dropped it,
+// would otherwise block ReadMessage forever. So jetstream is pinged every
+// JETSTREAM_PING_INTERVAL, and a read fails once neither a message nor a
+// pong arrived for JETSTREAM_READ_TIMEOUT, which makes the loop reconnect.
+var (
+	jetstreamPingInterval = envDuration("JETSTREAM_PING_INTERVAL", 10*time.Second)
+	jetstreamReadTimeout  = envDuration("JETSTREAM_READ_TIMEOUT", 30*time.Second)
+)
+
+var jetstreamReconnects = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "meowview_jetstream_reconnects_total",
+	Help: "Jetstream reconnects, by reason (timeout or error).",
+}, []string{"reason"})
+
+func keepAlive(conn *websocket.Conn) {
+	if jetstreamPingInterval >= jetstreamReadTimeout {
+		log.Fatal("JETSTREAM_PING_INTERVAL must be shorter than JETSTREAM_READ_TIMEOUT")
+	}
+	conn.SetReadDeadline(time.Now().Add(jetstreamReadTimeout))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(jetstreamReadTimeout))
+	})
+	go func() {
+		ticker := time.NewTicker(jetstreamPingInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			// WriteControl may be called concurrently with other writes;
+			// it fails once the connection is closed
+			err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(jetstreamPingInterval))
+			if err != nil {
+				return
+			}
+		}
+	}()
+}
+
+// readJetstream reads the next message and extends the read deadline.
+func readJetstream(conn *websocket.Conn) ([]byte, error) {
+	_, message, err := conn.ReadMessage()
+	if err != nil {
+		return nil, err
+	}
+	conn.SetReadDeadline(time.Now().Add(jetstreamReadTimeout))
+	return message, nil
+}
+
+const (
+	ingestRunning  = "running"
+	ingestPaused   = "paused"
+	ingestDropping = "drop"
+)
+
+// ingestControl lets the admin API pause the consumer or switch it to
+// drop-only mode, e.g. during database maintenance. Pausing closes the
+// websocket so jetstream doesn't queue up events for us, and stores the
+// cursor so resuming replays everything missed in between.
+type ingestControl struct {
+	mu      sync.Mutex
+	mode    string
+	conn    *websocket.Conn
+	resume  chan struct{}
+	cursor  int64
+	dropped uint64
+	filters jetstreamFilters
+}
+
+var ingest = &ingestControl{mode: ingestRunning}
+
+func createIngestTables(session *gocql.Session) error {
+	err := session.Query(`
+		CREATE TABLE IF NOT EXISTS ingest_state (
+			name TEXT PRIMARY KEY,
+			cursor BIGINT,
+			updated_at TIMESTAMP
+		)`).Exec()
+	if err != nil {
+		return err
+	}
+
+	// the sequence rows, see seq.go
+	return addColumn(session, "ingest_state", "seq", "BIGINT")
+}
+
+func saveCursor(session *gocql.Session, cursor int64) error {
+	return session.Query(`
+		INSERT INTO ingest_state (name, cursor, updated_at) VALUES (?, ?, ?)`,
+		cursorName(), cursor, time.Now(),
+	).Exec()
+}
+
+func loadCursor(session *gocql.Session) (int64, error) {
+	var cursor int64
+	err := session.Query(`SELECT cursor FROM ingest_state WHERE name = ?`, cursorName()).Scan(&cursor)
+	if err == gocql.ErrNotFound {
+		return 0, nil
+	}
+	return cursor, err
+}
+
+// processEvent logs an event read from jetstream and indexes it. It fails
+// when the database couldn't take it, see spool.go.
+func processEvent(session *gocql.Session, ev meowEvent) error {
+	if err := appendEvent(session, ev); err != nil {
+		if unavailable(err) {
+			return err
+		}
+		log.Println("append event error:", err)
+	}
+	counted, err := applyEvent(session, ev, true)
+	if err != nil {
+		return err
+	}
+	hub.publish(MeowChange{Op: ev.Op, MeowResponse: ev.Meow.response(), rev: ev.Rev, record: ev.Record})
+	lastIndexedUS.Store(ev.TimeUS)
+	lanes.observeLive(time.Since(time.UnixMicro(ev.TimeUS)))
+	if ev.Op == "create" {
+		confirmEcho(session, ev.DID, ev.Rkey)
+		actorHandles.observe(session, ev.DID, ev.TimeUS)
+	}
+	// counters, like the derived counts, are bumped by the one region that
+	// counted the meow
+	if ev.Op == "create" && counted && timezones != nil {
+		timezones.observe(session, ev.DID, ev.TimeUS)
+	}
+	if ev.Op == "create" && counted && alerts != nil {
+		alerts.countEmotion(session, ev.Meow)
+	}
+	observeIngest(ev.Op, ev.TimeUS)
+	return nil
+}
+
+func (ic *ingestControl) setConn(conn *websocket.Conn) {
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+	ic.conn = conn
+}
+
+func (ic *ingestControl) subscription() jetstreamFilters {
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+	return ic.filters
+}
+
+// setFilters changes the subscription, updating the live connection.
+func (ic *ingestControl) setFilters(f jetstreamFilters) error {
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+	if ic.filters.equal(f) {
+		return nil
+	}
+	ic.filters = f
+	if ic.conn == nil || ic.mode == ingestPaused {
+		return nil
+	}
+	log.Printf("updating jetstream filters: %d collections, %d dids", len(f.Collections), len(f.DIDs))
+	return ic.conn.WriteJSON(gin.H{"type": "options_update", "payload": f})
+}
+
+// advance records the time_us of the last event read from jetstream.
+func (ic *ingestControl) advance(timeUS int64) {
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+	if timeUS > ic.cursor {
+		ic.cursor = timeUS
+	}
+}
+
+func (ic *ingestControl) paused() bool {
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+	return ic.mode == ingestPaused
+}
+
+// drop reports whether the current event should be thrown away.
+func (ic *ingestControl) drop() bool {
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+	if ic.mode == ingestDropping {
+		ic.dropped++
+		return true
+	}
+	return false
+}
+
+type IngestState struct {
+	Mode   string `json:"mode"`
+	Cursor int64  `json:"cursor"`
+	// CursorAt is Cursor as an RFC 3339 UTC timestamp
+	CursorAt string `json:"cursorAt,omitempty"`
+	Dropped  uint64 `json:"dropped"`
+	Error    string `json:"error,omitempty"`
+}
+
+func (ic *ingestControl) state() IngestState {
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+	return IngestState{Mode: ic.mode, Cursor: ic.cursor, CursorAt: indexedAt(ic.cursor), Dropped: ic.dropped}
+}
+
+// pause stops consumption and persists the cursor. The read loop notices the
+// closed connection and blocks in waitForResume.
+func (ic *ingestControl) pause(session *gocql.Session) error {
+	ic.mu.Lock()
+	if ic.mode == ingestPaused {
+		ic.mu.Unlock()
+		return nil
+	}
+	ic.mode = ingestPaused
+	ic.resume = make(chan struct{})
+	cursor := ic.cursor
+	conn := ic.conn
+	ic.mu.Unlock()
+
+	if conn != nil {
+		conn.Close()
+	}
+	log.Printf("ingestion paused at cursor %d", cursor)
+	return saveCursor(session, cursor)
+}
+
+// setMode switches between running and drop-only, waking a paused loop.
+func (ic *ingestControl) setMode(mode string) {
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+	if ic.mode == ingestPaused {
+		close(ic.resume)
+	}
+	ic.mode = mode
+	log.Printf("ingestion mode set to %s", mode)
+}
+
+// awaitResume blocks while ingestion is paused.
+func (ic *ingestControl) awaitResume() {
+	ic.mu.Lock()
+	resume := ic.resume
+	paused := ic.mode == ingestPaused
+	ic.mu.Unlock()
+	if paused {
+		<-resume
+	}
+}
+
+// waitForResume blocks while paused, then reconnects from the persisted
+// cursor, retrying until jetstream accepts the connection.
+func (ic *ingestControl) waitForResume(session *gocql.Session) *websocket.Conn {
+	ic.mu.Lock()
+	resume := ic.resume
+	fallback := ic.cursor
+	ic.mu.Unlock()
+	<-resume
+
+	cursor, err := loadCursor(session)
+	if err != nil || cursor == 0 {
+		log.Println("load cursor:", err)
+		cursor = fallback
+	}
+
+	for {
+		conn, err := dialJetstream(cursor)
+		if err == nil {
+			log.Printf("ingestion resumed from cursor %d", cursor)
+			ic.setConn(conn)
+			return conn
+		}
+		log.Println("redial:", err)
+		firehose.setError(err)
+		time.Sleep(5 * time.Second)
+	}
+}
+
+// reconnect replaces a connection that failed with err, resuming from the
+// last event read. It retries with backoff until jetstream accepts, or
+// hands over to waitForResume when ingestion was paused meanwhile.
+func (ic *ingestControl) reconnect(session *gocql.Session, err error) *websocket.Conn {
+	reason := "error"
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		reason = "timeout"
+	}
+	jetstreamReconnects.WithLabelValues(reason).Inc()
+	log.Printf("jetstream connection lost (%s): %v", reason, err)
+	firehose.setError(err)
+
+	ic.mu.Lock()
+	if ic.conn != nil {
+		ic.conn.Close()
+	}
+	ic.mu.Unlock()
+
+	backoff := time.Second
+	for {
+		if ic.paused() {
+			return ic.waitForResume(session)
+		}
+		conn, err := dialJetstream(ic.state().Cursor)
+		if err == nil {
+			log.Printf("reconnected to jetstream at cursor %d", ic.state().Cursor)
+			ic.setConn(conn)
+			return conn
+		}
+		log.Println("redial:", err)
+		firehose.setError(err)
+		time.Sleep(backoff)
+		backoff = min(backoff*2, 30*time.Second)
+	}
+}
+
+func pauseIngestion(session *gocql.Session) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		err := ingest.pause(session)
+		st := ingest.state()
+		if err != nil {
+			// still paused, the cursor is kept in memory for the resume
+			st.Error = "cursor not persisted: " + err.Error()
+		}
+		c.JSON(http.StatusOK, st)
+	}
+}
+
+func resumeIngestion(c *gin.Context) {
+	ingest.setMode(ingestRunning)
+	c.JSON(http.StatusOK, ingest.state())
+}
+
+func dropIngestion(c *gin.Context) {
+	ingest.setMode(ingestDropping)
+	c.JSON(http.StatusOK, ingest.state())
+}
+
+func getIngestionState(c *gin.Context) {
+	c.JSON(http.StatusOK, ingest.state())
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/gocql/gocql"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	janitorReclaimed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "meowview_janitor_reclaimed_rows_total",
+		Help: "Rows and cache entries the janitor removed, by table or cache.",
+	}, []string{"table"})
+
+	janitorErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "meowview_janitor_errors_total",
+		Help: "Janitor tasks that failed, by task.",
+	}, []string{"task"})
+)
+
+// The janitor removes what nothing reads anymore, every JANITOR_INTERVAL:
+//   - expired entries of the in-memory DID, post and API key caches, which
+//     are otherwise only replaced on their next lookup, and finished API key
+//     rate windows
+//   - actor_handles rows of actors who haven't meowed for
+//     ACTOR_HANDLE_RETENTION
+//   - meow_events past the change feed retention beyond a meow's
+//     EVENT_HISTORY_KEEP newest
+//   - emotion_counts and meow_activity_by_offset days older than
+//     COUNTER_RETENTION
+//
+// Each run only looks JANITOR_LOOKBACK past a retention, since earlier
+// runs cleared what is older.
+var (
+	janitorInterval      = envDuration("JANITOR_INTERVAL", 6*time.Hour)
+	janitorLookback      = envDuration("JANITOR_LOOKBACK", 30*24*time.Hour)
+	actorHandleRetention = envDuration("ACTOR_HANDLE_RETENTION", 180*24*time.Hour)
+	eventHistoryKeep     = envInt("EVENT_HISTORY_KEEP", 20)
+	counterRetention     = envDuration("COUNTER_RETENTION", 90*24*time.Hour)
+)
+
+func runJanitor(session *gocql.Session) {
+	if janitorInterval <= 0 {
+		return
+	}
+	// getActivityByTimezone reads up to 30 days back
+	if counterRetention < 31*24*time.Hour {
+		log.Fatal("COUNTER_RETENTION must be at least 31 days")
+	}
+	ticker := time.NewTicker(janitorInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		runJanitorOnce(session)
+	}
+}
+
+func runJanitorOnce(session *gocql.Session) {
+	reclaim := func(table string, n int) {
+		janitorReclaimed.WithLabelValues(table).Add(float64(n))
+		if n > 0 {
+			log.Printf("janitor removed %d from %s", n, table)
+		}
+	}
+	reclaim("did_cache", didResolver.Prune())
+	if posts != nil {
+		reclaim("post_cache", posts.prune())
+	}
+	reclaim("api_key_cache", apiKeys.prune())
+
+	tasks := []struct {
+		name string
+		run  func(*gocql.Session, func(string, int)) error
+	}{
+		{"actor_handles", expireActorHandles},
+		{"meow_events", trimEventHistory},
+		{"counters", compactCounters},
+	}
+	for _, t := range tasks {
+		if err := t.run(session, reclaim); err != nil {
+			log.Printf("janitor %s error: %v", t.name, err)
+			janitorErrors.WithLabelValues(t.name).Inc()
+		}
+	}
+}
+
+// expireActorHandles deletes the handles of actors gone quiet, which
+// suggestActors would rank last anyway. They are resolved again should
+// the actor meow.
+func expireActorHandles(session *gocql.Session, reclaim func(string, int)) error {
+	cutoff := time.Now().Add(-actorHandleRetention)
+	n := 0
+	defer func() { reclaim("actor_handles", n) }()
+	for bucket := 0; bucket < actorHandleBuckets; bucket++ {
+		iter := session.Query(`SELECT did, last_time_us, resolved_at FROM actor_handles WHERE bucket = ?`, bucket).Iter()
+		var did string
+		var last int64
+		var resolved time.Time
+		var stale []string
+		for iter.Scan(&did, &last, &resolved) {
+			if time.UnixMicro(last).Before(cutoff) && resolved.Before(cutoff) {
+				stale = append(stale, did)
+			}
+			last, resolved = 0, time.Time{}
+		}
+		if err := iter.Close(); err != nil {
+			return err
+		}
+		for _, did := range stale {
+			err := session.Query(`DELETE FROM actor_handles WHERE bucket = ? AND did = ?`, bucket, did).Exec()
+			if err != nil {
+				return err
+			}
+			actorHandles.forget(did)
+			n++
+		}
+	}
+	return nil
+}
+
+// trimEventHistory keeps the EVENT_HISTORY_KEEP newest events of each meow
+// among those the change feed no longer serves. Events within the change
+// feed retention are neither trimmed nor counted.
+func trimEventHistory(session *gocql.Session, reclaim func(string, int)) error {
+	if eventHistoryKeep <= 0 {
+		return nil
+	}
+	type event struct {
+		timeUS    int64
+		did, rkey string
+	}
+	n := 0
+	defer func() { reclaim("meow_events", n) }()
+	seen := map[string]int{}
+	newest := time.Now().Add(-changeRetention).UTC().Truncate(24*time.Hour).AddDate(0, 0, -1)
+	oldest := newest.Add(-janitorLookback)
+	for day := newest; !day.Before(oldest); day = day.AddDate(0, 0, -1) {
+		iter := session.Query(`SELECT time_us, did, rkey FROM meow_events WHERE day = ?`, day.Format("2006-01-02")).Iter()
+		var events []event
+		var ev event
+		for iter.Scan(&ev.timeUS, &ev.did, &ev.rkey) {
+			events = append(events, ev)
+		}
+		if err := iter.Close(); err != nil {
+			return err
+		}
+		// newest first, against the clustering order
+		for i := len(events) - 1; i >= 0; i-- {
+			ev := events[i]
+			key := meowURI(ev.did, ev.rkey)
+			if seen[key]++; seen[key] <= eventHistoryKeep {
+				continue
+			}
+			err := session.Query(`
+				DELETE FROM meow_events
+				WHERE day = ? AND time_us = ? AND did = ? AND rkey = ?`,
+				day.Format("2006-01-02"), ev.timeUS, ev.did, ev.rkey,
+			).Exec()
+			if err != nil {
+				return err
+			}
+			n++
+		}
+	}
+	return nil
+}
+
+// compactCounters drops the per-day counter partitions older than
+// COUNTER_RETENTION. Counters can't expire with a TTL.
+func compactCounters(session *gocql.Session, reclaim func(string, int)) error {
+	var tables []string
+	if alerts != nil {
+		tables = append(tables, "emotion_counts")
+	}
+	if timezones != nil {
+		tables = append(tables, "meow_activity_by_offset")
+	}
+	for _, table := range tables {
+		n, err := compactCounterTable(session, table)
+		reclaim(table, n)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func compactCounterTable(session *gocql.Session, table string) (int, error) {
+	n := 0
+	newest := time.Now().Add(-counterRetention).UTC().Truncate(24*time.Hour).AddDate(0, 0, -1)
+	for day := newest; !day.Before(newest.Add(-janitorLookback)); day = day.AddDate(0, 0, -1) {
+		var rows int
+		err := session.Query(`SELECT COUNT(*) FROM `+table+` WHERE day = ?`, day.Format("2006-01-02")).Scan(&rows)
+		if err != nil {
+			return n, err
+		}
+		if rows == 0 {
+			continue
+		}
+		if err := session.Query(`DELETE FROM `+table+` WHERE day = ?`, day.Format("2006-01-02")).Exec(); err != nil {
+			return n, err
+		}
+		n += rows
+	}
+	return n, nil
+}
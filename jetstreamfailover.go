@@ -0,0 +1,171 @@
+package main
+
+import (
+	"log"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/gocql/gocql"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// JETSTREAM_URLS lists jetstream instances to fail over between, in order
+// of preference, and replaces JETSTREAM_URL. Ingestion starts on the first
+// and moves on to the next one, wrapping around,
+//   - when dialing the current one fails, or
+//   - when it lags: the last event read is older than JETSTREAM_FAILOVER_LAG
+//     and didn't get any closer on two checks in a row.
+//
+// It stays on the new instance until that one fails in turn.
+//
+// Every instance stamps time_us with its own clock, so a cursor from one is
+// only roughly right on another. The new instance replays from
+// JETSTREAM_FAILOVER_REWIND before the cursor, and events up to the old
+// cursor that are already indexed are skipped instead of counted twice.
+var jetstreamFailovers = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "meowview_jetstream_failovers_total",
+	Help: "Switches to the next jetstream instance, by reason (unreachable or lagging).",
+}, []string{"reason"})
+
+type jetstreamEndpoints struct {
+	urls   []string
+	rewind time.Duration
+	lag    time.Duration
+
+	mu      sync.Mutex
+	current int
+	// rewinding is set by a failover until the next instance accepted a dial
+	rewinding bool
+	// replayUntil is the cursor at the last failover, 0 once events past
+	// it were read
+	replayUntil int64
+}
+
+var jetstreams = newJetstreamEndpoints()
+
+func newJetstreamEndpoints() *jetstreamEndpoints {
+	urls := envList("JETSTREAM_URLS")
+	if len(urls) == 0 {
+		urls = []string{jetstreamURL}
+	}
+	for _, u := range urls {
+		if _, err := url.Parse(u); err != nil {
+			log.Fatalf("JETSTREAM_URLS: %v", err)
+		}
+	}
+	return &jetstreamEndpoints{
+		urls:   urls,
+		rewind: envDuration("JETSTREAM_FAILOVER_REWIND", 10*time.Second),
+		lag:    envDuration("JETSTREAM_FAILOVER_LAG", 2*time.Minute),
+	}
+}
+
+// url is the instance to dial.
+func (j *jetstreamEndpoints) url() string {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.urls[j.current]
+}
+
+// host is the current instance without its query, for the status page.
+func (j *jetstreamEndpoints) host() string {
+	return hostOf(j.url())
+}
+
+// failover moves on to the next instance, cursor being the time_us of the
+// last event read from the current one.
+func (j *jetstreamEndpoints) failover(reason string, cursor int64) {
+	if len(j.urls) < 2 {
+		return
+	}
+	j.mu.Lock()
+	from := j.urls[j.current]
+	j.current = (j.current + 1) % len(j.urls)
+	to := j.urls[j.current]
+	j.rewinding = true
+	j.replayUntil = max(j.replayUntil, cursor)
+	j.mu.Unlock()
+
+	jetstreamFailovers.WithLabelValues(reason).Inc()
+	log.Printf("jetstream %s is %s, failing over to %s", hostOf(from), reason, hostOf(to))
+}
+
+// dialCursor is the cursor to dial the current instance with.
+func (j *jetstreamEndpoints) dialCursor(cursor int64) int64 {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if !j.rewinding || cursor == 0 {
+		return cursor
+	}
+	return max(cursor-j.rewind.Microseconds(), 1)
+}
+
+// connected ends the rewind once an instance accepted the dial.
+func (j *jetstreamEndpoints) connected() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.rewinding = false
+}
+
+// replayed reports whether ev was re-delivered by the rewind after a
+// failover and is already indexed.
+func (j *jetstreamEndpoints) replayed(session *gocql.Session, ev meowEvent) bool {
+	j.mu.Lock()
+	until := j.replayUntil
+	if until != 0 && ev.TimeUS > until {
+		j.replayUntil = 0
+	}
+	j.mu.Unlock()
+	if until == 0 || ev.TimeUS > until {
+		return false
+	}
+	return alreadyApplied(session, ev)
+}
+
+// watchLag fails over from an instance that fell behind, or went quiet
+// while still answering pings, by closing the connection under the read
+// loop, which then redials the next instance.
+func (j *jetstreamEndpoints) watchLag() {
+	if len(j.urls) < 2 || j.lag <= 0 {
+		return
+	}
+	ticker := time.NewTicker(j.lag / 2)
+	defer ticker.Stop()
+	var last time.Duration
+	strikes := 0
+	for range ticker.C {
+		st := ingest.state()
+		fh := firehose.status()
+		if st.Mode == ingestPaused || st.Cursor == 0 || fh.ConnectedSince == nil || time.Since(*fh.ConnectedSince) < j.lag {
+			strikes, last = 0, 0
+			continue
+		}
+		lag := time.Since(time.UnixMicro(st.Cursor))
+		if lag > j.lag && lag >= last {
+			strikes++
+		} else {
+			strikes = 0
+		}
+		last = lag
+		if strikes < 2 {
+			continue
+		}
+		strikes, last = 0, 0
+		j.failover("lagging", st.Cursor)
+		ingest.mu.Lock()
+		if ingest.conn != nil {
+			ingest.conn.Close()
+		}
+		ingest.mu.Unlock()
+	}
+}
+
+func hostOf(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return raw
+	}
+	return u.Host
+}
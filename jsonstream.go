@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// listStream writes a list response element by element as rows are
+// scanned, so a request holds one row in memory rather than the whole
+// page. The elements form the JSON array under key, followed by the
+// remaining fields. With Accept: application/x-ndjson every element is a
+// line of its own instead, and the remaining fields make up the last line.
+//
+// Once the first element is written the status can't change anymore. An
+// error after that ends a JSON response before the array is closed, so
+// clients see invalid JSON rather than a short list, and adds an
+// {"error": ...} line to an NDJSON one.
+type listStream struct {
+	c      *gin.Context
+	key    string
+	ndjson bool
+	n      int
+}
+
+func newListStream(c *gin.Context, key string) *listStream {
+	return &listStream{c: c, key: key, ndjson: strings.Contains(c.GetHeader("Accept"), "application/x-ndjson")}
+}
+
+func (s *listStream) start() {
+	w := s.c.Writer
+	if s.ndjson {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.WriteString(`{"` + s.key + `":[`)
+}
+
+func (s *listStream) add(v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if s.n == 0 {
+		s.start()
+	}
+	w := s.c.Writer
+	if s.ndjson {
+		b = append(b, '\n')
+	} else if s.n > 0 {
+		w.WriteString(",")
+	}
+	s.n++
+	_, err = w.Write(b)
+	return err
+}
+
+// finish closes the list and writes fields after it.
+func (s *listStream) finish(fields gin.H) {
+	if s.n == 0 {
+		s.start()
+	}
+	w := s.c.Writer
+	b, _ := json.Marshal(fields)
+	if s.ndjson {
+		if len(fields) > 0 {
+			w.Write(append(b, '\n'))
+		}
+		return
+	}
+	w.WriteString("]")
+	if len(fields) > 0 {
+		// the fields' object without its opening brace
+		w.WriteString(",")
+		w.Write(b[1:])
+	} else {
+		w.WriteString("}")
+	}
+}
+
+// fail answers with an error response when nothing was written yet, and
+// otherwise cuts the stream short as described above.
+func (s *listStream) fail(status int, err error) {
+	if s.n == 0 {
+		s.c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	if s.ndjson {
+		b, _ := json.Marshal(gin.H{"error": err.Error()})
+		s.c.Writer.Write(append(b, '\n'))
+	}
+	s.c.Abort()
+}
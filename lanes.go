@@ -0,0 +1,105 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	backfillWriteWait = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "meowview_backfill_write_wait_seconds",
+		Help:    "Time backfill writes waited for live events to go first.",
+		Buckets: prometheus.DefBuckets,
+	})
+
+	backfillHeld = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "meowview_backfill_held",
+		Help: "1 while backfill writes are held because the live lag is over LIVE_LAG_TARGET.",
+	})
+)
+
+// Live events and backfilled meows are written to the same tables. Live
+// events are written by the jetstream reader as they arrive; backfill
+// writes go through writeLanes so they don't crowd them out:
+//   - at most BACKFILL_WRITERS backfill writes run at once
+//   - while live events keep coming, a backfill write is let through for
+//     every BACKFILL_WRITE_WEIGHT live ones
+//   - while the live lag is over LIVE_LAG_TARGET, none are
+//
+// Once no live event has come for liveIdleAfter, backfill writes run as
+// fast as the writers allow.
+type writeLanes struct {
+	writers   chan struct{}
+	weight    int
+	lagTarget time.Duration
+
+	mu sync.Mutex
+	// live counts live events since the last backfill credit
+	live     int
+	credits  int
+	lastLive time.Time
+	lag      time.Duration
+}
+
+// liveIdleAfter is how long without live events before backfill writes
+// stop waiting for them.
+const liveIdleAfter = time.Second
+
+var lanes = &writeLanes{
+	writers:   make(chan struct{}, max(envInt("BACKFILL_WRITERS", 2), 1)),
+	weight:    max(envInt("BACKFILL_WRITE_WEIGHT", 4), 1),
+	lagTarget: envDuration("LIVE_LAG_TARGET", 5*time.Second),
+}
+
+// observeLive records a live event written with the given lag.
+func (l *writeLanes) observeLive(lag time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lastLive = time.Now()
+	l.lag = lag
+	if l.live++; l.live >= l.weight {
+		l.live = 0
+		l.credits = min(l.credits+1, cap(l.writers))
+	}
+}
+
+// admit reports whether a backfill write may go now, and whether it is
+// held back by the live lag.
+func (l *writeLanes) admit() (ok, held bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	switch {
+	case time.Since(l.lastLive) > liveIdleAfter:
+		return true, false
+	case l.lag > l.lagTarget:
+		return false, true
+	case l.credits > 0:
+		l.credits--
+		return true, false
+	}
+	return false, false
+}
+
+// backfill waits for a backfill write's turn. The returned func must be
+// called once the write is done.
+func (l *writeLanes) backfill() func() {
+	start := time.Now()
+	l.writers <- struct{}{}
+	for {
+		ok, held := l.admit()
+		if held {
+			backfillHeld.Set(1)
+		} else {
+			backfillHeld.Set(0)
+		}
+		if ok {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	backfillWriteWait.Observe(time.Since(start).Seconds())
+	return func() { <-l.writers }
+}
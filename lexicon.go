@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// meowNSID is the collection of meow records.
+const meowNSID = "moe.kasey.meow"
+
+// emotionMaxLength is the longest emotion kept, in bytes; longer ones are
+// truncated on ingest, at a rune boundary, see normalizeEmotion.
+const emotionMaxLength = 50
+
+// Lexicon documents, as specified at https://atproto.com/specs/lexicon.
+// Only the parts the meow lexicon uses are modelled.
+type Lexicon struct {
+	Lexicon     int                   `json:"lexicon"`
+	ID          string                `json:"id"`
+	Revision    int                   `json:"revision,omitempty"`
+	Description string                `json:"description,omitempty"`
+	Defs        map[string]LexiconDef `json:"defs"`
+}
+
+type LexiconDef struct {
+	Type        string         `json:"type"`
+	Description string         `json:"description,omitempty"`
+	Key         string         `json:"key,omitempty"`
+	Record      *LexiconObject `json:"record,omitempty"`
+}
+
+type LexiconObject struct {
+	Type       string                     `json:"type"`
+	Required   []string                   `json:"required,omitempty"`
+	Properties map[string]LexiconProperty `json:"properties"`
+}
+
+type LexiconProperty struct {
+	Type      string `json:"type"`
+	Format    string `json:"format,omitempty"`
+	MaxLength int    `json:"maxLength,omitempty"`
+	// Enum closes a string property to these values, see
+	// lexiconvalidate.go
+	Enum        []string `json:"enum,omitempty"`
+	Description string   `json:"description,omitempty"`
+}
+
+// meowLexicon describes the record ingest accepts, built from the same
+// constants and checks ingest validates with: the tid record key of
+// rkeyRegex, emotionMaxLength, and the subjects validateSubject keeps.
+var meowLexicon = Lexicon{
+	Lexicon:     1,
+	ID:          meowNSID,
+	Revision:    1,
+	Description: "A meow: an emotion, optionally about a subject.",
+	Defs: map[string]LexiconDef{
+		"main": {
+			Type: "record",
+			Key:  "tid",
+			Record: &LexiconObject{
+				Type: "object",
+				Properties: map[string]LexiconProperty{
+					// no maxLength, which would get longer ones rejected
+					"emotion": {
+						Type:        "string",
+						Description: fmt.Sprintf("Free-form emotion, compared case-insensitively. Ones longer than %d bytes are truncated.", emotionMaxLength),
+					},
+					"subject": {
+						Type:        "string",
+						Format:      "uri",
+						Description: "A did:plc or did:web DID, or the at:// URI of a post or meow. Other URIs are dropped; a subject that isn't a URI gets the record rejected.",
+					},
+				},
+			},
+		},
+	},
+}
+
+// lexicons are the documents served under /lexicons/, by NSID: the newest
+// revision, see lexiconversions.go, or LEXICON_FILE, see
+// lexiconvalidate.go.
+var lexicons = servedLexicons()
+
+// indexedLexicons are the record collections this AppView ingests.
+var indexedLexicons = []string{meowNSID}
+
+// getLexicon serves a lexicon document at /lexicons/<nsid>, with or
+// without a .json suffix, and older revisions with ?revision=.
+func getLexicon(c *gin.Context) {
+	nsid := strings.TrimSuffix(c.Param("nsid"), ".json")
+	lex, ok := lexicons[nsid]
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "unknown lexicon"})
+		return
+	}
+	if v := c.Query("revision"); v != "" {
+		n, _ := strconv.Atoi(v)
+		rev := lexiconRevision(nsid, n)
+		if rev == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "unknown revision"})
+			return
+		}
+		lex = *rev
+	}
+	c.Header("Cache-Control", "public, max-age=3600")
+	c.JSON(http.StatusOK, lex)
+}
+
+// listLexicons lists the NSIDs served under /lexicons/.
+func listLexicons(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"lexicons": indexedLexicons})
+}
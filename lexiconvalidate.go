@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Decoded records are validated against their lexicon revision's document
+// before they are indexed: $type, required properties, property types,
+// string lengths, formats and enums. A record that breaks it is rejected as a whole
+// with reason schema, see rejections.go, rather than indexed with garbage.
+// Properties the document doesn't declare are let through, as atproto
+// expects of records written against a newer revision.
+//
+// LEXICON_FILE names a lexicon JSON document, e.g. one narrowing emotion
+// down to an enum, which the built-in document leaves free-form, that
+// replaces the built-in document of the newest
+// revision of its collection, for validation and under /lexicons/. It is
+// read at startup.
+//
+// Only the formats meows use are checked: did, handle, at-uri, uri and
+// datetime; others pass.
+
+var lexiconFile = loadLexiconFile(envString("LEXICON_FILE", ""))
+
+// lexiconViolation is a record breaking its lexicon.
+type lexiconViolation struct {
+	// Field is the property, or $type
+	Field  string
+	Reason string
+}
+
+func (v *lexiconViolation) Error() string {
+	return v.Field + ": " + v.Reason
+}
+
+var (
+	lexiconDIDRegex   = regexp.MustCompile(`^did:[a-z]+:[a-zA-Z0-9._:%-]*[a-zA-Z0-9._-]$`)
+	lexiconATURIRegex = regexp.MustCompile(`^at://[^/?#\s]+(/[a-zA-Z0-9.-]+(/[^/?#\s]+)?)?$`)
+	lexiconURIRegex   = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9+.-]*:\S+$`)
+)
+
+func loadLexiconFile(path string) *Lexicon {
+	if path == "" {
+		return nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		log.Fatalf("LEXICON_FILE: %v", err)
+	}
+	var lex Lexicon
+	if err := json.Unmarshal(b, &lex); err != nil {
+		log.Fatalf("LEXICON_FILE: %v", err)
+	}
+	if len(recordVersions[lex.ID]) == 0 {
+		log.Fatalf("LEXICON_FILE: %q is not an indexed collection", lex.ID)
+	}
+	if lex.Defs["main"].Record == nil {
+		log.Fatalf("LEXICON_FILE: %s has no main record definition", lex.ID)
+	}
+	log.Printf("validating %s records against %s", lex.ID, path)
+	return &lex
+}
+
+// servedLexicons are the newest documents, LEXICON_FILE's taking over.
+func servedLexicons() map[string]Lexicon {
+	served := map[string]Lexicon{}
+	for nsid, versions := range recordVersions {
+		served[nsid] = *versions[len(versions)-1].Lexicon
+	}
+	if lexiconFile != nil {
+		served[lexiconFile.ID] = *lexiconFile
+	}
+	return served
+}
+
+// validationLexicon is the document records of revision version of nsid
+// are validated against.
+func validationLexicon(nsid string, version int) *Lexicon {
+	versions := recordVersions[nsid]
+	if lexiconFile != nil && lexiconFile.ID == nsid && version == versions[len(versions)-1].Version {
+		return lexiconFile
+	}
+	return lexiconRevision(nsid, version)
+}
+
+// validateRecord checks a record against the main definition of lex.
+func validateRecord(lex *Lexicon, raw []byte) error {
+	def := lex.Defs["main"].Record
+	if def == nil {
+		return nil
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return err
+	}
+	var typ string
+	if json.Unmarshal(fields["$type"], &typ) != nil || typ != lex.ID {
+		return &lexiconViolation{Field: "$type", Reason: "must be " + lex.ID}
+	}
+	for _, name := range def.Required {
+		if v, ok := fields[name]; !ok || string(v) == "null" {
+			return &lexiconViolation{Field: name, Reason: "is required"}
+		}
+	}
+	names := make([]string, 0, len(def.Properties))
+	for name := range def.Properties {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		v, ok := fields[name]
+		if !ok || string(v) == "null" {
+			continue
+		}
+		if reason := validateProperty(def.Properties[name], v); reason != "" {
+			return &lexiconViolation{Field: name, Reason: reason}
+		}
+	}
+	return nil
+}
+
+// validateProperty returns why v breaks prop, or "".
+func validateProperty(prop LexiconProperty, v json.RawMessage) string {
+	switch prop.Type {
+	case "string":
+		var s string
+		if json.Unmarshal(v, &s) != nil {
+			return "must be a string"
+		}
+		// in UTF-8 bytes, as atproto counts it
+		if prop.MaxLength > 0 && len(s) > prop.MaxLength {
+			return fmt.Sprintf("must be at most %d bytes", prop.MaxLength)
+		}
+		if reason := validateFormat(prop.Format, s); reason != "" {
+			return reason
+		}
+		if len(prop.Enum) > 0 && !slices.Contains(prop.Enum, s) {
+			return "must be one of " + strings.Join(prop.Enum, ", ")
+		}
+	case "integer":
+		var n float64
+		if json.Unmarshal(v, &n) != nil || n != math.Trunc(n) {
+			return "must be an integer"
+		}
+	case "boolean":
+		var b bool
+		if json.Unmarshal(v, &b) != nil {
+			return "must be a boolean"
+		}
+	case "array":
+		var a []json.RawMessage
+		if json.Unmarshal(v, &a) != nil {
+			return "must be an array"
+		}
+	case "object":
+		var o map[string]json.RawMessage
+		if json.Unmarshal(v, &o) != nil {
+			return "must be an object"
+		}
+	}
+	return ""
+}
+
+// validateFormat returns why s isn't of the string format, or "".
+func validateFormat(format, s string) string {
+	ok := true
+	switch format {
+	case "did":
+		ok = lexiconDIDRegex.MatchString(s)
+	case "handle":
+		ok = handleRegex.MatchString(strings.ToLower(s))
+	case "at-uri":
+		ok = lexiconATURIRegex.MatchString(s)
+	case "uri":
+		// not url.Parse, which takes the did:plc: of an at:// authority
+		// for a port
+		ok = lexiconURIRegex.MatchString(s) && len(s) <= 8192
+	case "datetime":
+		_, err := time.Parse(time.RFC3339Nano, s)
+		ok = err == nil
+	}
+	if !ok {
+		return "is not a valid " + format
+	}
+	return ""
+}
+
+// rejectionReason is the rejected_meows reason of a decodeRecord or
+// setRecord error.
+func rejectionReason(err error) string {
+	var v *lexiconViolation
+	switch {
+	case errors.As(err, &v):
+		return rejectSchema
+	case errors.Is(err, errEmotionRefused):
+		return rejectPolicy
+	}
+	return rejectInvalid
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gocql/gocql"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Lexicons evolve by revision: a new one may add optional properties, and
+// records of every revision keep arriving, from old clients and from
+// backfills. recordVersions registers, per collection and oldest first,
+// how the records of each revision are recognised and decoded. A record is
+// of the newest revision whose added properties it uses. Properties no
+// revision knows are ignored, so a record of a revision newer than the
+// registry decodes as the newest one it knows.
+//
+// Adding a revision means appending it here with the properties it adds
+// and a decoder filling them into MeowRecord; the decoders of older
+// revisions stay as they are.
+//
+// Each meow stores the revision it was decoded as, as lexicon_version in
+// meows and meow_events; rows from before it have none, and reprocess
+// fills it in.
+
+type recordVersion struct {
+	Version int
+	// Lexicon is the document of this revision
+	Lexicon *Lexicon
+	// Added are the properties the revision introduced
+	Added []string
+	// Decode reads and validates a record of this revision
+	Decode func(raw []byte) (MeowRecord, error)
+}
+
+var recordVersions = map[string][]recordVersion{
+	meowNSID: {
+		{Version: 1, Lexicon: &meowLexicon, Decode: decodeMeowV1},
+	},
+}
+
+var recordsDecoded = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "meowview_records_decoded_total",
+	Help: "Records decoded, by collection, lexicon revision and whether they were valid.",
+}, []string{"collection", "version", "valid"})
+
+func decodeMeowV1(raw []byte) (MeowRecord, error) {
+	var record MeowRecord
+	if err := json.Unmarshal(raw, &record); err != nil {
+		return MeowRecord{}, err
+	}
+	if record.Type != meowNSID {
+		return MeowRecord{}, &lexiconViolation{Field: "$type", Reason: "must be " + meowNSID}
+	}
+	return record, nil
+}
+
+// decodeRecord validates a record of the collection nsid against the
+// lexicon of its revision, see lexiconvalidate.go, and decodes it with the
+// revision's decoder. It returns the revision.
+func decodeRecord(nsid string, raw []byte) (MeowRecord, int, error) {
+	versions := recordVersions[nsid]
+	if len(versions) == 0 {
+		return MeowRecord{}, 0, fmt.Errorf("no decoder for %s", nsid)
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return MeowRecord{}, 0, err
+	}
+	v := versions[0]
+	for _, candidate := range versions[1:] {
+		for _, name := range candidate.Added {
+			if _, ok := fields[name]; ok {
+				v = candidate
+			}
+		}
+	}
+	var record MeowRecord
+	var err error
+	if lex := validationLexicon(nsid, v.Version); lex != nil {
+		err = validateRecord(lex, raw)
+	}
+	if err == nil {
+		record, err = v.Decode(raw)
+	}
+	recordsDecoded.WithLabelValues(nsid, strconv.Itoa(v.Version), strconv.FormatBool(err == nil)).Inc()
+	if err != nil {
+		return MeowRecord{}, v.Version, err
+	}
+	return record, v.Version, nil
+}
+
+// lexiconRevision is the document of one revision of nsid, or nil.
+func lexiconRevision(nsid string, version int) *Lexicon {
+	for _, v := range recordVersions[nsid] {
+		if v.Version == version {
+			return v.Lexicon
+		}
+	}
+	return nil
+}
+
+// getMeowsByLexiconVersion lists meows stored as a given revision of the
+// meow lexicon, e.g. to check how a new revision is being adopted. Meows
+// without a stored revision aren't listed.
+func getMeowsByLexiconVersion(session *gocql.Session) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		version, err := strconv.Atoi(c.Query("version"))
+		if err != nil || lexiconRevision(meowNSID, version) == nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "version must be a known revision of " + meowNSID})
+			return
+		}
+		limit := 100
+		if v := c.Query("limit"); v != "" {
+			if limit, err = strconv.Atoi(v); err != nil || limit < 1 || limit > 1000 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and 1000"})
+				return
+			}
+		}
+		iter := session.Query(`
+			SELECT `+meowSeqColumns+`
+			FROM cat.meows
+			WHERE lexicon_version = ?
+			LIMIT ?
+			ALLOW FILTERING`,
+			version, limit,
+		).WithContext(c.Request.Context()).Iter()
+		meows := []MeowResponse{}
+		var row meowRow
+		for iter.Scan(row.seqDest()...) {
+			meows = append(meows, row.meow().response())
+			row = meowRow{}
+		}
+		if err := iter.Close(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"version": version, "meows": meows})
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gocql/gocql"
+)
+
+// legacyListResponses makes the meow list endpoints answer with a bare
+// array again, for clients that predate MeowPage.
+var legacyListResponses = envBool("LEGACY_LIST_RESPONSES", false)
+
+// MeowPage is a page of a meow list endpoint.
+type MeowPage struct {
+	Meows []MeowResponse `json:"meows"`
+	// Cursor is passed back as ?cursor= for the next, older page. It is
+	// empty on the last page.
+	Cursor string `json:"cursor,omitempty"`
+	// ApproxTotal is how many meows the list has over all time, from
+	// counters that replayed or lost writes can leave slightly off.
+	ApproxTotal int64 `json:"approxTotal"`
+	// IndexLagMs is how far the index is behind the network, see
+	// freshness.go
+	IndexLagMs int64 `json:"indexLagMs"`
+}
+
+// meow_counts scopes; the key is "" for all meows, else the DID or subject
+const (
+	countAll     = "all"
+	countActor   = "actor"
+	countSubject = "subject"
+)
+
+func createCountTables(session *gocql.Session) error {
+	err := session.Query(`
+		CREATE TABLE IF NOT EXISTS meow_counts (
+			scope TEXT,
+			key TEXT,
+			meows COUNTER,
+			PRIMARY KEY ((scope, key))
+		)`).Exec()
+	if err != nil {
+		return err
+	}
+
+	// the version of each meow the counters hold, see claimCount
+	return session.Query(`
+		CREATE TABLE IF NOT EXISTS counted_meows (
+			did TEXT,
+			rkey TEXT,
+			cid TEXT,
+			time_us BIGINT,
+			emotion TEXT,
+			subject TEXT,
+			inferred_emotion TEXT,
+			PRIMARY KEY ((did, rkey))
+		)`).Exec()
+}
+
+// countMeow adds delta to the counters of every list m is on. It runs
+// alongside the derived tables, so an update that changes the subject
+// moves the meow from one count to the other. Counting isn't idempotent
+// itself; claimCount and releaseCount make sure each meow is counted once.
+func countMeow(session *gocql.Session, m Meow, delta int64) {
+	keys := [][2]string{{countAll, ""}, {countActor, m.DID}}
+	if m.Subject != "" {
+		keys = append(keys, [2]string{countSubject, m.Subject})
+	}
+	for _, k := range keys {
+		err := session.Query(`
+			UPDATE meow_counts SET meows = meows + ?
+			WHERE scope = ? AND key = ?`,
+			delta, k[0], k[1],
+		).Exec()
+		if err != nil {
+			log.Println("update meow_counts error:", err)
+		}
+	}
+}
+
+func approxMeowCount(ctx context.Context, session *gocql.Session, scope, key string) (int64, error) {
+	var n int64
+	err := session.Query(`SELECT meows FROM meow_counts WHERE scope = ? AND key = ?`, scope, key).
+		WithContext(ctx).Scan(&n)
+	if err == gocql.ErrNotFound {
+		return 0, nil
+	}
+	return max(n, 0), err
+}
+
+// listCursor points at the oldest meow of a MeowPage, as
+// "<time_us>/<seq>". The sequence number breaks ties between meows with
+// the same time_us, so the next page neither skips nor repeats them.
+type listCursor struct {
+	TimeUS int64
+	Seq    int64
+}
+
+func (cur listCursor) String() string {
+	return fmt.Sprintf("%d/%d", cur.TimeUS, cur.Seq)
+}
+
+// parseListCursor also takes the bare time_us cursors of before sequence
+// numbers, as the cursor of every meow with that time_us.
+func parseListCursor(s string) (listCursor, error) {
+	t, seq, hasSeq := strings.Cut(s, "/")
+	timeUS, err := strconv.ParseInt(t, 10, 64)
+	if err != nil || timeUS < 0 {
+		return listCursor{}, fmt.Errorf("invalid cursor")
+	}
+	if !hasSeq {
+		return listCursor{TimeUS: timeUS}, nil
+	}
+	n, err := strconv.ParseInt(seq, 10, 64)
+	if err != nil || n < 0 {
+		return listCursor{}, fmt.Errorf("invalid cursor")
+	}
+	return listCursor{TimeUS: timeUS, Seq: n}, nil
+}
+
+// nextCursor is the cursor after a page, taken before moderation filters
+// it: that of its oldest meow, or "" when the query didn't fill the page.
+func nextCursor(meows []MeowResponse, full bool) string {
+	if !full || len(meows) == 0 {
+		return ""
+	}
+	oldest := listCursor{TimeUS: meows[0].TimeUS, Seq: meows[0].seq}
+	for _, m := range meows[1:] {
+		if m.TimeUS < oldest.TimeUS || (m.TimeUS == oldest.TimeUS && m.seq < oldest.Seq) {
+			oldest = listCursor{TimeUS: m.TimeUS, Seq: m.seq}
+		}
+	}
+	return oldest.String()
+}
+
+// writeMeowPage answers a meow list request, newest first, with the count
+// of the list named by scope and key.
+func writeMeowPage(c *gin.Context, session *gocql.Session, meows []MeowResponse, cursor, scope, key string) {
+	sort.SliceStable(meows, func(i, j int) bool {
+		if meows[i].TimeUS != meows[j].TimeUS {
+			return meows[i].TimeUS > meows[j].TimeUS
+		}
+		return meows[i].seq > meows[j].seq
+	})
+	writeMeowList(c, session, meows, cursor, scope, key)
+}
+
+// writeMeowList is writeMeowPage for meows already in the order asked for.
+func writeMeowList(c *gin.Context, session *gocql.Session, meows []MeowResponse, cursor, scope, key string) {
+	lag := setIndexLag(c)
+	if legacyListResponses {
+		c.JSON(http.StatusOK, meows)
+		return
+	}
+	total, err := approxMeowCount(c.Request.Context(), session, scope, key)
+	if err != nil {
+		// the page is still useful without its total
+		log.Println("read meow_counts error:", err)
+	}
+	if meows == nil {
+		meows = []MeowResponse{}
+	}
+	c.JSON(http.StatusOK, MeowPage{Meows: meows, Cursor: cursor, ApproxTotal: total, IndexLagMs: lag})
+}
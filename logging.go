@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// LOG_LEVEL is debug, the default, which logs every firehose message, or
+// info, which leaves those lines out. It is reloaded at runtime along with
+// SLOW_QUERY_THRESHOLD.
+var debugLogging atomic.Bool
+
+func loadLogLevel() (bool, error) {
+	switch level := envString("LOG_LEVEL", "debug"); level {
+	case "debug":
+		return true, nil
+	case "info":
+		return false, nil
+	default:
+		return false, fmt.Errorf("LOG_LEVEL: unknown level %q, want debug or info", level)
+	}
+}
+
+func reloadLogging() (func(), error) {
+	debug, err := loadLogLevel()
+	if err != nil {
+		return nil, err
+	}
+	threshold, err := lookupDuration("SLOW_QUERY_THRESHOLD", 500*time.Millisecond)
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		debugLogging.Store(debug)
+		slowQueryLog.threshold.Store(int64(threshold))
+	}, nil
+}
+
+// debugf logs only at LOG_LEVEL=debug.
+func debugf(format string, args ...any) {
+	if debugLogging.Load() {
+		log.Printf(format, args...)
+	}
+}
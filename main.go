@@ -13,13 +13,9 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/gocql/gocql"
 	"github.com/gorilla/websocket"
-	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-type DIDDocument struct {
-	ID string `json:"id"`
-}
-
 type WebSocketMessage struct {
 	DID    string `json:"did"`
 	TimeUS int64  `json:"time_us"`
@@ -32,6 +28,13 @@ type WebSocketMessage struct {
 		Record     json.RawMessage `json:"record"`
 		CID        string          `json:"cid"`
 	} `json:"commit"`
+	Account struct {
+		Active bool   `json:"active"`
+		Status string `json:"status"`
+	} `json:"account"`
+	Identity struct {
+		Handle string `json:"handle"`
+	} `json:"identity"`
 }
 
 type MeowRecord struct {
@@ -43,61 +46,167 @@ type MeowRecord struct {
 type MeowResponse struct {
 	Rkey string `json:"rkey"`
 	TimeUS int64 `json:"time_us"`
+	// IndexedAt is TimeUS as an RFC 3339 UTC timestamp
+	IndexedAt string `json:"indexedAt,omitempty"`
 	CID string `json:"cid"`
 	DID string `json:"did"`
 	Emotion string `json:"emotion"`
 	Subject string `json:"subject"`
+	// InferredEmotion is set by the classifier when the record had no emotion
+	InferredEmotion string `json:"inferred_emotion,omitempty"`
+	// Post is the app.bsky.feed.defs#postView of a post subject, only
+	// present when requested with hydrate=posts
+	Post json.RawMessage `json:"post,omitempty"`
+	// Quoted is the meow a meow's subject points to, see embedQuotes
+	Quoted *MeowResponse `json:"quoted,omitempty"`
+	// Labels are moderation labels, see moderation.go
+	Labels []string `json:"labels,omitempty"`
+	// Pinned is set on the meow its author pinned, see pins.go
+	Pinned bool `json:"pinned,omitempty"`
+	// Handle is the author's handle and HandleVerified whether it
+	// resolves back to them, only present when requested with
+	// hydrate=actors, see handleverify.go
+	Handle         string `json:"handle,omitempty"`
+	HandleVerified *bool  `json:"handleVerified,omitempty"`
+	// LexiconVersion is the revision of the record, see lexiconversions.go
+	LexiconVersion int `json:"lexicon_version,omitempty"`
+	// seq breaks time_us ties in list cursors, see listpage.go
+	seq int64
 }
 
 func createKeyspace(session *gocql.Session) error {
-	const maxRetries = 20
-	var err error
-
-	for i := 0; i < maxRetries; i++ {
-		err = session.Query(`
-			CREATE KEYSPACE IF NOT EXISTS cat 
-			WITH replication = {
-				'class': 'SimpleStrategy',
-				'replication_factor': 1
-			}`).Exec()
-		if err == nil {
-			return nil
-		}
-		log.Printf("keyspace creation attempt %d failed: %v", i+1, err)
-		time.Sleep(5 * time.Second)
+	err := session.Query(`
+		CREATE KEYSPACE IF NOT EXISTS cat 
+		WITH replication = ` + keyspaceReplication()).Exec()
+	if err != nil {
+		return err
+	}
+	return alterKeyspaceReplication(session)
+}
+
+// createMeowTables creates the meows table and its secondary indexes.
+func createMeowTables(session *gocql.Session) error {
+	// Create table with DID column
+	err := session.Query(`
+		CREATE TABLE IF NOT EXISTS meows (
+			id UUID PRIMARY KEY,
+			rkey TEXT,
+			time_us BIGINT,
+			cid TEXT,
+			did TEXT,
+			emotion TEXT,
+			subject TEXT,
+			inferred_emotion TEXT,
+			seq BIGINT,
+			lexicon_version INT
+		)`).Exec()
+	if err != nil {
+		return err
+	}
+
+	// tables created before emotion inference existed lack the column
+	if err := addColumn(session, "meows", "inferred_emotion", "TEXT"); err != nil {
+		return err
+	}
+	if err := addColumn(session, "meows", "seq", "BIGINT"); err != nil {
+		return err
+	}
+	if err := addColumn(session, "meows", "lexicon_version", "INT"); err != nil {
+		return err
+	}
+	
+	// single meows are looked up by their id, see meowID
+	err = session.Query(`DROP INDEX IF EXISTS meows_rkey_idx`).Exec()
+	if err != nil {
+		return err
+	}
+
+	// Create secondary index on DID
+	err = session.Query(`
+		CREATE INDEX IF NOT EXISTS meows_did_idx 
+		ON meows (did)`).Exec()
+	if err != nil {
+		return err
+	}
+	
+	// create secondary index on subject
+	err = session.Query(`
+		CREATE INDEX IF NOT EXISTS meows_subject_idx 
+		ON meows (subject)`).Exec()
+	if err != nil {
+		return err
 	}
-	return fmt.Errorf("failed to create keyspace after %d attempts: %v", maxRetries, err)
+
+	// create secondary index on time 
+	err = session.Query(`
+		CREATE INDEX IF NOT EXISTS meows_time_idx 
+		ON meows (time_us)`).Exec()
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// addColumn adds a column to an existing table, treating "already exists"
+// as success so it can run on every startup.
+func addColumn(session *gocql.Session, table, column, typ string) error {
+	err := session.Query(fmt.Sprintf(`ALTER TABLE %s ADD %s %s`, table, column, typ)).Exec()
+	if err != nil && (strings.Contains(err.Error(), "conflicts with an existing column") ||
+		strings.Contains(err.Error(), "already exist")) {
+		return nil
+	}
+	return err
 }
 
 func main() {
+	// secrets never reach the log, see secrets.go
+	redactLogs()
+	if len(os.Args) > 1 && os.Args[1] == "publish" {
+		runPublish(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "reprocess" {
+		runReprocess(os.Args[2:])
+		return
+	}
+
 	log.Println("starting meow server")
-	cassandraHost := os.Getenv("CASSANDRA_HOST")
+	// signals and service managers, see service.go
+	handleShutdown()
+	// settings that can be changed without a restart, see reload.go
+	if err := applyConfig(); err != nil {
+		log.Fatal("config:", err)
+	}
+	go runConfigWatcher()
+	cassandraHost := getenv("CASSANDRA_HOST")
 	if cassandraHost == "" {
 		cassandraHost = "127.0.0.1"
 	}
 	cluster := gocql.NewCluster(cassandraHost)
 	cluster.Timeout = 5 * time.Second
 	cluster.ProtoVersion = 4
+	cluster.QueryObserver = slowQueryLog
+	configureRegion(cluster)
+	configureAuth(cluster)
 
 	// Create keyspace
 	systemCluster := gocql.NewCluster(cassandraHost)
 	systemCluster.Keyspace = "system"
 	systemCluster.ProtoVersion = 4
 	systemCluster.Timeout = 10 * time.Second
+	configureRegion(systemCluster)
+	configureAuth(systemCluster)
 
-	systemSession, err := systemCluster.CreateSession()
+	// wait for Cassandra, then migrate and verify the schema before
+	// serving, see startup.go
+	systemSession, err := waitForDatabase(systemCluster)
 	if err != nil {
-		log.Fatal("system session:", err)
+		log.Fatal("wait for cassandra:", err)
 	}
 	defer systemSession.Close()
-	if err := createKeyspace(systemSession); err != nil {
-		log.Fatal("create keyspace:", err)
-	}
 
-	err = systemSession.Query(`
-		CREATE KEYSPACE IF NOT EXISTS cat 
-		WITH replication = {'class': 'SimpleStrategy', 'replication_factor': 1}`).Exec()
-	if err != nil {
+	startup.enter(phaseMigrating)
+	if err := createKeyspace(systemSession); err != nil {
 		log.Fatal("create keyspace:", err)
 	}
 
@@ -108,79 +217,153 @@ func main() {
 		log.Fatal("cassandra session:", err)
 	}
 	defer session.Close()
+	if err := runMigrations(session); err != nil {
+		log.Fatal("migrate:", err)
+	}
 
-	// Create table with DID column
-	err = session.Query(`
-		CREATE TABLE IF NOT EXISTS meows (
-			id UUID PRIMARY KEY,
-			rkey TEXT,
-			time_us BIGINT,
-			cid TEXT,
-			did TEXT,
-			emotion TEXT,
-			subject TEXT
-		)`).Exec()
+	startup.enter(phaseVerifyingSchema)
+	err = startup.retry(envDuration("STARTUP_SCHEMA_TIMEOUT", time.Minute), func() error {
+		return verifySchema(session)
+	})
 	if err != nil {
-		log.Fatal("create table:", err)
+		log.Fatal("verify schema:", err)
 	}
-	
-	// craete secondary index on rkey
-	err = session.Query(`
-		CREATE INDEX IF NOT EXISTS meows_rkey_idx 
-		ON meows (rkey)`).Exec()
-	if err != nil {
-		log.Fatal("create rkey index:", err)
+
+	// daily/weekly digest emails, only when configured
+	if digest := digestConfigFromEnv(); digest != nil {
+		log.Printf("sending %s digest to %d recipients", digest.Interval, len(digest.Recipients))
+		go runDigest(session, digest)
+		enableFeature("digest")
 	}
 
-	// Create secondary index on DID
-	err = session.Query(`
-		CREATE INDEX IF NOT EXISTS meows_did_idx 
-		ON meows (did)`).Exec()
-	if err != nil {
-		log.Fatal("create actor index:", err)
+	// hidden and labelled meows, kept in memory for the read path
+	if err := moderation.load(session); err != nil {
+		log.Fatal("load moderation state:", err)
 	}
-	
-	// create secondary index on subject
-	err = session.Query(`
-		CREATE INDEX IF NOT EXISTS meows_subject_idx 
-		ON meows (subject)`).Exec()
-	if err != nil {
-		log.Fatal("create subject index:", err)
+	go moderation.run(session)
+	// emotion and actor typeahead, see emotionsuggest.go and actorsuggest.go
+	if err := emotionSuggestions.load(session); err != nil {
+		log.Println("load emotion vocabulary error:", err)
+	}
+	go emotionSuggestions.run(session)
+	if err := actorHandles.load(session); err != nil {
+		log.Println("load actor handles error:", err)
+	}
+	go actorHandles.run(session)
+	go runAbuseScan(session, abuseHeuristics)
+	go runEchoReconciler(session)
+	// stale caches, trimmed event history and old counters, see janitor.go
+	go runJanitor(session)
+	// history from PDSs, queued with /_admin/startBackfill
+	go backfill.run(session)
+	// a candidate pipeline compared on sampled live events, see shadow.go
+	if shadow != nil {
+		go shadow.run()
+	}
+	// events spooled while the database was down or journaled before a
+	// crash, see spool.go
+	if spool != nil {
+		go spool.run(session)
+		enableFeature("eventSpool")
+	}
+	if getenv("SERVICE_DID") != "" {
+		enableFeature("bookmarks")
+		enableFeature("preferences")
+		enableFeature("apiKeys")
+		enableFeature("pins")
+		enableFeature("reports")
+		enableFeature("localEcho")
 	}
 
-	// create secondary index on time 
-	err = session.QUERY(`
-		CREATE INDEX IF NOT EXISTS meows_time_idx 
-		ON meows (time_us)`).Exec()
-	if err != nil {
-		log.Fatal("create time index:", err)
+	// outbox for webhook and Kafka sinks
+	if len(outboxSinks) > 0 {
+		log.Printf("delivering meows to %d outbox sinks", len(outboxSinks))
+		go runOutbox(session)
+	}
+
+	// opt-in activity by declared timezone, see timezone.go
+	if timezones != nil {
+		log.Println("actor timezone enrichment enabled")
+		enableFeature("timezoneActivity")
+	}
+
+	// webhooks when an emotion takes over, see alerts.go
+	if alerts != nil {
+		log.Printf("evaluating %d emotion alerts", len(alerts.alerts))
+		go alerts.run(session)
+		enableFeature("emotionAlerts")
+	}
+
+	classifier := newEmotionClassifier()
+	if classifier != nil {
+		log.Println("emotion inference enabled")
+		enableFeature("emotionInference")
 	}
 
-	// WebSocket connection remains the same
-	conn, _, err := websocket.DefaultDialer.Dial(
-		"wss://jetstream2.us-east.bsky.network/subscribe?wantedCollections=moe.kasey.meow",
-		nil,
-	)
+	// repos on PDSs the relay doesn't crawl, see pdsstream.go
+	if len(pdsSubscribeHosts) > 0 {
+		log.Printf("subscribing to %d PDSs", len(pdsSubscribeHosts))
+		go runPDSSubscriptions(session, classifier)
+		enableFeature("pdsSubscriptions")
+	}
+
+	// the API serves, degraded, while the firehose connects
+	server := &http.Server{Handler: setupRouter(session).Handler()}
+	shutdown.serving(session, server)
+	go func() {
+		if err := server.Serve(listen()); err != nil && err != http.ErrServerClosed {
+			log.Fatal("router error:", err)
+		}
+	}()
+
+	startup.enter(phaseConnectingFirehose)
+	var conn *websocket.Conn
+	cursor := startCursor(session)
+	if err := sequence.start(session); err != nil {
+		log.Println("load sequence:", err)
+	}
+	// see relaystream.go
+	if ingestSource == ingestFromRelay {
+		startup.enter(phaseReady)
+		sdNotify("READY=1")
+		runRelay(session, classifier)
+	}
+	err = startup.retry(envDuration("STARTUP_FIREHOSE_TIMEOUT", 10*time.Minute), func() error {
+		var err error
+		conn, err = dialJetstream(cursor)
+		return err
+	})
 	if err != nil {
 		log.Fatal("dial:", err)
 	}
 	log.Println("connected to websocket")
+	ingest.setConn(conn)
 	defer conn.Close()
-	
-	go func() {
-		r := setupRouter(session) 
-		if err := r.Run(":8134"); err != nil {
-			log.Fatal("router error:", err)
-		}
+	if region != "" {
+		log.Printf("ingesting as region %s", region)
 	}
+	go runCursorCheckpoint(session)
+	go jetstreams.watchLag()
+	startup.enter(phaseReady)
+	sdNotify("READY=1")
 
 	for {
-		_, message, err := conn.ReadMessage()
-		log.Printf("Received raw message: %s", string(message))
+		message, err := readJetstream(conn)
 		if err != nil {
-			log.Println("read error:", err)
+			if ingest.paused() {
+				firehose.setError(errIngestPaused)
+				conn = ingest.waitForResume(session)
+				continue
+			}
+			conn = ingest.reconnect(session, err)
 			continue
 		}
+		// see jetstreamcompress.go
+		if message, err = decodeJetstreamMessage(message); err != nil {
+			log.Println("decompress error:", err)
+			continue
+		}
+		debugf("Received raw message: %s", string(message))
 
 		var msg WebSocketMessage
 		if err := json.Unmarshal(message, &msg); err != nil {
@@ -188,183 +371,135 @@ func main() {
 			continue
 		}
 
-		var record MeowRecord
-		if err := json.Unmarshal(msg.Commit.Record, &record); err != nil {
-			log.Println("record parse error:", err)
+		if ingest.drop() {
+			ingest.advance(msg.TimeUS)
+			continue
+		}
+		// handle changes, see identities.go and handleverify.go
+		if msg.Kind == "identity" {
+			recordIdentity(session, msg)
+			actorHandles.identityChanged(session, msg.DID)
+		}
+		// see accounts.go
+		if msg.Kind == "account" {
+			accountChanged(session, msg)
+		}
+		// JETSTREAM_WANTED_COLLECTIONS may subscribe to more, but only
+		// meows are indexed
+		if msg.Kind != "commit" || msg.Commit.Collection != meowNSID {
+			ingest.advance(msg.TimeUS)
 			continue
 		}
-		
-		var emotion *string
-		if record.Emotion != nil {
-			// coerce emotion to a lower case string
-			// exclude possible sql injections and malicious input
-			emotion = strings.ToLower(record.Emotion)
-			truncated := *record.Emotion
-			if len(truncated) > 50 {
-				truncated = (truncated)[:50]
-				log.Println("emotion too long, truncating to 50 characters")
-			}
-			emotion = &truncated
 
-			if strings.Contains(emotion, ";") || strings.Contains(emotion, "'") || strings.Contains(emotion, "\"") || strings.Contains(emotion, "`") {
-				log.Println("emotion contains malicious input, ignoring")
-				continue
-			}
-			if string.Contains(emotion, "create") || string.Contains(emotion, "insert") || string.Contains(emotion, "update") || string.Contains(emotion, "delete") || string.Contains(emotion, "drop") {
-				log.Println("emotion contains malicious input, ignoring")
+		// delete commits carry no record; others are decoded as their
+		// lexicon revision, see lexiconversions.go
+		var record MeowRecord
+		var lexiconVersion int
+		if msg.Commit.Operation != "delete" {
+			var err error
+			if record, lexiconVersion, err = decodeRecord(meowNSID, msg.Commit.Record); err != nil {
+				rejectMessage(session, msg, rejectionReason(err), err.Error())
 				continue
 			}
-			
+		}
+		debugf("Parsed message - DID: %s, Rkey: %s, Operation: %s", msg.DID, msg.Commit.Rkey, msg.Commit.Operation)
 
+		ev := eventFromMessage(msg)
+		// the same validation as every other source, see meow.go
+		if err := ev.setRecord(record, lexiconVersion); err != nil {
+			rejectMessage(session, msg, rejectionReason(err), err.Error())
+			continue
 		}
-		// coerce emotion to 
-		var subject *string
-		if record.Subject != nil {
-			subject = validateSubject(*record.Subject)
+		// only infer when the author did not pick an emotion themselves
+		if record.Emotion == nil && classifier != nil {
+			ev.InferredEmotion = derefString(inferEmotion(classifier, msg.DID, msg.Commit.Record))
 		}
-		else {
-			subject = nil
+		// overlap after a failover, see jetstreamfailover.go
+		if jetstreams.replayed(session, ev) {
+			ingest.advance(msg.TimeUS)
+			continue
 		}
+		// see shadow.go
+		shadow.sample(ev)
+		// the cursor only moves past an event once it is applied or
+		// journaled, see spool.go
+		sequence.assign(&ev)
+		ingestEvent(session, ev)
+		ingest.advance(msg.TimeUS)
+	}
+}
 
-		log.Printf("Parsed message - DID: %s, Rkey: %s, Operation: %s", msg.DID, msg.Commit.Rkey, msg.Commit.Operation)
-
-		op := msg.Commit.Operation
-		rkey := msg.Commit.Rkey
-		id := uuid.New()
-
-		switch op {
-		case "create", "update":
-			err := session.Query(`
-				INSERT INTO meows (id, rkey, time_us, cid, did, emotion, subject) 
-				VALUES (?, ?, ?, ?, ?, ?, ?)`,
-				id,
-				msg.Commit.Rkey,
-				msg.TimeUS,
-				msg.Commit.CID,
-				msg.DID,  //
-				emotion, // can be nil
-				subject, // can be nil
-			).Exec()
-			if err != nil {
-				log.Println("insert error:", err)
-			}
-
-		case "delete":
-			err := session.Query(`DELETE FROM meows WHERE rkey = ?`, rkey).Exec()
-			if err != nil {
-				log.Println("delete error:", err)
-			}
-
-		default:
-			log.Printf("Unknown operation: %s\n", op)
-		}
+func derefString(s *string) string {
+	if s == nil {
+		return ""
 	}
+	return *s
 }
 
 func validateSubject(subject string) string {
 	// starts with did:plc and starts with did:web, make requet to the did doc or the plc directory
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
-	
-	if strings.HasPrefix(subject, "did:plc:") {
-		return validatePLCDID(ctx, subject)
-	}
-	
-	if strings.HasPrefix(subject, "did:web:") {
-		return validateWebDID(ctx, subject)
-	}
-	
-	return nil 
-}
 
-func validatePLCDID(ctx context.Context, did string) string {
-	client := &http.Client{Timeout: 5 * time.Second}
-	url := fmt.Sprintf("https://plc.directory/%s", did)
-
-	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
-	if err != nil {
-		log.Printf("PLC DID request error: %v", err)
-		return nil
+	subject = normalizeSubject(ctx, subject)
+	if strings.HasPrefix(subject, "did:plc:") || strings.HasPrefix(subject, "did:web:") {
+		return resolvedDID(ctx, subject)
 	}
 
-	resp, err := client.Do(req)
-	if err != nil {
-		log.Printf("PLC DID fetch error: %v", err)
-		return nil
+	// meows about a post or quoting another meow
+	if strings.HasPrefix(subject, "at://") {
+		return validateSubjectURI(ctx, subject)
 	}
-	defer resp.Body.Close()
-
-	var doc DIDDocument
-	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
-		log.Printf("PLC DID decode error: %v", err)
-		return nil
-	}
-
-	return doc.ID
+	
+	return nil 
 }
 
-
-func validateWebDID(ctx context.Context, did string) string {
-	parts := strings.SplitN(did, ":", 3)
-	if len(parts) != 3 {
-		return nil
-	}
-
-	domain := parts[2]
-	url := fmt.Sprintf("https://%s/.well-known/did.json", domain)
-
-	client := &http.Client{
-		Timeout: 5 * time.Second,
-		CheckRedirect: func(req *http.Request, via []*http.Request) error {
-			return http.ErrUseLastResponse
-		},
-	}
-
-	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
-	if err != nil {
-		log.Printf("Web DID request error: %v", err)
-		return nil
-	}
-
-	resp, err := client.Do(req)
-	if err != nil {
-		log.Printf("Web DID fetch error: %v", err)
-		return nil
-	}
-	defer resp.Body.Close()
-
-	var doc DIDDocument
-	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
-		log.Printf("Web DID decode error: %v", err)
-		return nil
-	}
-
-	return doc.ID
-}
+// validate the rkey 3lq4slogsz52p - it must be a valid string 13 letters, and only alpha numerics
+var rkeyRegex = regexp.MustCompile(`^[a-z0-9]{13}$`)
 
 func setupRouter(session *gocql.Session) *gin.Engine {
 	r := gin.Default()
+	if err := configureEngine(r); err != nil {
+		log.Fatal("configure router:", err)
+	}
+	r.Use(requestTracing())
+	// before anything reads the database, see waf.go
+	r.Use(firewall())
+	r.Use(apiKeys.middleware(session))
+	r.Use(metricsMiddleware())
+	r.Use(maintenanceMiddleware())
+	// see datamodel.go
+	r.Use(dataModelEncoding())
+
+	r.GET("/metrics", gin.WrapH(promhttp.Handler()))
+	r.GET("/status", getStatus(session))
 
 	// 1. Get last N meows by time
-	r.GET("/_endpoints/getLastMeows", func(c *gin.Context) {
-		limit, _ := strconv.Atoi(c.DefaultQuery("limit", "10"))
-		if limit > 100 {
-			limit = 100
+	r.GET("/_endpoints/getLastMeows", cacheable(cdnAllMeowsKeys), func(c *gin.Context) {
+		page, err := lastMeowsGuardrail.parse(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
 		}
 
 		var meows []MeowResponse
+		filter, args := page.timeFilter(false)
 		iter := session.Query(`
-			SELECT rkey, time_us, cid, did, emotion, subject
-			FROM cat.meows 
+			SELECT `+meowSeqColumns+`
+			FROM cat.meows`+filter+`
 			LIMIT ?
 			ALLOW FILTERING`,
-			limit,
-		).Iter()
-
-		var m MeowResponse
-		for iter.Scan(&m.RKey, &m.TimeUS, &m.CID, &m.DID, &m.Emotion. &m.Subject) {
-			meows = append(meows, m)
-			m = MeowResponse{}
+			append(args, page.Limit)...,
+		).WithContext(c.Request.Context()).Iter()
+
+		var row meowRow
+		scanned := 0
+		for iter.Scan(row.seqDest()...) {
+			scanned++
+			if !page.seen(row.TimeUS, row.Seq) {
+				meows = append(meows, row.meow().response())
+			}
+			row = meowRow{}
 		}
 
 		if err := iter.Close(); err != nil {
@@ -372,27 +507,67 @@ func setupRouter(session *gocql.Session) *gin.Engine {
 			return
 		}
 
-		c.JSON(http.StatusOK, meows)
+		cursor := nextCursor(meows, scanned == page.Limit)
+		meows = moderation.applyGlobal(meows)
+		hydrateRequested(c, meows)
+		if err := embedQuotes(c, session, meows); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		writeMeowPage(c, session, meows, cursor, countAll, "")
 	})
 
 	// 2. Get meows by DID
-	r.GET("/_endpoints/getActorMeows", func(c *gin.Context) {
+	r.GET("/_endpoints/getActorMeows", cacheable(cdnQueryKey("did", cdnActorKey)), func(c *gin.Context) {
 		did := c.Query("did")
 		validatedDid := validateDID(did)
+		// other orders than newest, see actorsort.go
+		switch order := c.DefaultQuery("sort", actorSortNewest); order {
+		case actorSortNewest:
+		case actorSortOldest, actorSortEmotionGrouped:
+			if did == "" || validatedDid != did {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid did"})
+				return
+			}
+			if c.Query("since") != "" || c.Query("until") != "" {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "since and until only apply to sort=newest"})
+				return
+			}
+			if order == actorSortOldest {
+				getActorMeowsOldest(c, session, validatedDid)
+			} else {
+				getActorMeowsByEmotion(c, session, validatedDid)
+			}
+			return
+		default:
+			c.JSON(http.StatusBadRequest, gin.H{"error": "sort must be newest, oldest or emotionGrouped"})
+			return
+		}
+		page, err := actorMeowsGuardrail.parse(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
 		var meows []MeowResponse
 
+		filter, args := page.timeFilter(true)
 		iter := session.Query(`
-			SELECT rkey, time_us, cid, did, emotion, subject
+			SELECT `+meowSeqColumns+`
 			FROM cat.meows 
-			WHERE did = ?
+			WHERE did = ?`+filter+`
+			LIMIT ?
 			ALLOW FILTERING`,
-			validatedDid,
-		).Iter()
-
-		var m MeowResponse
-		for iter.Scan(&m.RKey, &m.TimeUS, &m.CID, &m.DID, &m.Emotion, &m.Subject) {
-			meows = append(meows, m)
-			m = MeowResponse{}
+			append(append([]any{validatedDid}, args...), page.Limit)...,
+		).WithContext(c.Request.Context()).Iter()
+
+		var row meowRow
+		scanned := 0
+		for iter.Scan(row.seqDest()...) {
+			scanned++
+			if !page.seen(row.TimeUS, row.Seq) {
+				meows = append(meows, row.meow().response())
+			}
+			row = meowRow{}
 		}
 
 		if err := iter.Close(); err != nil {
@@ -400,27 +575,46 @@ func setupRouter(session *gocql.Session) *gin.Engine {
 			return
 		}
 
-		c.JSON(http.StatusOK, meows)
+		cursor := nextCursor(meows, scanned == page.Limit)
+		meows = moderation.apply(meows)
+		markPinned(c.Request.Context(), session, validatedDid, meows)
+		hydrateRequested(c, meows)
+		if err := embedQuotes(c, session, meows); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		writeMeowPage(c, session, meows, cursor, countActor, validatedDid)
 	})
 
 	// 3. Get meows by subject DID
-	r.GET("/_endpoints/getSubjectMeows", func(c *gin.Context) {
-		subject := c.Query("did")
+	r.GET("/_endpoints/getSubjectMeows", cacheable(cdnQueryKey("did", cdnSubjectKey)), func(c *gin.Context) {
+		subject := normalizeSubject(c.Request.Context(), c.Query("did"))
 		validatedSubject := validateDID(subject)
+		page, err := subjectMeowsGuardrail.parse(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
 		var meows []MeowResponse
 
+		filter, args := page.timeFilter(true)
 		iter := session.Query(`
-			SELECT rkey, time_us, cid, did, emotion, subject
+			SELECT `+meowSeqColumns+`
 			FROM cat.meows 
-			WHERE subject = ?
+			WHERE subject = ?`+filter+`
+			LIMIT ?
 			ALLOW FILTERING`,
-			validatedSubject,
-		).Iter()
-
-		var m MeowResponse
-		for iter.Scan(&m.RKey, &m.TimeUS, &m.CID, &m.DID, &m.Emotion, &m.Subject) {
-			meows = append(meows, m)
-			m = MeowResponse{}
+			append(append([]any{validatedSubject}, args...), page.Limit)...,
+		).WithContext(c.Request.Context()).Iter()
+
+		var row meowRow
+		scanned := 0
+		for iter.Scan(row.seqDest()...) {
+			scanned++
+			if !page.seen(row.TimeUS, row.Seq) {
+				meows = append(meows, row.meow().response())
+			}
+			row = meowRow{}
 		}
 
 		if err := iter.Close(); err != nil {
@@ -428,11 +622,18 @@ func setupRouter(session *gocql.Session) *gin.Engine {
 			return
 		}
 
-		c.JSON(http.StatusOK, meows)
+		cursor := nextCursor(meows, scanned == page.Limit)
+		meows = moderation.applyGlobal(meows)
+		hydrateRequested(c, meows)
+		if err := embedQuotes(c, session, meows); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		writeMeowPage(c, session, meows, cursor, countSubject, validatedSubject)
 	})
 
 	// 4. Get specific meow
-	r.GET("/_endpoints/getMeow", func(c *gin.Context) {
+	r.GET("/_endpoints/getMeow", cacheable(cdnMeowKeys), func(c *gin.Context) {
 		rkey := c.Query("rkey")
 		did := c.Query("did")
 		validatedDid := validateDID(did)
@@ -440,21 +641,18 @@ func setupRouter(session *gocql.Session) *gin.Engine {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid did"})
 			return
 		}
-		// validate the rkey 3lq4slogsz52p - it must be a valid string 13 letters, and only alpha numerics
-		re := regexp.MustCompile(`^[a-z0-9]{13}$`)
-		if !re.MatchString(rkey) {
+		if !rkeyRegex.MatchString(rkey) {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid rkey"})
 			return
 		}
 
-		var m MeowResponse
+		var row meowRow
 		err := session.Query(`
-			SELECT rkey, time_us, cid, did, emotion, subject
-			FROM cat.meows 
-			WHERE rkey = ? AND did = ?
-			LIMIT 1`,
-			rkey, validatedDid,
-		).Scan(&m.Rkey, &m.TimeUS, &m.CID, &m.DID, &m.Emotion, &m.Subject)
+			SELECT `+meowColumns+`
+			FROM cat.meows
+			WHERE id = ?`,
+			meowID(validatedDid, rkey),
+		).WithContext(c.Request.Context()).Scan(row.dest()...)
 
 		if err != nil {
 			if err == gocql.ErrNotFound {
@@ -465,10 +663,162 @@ func setupRouter(session *gocql.Session) *gin.Engine {
 			return
 		}
 
-		m.RKey = rkey
-		c.JSON(http.StatusOK, m)
+		single := moderation.apply([]MeowResponse{row.meow().response()})
+		if len(single) == 0 {
+			c.JSON(http.StatusNotFound, gin.H{"error": "meow not found"})
+			return
+		}
+		markPinned(c.Request.Context(), session, validatedDid, single)
+		hydrateRequested(c, single)
+		if err := embedQuotes(c, session, single); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, single[0])
 	})
 
+	// 5. Get meows related to a specific meow
+	r.GET("/_endpoints/getRelatedMeows", requireFeature("relatedMeows"), getRelatedMeows(session))
+
+	// 6. Get which emotion tends to follow which for an actor
+	r.GET("/_endpoints/getEmotionTransitions", requireFeature("emotionTransitions"), getEmotionTransitions(session))
+
+	// 7. Unsubscribe from the digest email
+	r.GET("/_endpoints/unsubscribeDigest", unsubscribeDigest(session))
+
+	// 8. Render an og:image card for a meow
+	r.GET("/_endpoints/getMeowCard", requireFeature("meowCards"), getMeowCard(session))
+
+	// 9. SLO status summary and matching Prometheus alerting rules
+	r.GET("/_endpoints/getSLOStatus", getSLOStatus)
+	r.GET("/_endpoints/getSLOAlertRules", getSLOAlertRules)
+
+	// 10. Build info, enabled features and limits for client feature detection
+	r.GET("/_endpoints/getServerInfo", getServerInfo)
+
+	// 11. XRPC capability discovery for generic atproto tooling
+	r.GET("/xrpc/moe.kasey.meowview.describeServer", describeServer)
+	r.GET("/lexicons", listLexicons)
+	r.GET("/lexicons/:nsid", getLexicon)
+
+	// 12. Meows exchanged between two DIDs, oldest first
+	r.GET("/_endpoints/getConversation", getConversation(session))
+
+	// 13. Change feed of creates, updates and deletes for delta sync
+	r.GET("/_endpoints/getMeowsSince", getMeowsSince(session))
+
+	// 14. Bookmarks, authenticated with atproto service auth
+	r.POST("/_endpoints/bookmarkMeow", requireAuth("bookmarkMeow"), bookmarkMeow(session))
+	r.DELETE("/_endpoints/bookmarkMeow", requireAuth("bookmarkMeow"), unbookmarkMeow(session))
+	r.GET("/_endpoints/getBookmarks", requireAuth("getBookmarks"), getBookmarks(session))
+
+	// 15. View preferences shared across a viewer's devices
+	r.GET("/_endpoints/getPreferences", requireAuth("getPreferences"), getPreferences(session))
+	r.PUT("/_endpoints/putPreferences", requireAuth("putPreferences"), putPreferences(session))
+
+	if posts != nil {
+		enableFeature("postHydration")
+	}
+
+	// 16. Meow counts per declared UTC offset, only with timezone enrichment
+	if timezones != nil {
+		r.GET("/_endpoints/getActivityByTimezone", getActivityByTimezone(session))
+	}
+
+	// 17. Self-service API keys
+	r.POST("/_endpoints/createApiKey", requireAuth("createApiKey"), createAPIKey(session))
+	r.GET("/_endpoints/listApiKeys", requireAuth("listApiKeys"), listAPIKeys(session))
+	r.POST("/_endpoints/rotateApiKey", requireAuth("rotateApiKey"), rotateAPIKey(session))
+	r.POST("/_endpoints/revokeApiKey", requireAuth("revokeApiKey"), revokeAPIKey(session))
+
+	// 18. Report a meow to the moderators
+	r.POST("/_endpoints/createReport", requireAuth("createReport"), idempotent(session), createReport(session))
+
+	// 19. Show a just created meow to its author before the firehose has it
+	r.POST("/_endpoints/echoMeow", requireAuth("echoMeow"), idempotent(session), echoMeow(session))
+
+	// 20. Actors who recently expressed an emotion
+	r.GET("/_endpoints/getActorsByEmotion", getActorsByEmotion(session))
+
+	// 21. Subjects an actor has meowed at
+	r.GET("/_endpoints/getActorSubjects", getActorSubjects(session))
+
+	// 22. Live changes as server-sent events
+	r.GET("/_endpoints/subscribeMeows", requireFeature("streaming"), subscribeMeows)
+	enableFeature("streaming")
+
+	// 23. Jetstream-compatible rebroadcast of the meow collection
+	r.GET("/subscribe", requireFeature("rebroadcast"), subscribeRebroadcast)
+	enableFeature("rebroadcast")
+
+	// 24. Emotion typeahead
+	r.GET("/_endpoints/suggestEmotions", suggestEmotions)
+
+	// 25. Handle typeahead among actors who have meowed
+	r.GET("/_endpoints/suggestActors", suggestActors)
+
+	// 26. Pinned meows, set with atproto service auth
+	r.POST("/_endpoints/pinMeow", requireAuth("pinMeow"), pinMeow(session))
+	r.DELETE("/_endpoints/pinMeow", requireAuth("pinMeow"), unpinMeow(session))
+	r.GET("/_endpoints/getActorPinnedMeow", cacheable(cdnQueryKey("did", cdnActorKey)), getActorPinnedMeow(session))
+
+	// 27. An actor's emotions, for profile pages
+	r.GET("/_endpoints/getActorEmotionBreakdown", getActorEmotionBreakdown(session))
+
+	// 28. Emotions of every meow over time
+	r.GET("/_endpoints/getEmotionHistogram", getEmotionHistogram(session))
+
+	// 29. Drafts of unposted meows, synced across a viewer's devices
+	r.POST("/_endpoints/createDraft", requireAuth("createDraft"), idempotent(session), createDraft(session))
+	r.GET("/_endpoints/getDrafts", requireAuth("getDrafts"), getDrafts(session))
+	r.PUT("/_endpoints/updateDraft", requireAuth("updateDraft"), updateDraft(session))
+	r.DELETE("/_endpoints/deleteDraft", requireAuth("deleteDraft"), deleteDraft(session))
+
+	// 30. Handle to DID and back, kept current from identity events
+	r.GET("/_endpoints/getIdentity", getIdentity(session))
+
+	// 31. Why a viewer's records were turned away at ingest
+	r.GET("/_endpoints/getMyRejectedMeows", requireAuth("getMyRejectedMeows"), getMyRejectedMeows(session))
+
+	// unknown XRPC queries go to the upstream AppView, when configured
+	if proxy := newXRPCProxy(); proxy != nil {
+		r.NoRoute(proxy.handle)
+		enableFeature("xrpcProxy")
+	}
+
+	// admin API, requires ADMIN_TOKEN
+	admin := r.Group("/_admin", requireAdmin(), idempotent(session))
+	admin.GET("/getIngestionState", getIngestionState)
+	admin.POST("/pauseIngestion", pauseIngestion(session))
+	admin.POST("/resumeIngestion", resumeIngestion)
+	admin.POST("/dropIngestion", dropIngestion)
+	admin.POST("/setMaintenance", setMaintenance(session))
+	admin.GET("/getFeatureFlags", getFeatureFlags)
+	admin.POST("/setFeatureFlag", setFeatureFlag)
+	admin.POST("/updateApiKey", updateAPIKey(session))
+	admin.GET("/listReports", listReports(session))
+	admin.POST("/updateReport", updateReport(session))
+	admin.GET("/getModerationQueue", getModerationQueue(session))
+	admin.POST("/moderateMeows", moderateMeows(session))
+	admin.POST("/setActorModeration", setActorModeration(session))
+	admin.GET("/listDeprioritizedActors", listDeprioritizedActors(session))
+	admin.GET("/getAbuseReport", getAbuseReport(session))
+	admin.GET("/getEmotionAlerts", getEmotionAlerts)
+	admin.GET("/getRegions", getRegions(session))
+	admin.GET("/getLocalEchoes", getLocalEchoes(session))
+	admin.POST("/reloadConfig", reloadConfigHandler)
+	admin.GET("/getConfigReload", getConfigReload)
+	admin.POST("/rekeyMeows", rekeyMeows(session))
+	admin.POST("/normalizeSubjects", normalizeSubjects(session))
+	admin.GET("/getDIDResolutionFailures", getDIDResolutionFailures)
+	admin.POST("/startBackfill", startBackfill(session))
+	admin.GET("/getBackfillStatus", getBackfillStatus(session))
+	admin.GET("/getPendingDeletes", getPendingDeletes(session))
+	admin.POST("/undoDeletes", undoDeletes(session))
+	admin.POST("/purgeCache", purgeCache)
+	admin.GET("/getMeowsByLexiconVersion", getMeowsByLexiconVersion(session))
+	admin.GET("/getShadowStatus", getShadowStatus)
+
 	return r
 }
 
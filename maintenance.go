@@ -0,0 +1,113 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gocql/gocql"
+)
+
+// maintenanceState puts the read API into maintenance: requests get a 503
+// with Retry-After instead of timing out while the database is migrated.
+// It starts from MAINTENANCE_MODE and MAINTENANCE_RETRY_AFTER (seconds) and
+// can be toggled through the admin API.
+type maintenanceState struct {
+	mu         sync.Mutex
+	enabled    bool
+	retryAfter int
+	message    string
+}
+
+var maintenance = &maintenanceState{
+	enabled:    envBool("MAINTENANCE_MODE", false),
+	retryAfter: envInt("MAINTENANCE_RETRY_AFTER", 300),
+	message:    "meowview is down for maintenance",
+}
+
+type MaintenanceStatus struct {
+	Enabled    bool   `json:"enabled"`
+	RetryAfter int    `json:"retryAfter"`
+	Message    string `json:"message"`
+}
+
+func (m *maintenanceState) status() MaintenanceStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return MaintenanceStatus{Enabled: m.enabled, RetryAfter: m.retryAfter, Message: m.message}
+}
+
+// maintenanceExempt are paths that keep answering during maintenance so
+// operators and users can still see what is going on.
+var maintenanceExempt = []string{"/_admin/", "/status", "/metrics"}
+
+func maintenanceMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		for _, prefix := range maintenanceExempt {
+			if strings.HasPrefix(c.Request.URL.Path, prefix) {
+				c.Next()
+				return
+			}
+		}
+
+		st := maintenance.status()
+		if !st.Enabled {
+			c.Next()
+			return
+		}
+		c.Header("Retry-After", strconv.Itoa(st.RetryAfter))
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": st.Message})
+	}
+}
+
+// setMaintenance toggles maintenance mode. scope picks what goes into
+// maintenance: "api" (reads return 503, ingestion continues), "ingest"
+// (ingestion pauses, reads continue) or "both".
+func setMaintenance(session *gocql.Session) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		enabled, err := strconv.ParseBool(c.Query("enabled"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "enabled must be true or false"})
+			return
+		}
+		scope := c.DefaultQuery("scope", "api")
+		if scope != "api" && scope != "ingest" && scope != "both" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "scope must be api, ingest or both"})
+			return
+		}
+		retryAfter := -1
+		if v := c.Query("retryAfter"); v != "" {
+			if retryAfter, err = strconv.Atoi(v); err != nil || retryAfter < 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "retryAfter must be a number of seconds"})
+				return
+			}
+		}
+
+		if scope == "api" || scope == "both" {
+			maintenance.mu.Lock()
+			maintenance.enabled = enabled
+			if retryAfter >= 0 {
+				maintenance.retryAfter = retryAfter
+			}
+			if msg := c.Query("message"); msg != "" {
+				maintenance.message = msg
+			}
+			maintenance.mu.Unlock()
+		}
+
+		resp := gin.H{"maintenance": maintenance.status()}
+		if scope == "ingest" || scope == "both" {
+			if enabled {
+				if err := ingest.pause(session); err != nil {
+					resp["error"] = "cursor not persisted: " + err.Error()
+				}
+			} else if ingest.paused() {
+				ingest.setMode(ingestRunning)
+			}
+		}
+		resp["ingestion"] = ingest.state()
+		c.JSON(http.StatusOK, resp)
+	}
+}
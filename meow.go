@@ -0,0 +1,195 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// A meow takes four shapes on its way through meowview, each converted to
+// the next only by the functions in this file:
+//
+//	WebSocketMessage  as jetstream delivers it (transport)
+//	Meow              what the rest of the code works with (domain)
+//	meowRow           a row of the meows tables (storage)
+//	MeowResponse      as the API returns it
+//
+// Keeping them apart lets the wire format, the schema and the API change
+// independently of each other.
+
+// Meow is a meow record as indexed, after validation.
+type Meow struct {
+	DID    string
+	Rkey   string
+	CID    string
+	TimeUS int64
+	// Emotion and Subject are empty when the record had none or they
+	// didn't validate
+	Emotion         string
+	Subject         string
+	InferredEmotion string
+	// Seq numbers meows in ingest order, breaking ties between equal
+	// TimeUS; 0 for meows from before it existed. See seq.go.
+	Seq int64
+	// LexiconVersion is the revision of the meow lexicon the record was
+	// decoded as; 0 for meows from before it was stored. See
+	// lexiconversions.go.
+	LexiconVersion int
+}
+
+// meowColumns are the columns of the meows tables meowRow.dest scans, in
+// order.
+const meowColumns = "rkey, time_us, cid, did, emotion, subject, inferred_emotion"
+
+// meowRow is a row of meows or one of the tables derived from it. Queries
+// selecting fewer columns scan into the fields they have.
+type meowRow struct {
+	Rkey            string
+	TimeUS          int64
+	CID             string
+	DID             string
+	Emotion         string
+	Subject         string
+	InferredEmotion string
+	Seq             int64
+	LexiconVersion  int
+}
+
+// dest is the scan destination for meowColumns.
+func (r *meowRow) dest() []any {
+	return []any{&r.Rkey, &r.TimeUS, &r.CID, &r.DID, &r.Emotion, &r.Subject, &r.InferredEmotion}
+}
+
+// meowSeqColumns are meowColumns, seq and lexicon_version, which only
+// meows and meow_events have; seqDest scans them.
+const meowSeqColumns = meowColumns + ", seq, lexicon_version"
+
+func (r *meowRow) seqDest() []any {
+	return append(r.dest(), &r.Seq, &r.LexiconVersion)
+}
+
+func (r meowRow) meow() Meow {
+	return Meow{
+		DID:             r.DID,
+		Rkey:            r.Rkey,
+		CID:             r.CID,
+		TimeUS:          r.TimeUS,
+		Emotion:         r.Emotion,
+		Subject:         r.Subject,
+		InferredEmotion: r.InferredEmotion,
+		Seq:             r.Seq,
+		LexiconVersion:  r.LexiconVersion,
+	}
+}
+
+func (m Meow) response() MeowResponse {
+	return MeowResponse{
+		Rkey:            m.Rkey,
+		TimeUS:          m.TimeUS,
+		IndexedAt:       indexedAt(m.TimeUS),
+		CID:             m.CID,
+		DID:             m.DID,
+		Emotion:         m.Emotion,
+		Subject:         m.Subject,
+		InferredEmotion: m.InferredEmotion,
+		LexiconVersion:  m.LexiconVersion,
+		seq:             m.Seq,
+	}
+}
+
+// eventFromMessage maps a jetstream commit to an event. The emotion and
+// subject are set from the decoded record by setRecord, the inferred
+// emotion by the caller.
+func eventFromMessage(msg WebSocketMessage) meowEvent {
+	return meowEvent{
+		Meow: Meow{
+			DID:    msg.DID,
+			Rkey:   msg.Commit.Rkey,
+			CID:    msg.Commit.CID,
+			TimeUS: msg.TimeUS,
+		},
+		Op:     msg.Commit.Operation,
+		Rev:    msg.Commit.Rev,
+		Record: string(msg.Commit.Record),
+	}
+}
+
+// errEmotionRefused is the error for emotions the ingest filter refuses.
+var errEmotionRefused = errors.New("emotion contains characters or words the ingest filter refuses")
+
+// refusedEmotionWords are refused anywhere in an emotion, along with
+// quotes and semicolons.
+var refusedEmotionWords = []string{"create", "insert", "update", "delete", "drop"}
+
+// normalizeEmotion lowercases an emotion and cuts it to emotionMaxLength
+// bytes, backing off to the last whole rune. Emotions the ingest filter
+// refuses return errEmotionRefused.
+func normalizeEmotion(raw string) (string, error) {
+	emotion := strings.ToLower(raw)
+	if len(emotion) > emotionMaxLength {
+		n := emotionMaxLength
+		for n > 0 && !utf8.RuneStart(emotion[n]) {
+			n--
+		}
+		emotion = emotion[:n]
+	}
+	if strings.ContainsAny(emotion, ";'\"`") {
+		return "", errEmotionRefused
+	}
+	for _, w := range refusedEmotionWords {
+		if strings.Contains(emotion, w) {
+			return "", errEmotionRefused
+		}
+	}
+	return emotion, nil
+}
+
+// setRecord validates the emotion and subject of an event's record,
+// decoded as the given revision, for every source: jetstream, PDS and
+// relay subscriptions, backfill and the records shadow. See
+// normalizeEmotion for what happens to the emotion.
+func (ev *meowEvent) setRecord(record MeowRecord, version int) error {
+	ev.LexiconVersion = version
+	if record.Emotion != nil {
+		emotion, err := normalizeEmotion(*record.Emotion)
+		if err != nil {
+			return err
+		}
+		ev.Emotion = emotion
+	}
+	if record.Subject != nil {
+		ev.Subject = validateSubject(*record.Subject)
+	}
+	return nil
+}
+
+// indexedAtLayout is RFC 3339 with the microseconds time_us has.
+const indexedAtLayout = "2006-01-02T15:04:05.000000Z"
+
+// indexedAt formats a time_us for responses, next to the integer; "" for
+// none, e.g. on tombstones.
+func indexedAt(timeUS int64) string {
+	if timeUS == 0 {
+		return ""
+	}
+	return time.UnixMicro(timeUS).UTC().Format(indexedAtLayout)
+}
+
+// parseTimeParam reads a time given either as time_us or as an RFC 3339
+// timestamp.
+func parseTimeParam(v string) (int64, error) {
+	if us, err := strconv.ParseInt(v, 10, 64); err == nil {
+		if us < 0 {
+			return 0, fmt.Errorf("negative time")
+		}
+		return us, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, v)
+	if err != nil {
+		return 0, err
+	}
+	return t.UnixMicro(), nil
+}
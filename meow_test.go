@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestEventFromMessage(t *testing.T) {
+	var msg WebSocketMessage
+	msg.DID = "did:plc:abc"
+	msg.TimeUS = 1700000000000000
+	msg.Kind = "commit"
+	msg.Commit.Rev = "3lq4slogsz52p"
+	msg.Commit.Operation = "create"
+	msg.Commit.Collection = meowNSID
+	msg.Commit.Rkey = "3lq4slogsz52q"
+	msg.Commit.CID = "bafyreib"
+	msg.Commit.Record = json.RawMessage(`{"emotion":"Happy"}`)
+
+	got := eventFromMessage(msg)
+	want := meowEvent{
+		Meow: Meow{
+			DID:    "did:plc:abc",
+			Rkey:   "3lq4slogsz52q",
+			CID:    "bafyreib",
+			TimeUS: 1700000000000000,
+		},
+		Op:     "create",
+		Rev:    "3lq4slogsz52p",
+		Record: `{"emotion":"Happy"}`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("eventFromMessage = %+v, want %+v", got, want)
+	}
+}
+
+func TestSetRecord(t *testing.T) {
+	str := func(s string) *string { return &s }
+	tests := []struct {
+		name    string
+		record  MeowRecord
+		version int
+		emotion string
+		subject string
+		err     error
+	}{
+		{name: "empty", version: 1},
+		{name: "lowercased", record: MeowRecord{Emotion: str("Happy")}, version: 2, emotion: "happy"},
+		{name: "truncated", record: MeowRecord{Emotion: str(strings.Repeat("a", emotionMaxLength+10))}, emotion: strings.Repeat("a", emotionMaxLength)},
+		{
+			name:    "truncated at a rune boundary",
+			record:  MeowRecord{Emotion: str(strings.Repeat("a", emotionMaxLength-1) + "é")},
+			emotion: strings.Repeat("a", emotionMaxLength-1),
+		},
+		{
+			name:    "truncated after lowercasing",
+			record:  MeowRecord{Emotion: str(strings.Repeat("A", emotionMaxLength) + "B")},
+			emotion: strings.Repeat("a", emotionMaxLength),
+		},
+		{name: "quote", record: MeowRecord{Emotion: str("happy'")}, err: errEmotionRefused},
+		{name: "semicolon", record: MeowRecord{Emotion: str("happy;")}, err: errEmotionRefused},
+		{name: "keyword", record: MeowRecord{Emotion: str("DROP table")}, err: errEmotionRefused},
+		{name: "invalid subject", record: MeowRecord{Subject: str("not a subject!")}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var ev meowEvent
+			err := ev.setRecord(tt.record, tt.version)
+			if err != tt.err {
+				t.Fatalf("setRecord error = %v, want %v", err, tt.err)
+			}
+			if err != nil {
+				return
+			}
+			if ev.Emotion != tt.emotion {
+				t.Errorf("Emotion = %q, want %q", ev.Emotion, tt.emotion)
+			}
+			if ev.Subject != tt.subject {
+				t.Errorf("Subject = %q, want %q", ev.Subject, tt.subject)
+			}
+			if ev.LexiconVersion != tt.version {
+				t.Errorf("LexiconVersion = %d, want %d", ev.LexiconVersion, tt.version)
+			}
+		})
+	}
+}
+
+func TestMeowRowMeow(t *testing.T) {
+	row := meowRow{
+		Rkey:            "3lq4slogsz52q",
+		TimeUS:          1700000000000000,
+		CID:             "bafyreib",
+		DID:             "did:plc:abc",
+		Emotion:         "happy",
+		Subject:         "did:plc:def",
+		InferredEmotion: "content",
+		Seq:             7,
+		LexiconVersion:  2,
+	}
+	want := Meow{
+		DID:             "did:plc:abc",
+		Rkey:            "3lq4slogsz52q",
+		CID:             "bafyreib",
+		TimeUS:          1700000000000000,
+		Emotion:         "happy",
+		Subject:         "did:plc:def",
+		InferredEmotion: "content",
+		Seq:             7,
+		LexiconVersion:  2,
+	}
+	if got := row.meow(); got != want {
+		t.Errorf("meow() = %+v, want %+v", got, want)
+	}
+}
+
+func TestMeowResponse(t *testing.T) {
+	tests := []struct {
+		name string
+		meow Meow
+		want MeowResponse
+	}{
+		{
+			name: "indexed",
+			meow: Meow{
+				DID:             "did:plc:abc",
+				Rkey:            "3lq4slogsz52q",
+				CID:             "bafyreib",
+				TimeUS:          1700000000123456,
+				Emotion:         "happy",
+				Subject:         "did:plc:def",
+				InferredEmotion: "content",
+				Seq:             7,
+				LexiconVersion:  2,
+			},
+			want: MeowResponse{
+				Rkey:            "3lq4slogsz52q",
+				TimeUS:          1700000000123456,
+				IndexedAt:       "2023-11-14T22:13:20.123456Z",
+				CID:             "bafyreib",
+				DID:             "did:plc:abc",
+				Emotion:         "happy",
+				Subject:         "did:plc:def",
+				InferredEmotion: "content",
+				LexiconVersion:  2,
+				seq:             7,
+			},
+		},
+		{
+			name: "tombstone",
+			meow: Meow{DID: "did:plc:abc", Rkey: "3lq4slogsz52q"},
+			want: MeowResponse{DID: "did:plc:abc", Rkey: "3lq4slogsz52q"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.meow.response(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("response() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	meowsIngested = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "meowview_ingest_events_total",
+		Help: "Jetstream commit events processed, by operation.",
+	}, []string{"operation"})
+
+	ingestLag = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "meowview_ingest_lag_seconds",
+		Help: "Difference between now and the time_us of the last processed event.",
+	})
+
+	httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "meowview_http_request_duration_seconds",
+		Help:    "API request latency, by route and status code.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "status"})
+)
+
+// observeIngest records a processed jetstream event.
+func observeIngest(op string, timeUS int64) {
+	meowsIngested.WithLabelValues(op).Inc()
+	lag := time.Since(time.UnixMicro(timeUS))
+	ingestLag.Set(lag.Seconds())
+	slo.observeIngestLag(lag)
+	firehose.event(timeUS)
+}
+
+// metricsMiddleware times every request that matched a route.
+func metricsMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" || route == "/metrics" {
+			return
+		}
+		elapsed := time.Since(start)
+		status := c.Writer.Status()
+		httpRequestDuration.WithLabelValues(route, strconv.Itoa(status)).Observe(elapsed.Seconds())
+		slo.observeRequest(elapsed, status)
+	}
+}
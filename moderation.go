@@ -0,0 +1,566 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gocql/gocql"
+)
+
+// Moderation actions on single meows: a hidden meow is left out of every
+// read endpoint, and labels are passed along with the meow for clients to
+// act on. Actors can be deprioritized (shadow-banned): their meows still
+// show on their own actor page, and to anyone looking one up directly, but
+// are left out of global endpoints like getLastMeows, getSubjectMeows,
+// related meows and the digest.
+//
+// Meows of inactive accounts are left out of every read, see accounts.go.
+//
+// The tables are small, so every instance keeps a copy in memory,
+// reloaded every MODERATION_REFRESH_INTERVAL, and the read path never
+// queries them.
+
+var labelRegex = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,63}$`)
+
+// maxBulkModeration caps how many meows one moderateMeows call may touch.
+const maxBulkModeration = 100
+
+var moderationQueueGuardrail = newGuardrail("moderation_queue", 50, 100, 0, 0)
+
+func createModerationTables(session *gocql.Session) error {
+	err := session.Query(`
+		CREATE TABLE IF NOT EXISTS meow_moderation (
+			did TEXT,
+			rkey TEXT,
+			hidden BOOLEAN,
+			labels SET<TEXT>,
+			updated_at TIMESTAMP,
+			PRIMARY KEY ((did), rkey)
+		)`).Exec()
+	if err != nil {
+		return err
+	}
+
+	err = session.Query(`
+		CREATE TABLE IF NOT EXISTS actor_moderation (
+			did TEXT PRIMARY KEY,
+			deprioritized BOOLEAN,
+			note TEXT,
+			updated_at TIMESTAMP
+		)`).Exec()
+	if err != nil {
+		return err
+	}
+
+	// see versioned.go
+	if err := addColumn(session, "meow_moderation", "version", "INT"); err != nil {
+		return err
+	}
+	return addColumn(session, "actor_moderation", "version", "INT")
+}
+
+type meowModeration struct {
+	hidden bool
+	labels []string
+}
+
+type moderationState struct {
+	mu    sync.RWMutex
+	meows map[string]meowModeration
+	// deprioritized actors, by DID
+	actors map[string]bool
+	// inactive accounts, by DID, with their status
+	inactive map[string]string
+}
+
+var moderation = &moderationState{meows: map[string]meowModeration{}, actors: map[string]bool{}, inactive: map[string]string{}}
+
+func (m *moderationState) load(session *gocql.Session) error {
+	iter := session.Query(`SELECT did, rkey, hidden, labels FROM meow_moderation`).Iter()
+	meows := map[string]meowModeration{}
+	var did, rkey string
+	var mm meowModeration
+	for iter.Scan(&did, &rkey, &mm.hidden, &mm.labels) {
+		meows[meowURI(did, rkey)] = mm
+		mm = meowModeration{}
+	}
+	if err := iter.Close(); err != nil {
+		return err
+	}
+
+	iter = session.Query(`SELECT did, deprioritized FROM actor_moderation`).Iter()
+	actors := map[string]bool{}
+	var deprioritized bool
+	for iter.Scan(&did, &deprioritized) {
+		if deprioritized {
+			actors[did] = true
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return err
+	}
+
+	iter = session.Query(`SELECT did, status FROM account_status`).Iter()
+	inactive := map[string]string{}
+	var status string
+	for iter.Scan(&did, &status) {
+		inactive[did] = status
+	}
+	if err := iter.Close(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	m.meows = meows
+	m.actors = actors
+	m.inactive = inactive
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *moderationState) run(session *gocql.Session) {
+	ticker := time.NewTicker(envDuration("MODERATION_REFRESH_INTERVAL", 30*time.Second))
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := m.load(session); err != nil {
+			log.Println("load moderation state error:", err)
+		}
+	}
+}
+
+func (m *moderationState) get(did, rkey string) meowModeration {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.meows[meowURI(did, rkey)]
+}
+
+func (m *moderationState) set(did, rkey string, mm meowModeration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !mm.hidden && len(mm.labels) == 0 {
+		delete(m.meows, meowURI(did, rkey))
+		return
+	}
+	m.meows[meowURI(did, rkey)] = mm
+}
+
+// setInactive records an account's status, "active" clearing it.
+func (m *moderationState) setInactive(did, status string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if status == "active" {
+		delete(m.inactive, did)
+		return
+	}
+	m.inactive[did] = status
+}
+
+func (m *moderationState) deprioritized(did string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.actors[did]
+}
+
+// apply drops hidden meows and those of inactive accounts, and attaches
+// labels to the rest.
+func (m *moderationState) apply(meows []MeowResponse) []MeowResponse {
+	return m.filter(meows, false)
+}
+
+// applyGlobal is apply for global endpoints: it also drops the meows of
+// deprioritized actors.
+func (m *moderationState) applyGlobal(meows []MeowResponse) []MeowResponse {
+	return m.filter(meows, true)
+}
+
+func (m *moderationState) filter(meows []MeowResponse, global bool) []MeowResponse {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if len(m.meows) == 0 && len(m.inactive) == 0 && (!global || len(m.actors) == 0) {
+		return meows
+	}
+	kept := meows[:0]
+	for _, meow := range meows {
+		mm := m.meows[meowURI(meow.DID, meow.Rkey)]
+		if _, inactive := m.inactive[meow.DID]; inactive || mm.hidden || (global && m.actors[meow.DID]) {
+			continue
+		}
+		meow.Labels = mm.labels
+		kept = append(kept, meow)
+	}
+	return kept
+}
+
+// QueueItem is a reported meow with the reports against it that are still
+// in the requested state.
+type QueueItem struct {
+	DID     string        `json:"did"`
+	Rkey    string        `json:"rkey"`
+	Meow    *MeowResponse `json:"meow"`
+	Reports []Report      `json:"reports"`
+	Reasons []string      `json:"reasons"`
+	Hidden  bool          `json:"hidden"`
+	Labels  []string      `json:"labels,omitempty"`
+	// Version is passed to moderateMeows to act only if nobody else has
+	Version int `json:"version"`
+
+	oldest time.Time
+}
+
+// getModerationQueue lists reported meows, oldest report first, for a
+// moderation frontend. Filters: ?state= of the reports (default open),
+// ?reason=, ?did= of the author and ?minReports=. The queue is built from
+// at most GUARDRAIL_MODERATION_QUEUE_SCAN reports.
+func getModerationQueue(session *gocql.Session) gin.HandlerFunc {
+	maxScan := envInt("GUARDRAIL_MODERATION_QUEUE_SCAN", 5000)
+	return func(c *gin.Context) {
+		state := c.DefaultQuery("state", reportOpen)
+		if _, ok := reportTransitions[state]; !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "state must be open, triaged or resolved"})
+			return
+		}
+		reason := c.Query("reason")
+		if reason != "" && !reportReasons[reason] {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "unknown reason " + reason})
+			return
+		}
+		author := c.Query("did")
+		minReports := 1
+		if v := c.Query("minReports"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "minReports must be a positive number"})
+				return
+			}
+			minReports = n
+		}
+		limit, err := moderationQueueGuardrail.parseLimit(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		iter := session.Query(`SELECT id FROM reports_by_state WHERE state = ? LIMIT ?`, state, maxScan).
+			WithContext(c.Request.Context()).Iter()
+		var ids []gocql.UUID
+		var id gocql.UUID
+		for iter.Scan(&id) {
+			ids = append(ids, id)
+		}
+		if err := iter.Close(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		items := map[string]*QueueItem{}
+		for _, id := range ids {
+			r, err := loadReport(c, session, id)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			if r == nil || (reason != "" && r.Reason != reason) || (author != "" && r.DID != author) {
+				continue
+			}
+			key := meowURI(r.DID, r.Rkey)
+			item, ok := items[key]
+			if !ok {
+				item = &QueueItem{DID: r.DID, Rkey: r.Rkey, oldest: r.CreatedAt}
+				items[key] = item
+			}
+			item.Reports = append(item.Reports, *r)
+		}
+
+		queue := []*QueueItem{}
+		for _, item := range items {
+			if len(item.Reports) >= minReports {
+				queue = append(queue, item)
+			}
+		}
+		sort.Slice(queue, func(i, j int) bool { return queue[i].oldest.Before(queue[j].oldest) })
+		if len(queue) > limit {
+			queue = queue[:limit]
+		}
+
+		for _, item := range queue {
+			seen := map[string]bool{}
+			for _, r := range item.Reports {
+				if !seen[r.Reason] {
+					seen[r.Reason] = true
+					item.Reasons = append(item.Reasons, r.Reason)
+				}
+			}
+			mm, version, err := readMeowModeration(c, session, item.DID, item.Rkey)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			item.Hidden, item.Labels, item.Version = mm.hidden, mm.labels, version
+			if item.Meow, err = lookupMeow(c, session, item.DID, item.Rkey); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+		}
+		c.JSON(http.StatusOK, gin.H{"queue": queue})
+	}
+}
+
+type moderateMeowsRequest struct {
+	// Action is one of hide, unhide, label, unlabel or dismiss.
+	Action string `json:"action"`
+	Label  string `json:"label"`
+	Note   string `json:"note"`
+	Meows  []struct {
+		DID  string `json:"did"`
+		Rkey string `json:"rkey"`
+		// Version, when set, is the moderation version the action is
+		// based on, see versioned.go
+		Version *int `json:"version"`
+	} `json:"meows"`
+}
+
+// moderateMeows applies one action to many meows. hide, label and dismiss
+// resolve the open and triaged reports against each meow; unhide and
+// unlabel leave reports alone.
+func moderateMeows(session *gocql.Session) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req moderateMeowsRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+			return
+		}
+		switch req.Action {
+		case "hide", "unhide", "dismiss":
+		case "label", "unlabel":
+			if !labelRegex.MatchString(req.Label) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "label must be lowercase letters, digits and dashes"})
+				return
+			}
+		default:
+			c.JSON(http.StatusBadRequest, gin.H{"error": "action must be hide, unhide, label, unlabel or dismiss"})
+			return
+		}
+		if len(req.Meows) == 0 || len(req.Meows) > maxBulkModeration {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "meows must list 1 to " + strconv.Itoa(maxBulkModeration) + " meows"})
+			return
+		}
+		for _, m := range req.Meows {
+			if !strings.HasPrefix(m.DID, "did:") || !rkeyRegex.MatchString(m.Rkey) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid meow " + m.DID + "/" + m.Rkey})
+				return
+			}
+		}
+
+		note := strings.TrimSpace(req.Note)
+		resolved := 0
+		versions := map[string]int{}
+		for _, m := range req.Meows {
+			version, err := moderateMeow(c, session, m.DID, m.Rkey, req.Action, req.Label, m.Version)
+			if err != nil {
+				respondWriteError(c, err, gin.H{"meow": meowURI(m.DID, m.Rkey), "resolved": resolved, "versions": versions})
+				return
+			}
+			if version > 0 {
+				versions[meowURI(m.DID, m.Rkey)] = version
+			}
+			if req.Action == "hide" || req.Action == "label" || req.Action == "dismiss" {
+				n, err := resolveMeowReports(c, session, m.DID, m.Rkey, note)
+				resolved += n
+				if err != nil {
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "resolved": resolved})
+					return
+				}
+			}
+		}
+		c.JSON(http.StatusOK, gin.H{"meows": len(req.Meows), "resolved": resolved, "versions": versions})
+	}
+}
+
+func readMeowModeration(c *gin.Context, session *gocql.Session, did, rkey string) (meowModeration, int, error) {
+	var mm meowModeration
+	var version int
+	err := session.Query(`SELECT hidden, labels, version FROM meow_moderation WHERE did = ? AND rkey = ?`, did, rkey).
+		WithContext(c.Request.Context()).Scan(&mm.hidden, &mm.labels, &version)
+	if err == gocql.ErrNotFound {
+		return meowModeration{}, 0, nil
+	}
+	return mm, version, err
+}
+
+// moderateMeow applies an action to a meow on top of its current
+// moderation state, and returns the new version; 0 for dismiss, which
+// changes nothing.
+func moderateMeow(c *gin.Context, session *gocql.Session, did, rkey, action, label string, expected *int) (int, error) {
+	if action != "hide" && action != "unhide" && action != "label" && action != "unlabel" {
+		return 0, nil
+	}
+	var mm meowModeration
+	version, err := versionedWrite(expected,
+		func() (int, error) {
+			var version int
+			var err error
+			mm, version, err = readMeowModeration(c, session, did, rkey)
+			return version, err
+		},
+		func(current int) (bool, error) {
+			switch action {
+			case "hide", "unhide":
+				mm.hidden = action == "hide"
+			case "label":
+				mm.labels = append(removeLabel(mm.labels, label), label)
+			case "unlabel":
+				mm.labels = removeLabel(mm.labels, label)
+			}
+			cond, args := versionCondition(current)
+			return casExec(session.Query(`
+				UPDATE meow_moderation SET hidden = ?, labels = ?, updated_at = ?, version = ?
+				WHERE did = ? AND rkey = ?`+cond,
+				append([]any{mm.hidden, mm.labels, time.Now(), current + 1, did, rkey}, args...)...,
+			).WithContext(c.Request.Context()))
+		})
+	if err != nil {
+		return 0, err
+	}
+	moderation.set(did, rkey, mm)
+	purgeCDNLater(cdnAllMeowsKey, cdnActorKey(did), cdnMeowKey(did, rkey))
+	return version, nil
+}
+
+func removeLabel(labels []string, label string) []string {
+	kept := []string{}
+	for _, l := range labels {
+		if l != label {
+			kept = append(kept, l)
+		}
+	}
+	return kept
+}
+
+// resolveMeowReports resolves every open or triaged report against a meow
+// and returns how many it resolved.
+func resolveMeowReports(c *gin.Context, session *gocql.Session, did, rkey, note string) (int, error) {
+	iter := session.Query(`SELECT id FROM reports_by_meow WHERE did = ? AND rkey = ?`, did, rkey).
+		WithContext(c.Request.Context()).Iter()
+	var ids []gocql.UUID
+	var id gocql.UUID
+	for iter.Scan(&id) {
+		ids = append(ids, id)
+	}
+	if err := iter.Close(); err != nil {
+		return 0, err
+	}
+
+	resolved := 0
+	for _, id := range ids {
+		r, err := loadReport(c, session, id)
+		if err != nil {
+			return resolved, err
+		}
+		if r == nil || r.State == reportResolved {
+			continue
+		}
+		if err := setReportState(c, session, r, reportResolved, note); err != nil {
+			return resolved, err
+		}
+		resolved++
+	}
+	return resolved, nil
+}
+
+// setActorModeration deprioritizes an actor, or lifts it, with
+// ?did=&deprioritized=true|false and an optional ?note=. With ?version=
+// it only does so on top of that version.
+func setActorModeration(session *gocql.Session) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		did := c.Query("did")
+		if !didSyntax.MatchString(did) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid did"})
+			return
+		}
+		deprioritized, err := strconv.ParseBool(c.Query("deprioritized"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "deprioritized must be true or false"})
+			return
+		}
+
+		var expected *int
+		if v := c.Query("version"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid version"})
+				return
+			}
+			expected = &n
+		}
+
+		// lifting keeps the row, with its version
+		version, err := versionedWrite(expected,
+			func() (int, error) {
+				var version int
+				err := session.Query(`SELECT version FROM actor_moderation WHERE did = ?`, did).
+					WithContext(c.Request.Context()).Scan(&version)
+				if err == gocql.ErrNotFound {
+					return 0, nil
+				}
+				return version, err
+			},
+			func(current int) (bool, error) {
+				cond, args := versionCondition(current)
+				return casExec(session.Query(`
+					UPDATE actor_moderation SET deprioritized = ?, note = ?, updated_at = ?, version = ?
+					WHERE did = ?`+cond,
+					append([]any{deprioritized, strings.TrimSpace(c.Query("note")), time.Now(), current + 1, did}, args...)...,
+				).WithContext(c.Request.Context()))
+			})
+		if err != nil {
+			respondWriteError(c, err, gin.H{"did": did})
+			return
+		}
+
+		moderation.mu.Lock()
+		if deprioritized {
+			moderation.actors[did] = true
+		} else {
+			delete(moderation.actors, did)
+		}
+		moderation.mu.Unlock()
+		purgeCDNLater(cdnAllMeowsKey, cdnActorKey(did))
+		c.JSON(http.StatusOK, gin.H{"did": did, "deprioritized": deprioritized, "version": version})
+	}
+}
+
+type ActorModeration struct {
+	DID       string    `json:"did"`
+	Note      string    `json:"note,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Version   int       `json:"version"`
+}
+
+func listDeprioritizedActors(session *gocql.Session) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		iter := session.Query(`SELECT did, deprioritized, note, updated_at, version FROM actor_moderation`).
+			WithContext(c.Request.Context()).Iter()
+		actors := []ActorModeration{}
+		var a ActorModeration
+		var deprioritized bool
+		for iter.Scan(&a.DID, &deprioritized, &a.Note, &a.UpdatedAt, &a.Version) {
+			if deprioritized {
+				actors = append(actors, a)
+			}
+			a = ActorModeration{}
+		}
+		if err := iter.Close(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		sort.Slice(actors, func(i, j int) bool { return actors[i].DID < actors[j].DID })
+		c.JSON(http.StatusOK, gin.H{"actors": actors})
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Address family settings:
+//
+//	LISTEN_ADDR           HTTP listen address, default :8134 (all v4 and v6 addresses)
+//	LISTEN_NETWORK        tcp (dual-stack), tcp4 or tcp6
+//	PREFERRED_IP_FAMILY   any, ipv4 or ipv6 for outbound connections
+//	HAPPY_EYEBALLS_DELAY  how long to wait on the first address family before
+//	                      racing the other one, default 300ms
+var (
+	listenAddr        = envString("LISTEN_ADDR", ":8134")
+	listenNetwork     = envString("LISTEN_NETWORK", "tcp")
+	preferredFamily   = envString("PREFERRED_IP_FAMILY", "any")
+	happyEyeballDelay = envDuration("HAPPY_EYEBALLS_DELAY", 300*time.Millisecond)
+)
+
+// outboundDialer is shared by every outgoing connection: jetstream, the PLC
+// directory and did:web hosts. With network "tcp" it races IPv6 and IPv4
+// addresses (RFC 6555), so IPv6-only and dual-stack hosts both work.
+var outboundDialer = &net.Dialer{
+	Timeout:       10 * time.Second,
+	KeepAlive:     30 * time.Second,
+	FallbackDelay: happyEyeballDelay,
+}
+
+// dialOutbound pins the address family when PREFERRED_IP_FAMILY asks for it.
+func dialOutbound(ctx context.Context, network, addr string) (net.Conn, error) {
+	if network == "tcp" {
+		switch preferredFamily {
+		case "ipv4":
+			network = "tcp4"
+		case "ipv6":
+			network = "tcp6"
+		}
+	}
+	return outboundDialer.DialContext(ctx, network, addr)
+}
+
+// outboundTransport is the transport used for DID resolution.
+var outboundTransport = &http.Transport{
+	Proxy:                 http.ProxyFromEnvironment,
+	DialContext:           dialOutbound,
+	ForceAttemptHTTP2:     true,
+	MaxIdleConns:          100,
+	IdleConnTimeout:       90 * time.Second,
+	TLSHandshakeTimeout:   10 * time.Second,
+	ExpectContinueTimeout: 1 * time.Second,
+}
+
+// jetstreamDialer is websocket.DefaultDialer with the shared outbound dialer.
+var jetstreamDialer = &websocket.Dialer{
+	Proxy:            http.ProxyFromEnvironment,
+	HandshakeTimeout: 45 * time.Second,
+	NetDialContext:   dialOutbound,
+}
+
+// listen opens the HTTP listener on the configured network, or takes the
+// socket passed in by systemd.
+func listen() net.Listener {
+	if ln, err := activatedListener(); err != nil {
+		log.Fatal("socket activation:", err)
+	} else if ln != nil {
+		log.Printf("listening on %s (socket activation)", ln.Addr())
+		return ln
+	}
+
+	switch listenNetwork {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		log.Fatalf("LISTEN_NETWORK must be tcp, tcp4 or tcp6, got %q", listenNetwork)
+	}
+	switch preferredFamily {
+	case "any", "ipv4", "ipv6":
+	default:
+		log.Fatalf("PREFERRED_IP_FAMILY must be any, ipv4 or ipv6, got %q", preferredFamily)
+	}
+
+	ln, err := net.Listen(listenNetwork, listenAddr)
+	if err != nil {
+		log.Fatal("listen:", err)
+	}
+	log.Printf("listening on %s (%s)", ln.Addr(), listenNetwork)
+	return ln
+}
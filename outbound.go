@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	outboundRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "meowview_outbound_requests_total",
+		Help: "Outbound HTTP requests, by host and status code (error for transport failures).",
+	}, []string{"host", "status"})
+
+	outboundDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "meowview_outbound_request_duration_seconds",
+		Help:    "Outbound HTTP request latency, by host.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"host"})
+
+	outboundRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "meowview_outbound_retries_total",
+		Help: "Outbound HTTP requests retried, by host.",
+	}, []string{"host"})
+
+	outboundThrottled = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "meowview_outbound_rate_limit_wait_seconds",
+		Help:    "Time spent waiting on the per-host rate limiter.",
+		Buckets: []float64{0.001, 0.01, 0.05, 0.1, 0.5, 1, 5},
+	}, []string{"host"})
+)
+
+// hostLimiter is a token bucket for a single host.
+type hostLimiter struct {
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+	rate   float64
+	burst  float64
+	// base is the configured rate; rate adapts below it, see adapt
+	base float64
+	// until is when the host asked, with Retry-After, to be left alone
+	// until
+	until time.Time
+}
+
+// pause holds every request to the host until t.
+func (l *hostLimiter) pause(t time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if t.After(l.until) {
+		l.until = t
+	}
+}
+
+// wait blocks until a token is available or ctx is done.
+func (l *hostLimiter) wait(ctx context.Context) error {
+	for {
+		l.mu.Lock()
+		now := time.Now()
+		if now.Before(l.until) {
+			delay := l.until.Sub(now)
+			l.mu.Unlock()
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(delay):
+			}
+			continue
+		}
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		if l.tokens > l.burst {
+			l.tokens = l.burst
+		}
+		l.last = now
+		if l.tokens >= 1 {
+			l.tokens--
+			l.mu.Unlock()
+			return nil
+		}
+		delay := time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+		l.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// outboundClient is the one HTTP client used for every outbound call (PLC
+// directory, did:web hosts, PDSs, the classifier). It pools connections,
+// rate limits per host and retries transient failures of idempotent requests.
+// Redirects are never followed; DID documents must be served in place.
+//
+// Every request identifies us with outboundUserAgent. A 429 or 503 with
+// Retry-After holds all requests to that host until then; a retry is only
+// attempted if that is within OUTBOUND_MAX_RETRY_AFTER. The per-host rate
+// also adapts to RateLimit headers and 429s, see adapt, and background
+// work is deferred rather than queued once a host's budget is spent.
+//
+//	OUTBOUND_RATE_PER_HOST     requests per second per host, default 10
+//	OUTBOUND_BURST             burst per host, default 20
+//	OUTBOUND_RETRIES           retries after the first attempt, default 2
+//	OUTBOUND_MAX_RETRY_AFTER   longest Retry-After waited for, default 30s
+type outboundClient struct {
+	client        *http.Client
+	userAgent     string
+	rate          float64
+	burst         float64
+	maxRetries    int
+	maxRetryAfter time.Duration
+
+	mu       sync.Mutex
+	limiters map[string]*hostLimiter
+}
+
+var outbound = newOutboundClient()
+
+// outboundUserAgent names us to the PLC directory, PDSs and everyone else
+// we call, as OUTBOUND_USER_AGENT or else
+// "meowview/<version> (+<OUTBOUND_CONTACT_URL>; <SERVICE_DID>)", so
+// operators know who is calling and how to reach us.
+func outboundUserAgent() string {
+	if ua := getenv("OUTBOUND_USER_AGENT"); ua != "" {
+		return ua
+	}
+	var about []string
+	if contact := getenv("OUTBOUND_CONTACT_URL"); contact != "" {
+		about = append(about, "+"+contact)
+	}
+	if did := getenv("SERVICE_DID"); did != "" {
+		about = append(about, did)
+	}
+	ua := "meowview/" + version
+	if len(about) > 0 {
+		ua += " (" + strings.Join(about, "; ") + ")"
+	}
+	return ua
+}
+
+// retryAfter parses a Retry-After header, in seconds or as an HTTP date.
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+	if resp == nil {
+		return 0, false
+	}
+	v := resp.Header.Get("Retry-After")
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return max(time.Until(t), 0), true
+	}
+	return 0, false
+}
+
+func newOutboundClient() *outboundClient {
+	return &outboundClient{
+		client: &http.Client{
+			Timeout:   10 * time.Second,
+			Transport: outboundTransport,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		userAgent:     outboundUserAgent(),
+		rate:          envFloat("OUTBOUND_RATE_PER_HOST", 10),
+		burst:         envFloat("OUTBOUND_BURST", 20),
+		maxRetries:    envInt("OUTBOUND_RETRIES", 2),
+		maxRetryAfter: envDuration("OUTBOUND_MAX_RETRY_AFTER", 30*time.Second),
+		limiters:      map[string]*hostLimiter{},
+	}
+}
+
+func (o *outboundClient) limiter(host string) *hostLimiter {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	l, ok := o.limiters[host]
+	if !ok {
+		l = &hostLimiter{tokens: o.burst, last: time.Now(), rate: o.rate, burst: o.burst, base: o.rate}
+		o.limiters[host] = l
+	}
+	return l
+}
+
+func retryable(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+}
+
+// Do sends the request. Only GET and HEAD requests, or requests whose body
+// can be replayed, are retried.
+func (o *outboundClient) Do(req *http.Request) (*http.Response, error) {
+	host := req.URL.Host
+	canRetry := req.Method == http.MethodGet || req.Method == http.MethodHead || req.GetBody != nil
+	req.Header.Set("User-Agent", o.userAgent)
+
+	for attempt := 0; ; attempt++ {
+		if isBackground(req.Context()) && o.limiter(host).saturated() {
+			outboundDeferred.WithLabelValues(host).Inc()
+			return nil, fmt.Errorf("%s: %w", host, errOutboundDeferred)
+		}
+		start := time.Now()
+		if err := o.limiter(host).wait(req.Context()); err != nil {
+			return nil, err
+		}
+		outboundThrottled.WithLabelValues(host).Observe(time.Since(start).Seconds())
+
+		if attempt > 0 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req.Body = body
+		}
+
+		start = time.Now()
+		resp, err := o.client.Do(req)
+		outboundDuration.WithLabelValues(host).Observe(time.Since(start).Seconds())
+		if err != nil {
+			outboundRequests.WithLabelValues(host, "error").Inc()
+		} else {
+			outboundRequests.WithLabelValues(host, strconv.Itoa(resp.StatusCode)).Inc()
+			o.limiter(host).adapt(host, resp)
+		}
+
+		// exponential backoff with jitter: 200ms, 400ms, 800ms...
+		backoff := time.Duration(200<<attempt) * time.Millisecond
+		backoff += time.Duration(rand.Int63n(int64(backoff) / 2))
+		if err == nil && (resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable) {
+			if wait, ok := retryAfter(resp); ok {
+				o.limiter(host).pause(time.Now().Add(wait))
+				if wait > o.maxRetryAfter {
+					return resp, err
+				}
+				// the limiter waits it out
+				backoff = 0
+			}
+		}
+
+		if !canRetry || attempt >= o.maxRetries || !retryable(resp, err) {
+			return resp, err
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+		outboundRetries.WithLabelValues(host).Inc()
+		select {
+		case <-req.Context().Done():
+			return nil, fmt.Errorf("%s: giving up after %d attempts: %w", host, attempt+1, req.Context().Err())
+		case <-time.After(backoff):
+		}
+	}
+}
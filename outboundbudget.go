@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	outboundRate = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "meowview_outbound_rate_per_host",
+		Help: "Requests per second currently allowed to a host, after adapting to its rate limits.",
+	}, []string{"host"})
+
+	outboundDeferred = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "meowview_outbound_deferred_total",
+		Help: "Background requests deferred because their host's budget was used up, by host.",
+	}, []string{"host"})
+)
+
+// errOutboundDeferred is returned for background requests to a host that
+// is rate limited right now; the work should be retried later.
+var errOutboundDeferred = errors.New("deferred: host is rate limited")
+
+// minOutboundRate is the least a host is slowed down to without being
+// told when to come back.
+const minOutboundRate = 0.1
+
+type backgroundKey struct{}
+
+// background marks requests made with ctx as enrichment work, which is
+// deferred with errOutboundDeferred instead of queueing behind a host's
+// rate limit, so a backfill doesn't hold up or crowd out the requests
+// serving API calls.
+func background(ctx context.Context) context.Context {
+	return context.WithValue(ctx, backgroundKey{}, true)
+}
+
+func isBackground(ctx context.Context) bool {
+	v, _ := ctx.Value(backgroundKey{}).(bool)
+	return v
+}
+
+// saturated reports whether a request now would have to wait.
+func (l *hostLimiter) saturated() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if now.Before(l.until) {
+		return true
+	}
+	tokens := l.tokens + now.Sub(l.last).Seconds()*l.rate
+	return tokens < 1
+}
+
+// rateLimitHeaders reads the RateLimit-Remaining and RateLimit-Reset
+// headers PDSs send. Reset is seconds from now in the IETF draft but a
+// unix time on atproto PDSs; both are accepted.
+func rateLimitHeaders(resp *http.Response) (remaining int, reset time.Duration, ok bool) {
+	r := resp.Header.Get("RateLimit-Remaining")
+	t := resp.Header.Get("RateLimit-Reset")
+	if r == "" || t == "" {
+		return 0, 0, false
+	}
+	remaining, err := strconv.Atoi(strings.TrimSpace(r))
+	if err != nil || remaining < 0 {
+		return 0, 0, false
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(t), 10, 64)
+	if err != nil || n < 0 {
+		return 0, 0, false
+	}
+	if n > 1e9 {
+		return remaining, max(time.Until(time.Unix(n, 0)), 0), true
+	}
+	return remaining, time.Duration(n) * time.Second, true
+}
+
+// adapt tunes the host's rate to a response. With RateLimit headers the
+// rate spreads what is left of the window over the time until it resets,
+// and a spent window holds requests until the reset. Without them a 429
+// halves the rate, and every success wins back a twentieth of the
+// configured rate.
+func (l *hostLimiter) adapt(host string, resp *http.Response) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if remaining, reset, ok := rateLimitHeaders(resp); ok {
+		switch {
+		case remaining == 0:
+			if until := time.Now().Add(reset); until.After(l.until) {
+				l.until = until
+			}
+		case reset > 0:
+			l.rate = max(min(l.base, float64(remaining)/reset.Seconds()), minOutboundRate)
+		}
+	} else if resp.StatusCode == http.StatusTooManyRequests {
+		l.rate = max(l.rate/2, minOutboundRate)
+	} else if resp.StatusCode < 400 {
+		l.rate = min(l.rate+l.base/20, l.base)
+	}
+	outboundRate.WithLabelValues(host).Set(l.rate)
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gocql/gocql"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/segmentio/kafka-go"
+)
+
+var outboxDeliveries = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "meowview_outbox_deliveries_total",
+	Help: "Outbox delivery attempts, by sink and result (ok, retry, dead).",
+}, []string{"sink", "result"})
+
+// outboxSink is somewhere meow operations are pushed to. Deliveries are at
+// least once: a crash between delivering and clearing the outbox row sends
+// the entry again, with the same ID, so sinks can drop duplicates.
+type outboxSink interface {
+	Name() string
+	Deliver(ctx context.Context, entry outboxEntry) error
+}
+
+type outboxEntry struct {
+	ID       gocql.UUID
+	TimeUS   int64
+	Key      string
+	Payload  []byte
+	Attempts int
+}
+
+// outboxPayload is the body sent to every sink.
+type outboxPayload struct {
+	ID string `json:"id"`
+	MeowChange
+}
+
+// webhookSink POSTs each entry as JSON. The body is signed with
+// OUTBOX_WEBHOOK_SECRET in X-Meowview-Signature when a secret is set.
+type webhookSink struct {
+	url    string
+	secret string
+}
+
+func (s *webhookSink) Name() string { return "webhook" }
+
+func (s *webhookSink) Deliver(ctx context.Context, entry outboxEntry) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(entry.Payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Meowview-Delivery", entry.ID.String())
+	if s.secret != "" {
+		mac := hmac.New(sha256.New, []byte(s.secret))
+		mac.Write(entry.Payload)
+		req.Header.Set("X-Meowview-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := outbound.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// kafkaSink produces each entry to a topic, keyed by author DID so one
+// actor's operations stay ordered within a partition.
+type kafkaSink struct {
+	writer *kafka.Writer
+}
+
+func (s *kafkaSink) Name() string { return "kafka" }
+
+func (s *kafkaSink) Deliver(ctx context.Context, entry outboxEntry) error {
+	return s.writer.WriteMessages(ctx, kafka.Message{
+		Key:   []byte(entry.Key),
+		Value: entry.Payload,
+		Headers: []kafka.Header{
+			{Key: "meowview-delivery", Value: []byte(entry.ID.String())},
+		},
+	})
+}
+
+func outboxSinksFromEnv() []outboxSink {
+	var sinks []outboxSink
+	if u := envString("OUTBOX_WEBHOOK_URL", ""); u != "" {
+		sinks = append(sinks, &webhookSink{url: u, secret: envSecret("OUTBOX_WEBHOOK_SECRET")})
+	}
+	if brokers := envList("OUTBOX_KAFKA_BROKERS"); len(brokers) > 0 {
+		sinks = append(sinks, &kafkaSink{writer: &kafka.Writer{
+			Addr:         kafka.TCP(brokers...),
+			Topic:        envString("OUTBOX_KAFKA_TOPIC", "meowview.meows"),
+			Balancer:     &kafka.Hash{},
+			RequiredAcks: kafka.RequireAll,
+		}})
+	}
+	// see cdn.go
+	if cdn != nil {
+		sinks = append(sinks, cdnSink{})
+	}
+	return sinks
+}
+
+var outboxSinks = outboxSinksFromEnv()
+
+// createOutboxTables creates the outbox. Rows are deleted once delivered,
+// so a sink's partition only holds what is still pending or dead.
+func createOutboxTables(session *gocql.Session) error {
+	return session.Query(`
+		CREATE TABLE IF NOT EXISTS outbox (
+			sink TEXT,
+			time_us BIGINT,
+			id UUID,
+			key TEXT,
+			payload BLOB,
+			attempts INT,
+			next_attempt_at TIMESTAMP,
+			last_error TEXT,
+			dead BOOLEAN,
+			PRIMARY KEY ((sink), time_us, id)
+		) WITH CLUSTERING ORDER BY (time_us ASC, id ASC)`).Exec()
+}
+
+// addOutboxEntries queues ev for every configured sink in the same logged
+// batch as the meows write, so either both land or neither does. The entry
+// ID is derived from the event, so applying it twice doesn't queue twice.
+func addOutboxEntries(batch *gocql.Batch, ev meowEvent) error {
+	for _, sink := range outboxSinks {
+		id := gocql.UUID(uuid.NewSHA1(uuid.NameSpaceURL,
+			[]byte(fmt.Sprintf("%s/%s/%s/%d/%s", sink.Name(), ev.DID, ev.Rkey, ev.TimeUS, ev.Op))))
+		payload, err := json.Marshal(outboxPayload{
+			ID:         id.String(),
+			MeowChange: MeowChange{Op: ev.Op, MeowResponse: ev.Meow.response()},
+		})
+		if err != nil {
+			return err
+		}
+		batch.Query(`
+			INSERT INTO outbox (sink, time_us, id, key, payload, attempts, dead)
+			VALUES (?, ?, ?, ?, ?, 0, false)`,
+			sink.Name(), ev.TimeUS, id, ev.DID, payload,
+		)
+	}
+	return nil
+}
+
+// runOutbox delivers pending outbox entries in order, one sink at a time.
+// A failing entry holds back the rest of its sink until it succeeds or
+// runs out of attempts and is marked dead.
+func runOutbox(session *gocql.Session) {
+	interval := envDuration("OUTBOX_POLL_INTERVAL", time.Second)
+	maxAttempts := envInt("OUTBOX_MAX_ATTEMPTS", 10)
+	for {
+		for _, sink := range outboxSinks {
+			dispatchOutbox(session, sink, maxAttempts)
+		}
+		time.Sleep(interval)
+	}
+}
+
+func dispatchOutbox(session *gocql.Session, sink outboxSink, maxAttempts int) {
+	iter := session.Query(`
+		SELECT time_us, id, key, payload, attempts, next_attempt_at, dead
+		FROM outbox
+		WHERE sink = ?`,
+		sink.Name(),
+	).PageSize(100).Iter()
+	defer func() {
+		if err := iter.Close(); err != nil {
+			log.Printf("outbox %s: read error: %v", sink.Name(), err)
+		}
+	}()
+
+	var entry outboxEntry
+	var nextAttempt time.Time
+	var dead bool
+	for iter.Scan(&entry.TimeUS, &entry.ID, &entry.Key, &entry.Payload, &entry.Attempts, &nextAttempt, &dead) {
+		if dead {
+			continue
+		}
+		if time.Now().Before(nextAttempt) {
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		err := sink.Deliver(ctx, entry)
+		cancel()
+		if err == nil {
+			outboxDeliveries.WithLabelValues(sink.Name(), "ok").Inc()
+			err := session.Query(`DELETE FROM outbox WHERE sink = ? AND time_us = ? AND id = ?`,
+				sink.Name(), entry.TimeUS, entry.ID).Exec()
+			if err != nil {
+				log.Printf("outbox %s: clear %s: %v", sink.Name(), entry.ID, err)
+				return
+			}
+			entry = outboxEntry{}
+			continue
+		}
+
+		attempts := entry.Attempts + 1
+		dead = attempts >= maxAttempts
+		backoff := time.Duration(1<<min(attempts, 10)) * time.Second
+		result := "retry"
+		if dead {
+			result = "dead"
+		}
+		outboxDeliveries.WithLabelValues(sink.Name(), result).Inc()
+		log.Printf("outbox %s: deliver %s (attempt %d): %v", sink.Name(), entry.ID, attempts, err)
+		err = session.Query(`
+			UPDATE outbox SET attempts = ?, next_attempt_at = ?, last_error = ?, dead = ?
+			WHERE sink = ? AND time_us = ? AND id = ?`,
+			attempts, time.Now().Add(backoff), err.Error(), dead,
+			sink.Name(), entry.TimeUS, entry.ID,
+		).Exec()
+		if err != nil {
+			log.Printf("outbox %s: update %s: %v", sink.Name(), entry.ID, err)
+		}
+		if !dead {
+			return
+		}
+		entry = outboxEntry{}
+	}
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/baphotex/meowview/repostream"
+	"github.com/gocql/gocql"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	pdsEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "meowview_pds_events_total",
+		Help: "Meow ops read from PDS and relay subscriptions, by host and result (indexed, duplicate, foreign, bad_signature, invalid or too_big).",
+	}, []string{"host", "result"})
+
+	pdsReconnects = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "meowview_pds_reconnects_total",
+		Help: "PDS subscription reconnects, by host.",
+	}, []string{"host"})
+)
+
+// PDS_SUBSCRIBE_HOSTS lists PDSs whose com.atproto.sync.subscribeRepos
+// streams are read directly, for repos on hosts the relay behind jetstream
+// doesn't crawl. Their meows go through the same pipeline as jetstream's.
+// Commit signatures aren't verified; instead only commits of repos whose
+// DID document names that host as their PDS are indexed, so a host can't
+// write meows for repos elsewhere. Each host's seq is kept in ingest_state
+// as "pds:<host>" and resumed from after a restart.
+var pdsSubscribeHosts = envList("PDS_SUBSCRIBE_HOSTS")
+
+// pdsCursorInterval is how often a host's seq is saved.
+const pdsCursorInterval = 10 * time.Second
+
+// pdsStreamURL is the subscribeRepos URL of a host given as a hostname or
+// a URL, wss unless it is http.
+func pdsStreamURL(host string) (*url.URL, error) {
+	if !strings.Contains(host, "://") {
+		host = "https://" + host
+	}
+	u, err := url.Parse(host)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, errors.New("no host")
+	}
+	switch u.Scheme {
+	case "https", "wss":
+		u.Scheme = "wss"
+	case "http", "ws":
+		u.Scheme = "ws"
+	default:
+		return nil, errors.New("unsupported scheme " + u.Scheme)
+	}
+	u.Path = "/xrpc/com.atproto.sync.subscribeRepos"
+	return u, nil
+}
+
+func runPDSSubscriptions(session *gocql.Session, classifier EmotionClassifier) {
+	for _, host := range pdsSubscribeHosts {
+		u, err := pdsStreamURL(host)
+		if err != nil {
+			log.Fatalf("PDS_SUBSCRIBE_HOSTS: %s: %v", host, err)
+		}
+		s := &pdsSubscription{host: u.Host, url: u, classifier: classifier}
+		go s.run(session)
+	}
+}
+
+type pdsSubscription struct {
+	host       string
+	url        *url.URL
+	classifier EmotionClassifier
+	// relay streams carry every repo, see relaystream.go
+	relay bool
+}
+
+func (s *pdsSubscription) cursorName() string {
+	if s.relay {
+		return "relay:" + s.host
+	}
+	return "pds:" + s.host
+}
+
+// run reads the host's stream, reconnecting with backoff.
+func (s *pdsSubscription) run(session *gocql.Session) {
+	backoff := time.Second
+	for {
+		if s.relay && ingest.paused() {
+			firehose.setError(errIngestPaused)
+			ingest.awaitResume()
+		}
+		var cursor int64
+		err := session.Query(`SELECT cursor FROM ingest_state WHERE name = ?`, s.cursorName()).Scan(&cursor)
+		if err != nil && err != gocql.ErrNotFound {
+			log.Printf("load %s cursor: %v", s.host, err)
+		}
+		read, err := s.read(session, cursor)
+		log.Printf("pds subscription %s: %v", s.host, err)
+		if s.relay {
+			firehose.setError(err)
+		}
+		pdsReconnects.WithLabelValues(s.host).Inc()
+		if read {
+			backoff = time.Second
+		}
+		time.Sleep(backoff)
+		backoff = min(backoff*2, time.Minute)
+	}
+}
+
+// read follows the stream from after cursor until it fails, and reports
+// whether any event was read.
+func (s *pdsSubscription) read(session *gocql.Session, cursor int64) (bool, error) {
+	u := *s.url
+	if cursor > 0 {
+		u.RawQuery = url.Values{"cursor": {strconv.FormatInt(cursor, 10)}}.Encode()
+	}
+	conn, _, err := jetstreamDialer.Dial(u.String(), http.Header{"User-Agent": {outbound.userAgent}})
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	keepAlive(conn)
+	if s.relay {
+		firehose.setConnected()
+	}
+	log.Printf("subscribed to %s from seq %d", s.host, cursor)
+
+	read := false
+	saved := time.Now()
+	defer func() {
+		if err := s.saveCursor(session, cursor); err != nil {
+			log.Printf("save %s cursor: %v", s.host, err)
+		}
+	}()
+	for {
+		frame, err := readJetstream(conn)
+		if err != nil {
+			return read, err
+		}
+		read = true
+		if s.relay && ingest.paused() {
+			return read, errIngestPaused
+		}
+		ev, err := repostream.ParseEvent(frame)
+		if errors.Is(err, repostream.ErrStream) {
+			return read, err
+		}
+		if err != nil {
+			log.Printf("pds subscription %s: %v", s.host, err)
+			continue
+		}
+		if ev.Type == "#info" {
+			log.Printf("pds subscription %s: %s %s", s.host, ev.Name, ev.Message)
+		}
+		if ev.Type == "#identity" || ev.Type == "#account" {
+			s.account(session, ev)
+		}
+		if ev.Commit != nil {
+			s.commit(session, ev.Commit)
+		}
+		if ev.Seq > cursor {
+			cursor = ev.Seq
+		}
+		if time.Since(saved) > pdsCursorInterval {
+			if err := s.saveCursor(session, cursor); err != nil {
+				log.Printf("save %s cursor: %v", s.host, err)
+			}
+			saved = time.Now()
+		}
+	}
+}
+
+func (s *pdsSubscription) saveCursor(session *gocql.Session, cursor int64) error {
+	if cursor == 0 {
+		return nil
+	}
+	return session.Query(`
+		INSERT INTO ingest_state (name, cursor, updated_at) VALUES (?, ?, ?)`,
+		s.cursorName(), cursor, time.Now(),
+	).Exec()
+}
+
+// account applies #identity and #account messages like jetstream's
+// identity and account events, see identities.go and accounts.go. A PDS
+// is only believed about the repos it hosts, and the handles it sends
+// aren't checked like a relay's, so they only trigger verifying the
+// actor's handle again, see handleverify.go, without going into
+// identities.
+func (s *pdsSubscription) account(session *gocql.Session, ev *repostream.Event) {
+	if s.relay && ingest.drop() {
+		return
+	}
+	if !s.relay && !s.hosts(ev.DID) {
+		return
+	}
+	// the time is the rows' write timestamp; one in the future would pin
+	// them
+	msg := WebSocketMessage{DID: ev.DID, TimeUS: time.Now().UnixMicro()}
+	if !ev.Time.IsZero() {
+		msg.TimeUS = min(ev.Time.UnixMicro(), msg.TimeUS)
+	}
+	switch ev.Type {
+	case "#identity":
+		msg.Kind = "identity"
+		msg.Identity.Handle = ev.Handle
+		if s.relay {
+			recordIdentity(session, msg)
+		}
+		actorHandles.identityChanged(session, ev.DID)
+	case "#account":
+		msg.Kind = "account"
+		msg.Account.Active = ev.Active
+		msg.Account.Status = ev.Status
+		accountChanged(session, msg)
+	}
+}
+
+// commit indexes the meow ops of a commit like jetstream events.
+func (s *pdsSubscription) commit(session *gocql.Session, c *repostream.Commit) {
+	var meows []repostream.Op
+	for _, op := range c.Ops {
+		if op.Collection() == meowNSID {
+			meows = append(meows, op)
+		}
+	}
+	if len(meows) == 0 {
+		return
+	}
+	count := func(result string) {
+		pdsEvents.WithLabelValues(s.host, result).Add(float64(len(meows)))
+	}
+	if s.relay && ingest.drop() {
+		return
+	}
+	if validateDID(c.Repo) != c.Repo {
+		count("invalid")
+		return
+	}
+	switch {
+	case s.relay && !c.TooBig && !s.signed(c):
+		count("bad_signature")
+		return
+	case !s.relay && !s.hosts(c.Repo):
+		count("foreign")
+		return
+	}
+	if c.TooBig {
+		// a backfill of the repo picks these up
+		log.Printf("pds subscription %s: commit %s of %s too big, skipped", s.host, c.Rev, c.Repo)
+		count("too_big")
+		return
+	}
+
+	for _, op := range meows {
+		result := s.op(session, c, op)
+		pdsEvents.WithLabelValues(s.host, result).Inc()
+	}
+}
+
+// hosts reports whether the DID document of did names this host as its
+// PDS.
+func (s *pdsSubscription) hosts(did string) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	doc, err := didResolver.Resolve(ctx, did)
+	if err != nil {
+		log.Printf("resolve %s: %v", did, err)
+		return false
+	}
+	pds, err := pdsEndpoint(doc)
+	if err != nil {
+		return false
+	}
+	u, err := url.Parse(pds)
+	return err == nil && strings.EqualFold(u.Host, s.host)
+}
+
+func (s *pdsSubscription) op(session *gocql.Session, c *repostream.Commit, op repostream.Op) string {
+	// a relay could add ops to a commit it didn't sign, see relaystream.go
+	if s.relay {
+		if err := c.Prove(op); err != nil {
+			log.Printf("relay %s: commit %s of %s: %v", s.host, c.Rev, c.Repo, err)
+			return "bad_signature"
+		}
+	}
+	rkey := op.Rkey()
+	if !rkeyRegex.MatchString(rkey) {
+		if op.Action != "delete" {
+			s.reject(session, c, op, rkey, rejectInvalidRkey, "")
+		}
+		return "invalid"
+	}
+	ev := meowEvent{
+		Meow:   Meow{DID: c.Repo, Rkey: rkey, TimeUS: time.Now().UnixMicro()},
+		Op:     op.Action,
+		Rev:    c.Rev,
+		Source: s.cursorName(),
+	}
+	switch op.Action {
+	case "create", "update":
+		record, err := c.Record(op)
+		if err != nil {
+			log.Printf("pds subscription %s: %s: %v", s.host, meowURI(c.Repo, rkey), err)
+			return "invalid"
+		}
+		m, version, err := decodeRecord(meowNSID, record)
+		if err != nil {
+			s.reject(session, c, op, rkey, rejectionReason(err), err.Error())
+			return "invalid"
+		}
+		ev.CID = op.CID.String()
+		ev.Record = string(record)
+		if err := ev.setRecord(m, version); err != nil {
+			s.reject(session, c, op, rkey, rejectionReason(err), err.Error())
+			return "invalid"
+		}
+		if m.Emotion == nil && s.classifier != nil {
+			ev.InferredEmotion = derefString(inferEmotion(s.classifier, c.Repo, record))
+		}
+	case "delete":
+	default:
+		return "invalid"
+	}
+
+	// the relay may crawl the host after all, then jetstream has it too
+	if alreadyApplied(session, ev) {
+		return "duplicate"
+	}
+
+	sequence.assign(&ev)
+	ingestEvent(session, ev)
+	return "indexed"
+}
+
+// reject records an op turned away, see rejections.go.
+func (s *pdsSubscription) reject(session *gocql.Session, c *repostream.Commit, op repostream.Op, rkey, reason, detail string) {
+	recordRejection(session, c.Repo, RejectedMeow{Rkey: rkey, CID: op.CID.String(), Source: "pds", Reason: reason, Detail: detail})
+}
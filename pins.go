@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gocql/gocql"
+)
+
+// An actor can pin one of their own meows, like a pinned post. The pin
+// stays when the meow is deleted; getActorPinnedMeow then has no meow.
+
+func createPinTables(session *gocql.Session) error {
+	return session.Query(`
+		CREATE TABLE IF NOT EXISTS actor_pins (
+			did TEXT PRIMARY KEY,
+			rkey TEXT,
+			pinned_at TIMESTAMP
+		)`).Exec()
+}
+
+type PinnedMeowResponse struct {
+	// Meow is nil when the actor has no pin or the pinned meow is gone
+	Meow     *MeowResponse `json:"meow"`
+	PinnedAt *time.Time    `json:"pinned_at,omitempty"`
+}
+
+// pinnedRkey is the rkey of the meow did pinned, or "".
+func pinnedRkey(ctx context.Context, session *gocql.Session, did string) (string, time.Time, error) {
+	var rkey string
+	var at time.Time
+	err := session.Query(`SELECT rkey, pinned_at FROM actor_pins WHERE did = ?`, did).
+		WithContext(ctx).Scan(&rkey, &at)
+	if err == gocql.ErrNotFound {
+		return "", time.Time{}, nil
+	}
+	return rkey, at, err
+}
+
+// markPinned sets Pinned on did's pinned meow among meows, all by did.
+// Without the pin the meows are still good, so errors are ignored.
+func markPinned(ctx context.Context, session *gocql.Session, did string, meows []MeowResponse) {
+	if did == "" || len(meows) == 0 {
+		return
+	}
+	rkey, _, err := pinnedRkey(ctx, session, did)
+	if err != nil || rkey == "" {
+		return
+	}
+	for i := range meows {
+		if meows[i].DID == did && meows[i].Rkey == rkey {
+			meows[i].Pinned = true
+		}
+	}
+}
+
+// pinMeow pins one of the viewer's own meows, replacing their pin.
+func pinMeow(session *gocql.Session) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		viewer := c.GetString("viewer")
+		rkey := c.Query("rkey")
+		if !rkeyRegex.MatchString(rkey) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid rkey"})
+			return
+		}
+		m, err := lookupMeow(c, session, viewer, rkey)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if m == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "meow not found"})
+			return
+		}
+		err = session.Query(`INSERT INTO actor_pins (did, rkey, pinned_at) VALUES (?, ?, ?)`,
+			viewer, rkey, time.Now(),
+		).WithContext(c.Request.Context()).Exec()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		purgeCDNLater(cdnActorKey(viewer))
+		c.Status(http.StatusNoContent)
+	}
+}
+
+func unpinMeow(session *gocql.Session) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		err := session.Query(`DELETE FROM actor_pins WHERE did = ?`, c.GetString("viewer")).
+			WithContext(c.Request.Context()).Exec()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		purgeCDNLater(cdnActorKey(c.GetString("viewer")))
+		c.Status(http.StatusNoContent)
+	}
+}
+
+// getActorPinnedMeow returns the meow an actor pinned, if any.
+func getActorPinnedMeow(session *gocql.Session) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		did := c.Query("did")
+		if did == "" || validateDID(did) != did {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid did"})
+			return
+		}
+		rkey, at, err := pinnedRkey(c.Request.Context(), session, did)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if rkey == "" {
+			c.JSON(http.StatusOK, PinnedMeowResponse{})
+			return
+		}
+		resp := PinnedMeowResponse{PinnedAt: &at}
+		m, err := lookupMeow(c, session, did, rkey)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if m != nil {
+			m.Pinned = true
+			if single := moderation.apply([]MeowResponse{*m}); len(single) > 0 {
+				hydrateRequested(c, single)
+				if err := embedQuotes(c, session, single); err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+				resp.Meow = &single[0]
+			}
+		}
+		c.JSON(http.StatusOK, resp)
+	}
+}
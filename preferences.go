@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gocql/gocql"
+)
+
+const (
+	maxHiddenEmotions = 50
+	maxMutedDIDs      = 500
+)
+
+var defaultSorts = []string{"newest", "oldest"}
+
+// didSyntax only checks the shape of a DID, for lists where resolving
+// every entry would be too slow.
+var didSyntax = regexp.MustCompile(`^did:(plc:[a-z2-7]{24}|web:[a-zA-Z0-9.%:-]+)$`)
+
+// Preferences are a viewer's view settings, stored server side so every
+// client they use shows the same thing. Applying them is up to clients.
+type Preferences struct {
+	HiddenEmotions []string  `json:"hidden_emotions"`
+	MutedDIDs      []string  `json:"muted_dids"`
+	DefaultSort    string    `json:"default_sort"`
+	UpdatedAt      time.Time `json:"updated_at,omitempty"`
+	// Version is bumped by every save, see versioned.go
+	Version int `json:"version"`
+}
+
+func createPreferenceTables(session *gocql.Session) error {
+	err := session.Query(`
+		CREATE TABLE IF NOT EXISTS preferences (
+			viewer TEXT PRIMARY KEY,
+			hidden_emotions SET<TEXT>,
+			muted_dids SET<TEXT>,
+			default_sort TEXT,
+			updated_at TIMESTAMP
+		)`).Exec()
+	if err != nil {
+		return err
+	}
+	return addColumn(session, "preferences", "version", "INT")
+}
+
+// normalize validates prefs and lower cases and dedupes the emotions the
+// same way ingest does.
+func (prefs *Preferences) normalize() error {
+	if prefs.DefaultSort == "" {
+		prefs.DefaultSort = defaultSorts[0]
+	}
+	valid := false
+	for _, s := range defaultSorts {
+		valid = valid || prefs.DefaultSort == s
+	}
+	if !valid {
+		return fmt.Errorf("default_sort must be one of %s", strings.Join(defaultSorts, ", "))
+	}
+
+	if len(prefs.HiddenEmotions) > maxHiddenEmotions {
+		return fmt.Errorf("at most %d hidden emotions", maxHiddenEmotions)
+	}
+	seen := map[string]bool{}
+	emotions := []string{}
+	for _, e := range prefs.HiddenEmotions {
+		e = strings.ToLower(strings.TrimSpace(e))
+		if e == "" || len(e) > 50 {
+			return fmt.Errorf("invalid hidden emotion %q", e)
+		}
+		if !seen[e] {
+			seen[e] = true
+			emotions = append(emotions, e)
+		}
+	}
+	prefs.HiddenEmotions = emotions
+
+	if len(prefs.MutedDIDs) > maxMutedDIDs {
+		return fmt.Errorf("at most %d muted dids", maxMutedDIDs)
+	}
+	for _, did := range prefs.MutedDIDs {
+		if !didSyntax.MatchString(did) {
+			return fmt.Errorf("invalid muted did %q", did)
+		}
+	}
+	if prefs.MutedDIDs == nil {
+		prefs.MutedDIDs = []string{}
+	}
+	return nil
+}
+
+func getPreferences(session *gocql.Session) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var prefs Preferences
+		err := session.Query(`
+			SELECT hidden_emotions, muted_dids, default_sort, updated_at, version
+			FROM preferences
+			WHERE viewer = ?`,
+			c.GetString("viewer"),
+		).WithContext(c.Request.Context()).Scan(&prefs.HiddenEmotions, &prefs.MutedDIDs, &prefs.DefaultSort, &prefs.UpdatedAt, &prefs.Version)
+		if err != nil && err != gocql.ErrNotFound {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		// viewers who never saved anything get the defaults
+		if err := prefs.normalize(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, prefs)
+	}
+}
+
+type putPreferencesRequest struct {
+	Preferences
+	// Version, when set, is the version the preferences were edited from;
+	// saving fails with 409 if they have changed since.
+	Version *int `json:"version"`
+}
+
+// putPreferences replaces the viewer's preferences as a whole.
+func putPreferences(session *gocql.Session) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req putPreferencesRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid preferences"})
+			return
+		}
+		prefs := req.Preferences
+		if err := prefs.normalize(); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		prefs.UpdatedAt = time.Now().UTC()
+
+		viewer := c.GetString("viewer")
+		version, err := versionedWrite(req.Version,
+			func() (int, error) {
+				var version int
+				err := session.Query(`SELECT version FROM preferences WHERE viewer = ?`, viewer).
+					WithContext(c.Request.Context()).Scan(&version)
+				if err == gocql.ErrNotFound {
+					return 0, nil
+				}
+				return version, err
+			},
+			func(current int) (bool, error) {
+				cond, args := versionCondition(current)
+				return casExec(session.Query(`
+					UPDATE preferences SET hidden_emotions = ?, muted_dids = ?, default_sort = ?, updated_at = ?, version = ?
+					WHERE viewer = ?`+cond,
+					append([]any{prefs.HiddenEmotions, prefs.MutedDIDs, prefs.DefaultSort, prefs.UpdatedAt, current + 1, viewer}, args...)...,
+				).WithContext(c.Request.Context()))
+			})
+		if err != nil {
+			respondWriteError(c, err, nil)
+			return
+		}
+		prefs.Version = version
+		c.JSON(http.StatusOK, prefs)
+	}
+}
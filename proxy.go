@@ -0,0 +1,178 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var proxyRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "meowview_xrpc_proxy_requests_total",
+	Help: "XRPC queries forwarded to the upstream AppView, by result (hit, miss, error).",
+}, []string{"result"})
+
+// proxyForwardHeaders are the request headers passed on to the upstream.
+// Authorization is deliberately not among them: the upstream is a public
+// AppView and responses are shared between callers through the cache.
+var proxyForwardHeaders = []string{"Accept", "Accept-Language", "Atproto-Accept-Labelers"}
+
+const maxProxyBody = 5 << 20
+
+type proxiedResponse struct {
+	status      int
+	contentType string
+	body        []byte
+	expires     time.Time
+}
+
+// xrpcProxy forwards XRPC queries this AppView doesn't implement, like
+// profiles and posts, to XRPC_PROXY_UPSTREAM so a client can use us as its
+// only base URL. Successful responses are cached for the upstream's
+// max-age, or XRPC_PROXY_CACHE_TTL when it doesn't send one.
+type xrpcProxy struct {
+	upstream *url.URL
+	ttl      time.Duration
+
+	mu         sync.Mutex
+	cache      map[string]proxiedResponse
+	maxEntries int
+}
+
+func newXRPCProxy() *xrpcProxy {
+	raw := envString("XRPC_PROXY_UPSTREAM", "")
+	if raw == "" {
+		return nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return nil
+	}
+	return &xrpcProxy{
+		upstream:   u,
+		ttl:        envDuration("XRPC_PROXY_CACHE_TTL", time.Minute),
+		cache:      map[string]proxiedResponse{},
+		maxEntries: envInt("XRPC_PROXY_CACHE_SIZE", 10000),
+	}
+}
+
+func (p *xrpcProxy) get(key string) (proxiedResponse, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	resp, ok := p.cache[key]
+	if !ok || time.Now().After(resp.expires) {
+		return proxiedResponse{}, false
+	}
+	return resp, true
+}
+
+func (p *xrpcProxy) put(key string, resp proxiedResponse) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.cache) >= p.maxEntries {
+		// drop expired entries first, then anything, to make room
+		now := time.Now()
+		for k, v := range p.cache {
+			if now.After(v.expires) {
+				delete(p.cache, k)
+			}
+		}
+		for k := range p.cache {
+			if len(p.cache) < p.maxEntries {
+				break
+			}
+			delete(p.cache, k)
+		}
+	}
+	p.cache[key] = resp
+}
+
+// maxAge reads max-age from a Cache-Control header. no-store and private
+// responses are not cached at all.
+func maxAge(cacheControl string, fallback time.Duration) time.Duration {
+	for _, directive := range strings.Split(cacheControl, ",") {
+		directive = strings.TrimSpace(strings.ToLower(directive))
+		if directive == "no-store" || directive == "private" || directive == "no-cache" {
+			return 0
+		}
+		if v, ok := strings.CutPrefix(directive, "max-age="); ok {
+			if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+				return time.Duration(secs) * time.Second
+			}
+		}
+	}
+	return fallback
+}
+
+// handle serves unknown routes: XRPC queries are proxied, anything else is
+// a plain 404.
+func (p *xrpcProxy) handle(c *gin.Context) {
+	xrpcPath := path.Clean(c.Request.URL.Path)
+	if c.Request.Method != http.MethodGet || !strings.HasPrefix(xrpcPath, "/xrpc/") {
+		c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+		return
+	}
+
+	// responses vary by the forwarded headers, so they are part of the key
+	key := c.Request.URL.RequestURI()
+	for _, h := range proxyForwardHeaders {
+		key += "\n" + c.GetHeader(h)
+	}
+	if resp, ok := p.get(key); ok {
+		proxyRequests.WithLabelValues("hit").Inc()
+		c.Header("X-Cache", "hit")
+		c.Data(resp.status, resp.contentType, resp.body)
+		return
+	}
+
+	target := *p.upstream
+	target.Path = strings.TrimSuffix(p.upstream.Path, "/") + xrpcPath
+	target.RawQuery = c.Request.URL.RawQuery
+	req, err := http.NewRequestWithContext(c.Request.Context(), http.MethodGet, target.String(), nil)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	for _, h := range proxyForwardHeaders {
+		if v := c.GetHeader(h); v != "" {
+			req.Header.Set(h, v)
+		}
+	}
+
+	upstream, err := outbound.Do(req)
+	if err != nil {
+		proxyRequests.WithLabelValues("error").Inc()
+		c.JSON(http.StatusBadGateway, gin.H{"error": "upstream appview unavailable"})
+		return
+	}
+	defer upstream.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(upstream.Body, maxProxyBody+1))
+	if err != nil || len(body) > maxProxyBody {
+		proxyRequests.WithLabelValues("error").Inc()
+		c.JSON(http.StatusBadGateway, gin.H{"error": "invalid upstream response"})
+		return
+	}
+
+	resp := proxiedResponse{
+		status:      upstream.StatusCode,
+		contentType: upstream.Header.Get("Content-Type"),
+		body:        body,
+	}
+	if upstream.StatusCode == http.StatusOK {
+		if ttl := maxAge(upstream.Header.Get("Cache-Control"), p.ttl); ttl > 0 {
+			resp.expires = time.Now().Add(ttl)
+			p.put(key, resp)
+		}
+	}
+	proxyRequests.WithLabelValues("miss").Inc()
+	c.Header("X-Cache", "miss")
+	c.Data(resp.status, resp.contentType, resp.body)
+}
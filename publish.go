@@ -0,0 +1,226 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"html/template"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+var publishTemplates = template.Must(template.New("layout").Funcs(template.FuncMap{
+	"time":      func(us int64) string { return time.UnixMicro(us).UTC().Format("2006-01-02 15:04:05 UTC") },
+	"actorPage": actorPageName,
+}).Parse(`{{define "layout"}}<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>{{.Title}} - meowview</title>
+<style>body{font-family:sans-serif;max-width:48em;margin:2em auto;padding:0 1em}table{border-collapse:collapse}td,th{padding:.2em .6em;text-align:left}</style>
+</head>
+<body>
+<nav><a href="{{.Root}}index.html">recent</a> | <a href="{{.Root}}stats.html">stats</a> | <a href="{{.Root}}actors.html">actors</a></nav>
+<h1>{{.Title}}</h1>
+{{template "body" .}}
+<footer><p>snapshot generated {{.Generated.Format "2006-01-02 15:04 UTC"}}</p></footer>
+</body>
+</html>{{end}}
+
+{{define "meows"}}<table>
+<tr><th>time</th><th>actor</th><th>emotion</th><th>subject</th></tr>
+{{range .Meows}}<tr><td>{{time .TimeUS}}</td><td><a href="{{$.Root}}{{actorPage .DID}}">{{.DID}}</a></td><td>{{if .Emotion}}{{.Emotion}}{{else if .InferredEmotion}}<i>{{.InferredEmotion}}</i>{{end}}</td><td>{{.Subject}}</td></tr>
+{{end}}</table>{{end}}`))
+
+var (
+	publishIndex = template.Must(template.Must(publishTemplates.Clone()).Parse(
+		`{{define "body"}}{{template "meows" .}}{{end}}`))
+	publishStats = template.Must(template.Must(publishTemplates.Clone()).Parse(`{{define "body"}}
+<p>{{.Total}} meows from {{len .Actors}} actors.</p>
+<h2>Emotions</h2>
+<table>{{range .Emotions}}<tr><td>{{.Key}}</td><td>{{.Count}}</td></tr>{{end}}</table>
+<h2>Most meowed-at subjects</h2>
+<table>{{range .Subjects}}<tr><td>{{.Key}}</td><td>{{.Count}}</td></tr>{{end}}</table>
+{{end}}`))
+	publishActors = template.Must(template.Must(publishTemplates.Clone()).Parse(`{{define "body"}}
+<table>{{range .Actors}}<tr><td><a href="{{actorPage .Key}}">{{.Key}}</a></td><td>{{.Count}}</td></tr>{{end}}</table>
+{{end}}`))
+	publishActor = template.Must(template.Must(publishTemplates.Clone()).Parse(
+		`{{define "body"}}{{template "meows" .}}{{end}}`))
+)
+
+type publishCount struct {
+	Key   string
+	Count int
+}
+
+type publishPage struct {
+	Title     string
+	Root      string
+	Generated time.Time
+	Meows     []Meow
+	Total     int
+	Emotions  []publishCount
+	Subjects  []publishCount
+	Actors    []publishCount
+}
+
+// actorPageName maps a DID to a file name that is safe on every static
+// host; colons are not allowed on some of them.
+func actorPageName(did string) string {
+	return "actors/" + strings.ReplaceAll(did, ":", "_") + ".html"
+}
+
+func sortedCounts(counts map[string]int, limit int) []publishCount {
+	out := make([]publishCount, 0, len(counts))
+	for k, n := range counts {
+		out = append(out, publishCount{k, n})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Count != out[j].Count {
+			return out[i].Count > out[j].Count
+		}
+		return out[i].Key < out[j].Key
+	})
+	if limit > 0 && len(out) > limit {
+		out = out[:limit]
+	}
+	return out
+}
+
+func writePage(path string, tmpl *template.Template, page publishPage) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := tmpl.ExecuteTemplate(f, "layout", page); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// moderatedMeows keeps the meows apply keeps.
+func moderatedMeows(meows []Meow, apply func([]MeowResponse) []MeowResponse) []Meow {
+	var kept []Meow
+	for _, m := range meows {
+		if len(apply([]MeowResponse{m.response()})) > 0 {
+			kept = append(kept, m)
+		}
+	}
+	return kept
+}
+
+// runPublish implements `meowview publish --out=dir`: it reads every meow
+// once and writes a static HTML snapshot with recent meows, stats and one
+// page per actor. Hidden meows and inactive accounts are left out, and
+// deprioritized actors only have their own page.
+func runPublish(args []string) {
+	fs := flag.NewFlagSet("publish", flag.ExitOnError)
+	out := fs.String("out", "", "directory to write the snapshot to")
+	recent := fs.Int("recent", 50, "number of meows on the front page")
+	fs.Parse(args)
+	if *out == "" {
+		fmt.Fprintln(os.Stderr, "usage: meowview publish --out=dir [--recent=50]")
+		os.Exit(2)
+	}
+
+	cassandraHost := getenv("CASSANDRA_HOST")
+	if cassandraHost == "" {
+		cassandraHost = "127.0.0.1"
+	}
+	cluster := gocql.NewCluster(cassandraHost)
+	cluster.Timeout = 10 * time.Second
+	cluster.ProtoVersion = 4
+	configureAuth(cluster)
+	cluster.Keyspace = "cat"
+	session, err := cluster.CreateSession()
+	if err != nil {
+		log.Fatal("cassandra session:", err)
+	}
+	defer session.Close()
+
+	iter := session.Query(`
+		SELECT ` + meowColumns + `
+		FROM cat.meows`).Iter()
+
+	var all []Meow
+	var row meowRow
+	for iter.Scan(row.dest()...) {
+		all = append(all, row.meow())
+		row = meowRow{}
+	}
+	if err := iter.Close(); err != nil {
+		log.Fatal("read meows:", err)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].TimeUS > all[j].TimeUS })
+
+	// moderated like the API: actor pages like getActorMeows, the rest
+	// like the global lists
+	if err := moderation.load(session); err != nil {
+		log.Fatal("load moderation state:", err)
+	}
+	byActor := map[string][]Meow{}
+	for _, m := range moderatedMeows(all, moderation.apply) {
+		byActor[m.DID] = append(byActor[m.DID], m)
+	}
+	all = moderatedMeows(all, moderation.applyGlobal)
+
+	emotions := map[string]int{}
+	subjects := map[string]int{}
+	actors := map[string]int{}
+	for _, m := range all {
+		actors[m.DID]++
+		if emotion, _ := effectiveEmotion(m); emotion != "" {
+			emotions[emotion]++
+		}
+		if m.Subject != "" {
+			subjects[m.Subject]++
+		}
+	}
+
+	now := time.Now().UTC()
+	front := all
+	if len(front) > *recent {
+		front = front[:*recent]
+	}
+
+	pages := []struct {
+		path string
+		tmpl *template.Template
+		page publishPage
+	}{
+		{"index.html", publishIndex, publishPage{Title: "Recent meows", Meows: front}},
+		{"stats.html", publishStats, publishPage{
+			Title:    "Stats",
+			Total:    len(all),
+			Emotions: sortedCounts(emotions, 0),
+			Subjects: sortedCounts(subjects, 20),
+			Actors:   sortedCounts(actors, 0),
+		}},
+		{"actors.html", publishActors, publishPage{Title: "Actors", Actors: sortedCounts(actors, 0)}},
+	}
+	for _, p := range pages {
+		p.page.Generated = now
+		if err := writePage(filepath.Join(*out, p.path), p.tmpl, p.page); err != nil {
+			log.Fatal("write page:", err)
+		}
+	}
+
+	for did, meows := range byActor {
+		page := publishPage{Title: did, Root: "../", Generated: now, Meows: meows}
+		if err := writePage(filepath.Join(*out, actorPageName(did)), publishActor, page); err != nil {
+			log.Fatal("write actor page:", err)
+		}
+	}
+
+	log.Printf("published %d meows from %d actors to %s", len(all), len(byActor), *out)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"log"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gocql/gocql"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	queryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "meowview_cassandra_query_duration_seconds",
+		Help:    "Cassandra query latency, by API endpoint (background for ingest and jobs).",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"endpoint"})
+
+	slowQueries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "meowview_cassandra_slow_queries_total",
+		Help: "Cassandra queries slower than SLOW_QUERY_THRESHOLD, by API endpoint.",
+	}, []string{"endpoint", "filtering"})
+)
+
+type requestInfoKey struct{}
+
+// requestInfo travels in the request context down to the query observer so
+// slow queries can be traced back to the endpoint that issued them.
+type requestInfo struct {
+	Endpoint string
+	TraceID  string
+}
+
+var traceIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// requestTracing assigns each request a trace ID, reusing a well formed
+// X-Request-Id from the caller, and echoes it back in the response.
+func requestTracing() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		traceID := c.GetHeader("X-Request-Id")
+		if !traceIDPattern.MatchString(traceID) {
+			traceID = uuid.New().String()
+		}
+		c.Header("X-Request-Id", traceID)
+		c.Set("traceID", traceID)
+
+		ctx := context.WithValue(c.Request.Context(), requestInfoKey{}, requestInfo{
+			Endpoint: c.FullPath(),
+			TraceID:  traceID,
+		})
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+	}
+}
+
+// slowQueryObserver times every Cassandra query and logs the ones slower
+// than the threshold with their endpoint, bound values and trace ID. Rows
+// returned and ALLOW FILTERING are logged as a rough cost estimate.
+type slowQueryObserver struct {
+	// threshold in nanoseconds, reloaded at runtime
+	threshold atomic.Int64
+}
+
+var slowQueryLog = newSlowQueryObserver()
+
+func newSlowQueryObserver() *slowQueryObserver {
+	o := &slowQueryObserver{}
+	o.threshold.Store(int64(envDuration("SLOW_QUERY_THRESHOLD", 500*time.Millisecond)))
+	return o
+}
+
+var whitespace = regexp.MustCompile(`\s+`)
+
+func (o *slowQueryObserver) ObserveQuery(ctx context.Context, q gocql.ObservedQuery) {
+	info, ok := ctx.Value(requestInfoKey{}).(requestInfo)
+	if !ok || info.Endpoint == "" {
+		info.Endpoint = "background"
+	}
+
+	elapsed := q.End.Sub(q.Start)
+	queryDuration.WithLabelValues(info.Endpoint).Observe(elapsed.Seconds())
+	if elapsed < time.Duration(o.threshold.Load()) {
+		return
+	}
+
+	statement := strings.TrimSpace(whitespace.ReplaceAllString(q.Statement, " "))
+	filtering := strings.Contains(strings.ToUpper(statement), "ALLOW FILTERING")
+	slowQueries.WithLabelValues(info.Endpoint, boolLabel(filtering)).Inc()
+	log.Printf("slow query: %s endpoint=%s trace=%s rows=%d attempt=%d filtering=%t err=%v statement=%q values=%v",
+		elapsed, info.Endpoint, info.TraceID, q.Rows, q.Attempt, filtering, q.Err, statement, q.Values)
+}
+
+func boolLabel(b bool) string {
+	if b {
+		return "true"
+	}
+	return "false"
+}
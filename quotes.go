@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gocql/gocql"
+)
+
+// maxQuoteDepth caps ?depth=, how many levels of quoted meows are embedded.
+const maxQuoteDepth = 3
+
+func meowURI(did, rkey string) string {
+	return "at://" + did + "/" + meowNSID + "/" + rkey
+}
+
+// quotedMeow returns the did and rkey of the meow a subject quotes.
+func quotedMeow(subject string) (string, string, bool) {
+	match := subjectURIRegex.FindStringSubmatch(subject)
+	if match == nil || match[2] != meowNSID || !rkeyRegex.MatchString(match[3]) {
+		return "", "", false
+	}
+	return match[1], match[3], true
+}
+
+// embedQuotes resolves meows whose subject is another meow and embeds the
+// quoted meow as Quoted, down to ?depth= levels (default 1, 0 turns it
+// off). A meow already on the current chain is not embedded again, so
+// quote cycles end. The returned error is the caller's fault.
+func embedQuotes(c *gin.Context, session *gocql.Session, meows []MeowResponse) error {
+	depth := 1
+	if v := c.Query("depth"); v != "" {
+		d, err := strconv.Atoi(v)
+		if err != nil || d < 0 || d > maxQuoteDepth {
+			return fmt.Errorf("depth must be between 0 and %d", maxQuoteDepth)
+		}
+		depth = d
+	}
+
+	// one lookup per quoted meow per request, even if quoted many times
+	found := map[string]*MeowResponse{}
+	var embed func(m *MeowResponse, depth int, chain map[string]bool)
+	embed = func(m *MeowResponse, depth int, chain map[string]bool) {
+		did, rkey, ok := quotedMeow(m.Subject)
+		if !ok || depth == 0 || chain[m.Subject] {
+			return
+		}
+		quoted, seen := found[m.Subject]
+		if !seen {
+			var err error
+			if quoted, err = lookupMeow(c, session, did, rkey); err != nil {
+				log.Println("quoted meow lookup error:", err)
+				return
+			}
+			found[m.Subject] = quoted
+		}
+		if quoted == nil {
+			return
+		}
+
+		// a copy, so the same meow can sit at different depths
+		q := *quoted
+		chain[m.Subject] = true
+		embed(&q, depth-1, chain)
+		delete(chain, m.Subject)
+		m.Quoted = &q
+	}
+
+	for i := range meows {
+		chain := map[string]bool{meowURI(meows[i].DID, meows[i].Rkey): true}
+		embed(&meows[i], depth, chain)
+	}
+	return nil
+}
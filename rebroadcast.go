@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// rebroadcastMaxPerIP is how many /subscribe connections one client IP may
+// hold; STREAM_MAX_SUBSCRIBERS caps them all together with subscribeMeows.
+var rebroadcastMaxPerIP = envInt("REBROADCAST_MAX_PER_IP", 4)
+
+// rebroadcastMaxDIDs matches jetstream's own wantedDids limit.
+const rebroadcastMaxDIDs = 10000
+
+var rebroadcastRejected = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "meowview_rebroadcast_rejected_total",
+	Help: "Rebroadcast connections refused because their IP held REBROADCAST_MAX_PER_IP.",
+})
+
+// jetstreamEvent is a commit as jetstream sends it.
+type jetstreamEvent struct {
+	DID    string          `json:"did"`
+	TimeUS int64           `json:"time_us"`
+	Kind   string          `json:"kind"`
+	Commit jetstreamCommit `json:"commit"`
+}
+
+type jetstreamCommit struct {
+	Rev        string          `json:"rev"`
+	Operation  string          `json:"operation"`
+	Collection string          `json:"collection"`
+	Rkey       string          `json:"rkey"`
+	Record     json.RawMessage `json:"record,omitempty"`
+	CID        string          `json:"cid,omitempty"`
+}
+
+func jetstreamEventOf(ch MeowChange) jetstreamEvent {
+	ev := jetstreamEvent{
+		DID:    ch.DID,
+		TimeUS: ch.TimeUS,
+		Kind:   "commit",
+		Commit: jetstreamCommit{
+			Rev:        ch.rev,
+			Operation:  ch.Op,
+			Collection: meowNSID,
+			Rkey:       ch.Rkey,
+		},
+	}
+	if ch.Op != "delete" {
+		ev.Commit.Record = json.RawMessage(ch.record)
+		ev.Commit.CID = ch.CID
+	}
+	return ev
+}
+
+// wantsMeows reports whether jetstream's wantedCollections, which may end
+// in a ".*" wildcard, include the meow collection. None means all.
+func wantsMeows(collections []string) bool {
+	if len(collections) == 0 {
+		return true
+	}
+	for _, c := range collections {
+		if c == meowNSID || (strings.HasSuffix(c, ".*") && strings.HasPrefix(meowNSID, strings.TrimSuffix(c, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+// ipConns counts the open rebroadcast connections per client IP.
+type ipConns struct {
+	mu sync.Mutex
+	n  map[string]int
+}
+
+var rebroadcastConns = &ipConns{n: map[string]int{}}
+
+func (l *ipConns) acquire(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if rebroadcastMaxPerIP > 0 && l.n[ip] >= rebroadcastMaxPerIP {
+		return false
+	}
+	l.n[ip]++
+	return true
+}
+
+func (l *ipConns) release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.n[ip]--; l.n[ip] <= 0 {
+		delete(l.n, ip)
+	}
+}
+
+var rebroadcastUpgrader = websocket.Upgrader{
+	// the stream is public and read-only
+	CheckOrigin: func(*http.Request) bool { return true },
+}
+
+// subscribeRebroadcast serves the meow collection as a jetstream-compatible
+// websocket at /subscribe, so downstream projects can point a jetstream
+// client at us instead of reading the whole network. It takes jetstream's
+// wantedCollections, wantedDids and time_us cursor; a cursor replays what
+// is left of the hub's replay buffer after it. Compression and
+// requireHello are not supported. Hidden meows are left out, and a client
+// that falls behind is disconnected as on subscribeMeows.
+//
+// encoding=compact, not a jetstream parameter, sends commits as arrays,
+// see streamencoding.go.
+func subscribeRebroadcast(c *gin.Context) {
+	if !wantsMeows(c.QueryArray("wantedCollections")) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "only " + meowNSID + " is rebroadcast"})
+		return
+	}
+	if c.Query("compress") == "true" || c.Query("requireHello") == "true" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "compress and requireHello are not supported"})
+		return
+	}
+	encoding, err := parseStreamEncoding(c.Query("encoding"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	dids := c.QueryArray("wantedDids")
+	if len(dids) > rebroadcastMaxDIDs {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "too many wantedDids"})
+		return
+	}
+	wanted := map[string]bool{}
+	for _, did := range dids {
+		if validateDID(did) != did {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid did " + did})
+			return
+		}
+		wanted[did] = true
+	}
+	var from *pageCursor
+	if v := c.Query("cursor"); v != "" {
+		timeUS, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || timeUS < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid cursor"})
+			return
+		}
+		// jetstream resumes with the events at the cursor itself
+		from = &pageCursor{TimeUS: timeUS}
+	}
+
+	ip := c.ClientIP()
+	if !rebroadcastConns.acquire(ip) {
+		rebroadcastRejected.Inc()
+		c.Header("Retry-After", "30")
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "too many connections from this address"})
+		return
+	}
+	defer rebroadcastConns.release(ip)
+
+	var filter func(MeowChange) bool
+	// without wantedDids the stream is global, like the all-meows lists
+	moderate := moderation.applyGlobal
+	if len(wanted) > 0 {
+		filter = func(ch MeowChange) bool { return wanted[ch.DID] }
+		moderate = moderation.apply
+	}
+	s, missed, _, err := hub.subscribe(filter, from)
+	if err != nil {
+		c.Header("Retry-After", "30")
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	defer hub.unsubscribe(s)
+
+	conn, err := rebroadcastUpgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		// Upgrade has already answered
+		return
+	}
+	defer conn.Close()
+
+	// options_update and other client messages are read and ignored; the
+	// read fails once the client goes away
+	gone := make(chan struct{})
+	go func() {
+		defer close(gone)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	send := func(b bufferedChange) error {
+		if b.change.Op != "delete" && len(moderate([]MeowResponse{b.change.MeowResponse})) == 0 {
+			return nil
+		}
+		conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		if encoding == streamEncodingCompact {
+			return conn.WriteJSON(compactCommit(jetstreamEventOf(b.change)))
+		}
+		return conn.WriteJSON(jetstreamEventOf(b.change))
+	}
+	if encoding == streamEncodingCompact {
+		conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		if conn.WriteJSON(gin.H{"kind": "fields", "commit": commitFields}) != nil {
+			return
+		}
+	}
+	for _, b := range missed {
+		if send(b) != nil {
+			return
+		}
+	}
+
+	ping := time.NewTicker(30 * time.Second)
+	defer ping.Stop()
+	for {
+		select {
+		case b, ok := <-s.changes:
+			if !ok {
+				reason := "shutting down"
+				select {
+				case <-s.evicted:
+					reason = "consumer too slow"
+				default:
+				}
+				conn.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseTryAgainLater, reason),
+					time.Now().Add(time.Second))
+				return
+			}
+			if send(b) != nil {
+				return
+			}
+		case <-ping.C:
+			if conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(10*time.Second)) != nil {
+				return
+			}
+		case <-gone:
+			return
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gocql/gocql"
+)
+
+// Multi-region deployments run one meowview per region, each ingesting the
+// whole firehose from its nearest jetstream into the same keyspace,
+// replicated to every region's datacenter. Nothing is coordinated between
+// regions; instead every write is idempotent:
+//
+//   - rows are keyed on did+rkey, so both regions write the same rows
+//   - meows writes carry the record's rev as their write timestamp, so the
+//     latest revision of a record wins no matter which region's write
+//     lands last, and a late create can't resurrect a deleted meow
+//   - derived rows are clustered on the rev's timestamp rather than the
+//     time_us of whichever jetstream delivered the event, see derivedTimeUS,
+//     so both regions write the same derived rows too, and a delete drops
+//     them by did+rkey
+//
+// Counter tables (meow_counts, the emotion histograms and vocabularies)
+// can't be written twice safely, so the first region to claim a meow's
+// version in counted_meows counts it and the others skip it, see
+// claimCount.
+//
+// Each region checkpoints its jetstream cursor under its own name in
+// ingest_state, which is replicated too, so a restarted region resumes
+// where it stopped and getRegions shows how far behind each region is.
+//
+// Configuration, per region:
+//
+//	REGION=eu-west
+//	JETSTREAM_URL=wss://jetstream1.us-west.bsky.network/subscribe?wantedCollections=moe.kasey.meow
+//	CASSANDRA_LOCAL_DC=eu-west-1
+//	CASSANDRA_DATACENTERS=us-east-1:3,eu-west-1:3
+
+var region = envString("REGION", "")
+
+// keyspaceReplication is the replication clause for the cat keyspace:
+// NetworkTopologyStrategy over CASSANDRA_DATACENTERS ("dc:rf,dc:rf") when
+// set, a single replica otherwise.
+func keyspaceReplication() string {
+	dcs := envList("CASSANDRA_DATACENTERS")
+	if len(dcs) == 0 {
+		return `{'class': 'SimpleStrategy', 'replication_factor': 1}`
+	}
+	parts := []string{`'class': 'NetworkTopologyStrategy'`}
+	for _, dc := range dcs {
+		name, rf, ok := strings.Cut(dc, ":")
+		n, err := strconv.Atoi(rf)
+		if !ok || name == "" || err != nil || n < 1 {
+			log.Fatalf("CASSANDRA_DATACENTERS: invalid entry %q, want dc:replication_factor", dc)
+		}
+		parts = append(parts, fmt.Sprintf("'%s': %d", strings.ReplaceAll(name, "'", ""), n))
+	}
+	return "{" + strings.Join(parts, ", ") + "}"
+}
+
+// alterKeyspaceReplication brings an existing keyspace to the configured
+// datacenters. CREATE KEYSPACE IF NOT EXISTS leaves it untouched otherwise.
+// After adding a datacenter, run nodetool rebuild on its nodes.
+func alterKeyspaceReplication(session *gocql.Session) error {
+	if len(envList("CASSANDRA_DATACENTERS")) == 0 {
+		return nil
+	}
+	return session.Query(`ALTER KEYSPACE cat WITH replication = ` + keyspaceReplication()).Exec()
+}
+
+// configureRegion keeps queries in the local datacenter when
+// CASSANDRA_LOCAL_DC is set, reading and writing at LOCAL_QUORUM.
+func configureRegion(cluster *gocql.ClusterConfig) {
+	dc := envString("CASSANDRA_LOCAL_DC", "")
+	if dc == "" {
+		return
+	}
+	cluster.PoolConfig.HostSelectionPolicy = gocql.TokenAwareHostPolicy(gocql.DCAwareRoundRobinPolicy(dc))
+	cluster.Consistency = gocql.LocalQuorum
+}
+
+const tidAlphabet = "234567abcdefghijklmnopqrstuvwxyz"
+
+// revTimestamp decodes the microseconds in a repo rev, a TID: 13 base32
+// characters holding 53 bits of microseconds and 10 bits of clock id.
+func revTimestamp(rev string) (int64, bool) {
+	if len(rev) != 13 {
+		return 0, false
+	}
+	var v uint64
+	for i := 0; i < len(rev); i++ {
+		d := strings.IndexByte(tidAlphabet, rev[i])
+		if d < 0 {
+			return 0, false
+		}
+		v = v<<5 | uint64(d)
+	}
+	if v>>63 != 0 {
+		return 0, false
+	}
+	return int64(v >> 10), true
+}
+
+func cursorName() string {
+	if region == "" {
+		return "jetstream"
+	}
+	return "jetstream:" + region
+}
+
+// startCursor is where ingestion resumes after a restart: the last
+// journaled event, see spool.go, or else the checkpointed cursor. Without
+// either it starts live.
+func startCursor(session *gocql.Session) int64 {
+	if cursor := spool.resumeCursor(); cursor > 0 {
+		return cursor
+	}
+	cursor, err := loadCursor(session)
+	if err != nil {
+		log.Println("load cursor:", err)
+		return 0
+	}
+	return cursor
+}
+
+// runCursorCheckpoint saves the cursor every CURSOR_CHECKPOINT_INTERVAL, so
+// that even a crash loses no more than that to replay.
+func runCursorCheckpoint(session *gocql.Session) {
+	ticker := time.NewTicker(envDuration("CURSOR_CHECKPOINT_INTERVAL", 10*time.Second))
+	defer ticker.Stop()
+	for range ticker.C {
+		if ingest.paused() {
+			continue
+		}
+		if cursor := ingest.state().Cursor; cursor > 0 {
+			if err := saveCursor(session, cursor); err != nil {
+				log.Println("checkpoint cursor error:", err)
+			}
+		}
+	}
+}
+
+type RegionState struct {
+	Region string `json:"region"`
+	Cursor int64  `json:"cursor"`
+	// CursorAt is Cursor as an RFC 3339 UTC timestamp
+	CursorAt  string    `json:"cursorAt"`
+	LagMS     int64     `json:"lag_ms"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// getRegions lists the checkpointed cursor of every region.
+func getRegions(session *gocql.Session) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		iter := session.Query(`SELECT name, cursor, updated_at FROM ingest_state`).
+			WithContext(c.Request.Context()).Iter()
+		regions := []RegionState{}
+		var name string
+		var st RegionState
+		for iter.Scan(&name, &st.Cursor, &st.UpdatedAt) {
+			if r, ok := strings.CutPrefix(name, "jetstream:"); ok {
+				st.Region = r
+				st.CursorAt = indexedAt(st.Cursor)
+				st.LagMS = time.Since(time.UnixMicro(st.Cursor)).Milliseconds()
+				regions = append(regions, st)
+			}
+			st = RegionState{}
+		}
+		if err := iter.Close(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		sort.Slice(regions, func(i, j int) bool { return regions[i].Region < regions[j].Region })
+		c.JSON(http.StatusOK, gin.H{"region": region, "regions": regions})
+	}
+}
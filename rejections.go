@@ -0,0 +1,157 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gocql/gocql"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// A meow record that never shows up is hard to debug from the author's
+// side: ingest drops it with a log line they can't see. Every record
+// ingest turns away is kept in rejected_meows for REJECTED_MEOW_TTL (7d),
+// with why, and authors can list theirs with getMyRejectedMeows. Reasons:
+//   - invalid: the record isn't a JSON object
+//   - schema: the record breaks its lexicon, see lexiconvalidate.go
+//   - invalid_rkey: the record key isn't a tid
+//   - policy: the emotion was refused by the ingest filter
+//
+// Nothing is rate limited at ingest, so there is no reason for it yet.
+
+const (
+	rejectInvalid     = "invalid"
+	rejectSchema      = "schema"
+	rejectInvalidRkey = "invalid_rkey"
+	rejectPolicy      = "policy"
+
+	// maxRejectionDetail bounds the detail kept, which quotes parse errors
+	maxRejectionDetail = 300
+)
+
+var (
+	rejectedMeowTTL = envDuration("REJECTED_MEOW_TTL", 7*24*time.Hour)
+
+	rejectionsGuardrail = newGuardrail("rejections", 50, 100, 0, 0)
+
+	rejectedMeows = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "meowview_rejected_meows_total",
+		Help: "Meow records turned away at ingest, by source and reason.",
+	}, []string{"source", "reason"})
+)
+
+func createRejectionTables(session *gocql.Session) error {
+	return session.Query(`
+		CREATE TABLE IF NOT EXISTS rejected_meows (
+			did TEXT,
+			time_us BIGINT,
+			rkey TEXT,
+			cid TEXT,
+			source TEXT,
+			reason TEXT,
+			detail TEXT,
+			PRIMARY KEY ((did), time_us, rkey)
+		) WITH CLUSTERING ORDER BY (time_us DESC, rkey ASC)`).Exec()
+}
+
+type RejectedMeow struct {
+	Rkey   string `json:"rkey"`
+	CID    string `json:"cid,omitempty"`
+	TimeUS int64  `json:"time_us"`
+	// Source is where the record came from: jetstream, pds or backfill
+	Source string `json:"source"`
+	Reason string `json:"reason"`
+	Detail string `json:"detail,omitempty"`
+}
+
+type RejectedMeowsResponse struct {
+	Rejected []RejectedMeow `json:"rejected"`
+	Cursor   string         `json:"cursor,omitempty"`
+}
+
+// recordRejection keeps a record ingest turned away, for its author.
+func recordRejection(session *gocql.Session, did string, r RejectedMeow) {
+	rejectedMeows.WithLabelValues(r.Source, r.Reason).Inc()
+	if len(r.Detail) > maxRejectionDetail {
+		r.Detail = r.Detail[:maxRejectionDetail]
+	}
+	log.Printf("record rejected: did=%q rkey=%q source=%s reason=%s detail=%q", did, r.Rkey, r.Source, r.Reason, r.Detail)
+	if validateDID(did) != did {
+		return
+	}
+	if r.TimeUS == 0 {
+		r.TimeUS = time.Now().UnixMicro()
+	}
+	err := session.Query(`
+		INSERT INTO rejected_meows (did, time_us, rkey, cid, source, reason, detail)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		USING TTL ?`,
+		did, r.TimeUS, r.Rkey, nullString(r.CID), r.Source, r.Reason, nullString(r.Detail), int(rejectedMeowTTL.Seconds()),
+	).Exec()
+	if err != nil {
+		log.Println("insert rejected_meows error:", err)
+	}
+}
+
+// getMyRejectedMeows lists the viewer's records turned away at ingest,
+// newest first. The cursor is the time_us to continue before.
+func getMyRejectedMeows(session *gocql.Session) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		limit, err := rejectionsGuardrail.parseLimit(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		before := int64(-1)
+		if v := c.Query("cursor"); v != "" {
+			if before, err = strconv.ParseInt(v, 10, 64); err != nil || before < 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid cursor"})
+				return
+			}
+		}
+
+		query := `SELECT rkey, cid, time_us, source, reason, detail FROM rejected_meows WHERE did = ?`
+		args := []any{c.GetString("viewer")}
+		if before >= 0 {
+			query += ` AND time_us < ?`
+			args = append(args, before)
+		}
+		iter := session.Query(query+` LIMIT ?`, append(args, limit+1)...).
+			WithContext(c.Request.Context()).Iter()
+
+		rejected := []RejectedMeow{}
+		var r RejectedMeow
+		var cid, detail *string
+		for iter.Scan(&r.Rkey, &cid, &r.TimeUS, &r.Source, &r.Reason, &detail) {
+			r.CID, r.Detail = derefString(cid), derefString(detail)
+			rejected = append(rejected, r)
+			r, cid, detail = RejectedMeow{}, nil, nil
+		}
+		if err := iter.Close(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		var cursor string
+		if len(rejected) > limit {
+			rejected = rejected[:limit]
+			cursor = strconv.FormatInt(rejected[limit-1].TimeUS, 10)
+		}
+		c.JSON(http.StatusOK, RejectedMeowsResponse{Rejected: rejected, Cursor: cursor})
+	}
+}
+
+// rejectMessage records a jetstream commit turned away.
+func rejectMessage(session *gocql.Session, msg WebSocketMessage, reason, detail string) {
+	recordRejection(session, msg.DID, RejectedMeow{
+		Rkey:   msg.Commit.Rkey,
+		CID:    msg.Commit.CID,
+		TimeUS: msg.TimeUS,
+		Source: "jetstream",
+		Reason: reason,
+		Detail: detail,
+	})
+}
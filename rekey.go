@@ -0,0 +1,68 @@
+package main
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gocql/gocql"
+)
+
+// RekeyResult counts what a rekeyMeows run did.
+type RekeyResult struct {
+	Scanned int `json:"scanned"`
+	// Rekeyed rows had a random id and were moved to meowID. Several rows
+	// of the same record, from re-delivered events, collapse into one.
+	Rekeyed int `json:"rekeyed"`
+}
+
+// rekeyMeows moves meows rows written with a random id, before meowID
+// existed, to their deterministic id. Each row is written with its
+// original write time, so the newest of a record's duplicates wins, and
+// it is safe to run again or while ingesting.
+func rekeyMeows(session *gocql.Session) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		iter := session.Query(`
+			SELECT id, ` + meowColumns + `, WRITETIME(cid)
+			FROM meows`,
+		).WithContext(c.Request.Context()).Iter()
+
+		var res RekeyResult
+		var id gocql.UUID
+		var row meowRow
+		var written int64
+		dest := append([]any{&id}, append(row.dest(), &written)...)
+		for iter.Scan(dest...) {
+			res.Scanned++
+			canonical := meowID(row.DID, row.Rkey)
+			if id == canonical {
+				continue
+			}
+
+			batch := session.NewBatch(gocql.LoggedBatch).WithContext(c.Request.Context())
+			batch.Query(`
+				INSERT INTO meows (id, rkey, time_us, cid, did, emotion, subject, inferred_emotion)
+				VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+				USING TIMESTAMP ?`,
+				canonical, row.Rkey, row.TimeUS, row.CID, row.DID,
+				nullString(row.Emotion), nullString(row.Subject), nullString(row.InferredEmotion),
+				written,
+			)
+			batch.Query(`DELETE FROM meows WHERE id = ?`, id)
+			if err := session.ExecuteBatch(batch); err != nil {
+				iter.Close()
+				log.Printf("rekey %s: %v", id, err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "rekey failed", "result": res})
+				return
+			}
+			res.Rekeyed++
+		}
+		if err := iter.Close(); err != nil {
+			log.Println("rekey scan error:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "rekey failed", "result": res})
+			return
+		}
+		log.Printf("rekeyed %d of %d meows", res.Rekeyed, res.Scanned)
+		c.JSON(http.StatusOK, res)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gocql/gocql"
+)
+
+// relatedCandidates is how many rows are read from each derived partition
+// when looking for related meows.
+const relatedCandidates = 100
+
+type relatedMeow struct {
+	MeowResponse
+	Score int `json:"score"`
+}
+
+// getRelatedMeows returns recent meows sharing the subject or emotion of
+// the given meow. Sharing the subject counts more than sharing the emotion,
+// and meows by the same actor or by actors who also meowed at the subject
+// get a bonus; ties are broken by recency.
+func getRelatedMeows(session *gocql.Session) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		rkey := c.Query("rkey")
+		did := c.Query("did")
+		validatedDid := validateDID(did)
+		if validatedDid != did {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid did"})
+			return
+		}
+		if !rkeyRegex.MatchString(rkey) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid rkey"})
+			return
+		}
+		limit, err := relatedGuardrail.parseLimit(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		var row meowRow
+		err = session.Query(`
+			SELECT `+meowColumns+`
+			FROM cat.meows
+			WHERE id = ?`,
+			meowID(validatedDid, rkey),
+		).WithContext(c.Request.Context()).Scan(row.dest()...)
+		if err != nil {
+			if err == gocql.ErrNotFound {
+				c.JSON(http.StatusNotFound, gin.H{"error": "meow not found"})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		source := row.meow()
+
+		candidates := map[string]*relatedMeow{}
+		subjectActors := map[string]bool{}
+		key := func(m Meow) string { return m.DID + "/" + m.Rkey }
+		isSource := func(m Meow) bool { return m.DID == source.DID && m.Rkey == source.Rkey }
+
+		if source.Subject != "" {
+			iter := session.Query(`
+				SELECT rkey, time_us, cid, did, emotion, inferred_emotion
+				FROM cat.meows_by_subject
+				WHERE subject = ?
+				LIMIT ?`,
+				source.Subject, relatedCandidates,
+			).WithContext(c.Request.Context()).Iter()
+
+			var row meowRow
+			for iter.Scan(&row.Rkey, &row.TimeUS, &row.CID, &row.DID, &row.Emotion, &row.InferredEmotion) {
+				row.Subject = source.Subject
+				m := row.meow()
+				subjectActors[m.DID] = true
+				if !isSource(m) {
+					candidates[key(m)] = &relatedMeow{MeowResponse: m.response(), Score: 2}
+				}
+				row = meowRow{}
+			}
+			if err := iter.Close(); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+		}
+
+		if emotion, _ := effectiveEmotion(source); emotion != "" {
+			iter := session.Query(`
+				SELECT rkey, time_us, cid, did, subject, inferred
+				FROM cat.meows_by_emotion
+				WHERE emotion = ?
+				LIMIT ?`,
+				emotion, relatedCandidates,
+			).WithContext(c.Request.Context()).Iter()
+
+			var row meowRow
+			var inferred bool
+			for iter.Scan(&row.Rkey, &row.TimeUS, &row.CID, &row.DID, &row.Subject, &inferred) {
+				if inferred {
+					row.InferredEmotion = emotion
+				} else {
+					row.Emotion = emotion
+				}
+				m := row.meow()
+				if !isSource(m) {
+					if existing, ok := candidates[key(m)]; ok {
+						existing.Score++
+					} else {
+						candidates[key(m)] = &relatedMeow{MeowResponse: m.response(), Score: 1}
+					}
+				}
+				row = meowRow{}
+			}
+			if err := iter.Close(); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+		}
+
+		related := make([]relatedMeow, 0, len(candidates))
+		for _, r := range candidates {
+			if moderation.get(r.DID, r.Rkey).hidden || moderation.deprioritized(r.DID) {
+				continue
+			}
+			if r.DID == source.DID || subjectActors[r.DID] {
+				r.Score++
+			}
+			related = append(related, *r)
+		}
+		sort.Slice(related, func(i, j int) bool {
+			if related[i].Score != related[j].Score {
+				return related[i].Score > related[j].Score
+			}
+			return related[i].TimeUS > related[j].TimeUS
+		})
+		if len(related) > limit {
+			related = related[:limit]
+		}
+
+		c.JSON(http.StatusOK, related)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/baphotex/meowview/repostream"
+	"github.com/gocql/gocql"
+)
+
+// With INGEST_SOURCE=relay meows are read from a relay's
+// com.atproto.sync.subscribeRepos stream at RELAY_URL instead of from
+// jetstream, so meowview doesn't depend on a jetstream instance and runs
+// against any relay. The relay sends every commit of the network, so this
+// takes far more bandwidth than jetstream's filtered JSON.
+//
+// It is a PDS subscription, see pdsstream.go, that accepts every repo but
+// checks each meow commit's signature against the #atproto key of the
+// repo's DID document instead. The signature only covers the commit's
+// tree, not the op list sent along, so every meow op also has to be proven
+// in that tree: a relay can't slip a made-up record into a real commit. The relay's seq is kept in ingest_state as
+// "relay:<host>". #account and #identity messages are applied like
+// jetstream's. Pausing and drop-only mode work as with jetstream;
+// JETSTREAM_WANTED_* filters don't apply.
+const (
+	ingestFromJetstream = "jetstream"
+	ingestFromRelay     = "relay"
+)
+
+var ingestSource = ingestSourceFromEnv()
+
+var relayURL = envString("RELAY_URL", "wss://bsky.network")
+
+var errIngestPaused = errors.New("ingestion paused by admin")
+
+func ingestSourceFromEnv() string {
+	source := envString("INGEST_SOURCE", ingestFromJetstream)
+	if source != ingestFromJetstream && source != ingestFromRelay {
+		log.Fatalf("INGEST_SOURCE must be %s or %s, not %q", ingestFromJetstream, ingestFromRelay, source)
+	}
+	return source
+}
+
+// runRelay ingests from the relay, and never returns.
+func runRelay(session *gocql.Session, classifier EmotionClassifier) {
+	u, err := pdsStreamURL(relayURL)
+	if err != nil {
+		log.Fatalf("RELAY_URL: %v", err)
+	}
+	enableFeature("relayIngestion")
+	s := &pdsSubscription{host: u.Host, url: u, classifier: classifier, relay: true}
+	s.run(session)
+}
+
+// signed reports whether the commit is signed by its repo's key.
+func (s *pdsSubscription) signed(c *repostream.Commit) bool {
+	unsigned, sig, err := c.Signature()
+	if err != nil {
+		log.Printf("relay %s: commit %s of %s: %v", s.host, c.Rev, c.Repo, err)
+		return false
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	key, err := resolveSigningKey(ctx, c.Repo, false)
+	if err != nil {
+		log.Printf("resolve %s: %v", c.Repo, err)
+		return false
+	}
+	if key(unsigned, sig) {
+		return true
+	}
+	// the account may have rotated its key since we cached it
+	key, err = resolveSigningKey(ctx, c.Repo, true)
+	return err == nil && key(unsigned, sig)
+}
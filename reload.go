@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Restarting drops the jetstream connection and every client's stream, so
+// the settings that get tuned in production can be changed at runtime
+// instead: edit CONFIG_FILE and it is reloaded within
+// CONFIG_WATCH_INTERVAL, on SIGHUP, or by POST /_admin/reloadConfig.
+//
+// A reload is all or nothing. Every reloader parses its new settings
+// first, and only when all of them succeed are they switched over. Any
+// other variable that changed is reported as needing a restart.
+
+// reloader parses its settings and returns the function switching to
+// them.
+type reloader struct {
+	name    string
+	prepare func() (func(), error)
+}
+
+var reloaders = []reloader{
+	{"guardrails", reloadGuardrails},
+	{"api key tiers", reloadAPIKeyTiers},
+	{"logging", reloadLogging},
+	{"jetstream filters", reloadJetstreamFilters},
+	{"shadow ingestion", reloadShadow},
+	{"feature flags", reloadFeatureFlags},
+	{"firewall", reloadWAF},
+}
+
+// reloadableVars are the variables, or prefixes of them, the reloaders
+// read.
+var reloadableVars = []string{
+	"GUARDRAIL_",
+	"API_KEY_TIER_",
+	"LOG_LEVEL",
+	"SLOW_QUERY_THRESHOLD",
+	"JETSTREAM_WANTED_",
+	"SHADOW_SAMPLE_RATE",
+	"FEATURE_FLAGS",
+	"WAF_",
+}
+
+func reloadable(key string) bool {
+	for _, v := range reloadableVars {
+		if strings.HasPrefix(key, v) {
+			return true
+		}
+	}
+	return false
+}
+
+type ConfigReload struct {
+	At              time.Time `json:"at"`
+	Changed         []string  `json:"changed"`
+	RestartRequired []string  `json:"restart_required,omitempty"`
+	Error           string    `json:"error,omitempty"`
+}
+
+var configReloads struct {
+	sync.Mutex
+	modTime time.Time
+	last    *ConfigReload
+}
+
+// applyConfig runs every reloader, also once at startup so that the
+// reloadable settings start out the same way they are reloaded.
+func applyConfig() error {
+	applies := make([]func(), 0, len(reloaders))
+	for _, r := range reloaders {
+		apply, err := r.prepare()
+		if err != nil {
+			return fmt.Errorf("%s: %w", r.name, err)
+		}
+		applies = append(applies, apply)
+	}
+	for _, apply := range applies {
+		apply()
+	}
+	return nil
+}
+
+// reloadConfig rereads CONFIG_FILE and applies it, keeping the previous
+// configuration when anything in the file is invalid.
+func reloadConfig() ConfigReload {
+	configReloads.Lock()
+	defer configReloads.Unlock()
+	res := ConfigReload{At: time.Now().UTC(), Changed: []string{}}
+	defer func() { configReloads.last = &res }()
+
+	path := os.Getenv("CONFIG_FILE")
+	if path == "" {
+		res.Error = "CONFIG_FILE is not set"
+		return res
+	}
+	if fi, err := os.Stat(path); err == nil {
+		configReloads.modTime = fi.ModTime()
+	}
+	vars, err := readConfigFile(path)
+	if err != nil {
+		res.Error = err.Error()
+		log.Println("reload config:", err)
+		return res
+	}
+
+	configFile.Lock()
+	previous := configFile.vars
+	configFile.vars = vars
+	configFile.Unlock()
+	if err := applyConfig(); err != nil {
+		configFile.Lock()
+		configFile.vars = previous
+		configFile.Unlock()
+		res.Error = err.Error()
+		log.Println("reload config:", err)
+		return res
+	}
+
+	for k, v := range vars {
+		if old, ok := previous[k]; !ok || old != v {
+			res.Changed = append(res.Changed, k)
+		}
+	}
+	for k := range previous {
+		if _, ok := vars[k]; !ok {
+			res.Changed = append(res.Changed, k)
+		}
+	}
+	sort.Strings(res.Changed)
+	for _, k := range res.Changed {
+		if !reloadable(k) {
+			res.RestartRequired = append(res.RestartRequired, k)
+		}
+	}
+	log.Printf("reloaded config: %d changed, %d need a restart", len(res.Changed), len(res.RestartRequired))
+	return res
+}
+
+// runConfigWatcher reloads CONFIG_FILE on SIGHUP and whenever its
+// modification time changes, checked every CONFIG_WATCH_INTERVAL.
+func runConfigWatcher() {
+	path := os.Getenv("CONFIG_FILE")
+	if path == "" {
+		return
+	}
+	if fi, err := os.Stat(path); err == nil {
+		configReloads.Lock()
+		configReloads.modTime = fi.ModTime()
+		configReloads.Unlock()
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	ticker := time.NewTicker(envDuration("CONFIG_WATCH_INTERVAL", 5*time.Second))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-hup:
+			reloadConfig()
+		case <-ticker.C:
+			fi, err := os.Stat(path)
+			if err != nil {
+				log.Println("watch config file:", err)
+				continue
+			}
+			configReloads.Lock()
+			changed := !fi.ModTime().Equal(configReloads.modTime)
+			configReloads.Unlock()
+			if changed {
+				reloadConfig()
+			}
+		}
+	}
+}
+
+// reloadConfigHandler reloads CONFIG_FILE right away.
+func reloadConfigHandler(c *gin.Context) {
+	res := reloadConfig()
+	if res.Error != "" {
+		c.JSON(http.StatusBadRequest, res)
+		return
+	}
+	c.JSON(http.StatusOK, res)
+}
+
+// getConfigReload shows the outcome of the last reload.
+func getConfigReload(c *gin.Context) {
+	configReloads.Lock()
+	defer configReloads.Unlock()
+	if configReloads.last == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "the config has not been reloaded"})
+		return
+	}
+	c.JSON(http.StatusOK, configReloads.last)
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gocql/gocql"
+	"github.com/google/uuid"
+)
+
+// reportReasons are the reason codes a report can give, after the ones in
+// com.atproto.moderation.defs.
+var reportReasons = map[string]bool{
+	"spam":       true,
+	"violation":  true,
+	"misleading": true,
+	"sexual":     true,
+	"rude":       true,
+	"other":      true,
+}
+
+const (
+	reportOpen     = "open"
+	reportTriaged  = "triaged"
+	reportResolved = "resolved"
+)
+
+// reportTransitions lists the states a report can move to from each state.
+// Resolved reports can be reopened.
+var reportTransitions = map[string][]string{
+	reportOpen:     {reportTriaged, reportResolved},
+	reportTriaged:  {reportOpen, reportResolved},
+	reportResolved: {reportOpen},
+}
+
+const maxReportComment = 2000
+
+var reportsGuardrail = newGuardrail("reports", 50, 100, 0, 0)
+
+func createReportTables(session *gocql.Session) error {
+	err := session.Query(`
+		CREATE TABLE IF NOT EXISTS reports (
+			id UUID PRIMARY KEY,
+			did TEXT,
+			rkey TEXT,
+			reporter TEXT,
+			reason TEXT,
+			comment TEXT,
+			state TEXT,
+			note TEXT,
+			created_at TIMESTAMP,
+			updated_at TIMESTAMP
+		)`).Exec()
+	if err != nil {
+		return err
+	}
+
+	err = session.Query(`
+		CREATE TABLE IF NOT EXISTS reports_by_state (
+			state TEXT,
+			created_at TIMESTAMP,
+			id UUID,
+			PRIMARY KEY ((state), created_at, id)
+		) WITH CLUSTERING ORDER BY (created_at ASC, id ASC)`).Exec()
+	if err != nil {
+		return err
+	}
+
+	return session.Query(`
+		CREATE TABLE IF NOT EXISTS reports_by_meow (
+			did TEXT,
+			rkey TEXT,
+			id UUID,
+			PRIMARY KEY ((did, rkey), id)
+		)`).Exec()
+}
+
+type Report struct {
+	ID        gocql.UUID `json:"id"`
+	DID       string     `json:"did"`
+	Rkey      string     `json:"rkey"`
+	Reporter  string     `json:"reporter"`
+	Reason    string     `json:"reason"`
+	Comment   string     `json:"comment,omitempty"`
+	State     string     `json:"state"`
+	Note      string     `json:"note,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	// Meow is nil once the reported meow has been deleted.
+	Meow *MeowResponse `json:"meow,omitempty"`
+}
+
+// reportID is deterministic, so a viewer can only have one report per meow.
+func reportID(reporter, did, rkey string) gocql.UUID {
+	return gocql.UUID(uuid.NewSHA1(uuid.NameSpaceURL, []byte(reporter+" "+meowURI(did, rkey))))
+}
+
+func loadReport(c *gin.Context, session *gocql.Session, id gocql.UUID) (*Report, error) {
+	r := Report{ID: id}
+	err := session.Query(`
+		SELECT did, rkey, reporter, reason, comment, state, note, created_at, updated_at
+		FROM reports
+		WHERE id = ?`,
+		id,
+	).WithContext(c.Request.Context()).Scan(&r.DID, &r.Rkey, &r.Reporter, &r.Reason, &r.Comment, &r.State, &r.Note, &r.CreatedAt, &r.UpdatedAt)
+	if err == gocql.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+type createReportRequest struct {
+	DID     string `json:"did"`
+	Rkey    string `json:"rkey"`
+	Reason  string `json:"reason"`
+	Comment string `json:"comment"`
+}
+
+func createReport(session *gocql.Session) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req createReportRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+			return
+		}
+		if req.DID == "" || validateDID(req.DID) != req.DID {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid did"})
+			return
+		}
+		if !rkeyRegex.MatchString(req.Rkey) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid rkey"})
+			return
+		}
+		if !reportReasons[req.Reason] {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "unknown reason " + req.Reason})
+			return
+		}
+		req.Comment = strings.TrimSpace(req.Comment)
+		if len(req.Comment) > maxReportComment {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "comment must be at most " + strconv.Itoa(maxReportComment) + " bytes"})
+			return
+		}
+
+		m, err := lookupMeow(c, session, req.DID, req.Rkey)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if m == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "meow not found"})
+			return
+		}
+
+		now := time.Now().UTC()
+		r := Report{
+			ID:        reportID(c.GetString("viewer"), req.DID, req.Rkey),
+			DID:       req.DID,
+			Rkey:      req.Rkey,
+			Reporter:  c.GetString("viewer"),
+			Reason:    req.Reason,
+			Comment:   req.Comment,
+			State:     reportOpen,
+			CreatedAt: now,
+			UpdatedAt: now,
+		}
+		applied, err := session.Query(`
+			INSERT INTO reports (id, did, rkey, reporter, reason, comment, state, created_at, updated_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+			IF NOT EXISTS`,
+			r.ID, r.DID, r.Rkey, r.Reporter, r.Reason, r.Comment, r.State, r.CreatedAt, r.UpdatedAt,
+		).WithContext(c.Request.Context()).MapScanCAS(map[string]interface{}{})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if !applied {
+			c.JSON(http.StatusConflict, gin.H{"error": "meow already reported"})
+			return
+		}
+		batch := session.NewBatch(gocql.LoggedBatch).WithContext(c.Request.Context())
+		batch.Query(`INSERT INTO reports_by_state (state, created_at, id) VALUES (?, ?, ?)`,
+			r.State, r.CreatedAt, r.ID)
+		batch.Query(`INSERT INTO reports_by_meow (did, rkey, id) VALUES (?, ?, ?)`,
+			r.DID, r.Rkey, r.ID)
+		if err := session.ExecuteBatch(batch); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusCreated, r)
+	}
+}
+
+// listReports lists the reports in ?state= (default open), one by one,
+// oldest first, with the reported meows attached. The cursor is
+// "<created_at in µs>/<id>" of the last report on the previous page.
+func listReports(session *gocql.Session) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		state := c.DefaultQuery("state", reportOpen)
+		if _, ok := reportTransitions[state]; !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "state must be open, triaged or resolved"})
+			return
+		}
+		limit, err := reportsGuardrail.parseLimit(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		var iter *gocql.Iter
+		if v := c.Query("cursor"); v != "" {
+			after, id, err := parseReportCursor(v)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid cursor"})
+				return
+			}
+			iter = session.Query(`
+				SELECT id FROM reports_by_state
+				WHERE state = ? AND (created_at, id) > (?, ?)
+				LIMIT ?`,
+				state, after, id, limit+1,
+			).WithContext(c.Request.Context()).Iter()
+		} else {
+			iter = session.Query(`
+				SELECT id FROM reports_by_state WHERE state = ? LIMIT ?`,
+				state, limit+1,
+			).WithContext(c.Request.Context()).Iter()
+		}
+		var ids []gocql.UUID
+		var id gocql.UUID
+		for iter.Scan(&id) {
+			ids = append(ids, id)
+		}
+		if err := iter.Close(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		more := len(ids) > limit
+		if more {
+			ids = ids[:limit]
+		}
+
+		reports := []Report{}
+		for _, id := range ids {
+			r, err := loadReport(c, session, id)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			if r == nil {
+				continue
+			}
+			if r.Meow, err = lookupMeow(c, session, r.DID, r.Rkey); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			reports = append(reports, *r)
+		}
+		resp := gin.H{"reports": reports}
+		if more && len(reports) > 0 {
+			last := reports[len(reports)-1]
+			resp["cursor"] = strconv.FormatInt(last.CreatedAt.UnixMicro(), 10) + "/" + last.ID.String()
+		}
+		c.JSON(http.StatusOK, resp)
+	}
+}
+
+func parseReportCursor(v string) (time.Time, gocql.UUID, error) {
+	us, rest, _ := strings.Cut(v, "/")
+	t, err := strconv.ParseInt(us, 10, 64)
+	if err != nil {
+		return time.Time{}, gocql.UUID{}, err
+	}
+	id, err := gocql.ParseUUID(rest)
+	if err != nil {
+		return time.Time{}, gocql.UUID{}, err
+	}
+	return time.UnixMicro(t), id, nil
+}
+
+type updateReportRequest struct {
+	ID    string `json:"id"`
+	State string `json:"state"`
+	Note  string `json:"note"`
+}
+
+// setReportState moves a report to another state, keeping reports_by_state
+// in step.
+func setReportState(c *gin.Context, session *gocql.Session, r *Report, state, note string) error {
+	from := r.State
+	r.State = state
+	r.UpdatedAt = time.Now().UTC()
+	if note != "" {
+		r.Note = note
+	}
+	batch := session.NewBatch(gocql.LoggedBatch).WithContext(c.Request.Context())
+	batch.Query(`UPDATE reports SET state = ?, note = ?, updated_at = ? WHERE id = ?`,
+		r.State, r.Note, r.UpdatedAt, r.ID)
+	batch.Query(`DELETE FROM reports_by_state WHERE state = ? AND created_at = ? AND id = ?`,
+		from, r.CreatedAt, r.ID)
+	batch.Query(`INSERT INTO reports_by_state (state, created_at, id) VALUES (?, ?, ?)`,
+		r.State, r.CreatedAt, r.ID)
+	return session.ExecuteBatch(batch)
+}
+
+func canTransition(from, to string) bool {
+	for _, s := range reportTransitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+// updateReport moves a report along open → triaged → resolved, with an
+// optional moderator note.
+func updateReport(session *gocql.Session) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req updateReportRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+			return
+		}
+		id, err := gocql.ParseUUID(req.ID)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+			return
+		}
+		r, err := loadReport(c, session, id)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if r == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "report not found"})
+			return
+		}
+		if !canTransition(r.State, req.State) {
+			c.JSON(http.StatusConflict, gin.H{"error": "can't move a report from " + r.State + " to " + req.State})
+			return
+		}
+		if err := setReportState(c, session, r, req.State, strings.TrimSpace(req.Note)); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, r)
+	}
+}
@@ -0,0 +1,133 @@
+package repostream
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// ErrCAR is returned for blocks that aren't a valid CAR v1 file.
+var ErrCAR = errors.New("invalid car")
+
+// CID is a CIDv1, the hash link between repo blocks.
+type CID struct {
+	b string
+}
+
+var base32Lower = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+// String is the CID in base32, as atproto writes them.
+func (c CID) String() string {
+	return "b" + base32Lower.EncodeToString([]byte(c.b))
+}
+
+// sha256Multihash is the multihash code of sha2-256, which atproto hashes
+// every block with.
+const sha256Multihash = 0x12
+
+// parseCID reads the CIDv1 at the start of b, and returns how many bytes
+// it took.
+func parseCID(b []byte) (CID, int, error) {
+	pos := 0
+	uvarint := func() (uint64, error) {
+		v, n := binary.Uvarint(b[pos:])
+		if n <= 0 {
+			return 0, fmt.Errorf("%w: malformed cid", ErrCBOR)
+		}
+		pos += n
+		return v, nil
+	}
+	version, err := uvarint()
+	if err != nil {
+		return CID{}, 0, err
+	}
+	if version != 1 {
+		return CID{}, 0, fmt.Errorf("%w: cid version %d", ErrCBOR, version)
+	}
+	// the codec and the multihash code
+	for i := 0; i < 2; i++ {
+		if _, err := uvarint(); err != nil {
+			return CID{}, 0, err
+		}
+	}
+	size, err := uvarint()
+	if err != nil {
+		return CID{}, 0, err
+	}
+	if size > uint64(len(b)-pos) {
+		return CID{}, 0, fmt.Errorf("%w: malformed cid", ErrCBOR)
+	}
+	pos += int(size)
+	return CID{b: string(b[:pos])}, pos, nil
+}
+
+// verify checks that data is the block c links to. atproto hashes every
+// block with sha2-256, so CIDs with any other hash are refused rather than
+// taken on trust.
+func (c CID) verify(data []byte) bool {
+	b := []byte(c.b)
+	pos := 0
+	var code, size uint64
+	for i := 0; i < 4; i++ {
+		v, n := binary.Uvarint(b[pos:])
+		pos += n
+		switch i {
+		case 2:
+			code = v
+		case 3:
+			size = v
+		}
+	}
+	if code != sha256Multihash || size != sha256.Size {
+		return false
+	}
+	sum := sha256.Sum256(data)
+	return bytes.Equal(sum[:], b[pos:])
+}
+
+// readCAR reads the roots and blocks of a CAR v1 file, checking each
+// block against its CID.
+func readCAR(data []byte) ([]CID, map[CID][]byte, error) {
+	size, n := binary.Uvarint(data)
+	if n <= 0 || size > uint64(len(data)-n) {
+		return nil, nil, fmt.Errorf("%w: malformed header", ErrCAR)
+	}
+	header, err := decode(data[n : n+int(size)])
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: header: %v", ErrCAR, err)
+	}
+	h, ok := header.(map[string]any)
+	if !ok || h["version"] != int64(1) {
+		return nil, nil, fmt.Errorf("%w: not version 1", ErrCAR)
+	}
+	var roots []CID
+	list, _ := h["roots"].([]any)
+	for _, r := range list {
+		if c, ok := r.(CID); ok {
+			roots = append(roots, c)
+		}
+	}
+	data = data[n+int(size):]
+
+	blocks := map[CID][]byte{}
+	for len(data) > 0 {
+		size, n := binary.Uvarint(data)
+		if n <= 0 || size > uint64(len(data)-n) {
+			return nil, nil, fmt.Errorf("%w: malformed section", ErrCAR)
+		}
+		section := data[n : n+int(size)]
+		data = data[n+int(size):]
+		c, k, err := parseCID(section)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: %v", ErrCAR, err)
+		}
+		if !c.verify(section[k:]) {
+			return nil, nil, fmt.Errorf("%w: block %s doesn't match its cid", ErrCAR, c)
+		}
+		blocks[c] = section[k:]
+	}
+	return roots, blocks, nil
+}
@@ -0,0 +1,86 @@
+package repostream
+
+import (
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+func TestReadCAR(t *testing.T) {
+	block := mustCBOR(t, map[string]any{"$type": "moe.kasey.meow", "emotion": "sleepy"})
+	c := cidOf(block)
+	tampered := append([]byte(nil), block...)
+	tampered[len(tampered)-1] ^= 1
+	sum := sha512.Sum512(block)
+	sha512CID := CID{b: string(append([]byte{1, 0x71, 0x13, sha512.Size}, sum[:]...))}
+	short := CID{b: string([]byte{1, 0x71, sha256Multihash, 31}) + c.b[4:len(c.b)-1]}
+	v2 := mustCBOR(t, map[string]any{"version": int64(2), "roots": []any{}})
+
+	tests := []struct {
+		name string
+		car  []byte
+		err  error
+	}{
+		{name: "valid", car: carFile(t, c, carSection(c, block))},
+		{name: "no blocks", car: carFile(t, c)},
+		{name: "tampered block", car: carFile(t, c, carSection(c, tampered)), err: ErrCAR},
+		{name: "non-sha256 cid", car: carFile(t, sha512CID, carSection(sha512CID, block)), err: ErrCAR},
+		{name: "short digest", car: carFile(t, short, carSection(short, block)), err: ErrCAR},
+		{name: "empty", car: nil, err: ErrCAR},
+		{name: "truncated header length", car: []byte{0x80}, err: ErrCAR},
+		{name: "oversized header", car: []byte{0x7f, 0xa0}, err: ErrCAR},
+		{name: "header not version 1", car: append(binary.AppendUvarint(nil, uint64(len(v2))), v2...), err: ErrCAR},
+		{name: "truncated section length", car: append(carFile(t, c), 0xff), err: ErrCAR},
+		{name: "oversized section", car: append(carFile(t, c), binary.AppendUvarint(nil, 1<<40)...), err: ErrCAR},
+		{name: "truncated section", car: carFile(t, c, carSection(c, block)[:20]), err: ErrCAR},
+		{name: "section with a bad cid", car: carFile(t, c, []byte{3, 0x01, 0x71, 0x80}), err: ErrCAR},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			roots, blocks, err := readCAR(tt.car)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("readCAR error = %v, want %v", err, tt.err)
+			}
+			if err != nil {
+				return
+			}
+			if len(roots) != 1 || roots[0] != c {
+				t.Errorf("roots = %v, want [%v]", roots, c)
+			}
+			if b, ok := blocks[c]; len(blocks) > 0 && (!ok || string(b) != string(block)) {
+				t.Errorf("blocks = %v", blocks)
+			}
+		})
+	}
+}
+
+func TestParseCID(t *testing.T) {
+	c := cidOf([]byte("block"))
+	tests := []struct {
+		name string
+		s    string
+		err  error
+	}{
+		{name: "valid", s: c.String()},
+		{name: "not base32", s: "Qmabc", err: ErrCBOR},
+		{name: "bad base32", s: "b!!", err: ErrCBOR},
+		{name: "cidv0", s: CID{b: "\x00" + c.b[1:]}.String(), err: ErrCBOR},
+		{name: "truncated version", s: CID{b: "\x81"}.String(), err: ErrCBOR},
+		{name: "truncated codec", s: CID{b: "\x01\x80"}.String(), err: ErrCBOR},
+		{name: "truncated digest size", s: CID{b: "\x01\x71\x12"}.String(), err: ErrCBOR},
+		{name: "oversized digest", s: CID{b: "\x01\x71\x12\x40" + c.b[4:]}.String(), err: ErrCBOR},
+		{name: "trailing bytes", s: CID{b: c.b + "x"}.String(), err: ErrCBOR},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseCID(tt.s)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("ParseCID error = %v, want %v", err, tt.err)
+			}
+			if err == nil && got != c {
+				t.Errorf("ParseCID = %v, want %v", got, c)
+			}
+		})
+	}
+}
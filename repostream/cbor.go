@@ -0,0 +1,177 @@
+package repostream
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// ErrCBOR is returned for data that isn't valid DAG-CBOR.
+var ErrCBOR = errors.New("invalid dag-cbor")
+
+// maxDepth bounds the nesting of decoded values.
+const maxDepth = 64
+
+// decode reads the single DAG-CBOR value of data. Values are decoded to
+// int64, string, []byte, bool, nil, float64, []any, map[string]any and CID.
+func decode(data []byte) (any, error) {
+	v, rest, err := decodeFirst(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) > 0 {
+		return nil, fmt.Errorf("%w: %d trailing bytes", ErrCBOR, len(rest))
+	}
+	return v, nil
+}
+
+// decodeFirst reads the first DAG-CBOR value of data and returns the rest.
+func decodeFirst(data []byte) (any, []byte, error) {
+	d := &decoder{b: data}
+	v, err := d.value(0)
+	if err != nil {
+		return nil, nil, err
+	}
+	return v, d.b[d.pos:], nil
+}
+
+type decoder struct {
+	b   []byte
+	pos int
+}
+
+func (d *decoder) take(n uint64) ([]byte, error) {
+	if n > uint64(len(d.b)-d.pos) {
+		return nil, fmt.Errorf("%w: unexpected end", ErrCBOR)
+	}
+	b := d.b[d.pos : d.pos+int(n)]
+	d.pos += int(n)
+	return b, nil
+}
+
+// head reads an item's major type, additional info and argument.
+// Indefinite lengths aren't allowed in DAG-CBOR.
+func (d *decoder) head() (major, info byte, arg uint64, err error) {
+	b, err := d.take(1)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	major, info = b[0]>>5, b[0]&0x1f
+	switch {
+	case info < 24:
+		return major, info, uint64(info), nil
+	case info <= 27:
+		b, err := d.take(1 << (info - 24))
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		for _, c := range b {
+			arg = arg<<8 | uint64(c)
+		}
+		return major, info, arg, nil
+	}
+	return 0, 0, 0, fmt.Errorf("%w: additional info %d", ErrCBOR, info)
+}
+
+func (d *decoder) value(depth int) (any, error) {
+	if depth > maxDepth {
+		return nil, fmt.Errorf("%w: nested too deep", ErrCBOR)
+	}
+	major, info, arg, err := d.head()
+	if err != nil {
+		return nil, err
+	}
+	switch major {
+	case 0:
+		if arg > math.MaxInt64 {
+			return nil, fmt.Errorf("%w: integer overflow", ErrCBOR)
+		}
+		return int64(arg), nil
+	case 1:
+		if arg > math.MaxInt64 {
+			return nil, fmt.Errorf("%w: integer overflow", ErrCBOR)
+		}
+		return -1 - int64(arg), nil
+	case 2:
+		b, err := d.take(arg)
+		if err != nil {
+			return nil, err
+		}
+		return append([]byte(nil), b...), nil
+	case 3:
+		b, err := d.take(arg)
+		if err != nil {
+			return nil, err
+		}
+		return string(b), nil
+	case 4:
+		// every item takes at least a byte
+		if arg > uint64(len(d.b)-d.pos) {
+			return nil, fmt.Errorf("%w: unexpected end", ErrCBOR)
+		}
+		items := make([]any, 0, arg)
+		for i := uint64(0); i < arg; i++ {
+			v, err := d.value(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, v)
+		}
+		return items, nil
+	case 5:
+		if arg > uint64(len(d.b)-d.pos)/2 {
+			return nil, fmt.Errorf("%w: unexpected end", ErrCBOR)
+		}
+		m := make(map[string]any, arg)
+		for i := uint64(0); i < arg; i++ {
+			k, err := d.value(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, fmt.Errorf("%w: map key is not a string", ErrCBOR)
+			}
+			v, err := d.value(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			m[key] = v
+		}
+		return m, nil
+	case 6:
+		// tag 42 is the only tag DAG-CBOR has: a CID, as bytes with a
+		// leading 0 for the identity multibase
+		if arg != 42 {
+			return nil, fmt.Errorf("%w: tag %d", ErrCBOR, arg)
+		}
+		v, err := d.value(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		b, ok := v.([]byte)
+		if !ok || len(b) == 0 || b[0] != 0 {
+			return nil, fmt.Errorf("%w: malformed link", ErrCBOR)
+		}
+		c, n, err := parseCID(b[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n != len(b)-1 {
+			return nil, fmt.Errorf("%w: malformed link", ErrCBOR)
+		}
+		return c, nil
+	}
+
+	switch {
+	case info == 20:
+		return false, nil
+	case info == 21:
+		return true, nil
+	case info == 22:
+		return nil, nil
+	case info == 27:
+		return math.Float64frombits(arg), nil
+	}
+	return nil, fmt.Errorf("%w: simple value %d", ErrCBOR, info)
+}
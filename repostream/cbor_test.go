@@ -0,0 +1,79 @@
+package repostream
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestDecode(t *testing.T) {
+	link := cidOf([]byte("block"))
+	nested := bytes.Repeat([]byte{0x81}, maxDepth+2)
+	nested = append(nested, 0x00)
+
+	tests := []struct {
+		name string
+		data []byte
+		want any
+		err  error
+	}{
+		{name: "uint", data: []byte{0x18, 0x64}, want: int64(100)},
+		{name: "negative", data: []byte{0x38, 0x63}, want: int64(-100)},
+		{name: "string", data: []byte{0x63, 'm', 'e', 'o'}, want: "meo"},
+		{name: "bytes", data: []byte{0x42, 1, 2}, want: []byte{1, 2}},
+		{name: "list", data: []byte{0x82, 0x01, 0xf5}, want: []any{int64(1), true}},
+		{name: "map", data: []byte{0xa1, 0x61, 'a', 0xf6}, want: map[string]any{"a": nil}},
+		{name: "float", data: []byte{0xfb, 0x3f, 0xf8, 0, 0, 0, 0, 0, 0}, want: 1.5},
+		{name: "link", data: mustCBOR(t, link), want: link},
+
+		{name: "empty", data: nil, err: ErrCBOR},
+		{name: "truncated head", data: []byte{0x19, 0x01}, err: ErrCBOR},
+		{name: "truncated string", data: []byte{0x63, 'm'}, err: ErrCBOR},
+		{name: "truncated list", data: []byte{0x82, 0x01}, err: ErrCBOR},
+		{name: "oversized string", data: []byte{0x7b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, err: ErrCBOR},
+		{name: "oversized bytes", data: []byte{0x5a, 0xff, 0xff, 0xff, 0xff, 0x00}, err: ErrCBOR},
+		{name: "oversized list", data: []byte{0x9b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, err: ErrCBOR},
+		{name: "oversized map", data: []byte{0xba, 0x7f, 0xff, 0xff, 0xff, 0x61, 'a'}, err: ErrCBOR},
+		{name: "integer overflow", data: []byte{0x1b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, err: ErrCBOR},
+		{name: "indefinite length", data: []byte{0x5f, 0x41, 0x00, 0xff}, err: ErrCBOR},
+		{name: "map key not a string", data: []byte{0xa1, 0x01, 0x02}, err: ErrCBOR},
+		{name: "tag other than 42", data: []byte{0xc1, 0x00}, err: ErrCBOR},
+		{name: "link without multibase prefix", data: append([]byte{0xd8, 42, 0x58, byte(len(link.b))}, link.b...), err: ErrCBOR},
+		{name: "link with truncated varint", data: []byte{0xd8, 42, 0x43, 0x00, 0x01, 0x80}, err: ErrCBOR},
+		{name: "link longer than its cid", data: append([]byte{0xd8, 42}, mustCBOR(t, append([]byte{0}, link.b+"x"...))...), err: ErrCBOR},
+		{name: "nested too deep", data: nested, err: ErrCBOR},
+		{name: "trailing bytes", data: []byte{0x01, 0x02}, err: ErrCBOR},
+		{name: "simple value", data: []byte{0xf0}, err: ErrCBOR},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decode(tt.data)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("decode error = %v, want %v", err, tt.err)
+			}
+			if err == nil && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("decode = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeRoundTrip(t *testing.T) {
+	v := map[string]any{
+		"$type":   "moe.kasey.meow",
+		"emotion": "sleepy",
+		"count":   int64(-3),
+		"ratio":   0.5,
+		"tags":    []any{"a", []byte{1}, nil, false},
+		"link":    cidOf([]byte("block")),
+	}
+	b := mustCBOR(t, v)
+	got, err := decode(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, v) {
+		t.Errorf("decode(MarshalCBOR(v)) = %#v, want %#v", got, v)
+	}
+}
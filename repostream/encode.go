@@ -0,0 +1,265 @@
+package repostream
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The reverse of Record: JSON in the atproto data model is read with
+// FromJSON and written out again as DAG-CBOR or DAG-JSON, for clients
+// that speak IPLD rather than plain JSON.
+
+// ParseCID reads a CID in base32, as String writes it.
+func ParseCID(s string) (CID, error) {
+	b, ok := strings.CutPrefix(s, "b")
+	if !ok {
+		return CID{}, fmt.Errorf("%w: %q is not base32", ErrCBOR, s)
+	}
+	raw, err := base32Lower.DecodeString(b)
+	if err != nil {
+		return CID{}, fmt.Errorf("%w: %v", ErrCBOR, err)
+	}
+	c, n, err := parseCID(raw)
+	if err != nil {
+		return CID{}, err
+	}
+	if n != len(raw) {
+		return CID{}, fmt.Errorf("%w: malformed cid", ErrCBOR)
+	}
+	return c, nil
+}
+
+// FromJSON reads JSON in the atproto data model into the values decode
+// returns: {"$link": cid} objects become CIDs, {"$bytes": base64} ones
+// []byte, integers int64 and other numbers float64.
+func FromJSON(data []byte) (any, error) {
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	var v any
+	if err := d.Decode(&v); err != nil {
+		return nil, err
+	}
+	return fromJSON(v)
+}
+
+func fromJSON(v any) (any, error) {
+	switch v := v.(type) {
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n, nil
+		}
+		return v.Float64()
+	case []any:
+		out := make([]any, len(v))
+		for i, item := range v {
+			var err error
+			if out[i], err = fromJSON(item); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	case map[string]any:
+		if len(v) == 1 {
+			if s, ok := v["$link"].(string); ok {
+				return ParseCID(s)
+			}
+			if s, ok := v["$bytes"].(string); ok {
+				return base64.RawStdEncoding.DecodeString(strings.TrimRight(s, "="))
+			}
+		}
+		out := make(map[string]any, len(v))
+		for k, item := range v {
+			var err error
+			if out[k], err = fromJSON(item); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	}
+	return v, nil
+}
+
+// MarshalCBOR encodes a value like those decode returns as DAG-CBOR:
+// arguments as short as they go, map keys sorted by length and then
+// bytes, and floats in 64 bits.
+func MarshalCBOR(v any) ([]byte, error) {
+	var b bytes.Buffer
+	if err := encodeCBOR(&b, v); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// cborHead writes an item's major type and argument.
+func cborHead(b *bytes.Buffer, major byte, arg uint64) {
+	major <<= 5
+	switch {
+	case arg < 24:
+		b.WriteByte(major | byte(arg))
+	case arg <= math.MaxUint8:
+		b.WriteByte(major | 24)
+		b.WriteByte(byte(arg))
+	case arg <= math.MaxUint16:
+		b.WriteByte(major | 25)
+		b.Write(binary.BigEndian.AppendUint16(nil, uint16(arg)))
+	case arg <= math.MaxUint32:
+		b.WriteByte(major | 26)
+		b.Write(binary.BigEndian.AppendUint32(nil, uint32(arg)))
+	default:
+		b.WriteByte(major | 27)
+		b.Write(binary.BigEndian.AppendUint64(nil, arg))
+	}
+}
+
+func encodeCBOR(b *bytes.Buffer, v any) error {
+	switch v := v.(type) {
+	case nil:
+		b.WriteByte(0xf6)
+	case bool:
+		if v {
+			b.WriteByte(0xf5)
+		} else {
+			b.WriteByte(0xf4)
+		}
+	case int64:
+		if v >= 0 {
+			cborHead(b, 0, uint64(v))
+		} else {
+			cborHead(b, 1, uint64(-1-v))
+		}
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return fmt.Errorf("%w: %v can't be encoded", ErrCBOR, v)
+		}
+		b.WriteByte(0xfb)
+		b.Write(binary.BigEndian.AppendUint64(nil, math.Float64bits(v)))
+	case string:
+		cborHead(b, 3, uint64(len(v)))
+		b.WriteString(v)
+	case []byte:
+		cborHead(b, 2, uint64(len(v)))
+		b.Write(v)
+	case CID:
+		// tag 42, bytes with a leading 0 for the identity multibase
+		cborHead(b, 6, 42)
+		cborHead(b, 2, uint64(len(v.b)+1))
+		b.WriteByte(0)
+		b.WriteString(v.b)
+	case []any:
+		cborHead(b, 4, uint64(len(v)))
+		for _, item := range v {
+			if err := encodeCBOR(b, item); err != nil {
+				return err
+			}
+		}
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			if len(keys[i]) != len(keys[j]) {
+				return len(keys[i]) < len(keys[j])
+			}
+			return keys[i] < keys[j]
+		})
+		cborHead(b, 5, uint64(len(v)))
+		for _, k := range keys {
+			cborHead(b, 3, uint64(len(k)))
+			b.WriteString(k)
+			if err := encodeCBOR(b, v[k]); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("%w: can't encode %T", ErrCBOR, v)
+	}
+	return nil
+}
+
+// MarshalDAGJSON encodes a value like those decode returns as DAG-JSON:
+// links as {"/": cid}, bytes as {"/": {"bytes": base64}}, map keys sorted
+// by bytes, and no whitespace.
+func MarshalDAGJSON(v any) ([]byte, error) {
+	var b bytes.Buffer
+	if err := encodeDAGJSON(&b, v); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func encodeDAGJSON(b *bytes.Buffer, v any) error {
+	switch v := v.(type) {
+	case int64:
+		b.WriteString(strconv.FormatInt(v, 10))
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return fmt.Errorf("%w: %v can't be encoded", ErrCBOR, v)
+		}
+		s := strconv.FormatFloat(v, 'g', -1, 64)
+		if !strings.ContainsAny(s, ".e") {
+			// without one it would read back as an integer
+			s += ".0"
+		}
+		b.WriteString(s)
+	case []byte:
+		b.WriteString(`{"/":{"bytes":"` + base64.RawStdEncoding.EncodeToString(v) + `"}}`)
+	case CID:
+		b.WriteString(`{"/":"` + v.String() + `"}`)
+	case []any:
+		b.WriteByte('[')
+		for i, item := range v {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			if err := encodeDAGJSON(b, item); err != nil {
+				return err
+			}
+		}
+		b.WriteByte(']')
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		b.WriteByte('{')
+		for i, k := range keys {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			writeJSONString(b, k)
+			b.WriteByte(':')
+			if err := encodeDAGJSON(b, v[k]); err != nil {
+				return err
+			}
+		}
+		b.WriteByte('}')
+	case string:
+		writeJSONString(b, v)
+	case nil:
+		b.WriteString("null")
+	case bool:
+		b.WriteString(strconv.FormatBool(v))
+	default:
+		return fmt.Errorf("%w: can't encode %T", ErrCBOR, v)
+	}
+	return nil
+}
+
+// writeJSONString writes s as a JSON string, without escaping HTML like
+// json.Marshal does.
+func writeJSONString(b *bytes.Buffer, s string) {
+	e := json.NewEncoder(b)
+	e.SetEscapeHTML(false)
+	e.Encode(s)
+	// Encode ends with a newline
+	b.Truncate(b.Len() - 1)
+}
@@ -0,0 +1,117 @@
+package repostream
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrNotProven is returned for an op its commit's tree doesn't back.
+var ErrNotProven = errors.New("op not in the signed tree")
+
+// A repo's records are keyed "collection/rkey" in a merkle search tree. A
+// node has the subtree "l" left of its entries, and each entry "e" its
+// key, as the "p" bytes it shares with the previous key followed by "k",
+// its value "v" and the subtree "t" right of it.
+type treeEntry struct {
+	key   string
+	value CID
+	right *CID
+}
+
+func readTreeNode(blocks map[CID][]byte, node CID) (*CID, []treeEntry, error) {
+	block, ok := blocks[node]
+	if !ok {
+		return nil, nil, fmt.Errorf("%w: tree node %s", ErrMissingBlock, node)
+	}
+	v, err := decode(block)
+	if err != nil {
+		return nil, nil, fmt.Errorf("tree node %s: %w", node, err)
+	}
+	n, ok := v.(map[string]any)
+	if !ok {
+		return nil, nil, fmt.Errorf("%w: tree node is not a map", ErrCBOR)
+	}
+	var left *CID
+	if l, ok := n["l"].(CID); ok {
+		left = &l
+	}
+	list, _ := n["e"].([]any)
+	entries := make([]treeEntry, 0, len(list))
+	var key []byte
+	for _, e := range list {
+		entry, ok := e.(map[string]any)
+		if !ok {
+			return nil, nil, fmt.Errorf("%w: tree entry is not a map", ErrCBOR)
+		}
+		shared, _ := entry["p"].(int64)
+		suffix, _ := entry["k"].([]byte)
+		value, ok := entry["v"].(CID)
+		if !ok || shared < 0 || shared > int64(len(key)) {
+			return nil, nil, fmt.Errorf("%w: malformed tree entry", ErrCBOR)
+		}
+		key = append(key[:shared:shared], suffix...)
+		te := treeEntry{key: string(key), value: value}
+		if t, ok := entry["t"].(CID); ok {
+			te.right = &t
+		}
+		entries = append(entries, te)
+	}
+	return left, entries, nil
+}
+
+// walkTree visits the keys of the tree under node in order.
+func walkTree(blocks map[CID][]byte, node CID, depth int, visit func(key string, value CID) error) error {
+	if depth > maxDepth {
+		return fmt.Errorf("%w: tree too deep", ErrCBOR)
+	}
+	left, entries, err := readTreeNode(blocks, node)
+	if err != nil {
+		return err
+	}
+	if left != nil {
+		if err := walkTree(blocks, *left, depth+1, visit); err != nil {
+			return err
+		}
+	}
+	for _, e := range entries {
+		if err := visit(e.key, e.value); err != nil {
+			return err
+		}
+		if e.right != nil {
+			if err := walkTree(blocks, *e.right, depth+1, visit); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// lookupTree finds key under root, descending only into the subtree that
+// could hold it, so blocks only need the nodes on its path. It returns
+// nil when the tree proves the key absent, and ErrMissingBlock when the
+// blocks don't go deep enough to tell.
+func lookupTree(blocks map[CID][]byte, root CID, key string) (*CID, error) {
+	node := &root
+	for depth := 0; node != nil; depth++ {
+		if depth > maxDepth {
+			return nil, fmt.Errorf("%w: tree too deep", ErrCBOR)
+		}
+		left, entries, err := readTreeNode(blocks, *node)
+		if err != nil {
+			return nil, err
+		}
+		next := left
+		for _, e := range entries {
+			if e.key == key {
+				value := e.value
+				return &value, nil
+			}
+			if e.key > key {
+				break
+			}
+			next = e.right
+		}
+		node = next
+	}
+	return nil, nil
+}
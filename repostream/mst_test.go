@@ -0,0 +1,122 @@
+package repostream
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestLookupTree(t *testing.T) {
+	r := newTestRepo(t)
+	fields, err := decode(r.blocks[r.commit])
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := fields.(map[string]any)["data"].(CID)
+	pruned := blockStore{}
+	for c, b := range r.blocks {
+		if c != r.left {
+			pruned[c] = b
+		}
+	}
+
+	tests := []struct {
+		name   string
+		blocks blockStore
+		key    string
+		found  bool
+		err    error
+	}{
+		{name: "root entry", blocks: r.blocks, key: testPath, found: true},
+		{name: "left subtree", blocks: r.blocks, key: "app.bsky.feed.post/3l3qo2vuowo2a", found: true},
+		{name: "right subtree", blocks: r.blocks, key: "moe.kasey.meow/3l3qo2vuowo2c", found: true},
+		{name: "absent", blocks: r.blocks, key: "moe.kasey.meow/3l3qo2vuowo2d"},
+		{name: "absent between entries", blocks: r.blocks, key: "moe.kasey.meow/3l3qo2vuowo2a"},
+		{name: "proven absent without the other subtree", blocks: pruned, key: "moe.kasey.meow/3l3qo2vuowo2d"},
+		{name: "missing node", blocks: pruned, key: "app.bsky.feed.post/3l3qo2vuowo2b", err: ErrMissingBlock},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := lookupTree(tt.blocks, root, tt.key)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("lookupTree error = %v, want %v", err, tt.err)
+			}
+			if (got != nil) != tt.found {
+				t.Errorf("lookupTree = %v, want found %v", got, tt.found)
+			}
+		})
+	}
+}
+
+func TestWalkTree(t *testing.T) {
+	r := newTestRepo(t)
+	fields, err := decode(r.blocks[r.commit])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	err = walkTree(r.blocks, fields.(map[string]any)["data"].(CID), 0, func(key string, _ CID) error {
+		keys = append(keys, key)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"app.bsky.feed.post/3l3qo2vuowo2a", testPath, "moe.kasey.meow/3l3qo2vuowo2c"}
+	if !reflect.DeepEqual(keys, want) {
+		t.Errorf("walkTree visited %q, want %q", keys, want)
+	}
+}
+
+func TestReadTreeNode(t *testing.T) {
+	value := cidOf([]byte("record"))
+	tests := []struct {
+		name string
+		node any
+		keys []string
+		err  error
+	}{
+		{
+			name: "shared prefixes",
+			node: map[string]any{"l": nil, "e": []any{
+				map[string]any{"p": int64(0), "k": []byte("moe.kasey.meow/aaa"), "v": value, "t": nil},
+				map[string]any{"p": int64(15), "k": []byte("bbb"), "v": value, "t": nil},
+			}},
+			keys: []string{"moe.kasey.meow/aaa", "moe.kasey.meow/bbb"},
+		},
+		{
+			name: "prefix longer than the previous key",
+			node: map[string]any{"e": []any{map[string]any{"p": int64(4), "k": []byte("a"), "v": value}}},
+			err:  ErrCBOR,
+		},
+		{
+			name: "negative prefix",
+			node: map[string]any{"e": []any{map[string]any{"p": int64(-1), "k": []byte("a"), "v": value}}},
+			err:  ErrCBOR,
+		},
+		{
+			name: "entry without value",
+			node: map[string]any{"e": []any{map[string]any{"p": int64(0), "k": []byte("a")}}},
+			err:  ErrCBOR,
+		},
+		{name: "entry not a map", node: map[string]any{"e": []any{"a"}}, err: ErrCBOR},
+		{name: "node not a map", node: []any{}, err: ErrCBOR},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			blocks := blockStore{}
+			node := blocks.add(t, tt.node)
+			_, entries, err := readTreeNode(blocks, node)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("readTreeNode error = %v, want %v", err, tt.err)
+			}
+			var keys []string
+			for _, e := range entries {
+				keys = append(keys, e.key)
+			}
+			if !reflect.DeepEqual(keys, tt.keys) {
+				t.Errorf("readTreeNode keys = %q, want %q", keys, tt.keys)
+			}
+		})
+	}
+}
@@ -0,0 +1,87 @@
+package repostream
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Repo is a whole repo as exported by com.atproto.sync.getRepo: a CAR
+// rooted at the signed commit, whose data is the merkle search tree of
+// every record.
+//
+//	repo, err := repostream.ParseRepo(car)
+//	records, err := repo.Records("moe.kasey.meow")
+type Repo struct {
+	DID string
+	Rev string
+
+	data   CID
+	blocks map[CID][]byte
+}
+
+// Record is a record of a repo.
+type Record struct {
+	Rkey string
+	CID  CID
+	// Value is the record as JSON in the atproto data model, see
+	// Commit.Record
+	Value json.RawMessage
+}
+
+// ParseRepo reads a repo CAR.
+func ParseRepo(car []byte) (*Repo, error) {
+	roots, blocks, err := readCAR(car)
+	if err != nil {
+		return nil, err
+	}
+	if len(roots) != 1 {
+		return nil, fmt.Errorf("%w: %d roots", ErrCAR, len(roots))
+	}
+	block, ok := blocks[roots[0]]
+	if !ok {
+		return nil, ErrMissingBlock
+	}
+	v, err := decode(block)
+	if err != nil {
+		return nil, fmt.Errorf("commit: %w", err)
+	}
+	commit, ok := v.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("%w: commit is not a map", ErrCBOR)
+	}
+	r := &Repo{blocks: blocks}
+	r.DID, _ = commit["did"].(string)
+	r.Rev, _ = commit["rev"].(string)
+	if r.data, ok = commit["data"].(CID); !ok || r.DID == "" {
+		return nil, fmt.Errorf("%w: malformed commit", ErrCBOR)
+	}
+	return r, nil
+}
+
+// Records lists the records of a collection, in rkey order.
+func (r *Repo) Records(collection string) ([]Record, error) {
+	var records []Record
+	prefix := collection + "/"
+	err := walkTree(r.blocks, r.data, 0, func(key string, cid CID) error {
+		rkey, ok := strings.CutPrefix(key, prefix)
+		if !ok {
+			return nil
+		}
+		block, ok := r.blocks[cid]
+		if !ok {
+			return fmt.Errorf("%w: %s", ErrMissingBlock, key)
+		}
+		v, err := decode(block)
+		if err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+		value, err := json.Marshal(toJSON(v))
+		if err != nil {
+			return err
+		}
+		records = append(records, Record{Rkey: rkey, CID: cid, Value: value})
+		return nil
+	})
+	return records, err
+}
@@ -0,0 +1,220 @@
+// Package repostream decodes the frames of a PDS's
+// com.atproto.sync.subscribeRepos stream, and the records in its commits
+// and in whole repos exported by com.atproto.sync.getRepo.
+//
+//	ev, err := repostream.ParseEvent(frame)
+//	for _, op := range ev.Commit.Ops {
+//		record, err := ev.Commit.Record(op)
+//	}
+//
+// Blocks are checked against their CIDs. Commit signatures aren't verified
+// here, as that takes the repo's key from its DID document: callers check
+// Commit.Signature against it and Commit.Prove each op, or decide which
+// hosts they trust for which repos.
+package repostream
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrStream is returned for error frames, after which the host closes
+	// the stream, e.g. for a cursor in the future.
+	ErrStream = errors.New("stream error")
+	// ErrNoRecord is returned for the record of a delete.
+	ErrNoRecord = errors.New("op has no record")
+	// ErrMissingBlock is returned for a record not in the commit's blocks,
+	// e.g. of a commit that was too big to include them.
+	ErrMissingBlock = errors.New("record block missing")
+)
+
+// Event is a message of the stream. Commit is set for #commit messages;
+// Name and Message are set for #info ones, e.g. OutdatedCursor, DID and
+// Time for #identity and #account ones, Handle for #identity ones and
+// Active and Status for #account ones.
+type Event struct {
+	Type string
+	// Seq is 0 for messages without one, like #info
+	Seq     int64
+	Commit  *Commit
+	Name    string
+	Message string
+	DID     string
+	Time    time.Time
+	// Handle is empty when the message doesn't carry one
+	Handle string
+	Active bool
+	// Status says why an inactive account is, e.g. "takendown"
+	Status string
+}
+
+// Commit is a change to a repo.
+type Commit struct {
+	Repo string
+	Rev  string
+	Time time.Time
+	// TooBig commits don't carry their blocks; the repo has to be fetched
+	TooBig bool
+	Ops    []Op
+
+	// commit links the signed commit object in blocks
+	commit *CID
+	blocks map[CID][]byte
+}
+
+// Op is a record created, updated or deleted by a commit.
+type Op struct {
+	// Action is "create", "update" or "delete"
+	Action string
+	// Path is the collection and rkey, "collection/rkey"
+	Path string
+	// CID of the new record; nil for deletes
+	CID *CID
+}
+
+// Collection and Rkey split the op's path.
+func (op Op) Collection() string {
+	collection, _, _ := strings.Cut(op.Path, "/")
+	return collection
+}
+
+func (op Op) Rkey() string {
+	_, rkey, _ := strings.Cut(op.Path, "/")
+	return rkey
+}
+
+// ParseEvent decodes a frame, a header followed by the message body.
+func ParseEvent(frame []byte) (*Event, error) {
+	h, rest, err := decodeFirst(frame)
+	if err != nil {
+		return nil, fmt.Errorf("header: %w", err)
+	}
+	header, ok := h.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("%w: header is not a map", ErrCBOR)
+	}
+	b, err := decode(rest)
+	if err != nil {
+		return nil, fmt.Errorf("body: %w", err)
+	}
+	body, ok := b.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("%w: body is not a map", ErrCBOR)
+	}
+
+	switch header["op"] {
+	case int64(-1):
+		name, _ := body["error"].(string)
+		message, _ := body["message"].(string)
+		return nil, fmt.Errorf("%w: %s: %s", ErrStream, name, message)
+	case int64(1):
+	default:
+		return nil, fmt.Errorf("%w: unknown op %v", ErrCBOR, header["op"])
+	}
+
+	ev := &Event{}
+	ev.Type, _ = header["t"].(string)
+	ev.Seq, _ = body["seq"].(int64)
+	switch ev.Type {
+	case "#info":
+		ev.Name, _ = body["name"].(string)
+		ev.Message, _ = body["message"].(string)
+	case "#identity", "#account":
+		ev.DID, _ = body["did"].(string)
+		if t, ok := body["time"].(string); ok {
+			ev.Time, _ = time.Parse(time.RFC3339Nano, t)
+		}
+		ev.Handle, _ = body["handle"].(string)
+		ev.Active, _ = body["active"].(bool)
+		ev.Status, _ = body["status"].(string)
+	case "#commit":
+		ev.Commit, err = parseCommit(body)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ev, nil
+}
+
+func parseCommit(body map[string]any) (*Commit, error) {
+	c := &Commit{}
+	c.Repo, _ = body["repo"].(string)
+	c.Rev, _ = body["rev"].(string)
+	c.TooBig, _ = body["tooBig"].(bool)
+	if s, ok := body["time"].(string); ok {
+		c.Time, _ = time.Parse(time.RFC3339Nano, s)
+	}
+	if c.Repo == "" {
+		return nil, fmt.Errorf("%w: commit without repo", ErrCBOR)
+	}
+	if cid, ok := body["commit"].(CID); ok {
+		c.commit = &cid
+	}
+
+	ops, _ := body["ops"].([]any)
+	for _, o := range ops {
+		m, ok := o.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("%w: op is not a map", ErrCBOR)
+		}
+		var op Op
+		op.Action, _ = m["action"].(string)
+		op.Path, _ = m["path"].(string)
+		if cid, ok := m["cid"].(CID); ok {
+			op.CID = &cid
+		}
+		c.Ops = append(c.Ops, op)
+	}
+
+	if blocks, ok := body["blocks"].([]byte); ok && len(blocks) > 0 {
+		var err error
+		if _, c.blocks, err = readCAR(blocks); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// Record returns the record an op wrote, as JSON in the atproto data
+// model: links as {"$link": cid} and bytes as {"$bytes": base64}.
+func (c *Commit) Record(op Op) (json.RawMessage, error) {
+	if op.CID == nil {
+		return nil, ErrNoRecord
+	}
+	block, ok := c.blocks[*op.CID]
+	if !ok {
+		return nil, ErrMissingBlock
+	}
+	v, err := decode(block)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(toJSON(v))
+}
+
+func toJSON(v any) any {
+	switch v := v.(type) {
+	case CID:
+		return map[string]any{"$link": v.String()}
+	case []byte:
+		return map[string]any{"$bytes": base64.RawStdEncoding.EncodeToString(v)}
+	case []any:
+		out := make([]any, len(v))
+		for i, item := range v {
+			out[i] = toJSON(item)
+		}
+		return out
+	case map[string]any:
+		out := make(map[string]any, len(v))
+		for k, item := range v {
+			out[k] = toJSON(item)
+		}
+		return out
+	}
+	return v
+}
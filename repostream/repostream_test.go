@@ -0,0 +1,279 @@
+package repostream
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// The tests build their repos, commits and frames with MarshalCBOR and
+// sign commits with a P-256 key, as a PDS does.
+
+const (
+	testDID  = "did:plc:4xq7bnbd6mfxdmkd4w6wrq7u"
+	testRev  = "3l3qo2vutsw2b"
+	testPath = "moe.kasey.meow/3l3qo2vuowo2b"
+)
+
+// cidOf is the CID atproto gives a DAG-CBOR block.
+func cidOf(block []byte) CID {
+	sum := sha256.Sum256(block)
+	return CID{b: string(append([]byte{1, 0x71, sha256Multihash, sha256.Size}, sum[:]...))}
+}
+
+func mustCBOR(t *testing.T, v any) []byte {
+	t.Helper()
+	b, err := MarshalCBOR(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// blockStore collects the blocks of a test repo.
+type blockStore map[CID][]byte
+
+func (s blockStore) add(t *testing.T, v any) CID {
+	t.Helper()
+	b := mustCBOR(t, v)
+	c := cidOf(b)
+	s[c] = b
+	return c
+}
+
+// carSection is a CAR section of a block under its CID, which needn't be
+// the block's.
+func carSection(c CID, block []byte) []byte {
+	section := binary.AppendUvarint(nil, uint64(len(c.b)+len(block)))
+	section = append(section, c.b...)
+	return append(section, block...)
+}
+
+func carFile(t *testing.T, root CID, sections ...[]byte) []byte {
+	t.Helper()
+	header := mustCBOR(t, map[string]any{"version": int64(1), "roots": []any{root}})
+	car := binary.AppendUvarint(nil, uint64(len(header)))
+	car = append(car, header...)
+	for _, s := range sections {
+		car = append(car, s...)
+	}
+	return car
+}
+
+// testRepo is a signed repo with meows at testPath and a few other paths,
+// its tree two levels deep.
+type testRepo struct {
+	key    *ecdsa.PrivateKey
+	blocks blockStore
+	commit CID
+	record CID
+	// left is the tree node left of the root's entries
+	left CID
+}
+
+func newTestRepo(t *testing.T) *testRepo {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &testRepo{key: key, blocks: blockStore{}}
+	r.record = r.blocks.add(t, map[string]any{"$type": "moe.kasey.meow", "emotion": "sleepy"})
+	post := r.blocks.add(t, map[string]any{"$type": "app.bsky.feed.post", "text": "hi"})
+	later := r.blocks.add(t, map[string]any{"$type": "moe.kasey.meow", "emotion": "happy"})
+
+	entry := func(shared int64, suffix string, value CID, right any) map[string]any {
+		return map[string]any{"p": shared, "k": []byte(suffix), "v": value, "t": right}
+	}
+	r.left = r.blocks.add(t, map[string]any{"l": nil, "e": []any{entry(0, "app.bsky.feed.post/3l3qo2vuowo2a", post, nil)}})
+	right := r.blocks.add(t, map[string]any{"l": nil, "e": []any{entry(0, "moe.kasey.meow/3l3qo2vuowo2c", later, nil)}})
+	root := r.blocks.add(t, map[string]any{"l": r.left, "e": []any{entry(0, testPath, r.record, right)}})
+
+	unsigned := map[string]any{"did": testDID, "rev": testRev, "data": root, "version": int64(3), "prev": nil}
+	unsigned["sig"] = r.sign(t, mustCBOR(t, unsigned))
+	r.commit = r.blocks.add(t, unsigned)
+	return r
+}
+
+// sign signs data as atproto does: the ECDSA signature of its sha256 as
+// 64 bytes of r and s.
+func (r *testRepo) sign(t *testing.T, data []byte) []byte {
+	t.Helper()
+	hash := sha256.Sum256(data)
+	rr, s, err := ecdsa.Sign(rand.Reader, r.key, hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return append(rr.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+}
+
+func (r *testRepo) verify(unsigned, sig []byte) bool {
+	if len(sig) != 64 {
+		return false
+	}
+	hash := sha256.Sum256(unsigned)
+	rr, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+	return ecdsa.Verify(&r.key.PublicKey, hash[:], rr, s)
+}
+
+// car is the repo as a CAR file, every block verified.
+func (r *testRepo) car(t *testing.T) []byte {
+	t.Helper()
+	var sections [][]byte
+	for c, b := range r.blocks {
+		sections = append(sections, carSection(c, b))
+	}
+	return carFile(t, r.commit, sections...)
+}
+
+func frame(t *testing.T, typ string, body map[string]any) []byte {
+	t.Helper()
+	return append(mustCBOR(t, map[string]any{"op": int64(1), "t": typ}), mustCBOR(t, body)...)
+}
+
+func (r *testRepo) commitFrame(t *testing.T, blocks []byte) []byte {
+	t.Helper()
+	return frame(t, "#commit", map[string]any{
+		"seq":    int64(42),
+		"repo":   testDID,
+		"rev":    testRev,
+		"time":   "2024-09-09T19:46:02.329Z",
+		"commit": r.commit,
+		"tooBig": false,
+		"blocks": blocks,
+		"ops":    []any{map[string]any{"action": "create", "path": testPath, "cid": r.record}},
+	})
+}
+
+func TestParseEvent(t *testing.T) {
+	r := newTestRepo(t)
+	tampered := r.car(t)
+	tampered[len(tampered)-1] ^= 1
+
+	tests := []struct {
+		name  string
+		frame []byte
+		want  Event
+		err   error
+	}{
+		{
+			name:  "commit",
+			frame: r.commitFrame(t, r.car(t)),
+			want:  Event{Type: "#commit", Seq: 42},
+		},
+		{
+			name:  "tampered block",
+			frame: r.commitFrame(t, tampered),
+			err:   ErrCAR,
+		},
+		{
+			name:  "info",
+			frame: frame(t, "#info", map[string]any{"name": "OutdatedCursor", "message": "too old"}),
+			want:  Event{Type: "#info", Name: "OutdatedCursor", Message: "too old"},
+		},
+		{
+			name: "identity",
+			frame: frame(t, "#identity", map[string]any{
+				"seq": int64(7), "did": testDID, "time": "2024-09-09T19:46:02.329Z", "handle": "kasey.moe",
+			}),
+			want: Event{
+				Type: "#identity", Seq: 7, DID: testDID, Handle: "kasey.moe",
+				Time: time.Date(2024, 9, 9, 19, 46, 2, 329000000, time.UTC),
+			},
+		},
+		{
+			name: "account",
+			frame: frame(t, "#account", map[string]any{
+				"seq": int64(8), "did": testDID, "time": "2024-09-09T19:46:02.329Z", "active": false, "status": "takendown",
+			}),
+			want: Event{
+				Type: "#account", Seq: 8, DID: testDID, Status: "takendown",
+				Time: time.Date(2024, 9, 9, 19, 46, 2, 329000000, time.UTC),
+			},
+		},
+		{
+			name: "error",
+			frame: append(mustCBOR(t, map[string]any{"op": int64(-1)}),
+				mustCBOR(t, map[string]any{"error": "FutureCursor", "message": "cursor in the future"})...),
+			err: ErrStream,
+		},
+		{
+			name:  "unknown op",
+			frame: append(mustCBOR(t, map[string]any{"op": int64(2)}), mustCBOR(t, map[string]any{})...),
+			err:   ErrCBOR,
+		},
+		{
+			name:  "body not a map",
+			frame: append(mustCBOR(t, map[string]any{"op": int64(1), "t": "#info"}), mustCBOR(t, "body")...),
+			err:   ErrCBOR,
+		},
+		{
+			name:  "commit without repo",
+			frame: frame(t, "#commit", map[string]any{"seq": int64(1)}),
+			err:   ErrCBOR,
+		},
+		{
+			name:  "truncated body",
+			frame: r.commitFrame(t, r.car(t))[:100],
+			err:   ErrCBOR,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ev, err := ParseEvent(tt.frame)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("ParseEvent error = %v, want %v", err, tt.err)
+			}
+			if err != nil {
+				return
+			}
+			got := *ev
+			got.Commit = nil
+			if got != tt.want {
+				t.Errorf("ParseEvent = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCommitRecord(t *testing.T) {
+	r := newTestRepo(t)
+	ev, err := ParseEvent(r.commitFrame(t, r.car(t)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := ev.Commit
+	if c.Repo != testDID || c.Rev != testRev || len(c.Ops) != 1 {
+		t.Fatalf("commit = %+v", c)
+	}
+	op := c.Ops[0]
+	if op.Collection() != "moe.kasey.meow" || op.Rkey() != "3l3qo2vuowo2b" {
+		t.Errorf("op path split as %q, %q", op.Collection(), op.Rkey())
+	}
+	record, err := c.Record(op)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]any
+	if err := json.Unmarshal(record, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got["$type"] != "moe.kasey.meow" || got["emotion"] != "sleepy" {
+		t.Errorf("Record = %s", record)
+	}
+
+	if _, err := c.Record(Op{Action: "delete", Path: testPath}); err != ErrNoRecord {
+		t.Errorf("Record of a delete: error = %v, want %v", err, ErrNoRecord)
+	}
+	missing := cidOf([]byte("missing"))
+	if _, err := c.Record(Op{Action: "create", Path: testPath, CID: &missing}); err != ErrMissingBlock {
+		t.Errorf("Record of a missing block: error = %v, want %v", err, ErrMissingBlock)
+	}
+}
@@ -0,0 +1,127 @@
+package repostream
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrUnsigned is returned for a commit object without a signature.
+var ErrUnsigned = errors.New("commit is not signed")
+
+// Signature returns the signature of the commit and the bytes it signs:
+// the commit object's DAG-CBOR without its sig field. The object has to
+// be for the commit's repo and rev.
+func (c *Commit) Signature() (unsigned, sig []byte, err error) {
+	if c.commit == nil {
+		return nil, nil, fmt.Errorf("%w: commit without commit link", ErrCBOR)
+	}
+	block, ok := c.blocks[*c.commit]
+	if !ok {
+		return nil, nil, ErrMissingBlock
+	}
+	unsigned, fields, err := withoutField(block, "sig")
+	if err != nil {
+		return nil, nil, err
+	}
+	sig, ok = fields["sig"].([]byte)
+	if !ok {
+		return nil, nil, ErrUnsigned
+	}
+	if fields["did"] != c.Repo || fields["rev"] != c.Rev {
+		return nil, nil, fmt.Errorf("%w: commit object is for %v at %v", ErrCBOR, fields["did"], fields["rev"])
+	}
+	return unsigned, sig, nil
+}
+
+// Prove checks that the commit's tree backs op: the path of a create or
+// update leads to its CID, the path of a delete to nothing. The frame's op
+// list isn't signed, only the tree under the commit's data is, so an op is
+// only to be believed once it is proven and Signature verified.
+func (c *Commit) Prove(op Op) error {
+	if c.commit == nil {
+		return fmt.Errorf("%w: commit without commit link", ErrNotProven)
+	}
+	block, ok := c.blocks[*c.commit]
+	if !ok {
+		return fmt.Errorf("%w: %v", ErrNotProven, ErrMissingBlock)
+	}
+	v, err := decode(block)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrNotProven, err)
+	}
+	fields, _ := v.(map[string]any)
+	data, ok := fields["data"].(CID)
+	if !ok {
+		return fmt.Errorf("%w: commit without data", ErrNotProven)
+	}
+	got, err := lookupTree(c.blocks, data, op.Path)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrNotProven, err)
+	}
+	switch {
+	case op.CID == nil && got == nil:
+		return nil
+	case op.CID != nil && got != nil && *got == *op.CID:
+		return nil
+	}
+	return fmt.Errorf("%w: %s", ErrNotProven, op.Path)
+}
+
+// withoutField drops the entry name from the DAG-CBOR map block, keeping
+// the others' bytes as they are so the result is still canonical, and
+// returns the decoded entries too.
+func withoutField(block []byte, name string) ([]byte, map[string]any, error) {
+	d := &decoder{b: block}
+	major, _, n, err := d.head()
+	if err != nil {
+		return nil, nil, err
+	}
+	if major != 5 {
+		return nil, nil, fmt.Errorf("%w: commit is not a map", ErrCBOR)
+	}
+	if n > uint64(len(block))/2 {
+		return nil, nil, fmt.Errorf("%w: unexpected end", ErrCBOR)
+	}
+	fields := make(map[string]any, n)
+	var entries []byte
+	for i := uint64(0); i < n; i++ {
+		start := d.pos
+		k, err := d.value(1)
+		if err != nil {
+			return nil, nil, err
+		}
+		key, ok := k.(string)
+		if !ok {
+			return nil, nil, fmt.Errorf("%w: map key is not a string", ErrCBOR)
+		}
+		v, err := d.value(1)
+		if err != nil {
+			return nil, nil, err
+		}
+		fields[key] = v
+		if key != name {
+			entries = append(entries, block[start:d.pos]...)
+		}
+	}
+	if d.pos != len(block) {
+		return nil, nil, fmt.Errorf("%w: %d trailing bytes", ErrCBOR, len(block)-d.pos)
+	}
+	if _, ok := fields[name]; !ok {
+		return block, fields, nil
+	}
+	return append(mapHead(n-1), entries...), fields, nil
+}
+
+// mapHead is the shortest head of a map of n entries.
+func mapHead(n uint64) []byte {
+	const major = 5 << 5
+	switch {
+	case n < 24:
+		return []byte{major | byte(n)}
+	case n <= 0xff:
+		return []byte{major | 24, byte(n)}
+	case n <= 0xffff:
+		return []byte{major | 25, byte(n >> 8), byte(n)}
+	}
+	return []byte{major | 26, byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n)}
+}
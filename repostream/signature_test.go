@@ -0,0 +1,133 @@
+package repostream
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestProve(t *testing.T) {
+	r := newTestRepo(t)
+	other := cidOf([]byte("other"))
+	later := "moe.kasey.meow/3l3qo2vuowo2c"
+
+	tests := []struct {
+		name string
+		op   Op
+		err  error
+	}{
+		{name: "create", op: Op{Action: "create", Path: testPath, CID: &r.record}},
+		{name: "delete proven absent", op: Op{Action: "delete", Path: "moe.kasey.meow/3l3qo2vuowo2d"}},
+		{name: "forged path", op: Op{Action: "create", Path: "moe.kasey.meow/3l3qo2vuowo2d", CID: &r.record}, err: ErrNotProven},
+		{name: "forged cid", op: Op{Action: "update", Path: testPath, CID: &other}, err: ErrNotProven},
+		{name: "delete still in the tree", op: Op{Action: "delete", Path: later}, err: ErrNotProven},
+	}
+	ev, err := ParseEvent(r.commitFrame(t, r.car(t)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ev.Commit.Prove(tt.op); !errors.Is(err, tt.err) {
+				t.Errorf("Prove error = %v, want %v", err, tt.err)
+			}
+		})
+	}
+
+	t.Run("missing node", func(t *testing.T) {
+		c := *ev.Commit
+		c.blocks = blockStore{}
+		for k, b := range r.blocks {
+			if k != r.left {
+				c.blocks[k] = b
+			}
+		}
+		op := Op{Action: "delete", Path: "app.bsky.feed.post/3l3qo2vuowo2b"}
+		if err := c.Prove(op); !errors.Is(err, ErrNotProven) {
+			t.Errorf("Prove error = %v, want %v", err, ErrNotProven)
+		}
+	})
+	t.Run("no commit block", func(t *testing.T) {
+		c := *ev.Commit
+		c.blocks = nil
+		if err := c.Prove(ev.Commit.Ops[0]); !errors.Is(err, ErrNotProven) {
+			t.Errorf("Prove error = %v, want %v", err, ErrNotProven)
+		}
+	})
+}
+
+func TestSignature(t *testing.T) {
+	r := newTestRepo(t)
+	ev, err := ParseEvent(r.commitFrame(t, r.car(t)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	unsigned, sig, err := ev.Commit.Signature()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.verify(unsigned, sig) {
+		t.Error("signature doesn't verify")
+	}
+
+	bad := append([]byte(nil), sig...)
+	bad[10] ^= 1
+	if r.verify(unsigned, bad) {
+		t.Error("tampered signature verifies")
+	}
+	other := newTestRepo(t)
+	if other.verify(unsigned, sig) {
+		t.Error("signature verifies with another key")
+	}
+}
+
+func TestSignatureErrors(t *testing.T) {
+	r := newTestRepo(t)
+	fields, err := decode(r.blocks[r.commit])
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit := fields.(map[string]any)
+	without := func(name string) map[string]any {
+		m := map[string]any{}
+		for k, v := range commit {
+			if k != name {
+				m[k] = v
+			}
+		}
+		return m
+	}
+	with := func(name string, value any) map[string]any {
+		m := without(name)
+		m[name] = value
+		return m
+	}
+
+	tests := []struct {
+		name   string
+		commit any
+		repo   string
+		err    error
+	}{
+		{name: "unsigned", commit: without("sig"), repo: testDID, err: ErrUnsigned},
+		{name: "other repo", commit: commit, repo: "did:plc:someoneelse", err: ErrCBOR},
+		{name: "other rev", commit: with("rev", "3l3qo2vutsw2c"), repo: testDID, err: ErrCBOR},
+		{name: "not a map", commit: []any{}, repo: testDID, err: ErrCBOR},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			blocks := blockStore{}
+			link := blocks.add(t, tt.commit)
+			c := &Commit{Repo: tt.repo, Rev: testRev, commit: &link, blocks: blocks}
+			if _, _, err := c.Signature(); !errors.Is(err, tt.err) {
+				t.Errorf("Signature error = %v, want %v", err, tt.err)
+			}
+		})
+	}
+
+	t.Run("missing block", func(t *testing.T) {
+		c := &Commit{Repo: testDID, Rev: testRev, commit: &r.commit}
+		if _, _, err := c.Signature(); err != ErrMissingBlock {
+			t.Errorf("Signature error = %v, want %v", err, ErrMissingBlock)
+		}
+	})
+}
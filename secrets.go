@@ -0,0 +1,325 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gocql/gocql"
+)
+
+// Secrets, like ADMIN_TOKEN or CASSANDRA_PASSWORD, are read with envSecret
+// rather than getenv, which lets them come from elsewhere than the
+// environment or CONFIG_FILE:
+//
+//	ADMIN_TOKEN_FILE=/run/secrets/admin_token  the file's contents
+//	ADMIN_TOKEN=vault:secret/data/meowview#admin_token
+//	                                           a field of a Vault secret
+//	ADMIN_TOKEN=awssm:meowview/prod#admin_token
+//	                                           an AWS Secrets Manager secret,
+//	                                           or a field of it as JSON
+//
+// Vault is reached at VAULT_ADDR with VAULT_TOKEN (or VAULT_TOKEN_FILE)
+// and VAULT_NAMESPACE, and reads both KV versions. AWS takes AWS_REGION,
+// or the region of an ARN, and the static AWS_ACCESS_KEY_ID,
+// AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN. Secrets are read once, at
+// startup, so changing them needs a restart.
+//
+// Whatever their source, the values of secrets are replaced by [redacted]
+// in the log and in the errors on the status page.
+
+// minRedactedLen keeps short values, which would match all over the log,
+// from being redacted; no real secret is that short.
+const minRedactedLen = 4
+
+var secrets = struct {
+	sync.RWMutex
+	values   map[string]string
+	replacer *strings.Replacer
+	// fetched caches the secrets fetched from Vault or AWS by reference,
+	// without the field
+	fetched map[string]map[string]any
+}{values: map[string]string{}, replacer: strings.NewReplacer(), fetched: map[string]map[string]any{}}
+
+var secretsClient = &http.Client{Timeout: 10 * time.Second}
+
+// envSecret reads the secret key, or "" when unset.
+func envSecret(key string) string {
+	secrets.RLock()
+	v, ok := secrets.values[key]
+	secrets.RUnlock()
+	if ok {
+		return v
+	}
+	v, source, err := lookupSecret(key)
+	if err != nil {
+		log.Fatalf("%s: %v", key, err)
+	}
+	if source != "env" {
+		log.Printf("read %s from %s", key, source)
+	}
+	registerSecret(key, v)
+	return v
+}
+
+func registerSecret(key, v string) {
+	secrets.Lock()
+	defer secrets.Unlock()
+	secrets.values[key] = v
+	var pairs []string
+	for _, s := range secrets.values {
+		if len(s) >= minRedactedLen {
+			pairs = append(pairs, s, "[redacted]")
+		}
+	}
+	secrets.replacer = strings.NewReplacer(pairs...)
+}
+
+// lookupSecret reads the secret key and tells where it came from.
+func lookupSecret(key string) (string, string, error) {
+	if path := getenv(key + "_FILE"); path != "" {
+		if getenv(key) != "" {
+			return "", "", fmt.Errorf("set either %s or %s_FILE", key, key)
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return "", "", err
+		}
+		return strings.TrimRight(string(b), "\r\n"), "file " + path, nil
+	}
+	v := getenv(key)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	switch {
+	case strings.HasPrefix(v, "vault:"):
+		ref, field, _ := strings.Cut(strings.TrimPrefix(v, "vault:"), "#")
+		if field == "" {
+			return "", "", fmt.Errorf("want vault:<path>#<field>")
+		}
+		s, err := fetchSecret(ctx, "vault:"+ref, func() (map[string]any, error) { return fetchVaultSecret(ctx, ref) })
+		if err != nil {
+			return "", "", err
+		}
+		v, err := secretField(s, field)
+		return v, "vault", err
+	case strings.HasPrefix(v, "awssm:"):
+		ref, field, _ := strings.Cut(strings.TrimPrefix(v, "awssm:"), "#")
+		s, err := fetchSecret(ctx, "awssm:"+ref, func() (map[string]any, error) { return fetchAWSSecret(ctx, ref) })
+		if err != nil {
+			return "", "", err
+		}
+		v, err := secretField(s, field)
+		return v, "aws secrets manager", err
+	}
+	return v, "env", nil
+}
+
+func fetchSecret(ctx context.Context, ref string, fetch func() (map[string]any, error)) (map[string]any, error) {
+	secrets.RLock()
+	s, ok := secrets.fetched[ref]
+	secrets.RUnlock()
+	if ok {
+		return s, nil
+	}
+	s, err := fetch()
+	if err != nil {
+		return nil, err
+	}
+	secrets.Lock()
+	secrets.fetched[ref] = s
+	secrets.Unlock()
+	return s, nil
+}
+
+func secretField(s map[string]any, field string) (string, error) {
+	v, ok := s[field]
+	if !ok || v == nil {
+		return "", fmt.Errorf("secret has no field %q", field)
+	}
+	if str, ok := v.(string); ok {
+		return str, nil
+	}
+	return fmt.Sprint(v), nil
+}
+
+func fetchVaultSecret(ctx context.Context, path string) (map[string]any, error) {
+	addr := strings.TrimSuffix(getenv("VAULT_ADDR"), "/")
+	if addr == "" {
+		return nil, fmt.Errorf("VAULT_ADDR is not set")
+	}
+	if strings.HasPrefix(getenv("VAULT_TOKEN"), "vault:") {
+		return nil, fmt.Errorf("VAULT_TOKEN can't come from vault")
+	}
+	token := envSecret("VAULT_TOKEN")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, addr+"/v1/"+strings.TrimPrefix(path, "/"), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	if ns := getenv("VAULT_NAMESPACE"); ns != "" {
+		req.Header.Set("X-Vault-Namespace", ns)
+	}
+	var body struct {
+		Data map[string]any `json:"data"`
+	}
+	if err := doSecretRequest(req, &body); err != nil {
+		return nil, fmt.Errorf("vault %s: %v", path, err)
+	}
+	// KV version 2 nests the secret with its metadata
+	if inner, ok := body.Data["data"].(map[string]any); ok {
+		if _, ok := body.Data["metadata"]; ok {
+			return inner, nil
+		}
+	}
+	return body.Data, nil
+}
+
+// fetchAWSSecret gets the secret id: its SecretString as the field "",
+// and its fields when it is a JSON object.
+func fetchAWSSecret(ctx context.Context, id string) (map[string]any, error) {
+	region := envString("AWS_REGION", getenv("AWS_DEFAULT_REGION"))
+	if parts := strings.Split(id, ":"); len(parts) > 3 && parts[0] == "arn" {
+		region = parts[3]
+	}
+	if region == "" {
+		return nil, fmt.Errorf("AWS_REGION is not set")
+	}
+	for _, key := range []string{"AWS_SECRET_ACCESS_KEY", "AWS_SESSION_TOKEN"} {
+		if strings.HasPrefix(getenv(key), "awssm:") {
+			return nil, fmt.Errorf("%s can't come from aws secrets manager", key)
+		}
+	}
+	accessKey, secretKey := getenv("AWS_ACCESS_KEY_ID"), envSecret("AWS_SECRET_ACCESS_KEY")
+	if accessKey == "" || secretKey == "" {
+		return nil, fmt.Errorf("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY are required")
+	}
+	payload, err := json.Marshal(map[string]string{"SecretId": id})
+	if err != nil {
+		return nil, err
+	}
+	host := "secretsmanager." + region + ".amazonaws.com"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://"+host+"/", strings.NewReader(string(payload)))
+	if err != nil {
+		return nil, err
+	}
+	headers := map[string]string{
+		"content-type": "application/x-amz-json-1.1",
+		"host":         host,
+		"x-amz-date":   time.Now().UTC().Format("20060102T150405Z"),
+		"x-amz-target": "secretsmanager.GetSecretValue",
+	}
+	if token := envSecret("AWS_SESSION_TOKEN"); token != "" {
+		headers["x-amz-security-token"] = token
+	}
+	signAWSRequest(req, headers, payload, region, "secretsmanager", accessKey, secretKey)
+
+	var body struct {
+		SecretString string
+	}
+	if err := doSecretRequest(req, &body); err != nil {
+		return nil, fmt.Errorf("aws secret %s: %v", id, err)
+	}
+	s := map[string]any{}
+	// not JSON is fine, when only the whole secret is wanted
+	json.Unmarshal([]byte(body.SecretString), &s)
+	s[""] = body.SecretString
+	return s, nil
+}
+
+// signAWSRequest sets headers on req and signs them with Signature
+// Version 4.
+func signAWSRequest(req *http.Request, headers map[string]string, payload []byte, region, service, accessKey, secretKey string) {
+	names := make([]string, 0, len(headers))
+	for name, v := range headers {
+		names = append(names, name)
+		if name != "host" {
+			req.Header.Set(name, v)
+		}
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(headers[name]) + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+	payloadHash := sha256.Sum256(payload)
+	canonical := strings.Join([]string{
+		req.Method, "/", "", canonicalHeaders.String(), signedHeaders, hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+
+	amzDate := headers["x-amz-date"]
+	scope := amzDate[:8] + "/" + region + "/" + service + "/aws4_request"
+	canonicalHash := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+
+	key := []byte("AWS4" + secretKey)
+	for _, part := range []string{amzDate[:8], region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+accessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+hex.EncodeToString(hmacSHA256(key, toSign)))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func doSecretRequest(req *http.Request, v any) error {
+	resp, err := secretsClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, resp.Body)
+		return fmt.Errorf("%s", resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// redact replaces the values of secrets in s.
+func redact(s string) string {
+	secrets.RLock()
+	defer secrets.RUnlock()
+	return secrets.replacer.Replace(s)
+}
+
+type redactingWriter struct {
+	w io.Writer
+}
+
+func (r redactingWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(r.w, redact(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// redactLogs redacts secrets from the log and gin's request log.
+func redactLogs() {
+	log.SetOutput(redactingWriter{os.Stderr})
+	gin.DefaultWriter = redactingWriter{gin.DefaultWriter}
+	gin.DefaultErrorWriter = redactingWriter{gin.DefaultErrorWriter}
+}
+
+// configureAuth logs in to Cassandra with CASSANDRA_USERNAME and
+// CASSANDRA_PASSWORD, when set.
+func configureAuth(cluster *gocql.ClusterConfig) {
+	if user := getenv("CASSANDRA_USERNAME"); user != "" {
+		cluster.Authenticator = gocql.PasswordAuthenticator{Username: user, Password: envSecret("CASSANDRA_PASSWORD")}
+	}
+}
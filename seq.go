@@ -0,0 +1,63 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+// seqBlock is how many sequence numbers are reserved with one write.
+const seqBlock = 10000
+
+// sequencer numbers ingested events in the order they were read, as a
+// tiebreaker for meows with the same time_us, see pageParams.seen. The
+// numbers are reserved in blocks persisted to ingest_state, so they keep
+// increasing across restarts; a restart skips the rest of a block. Each
+// region has its own sequence, so they only order a region's own writes.
+type sequencer struct {
+	mu      sync.Mutex
+	session *gocql.Session
+	next    int64
+	// reserved is the end of the persisted block, exclusive
+	reserved int64
+}
+
+var sequence = &sequencer{}
+
+func seqName() string {
+	return "seq:" + cursorName()
+}
+
+// start loads the last reserved block. Numbering starts after it.
+func (s *sequencer) start(session *gocql.Session) error {
+	var seq int64
+	err := session.Query(`SELECT seq FROM ingest_state WHERE name = ?`, seqName()).Scan(&seq)
+	if err != nil && err != gocql.ErrNotFound {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.session, s.next, s.reserved = session, seq, seq
+	return nil
+}
+
+// assign gives ev the next sequence number. Should reserving a block
+// fail, numbering goes on from memory and the next reservation covers it.
+func (s *sequencer) assign(ev *meowEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.next >= s.reserved && s.session != nil {
+		err := s.session.Query(`
+			INSERT INTO ingest_state (name, seq, updated_at) VALUES (?, ?, ?)`,
+			seqName(), s.next+seqBlock, time.Now(),
+		).Exec()
+		if err != nil {
+			log.Println("reserve sequence numbers:", err)
+		}
+		s.reserved = s.next + seqBlock
+	}
+	s.next++
+	ev.Seq = s.next
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/gin-gonic/gin"
+)
+
+// configureEngine applies the HTTP server settings from the environment:
+//
+//	TRUSTED_PROXIES    comma separated IPs/CIDRs allowed to set forwarding headers
+//	TRUSTED_PLATFORM   cloudflare or google, trusts that platform's client IP header
+//	REMOTE_IP_HEADERS  headers carrying the client IP, default X-Forwarded-For,X-Real-IP
+//
+// Without TRUSTED_PROXIES no forwarding header is believed and c.ClientIP()
+// is the address of the peer, which behind a load balancer is the balancer.
+// GIN_MODE (debug, release or test) is read by gin itself.
+func configureEngine(r *gin.Engine) error {
+	if err := r.SetTrustedProxies(envList("TRUSTED_PROXIES")); err != nil {
+		return fmt.Errorf("TRUSTED_PROXIES: %w", err)
+	}
+
+	if headers := envList("REMOTE_IP_HEADERS"); len(headers) > 0 {
+		r.RemoteIPHeaders = headers
+	}
+
+	switch platform := envString("TRUSTED_PLATFORM", ""); platform {
+	case "":
+	case "cloudflare":
+		r.TrustedPlatform = gin.PlatformCloudflare
+	case "google":
+		r.TrustedPlatform = gin.PlatformGoogleAppEngine
+	default:
+		// any other value is taken as the header name itself
+		r.TrustedPlatform = platform
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Build information, overridden at build time with
+// -ldflags "-X main.version=... -X main.commit=... -X main.buildDate=...".
+var (
+	version   = "dev"
+	commit    = "unknown"
+	buildDate = "unknown"
+)
+
+type BuildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"buildDate"`
+	GoVersion string `json:"goVersion"`
+}
+
+// buildInfo falls back to the VCS stamp the go toolchain embeds when the
+// binary was built without ldflags.
+func buildInfo() BuildInfo {
+	info := BuildInfo{Version: version, Commit: commit, BuildDate: buildDate, GoVersion: runtime.Version()}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range bi.Settings {
+			switch {
+			case s.Key == "vcs.revision" && info.Commit == "unknown":
+				info.Commit = s.Value
+			case s.Key == "vcs.time" && info.BuildDate == "unknown":
+				info.BuildDate = s.Value
+			}
+		}
+	}
+	return info
+}
+
+// features records which optional subsystems are switched on in this
+// deployment, so clients can feature-detect instead of probing endpoints.
+// Ones behind a feature flag are only listed while it is on, see
+// featureflags.go.
+var features = struct {
+	sync.Mutex
+	enabled map[string]bool
+}{enabled: map[string]bool{
+	"relatedMeows":       true,
+	"emotionTransitions": true,
+	"meowCards":          true,
+	"metrics":            true,
+}}
+
+func enableFeature(name string) {
+	features.Lock()
+	defer features.Unlock()
+	features.enabled[name] = true
+}
+
+func enabledFeatures() []string {
+	features.Lock()
+	defer features.Unlock()
+	out := make([]string, 0, len(features.enabled))
+	for name, on := range features.enabled {
+		if on && featureEnabled(name) {
+			out = append(out, name)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+type ServerLimits struct {
+	DefaultLimit           int `json:"defaultLimit"`
+	MaxLimit               int `json:"maxLimit"`
+	RelatedCandidates      int `json:"relatedCandidates"`
+	TransitionHistoryLimit int `json:"transitionHistoryLimit"`
+	EmotionMaxLength       int `json:"emotionMaxLength"`
+}
+
+type ServerInfoResponse struct {
+	Build    BuildInfo `json:"build"`
+	Features []string  `json:"features"`
+	// Flags are the feature flags and whether each is on
+	Flags    map[string]bool `json:"flags"`
+	Lexicons []string        `json:"lexicons"`
+	Limits   ServerLimits    `json:"limits"`
+}
+
+func getServerInfo(c *gin.Context) {
+	c.JSON(http.StatusOK, ServerInfoResponse{
+		Build:    buildInfo(),
+		Features: enabledFeatures(),
+		Flags:    featureFlagStates(),
+		Lexicons: indexedLexicons,
+		Limits: ServerLimits{
+			DefaultLimit:           10,
+			MaxLimit:               100,
+			RelatedCandidates:      relatedCandidates,
+			TransitionHistoryLimit: transitionHistoryLimit,
+			EmotionMaxLength:       emotionMaxLength,
+		},
+	})
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+// Outside containers meowview runs under a service manager:
+//
+//   - systemd: with a .socket unit the listening socket is passed in
+//     (LISTEN_FDS), and with Type=notify readiness and shutdown are
+//     reported on NOTIFY_SOCKET
+//   - launchd: KeepAlive plus the SIGTERM handling below is all it needs
+//   - Windows: registered as a service it answers the service control
+//     manager, see service_windows.go
+//
+// However it is stopped, SIGINT, SIGTERM or a service stop request, the
+// server finishes in flight requests for up to SHUTDOWN_TIMEOUT and
+// checkpoints the jetstream cursor before exiting.
+
+// sdListenFDsStart is the first file descriptor systemd passes.
+const sdListenFDsStart = 3
+
+// activatedListener returns the socket systemd passed in, or nil when not
+// socket activated.
+func activatedListener() (net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("LISTEN_FDS: want a count of at least 1, got %q", os.Getenv("LISTEN_FDS"))
+	}
+	if n > 1 {
+		log.Printf("socket activation passed %d sockets, only the first is used", n)
+	}
+	// not for child processes
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	f := os.NewFile(sdListenFDsStart, "LISTEN_FD_3")
+	defer f.Close()
+	return net.FileListener(f)
+}
+
+// sdNotify reports a state change to systemd with Type=notify, and does
+// nothing otherwise.
+func sdNotify(state string) {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return
+	}
+	conn, err := net.Dial("unixgram", addr)
+	if err != nil {
+		log.Println("sd_notify:", err)
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		log.Println("sd_notify:", err)
+	}
+}
+
+type shutdownState struct {
+	once    sync.Once
+	mu      sync.Mutex
+	session *gocql.Session
+	server  *http.Server
+}
+
+var shutdown = &shutdownState{}
+
+// handleShutdown installs the signal handlers, and registers with the
+// Windows service manager, which has to happen within seconds of starting
+// rather than after startup.
+func handleShutdown() {
+	runPlatformService(shutdown.stop)
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		s := <-sig
+		log.Printf("received %s", s)
+		shutdown.stop()
+		os.Exit(0)
+	}()
+}
+
+// serving tells shutdown what to drain once the server is up.
+func (s *shutdownState) serving(session *gocql.Session, server *http.Server) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.session, s.server = session, server
+}
+
+// stop drains the HTTP server and checkpoints the cursor, or does nothing
+// while still starting up. It returns once done, leaving the exit to the
+// caller.
+func (s *shutdownState) stop() {
+	s.once.Do(func() {
+		log.Println("shutting down")
+		sdNotify("STOPPING=1")
+		s.mu.Lock()
+		session, server := s.session, s.server
+		s.mu.Unlock()
+		if server == nil {
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), envDuration("SHUTDOWN_TIMEOUT", 10*time.Second))
+		defer cancel()
+		hub.close()
+		if err := server.Shutdown(ctx); err != nil {
+			log.Println("http shutdown:", err)
+		}
+		if cursor := ingest.state().Cursor; cursor > 0 {
+			if err := saveCursor(session, cursor); err != nil {
+				log.Println("save cursor:", err)
+			}
+		}
+		if spool != nil {
+			spool.close()
+		}
+		session.Close()
+	})
+}
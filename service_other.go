@@ -0,0 +1,6 @@
+//go:build !windows
+
+package main
+
+// runPlatformService is a no-op outside Windows, signals cover the rest.
+func runPlatformService(stop func()) {}
@@ -0,0 +1,52 @@
+//go:build windows
+
+package main
+
+import (
+	"log"
+	"os"
+
+	"golang.org/x/sys/windows/svc"
+)
+
+// serviceName is what the service is registered as, e.g. with
+//
+//	sc.exe create meowview binPath= "C:\meowview\meowview.exe"
+var serviceName = envString("WINDOWS_SERVICE_NAME", "meowview")
+
+// runPlatformService answers the service control manager when running as
+// a Windows service.
+func runPlatformService(stop func()) {
+	isService, err := svc.IsWindowsService()
+	if err != nil {
+		log.Fatal("detect windows service:", err)
+	}
+	if !isService {
+		return
+	}
+	go func() {
+		if err := svc.Run(serviceName, &windowsService{stop: stop}); err != nil {
+			log.Fatal("windows service:", err)
+		}
+		os.Exit(0)
+	}()
+}
+
+type windowsService struct {
+	stop func()
+}
+
+func (s *windowsService) Execute(args []string, r <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	for req := range r {
+		switch req.Cmd {
+		case svc.Interrogate:
+			status <- req.CurrentStatus
+		case svc.Stop, svc.Shutdown:
+			status <- svc.Status{State: svc.StopPending}
+			s.stop()
+			return false, 0
+		}
+	}
+	return false, 0
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Shadow ingestion de-risks changes to the ingest pipeline, like a schema
+// redesign: with SHADOW_PIPELINE set, a sample of the live jetstream
+// events is run through that pipeline too, off the hot path, and what it
+// makes of each event is compared with what the primary indexed. Only the
+// primary's output is served; divergences are counted, logged and kept
+// for GET /_admin/getShadowStatus.
+//
+// SHADOW_SAMPLE_RATE (0.01) is the share of meows sampled, picked by a
+// hash of their URI so that every event of a sampled meow is. It is
+// reloaded at runtime, see reload.go, so a shadow can be ramped up.
+
+// shadowPipeline is an alternative ingest pipeline.
+type shadowPipeline interface {
+	Name() string
+	// Process makes the event it would index of a primary event's raw
+	// parts: DID, Rkey, CID, TimeUS, Op, Rev and Record. It may write to
+	// tables of its own, but nothing the primary reads.
+	Process(ctx context.Context, ev meowEvent) (meowEvent, error)
+}
+
+// shadowPipelines are the pipelines SHADOW_PIPELINE can name.
+var shadowPipelines = map[string]func() shadowPipeline{
+	"records": func() shadowPipeline { return recordsShadow{} },
+}
+
+const (
+	// shadowQueueSize bounds the sampled events waiting for the shadow;
+	// beyond it they are dropped rather than slowing ingestion
+	shadowQueueSize = 1000
+	// shadowKeptDivergences is how many recent divergences are kept
+	shadowKeptDivergences = 100
+)
+
+var shadowEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "meowview_shadow_events_total",
+	Help: "Sampled events run through the shadow pipeline, by pipeline and result: match, diverged, error or dropped.",
+}, []string{"pipeline", "result"})
+
+type ShadowDiff struct {
+	Field   string `json:"field"`
+	Primary string `json:"primary"`
+	Shadow  string `json:"shadow"`
+}
+
+type ShadowDivergence struct {
+	At    time.Time    `json:"at"`
+	URI   string       `json:"uri"`
+	Op    string       `json:"op"`
+	Diffs []ShadowDiff `json:"diffs,omitempty"`
+	// Error is set when the shadow failed where the primary didn't
+	Error string `json:"error,omitempty"`
+}
+
+type shadowRunner struct {
+	pipeline shadowPipeline
+	// rate is the sample rate as the bits of a float64
+	rate  atomic.Uint64
+	queue chan meowEvent
+
+	mu          sync.Mutex
+	counts      map[string]int64
+	divergences []ShadowDivergence
+}
+
+var shadow = shadowFromEnv()
+
+func shadowFromEnv() *shadowRunner {
+	name := envString("SHADOW_PIPELINE", "")
+	if name == "" {
+		return nil
+	}
+	newPipeline, ok := shadowPipelines[name]
+	if !ok {
+		log.Fatalf("SHADOW_PIPELINE: unknown pipeline %q", name)
+	}
+	return &shadowRunner{
+		pipeline: newPipeline(),
+		queue:    make(chan meowEvent, shadowQueueSize),
+		counts:   map[string]int64{},
+	}
+}
+
+func loadShadowSampleRate() (float64, error) {
+	rate, err := lookupFloat("SHADOW_SAMPLE_RATE", 0.01)
+	if err != nil {
+		return 0, err
+	}
+	if rate < 0 || rate > 1 {
+		return 0, fmt.Errorf("SHADOW_SAMPLE_RATE must be between 0 and 1")
+	}
+	return rate, nil
+}
+
+func reloadShadow() (func(), error) {
+	rate, err := loadShadowSampleRate()
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		if shadow != nil {
+			shadow.rate.Store(math.Float64bits(rate))
+		}
+	}, nil
+}
+
+func (s *shadowRunner) sampleRate() float64 {
+	return math.Float64frombits(s.rate.Load())
+}
+
+// sample queues ev, as the primary is about to index it, for the shadow
+// when its meow is sampled.
+func (s *shadowRunner) sample(ev meowEvent) {
+	if s == nil {
+		return
+	}
+	h := fnv.New64a()
+	h.Write([]byte(meowURI(ev.DID, ev.Rkey)))
+	if float64(h.Sum64())/math.MaxUint64 >= s.sampleRate() {
+		return
+	}
+	select {
+	case s.queue <- ev:
+	default:
+		s.count("dropped")
+	}
+}
+
+func (s *shadowRunner) count(result string) {
+	shadowEvents.WithLabelValues(s.pipeline.Name(), result).Inc()
+	s.mu.Lock()
+	s.counts[result]++
+	s.mu.Unlock()
+}
+
+// run processes the sampled events one at a time.
+func (s *shadowRunner) run() {
+	for primary := range s.queue {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		out, err := s.pipeline.Process(ctx, meowEvent{
+			Meow:   Meow{DID: primary.DID, Rkey: primary.Rkey, CID: primary.CID, TimeUS: primary.TimeUS},
+			Op:     primary.Op,
+			Rev:    primary.Rev,
+			Record: primary.Record,
+		})
+		cancel()
+
+		d := ShadowDivergence{At: time.Now().UTC(), URI: meowURI(primary.DID, primary.Rkey), Op: primary.Op}
+		switch {
+		case err != nil:
+			d.Error = err.Error()
+			s.count("error")
+		default:
+			if d.Diffs = diffEvents(primary, out); len(d.Diffs) == 0 {
+				s.count("match")
+				continue
+			}
+			s.count("diverged")
+		}
+		debugf("shadow %s diverged on %s: %+v %s", s.pipeline.Name(), d.URI, d.Diffs, d.Error)
+		s.mu.Lock()
+		s.divergences = append(s.divergences, d)
+		if len(s.divergences) > shadowKeptDivergences {
+			s.divergences = s.divergences[len(s.divergences)-shadowKeptDivergences:]
+		}
+		s.mu.Unlock()
+	}
+}
+
+// diffEvents lists the indexed fields in which the shadow's event differs
+// from the primary's.
+func diffEvents(primary, shadow meowEvent) []ShadowDiff {
+	fields := []struct {
+		name            string
+		primary, shadow string
+	}{
+		{"op", primary.Op, shadow.Op},
+		{"cid", primary.CID, shadow.CID},
+		{"time_us", strconv.FormatInt(primary.TimeUS, 10), strconv.FormatInt(shadow.TimeUS, 10)},
+		{"emotion", primary.Emotion, shadow.Emotion},
+		{"subject", primary.Subject, shadow.Subject},
+		{"inferred_emotion", primary.InferredEmotion, shadow.InferredEmotion},
+		{"lexicon_version", strconv.Itoa(primary.LexiconVersion), strconv.Itoa(shadow.LexiconVersion)},
+	}
+	var diffs []ShadowDiff
+	for _, f := range fields {
+		if f.primary != f.shadow {
+			diffs = append(diffs, ShadowDiff{Field: f.name, Primary: f.primary, Shadow: f.shadow})
+		}
+	}
+	return diffs
+}
+
+// recordsShadow validates records the way backfill and PDS subscriptions
+// do, through decodeRecord and setRecord, to converge the jetstream path
+// onto it. Emotions aren't inferred again, which would double the
+// classifier's load; the primary's are taken over.
+type recordsShadow struct{}
+
+func (recordsShadow) Name() string { return "records" }
+
+func (recordsShadow) Process(ctx context.Context, ev meowEvent) (meowEvent, error) {
+	if ev.Op == "delete" {
+		return ev, nil
+	}
+	record, version, err := decodeRecord(meowNSID, []byte(ev.Record))
+	if err != nil {
+		return ev, err
+	}
+	err = ev.setRecord(record, version)
+	return ev, err
+}
+
+type ShadowStatus struct {
+	Pipeline    string             `json:"pipeline"`
+	SampleRate  float64            `json:"sample_rate"`
+	Counts      map[string]int64   `json:"counts"`
+	Divergences []ShadowDivergence `json:"divergences"`
+}
+
+// getShadowStatus shows how the shadow pipeline compares, with the most
+// recent divergences first.
+func getShadowStatus(c *gin.Context) {
+	if shadow == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "SHADOW_PIPELINE is not set"})
+		return
+	}
+	shadow.mu.Lock()
+	defer shadow.mu.Unlock()
+	st := ShadowStatus{
+		Pipeline:    shadow.pipeline.Name(),
+		SampleRate:  shadow.sampleRate(),
+		Counts:      map[string]int64{},
+		Divergences: make([]ShadowDivergence, 0, len(shadow.divergences)),
+	}
+	for k, v := range shadow.counts {
+		st.Counts[k] = v
+	}
+	for i := len(shadow.divergences) - 1; i >= 0; i-- {
+		st.Divergences = append(st.Divergences, shadow.divergences[i])
+	}
+	c.JSON(http.StatusOK, st)
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// sloWindow counts good and total events in fixed size buckets covering a
+// rolling window, so ratios don't depend on when the process started.
+type sloWindow struct {
+	mu         sync.Mutex
+	bucketSize time.Duration
+	buckets    []sloBucket
+}
+
+type sloBucket struct {
+	slot  int64
+	good  uint64
+	total uint64
+}
+
+func newSLOWindow(window time.Duration) *sloWindow {
+	bucketSize := time.Minute
+	n := int(window / bucketSize)
+	if n < 1 {
+		n = 1
+	}
+	return &sloWindow{bucketSize: bucketSize, buckets: make([]sloBucket, n)}
+}
+
+func (w *sloWindow) record(now time.Time, good bool) {
+	slot := now.UnixNano() / int64(w.bucketSize)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	b := &w.buckets[slot%int64(len(w.buckets))]
+	if b.slot != slot {
+		*b = sloBucket{slot: slot}
+	}
+	b.total++
+	if good {
+		b.good++
+	}
+}
+
+func (w *sloWindow) totals(now time.Time) (good, total uint64) {
+	slot := now.UnixNano() / int64(w.bucketSize)
+	oldest := slot - int64(len(w.buckets)) + 1
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, b := range w.buckets {
+		if b.slot >= oldest && b.slot <= slot {
+			good += b.good
+			total += b.total
+		}
+	}
+	return good, total
+}
+
+type sloObjective struct {
+	Name        string
+	Description string
+	Target      float64
+	Threshold   time.Duration
+	window      *sloWindow
+}
+
+type SLOObjectiveStatus struct {
+	Name                 string  `json:"name"`
+	Description          string  `json:"description"`
+	Target               float64 `json:"target"`
+	Threshold            string  `json:"threshold,omitempty"`
+	Good                 uint64  `json:"good"`
+	Total                uint64  `json:"total"`
+	Ratio                float64 `json:"ratio"`
+	ErrorBudgetRemaining float64 `json:"errorBudgetRemaining"`
+	Met                  bool    `json:"met"`
+}
+
+func (o *sloObjective) status(now time.Time) SLOObjectiveStatus {
+	good, total := o.window.totals(now)
+	st := SLOObjectiveStatus{
+		Name:                 o.Name,
+		Description:          o.Description,
+		Target:               o.Target,
+		Good:                 good,
+		Total:                total,
+		Ratio:                1,
+		ErrorBudgetRemaining: 1,
+	}
+	if o.Threshold > 0 {
+		st.Threshold = o.Threshold.String()
+	}
+	if total > 0 {
+		st.Ratio = float64(good) / float64(total)
+		// budget is the share of allowed bad events not yet spent
+		allowed := (1 - o.Target) * float64(total)
+		if allowed > 0 {
+			st.ErrorBudgetRemaining = 1 - float64(total-good)/allowed
+		} else if good < total {
+			st.ErrorBudgetRemaining = 0
+		}
+	}
+	st.Met = st.Ratio >= o.Target
+	return st
+}
+
+// sloTracker holds the service level objectives, configured through
+// SLO_* environment variables:
+//
+//	SLO_WINDOW                rolling window, default 24h
+//	SLO_INGEST_LAG_THRESHOLD  events older than this on arrival are bad, default 30s
+//	SLO_INGEST_TARGET         default 0.99
+//	SLO_LATENCY_THRESHOLD     requests slower than this are bad, default 500ms
+//	SLO_LATENCY_TARGET        default 0.99, i.e. a p99 latency objective
+//	SLO_AVAILABILITY_TARGET   share of non-5xx responses, default 0.999
+type sloTracker struct {
+	window       time.Duration
+	ingest       *sloObjective
+	latency      *sloObjective
+	availability *sloObjective
+
+	mu        sync.Mutex
+	latencies []time.Duration
+	next      int
+}
+
+// latencySamples is how many recent request latencies feed the p99 estimate.
+const latencySamples = 1024
+
+// declared before slo, whose constructor registers the collector
+var (
+	sloTargetDesc = prometheus.NewDesc("meowview_slo_target",
+		"Target ratio of good events for the objective.", []string{"slo"}, nil)
+	sloRatioDesc = prometheus.NewDesc("meowview_slo_good_ratio",
+		"Ratio of good events over the SLO window.", []string{"slo"}, nil)
+	sloBudgetDesc = prometheus.NewDesc("meowview_slo_error_budget_remaining",
+		"Share of the error budget left in the SLO window; negative when exhausted.", []string{"slo"}, nil)
+	sloP99Desc = prometheus.NewDesc("meowview_api_latency_p99_seconds",
+		"p99 latency of recent API requests.", nil, nil)
+)
+
+var slo = newSLOTracker()
+
+func newSLOTracker() *sloTracker {
+	window := envDuration("SLO_WINDOW", 24*time.Hour)
+	t := &sloTracker{
+		window: window,
+		ingest: &sloObjective{
+			Name:        "ingest_lag",
+			Description: "events indexed within the lag threshold of being emitted",
+			Target:      envFloat("SLO_INGEST_TARGET", 0.99),
+			Threshold:   envDuration("SLO_INGEST_LAG_THRESHOLD", 30*time.Second),
+			window:      newSLOWindow(window),
+		},
+		latency: &sloObjective{
+			Name:        "api_latency",
+			Description: "API requests served within the latency threshold",
+			Target:      envFloat("SLO_LATENCY_TARGET", 0.99),
+			Threshold:   envDuration("SLO_LATENCY_THRESHOLD", 500*time.Millisecond),
+			window:      newSLOWindow(window),
+		},
+		availability: &sloObjective{
+			Name:        "api_availability",
+			Description: "API requests answered without a server error",
+			Target:      envFloat("SLO_AVAILABILITY_TARGET", 0.999),
+			window:      newSLOWindow(window),
+		},
+		latencies: make([]time.Duration, 0, latencySamples),
+	}
+	prometheus.MustRegister(t)
+	return t
+}
+
+func (t *sloTracker) objectives() []*sloObjective {
+	return []*sloObjective{t.ingest, t.latency, t.availability}
+}
+
+func (t *sloTracker) observeIngestLag(lag time.Duration) {
+	t.ingest.window.record(time.Now(), lag <= t.ingest.Threshold)
+}
+
+func (t *sloTracker) observeRequest(elapsed time.Duration, status int) {
+	now := time.Now()
+	t.latency.window.record(now, elapsed <= t.latency.Threshold)
+	t.availability.window.record(now, status < 500)
+
+	t.mu.Lock()
+	if len(t.latencies) < latencySamples {
+		t.latencies = append(t.latencies, elapsed)
+	} else {
+		t.latencies[t.next] = elapsed
+		t.next = (t.next + 1) % latencySamples
+	}
+	t.mu.Unlock()
+}
+
+// p99 is estimated from the most recent requests only.
+func (t *sloTracker) p99() time.Duration {
+	t.mu.Lock()
+	samples := append([]time.Duration(nil), t.latencies...)
+	t.mu.Unlock()
+	if len(samples) == 0 {
+		return 0
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+	return samples[(len(samples)*99)/100]
+}
+
+func (t *sloTracker) Describe(ch chan<- *prometheus.Desc) {
+	ch <- sloTargetDesc
+	ch <- sloRatioDesc
+	ch <- sloBudgetDesc
+	ch <- sloP99Desc
+}
+
+func (t *sloTracker) Collect(ch chan<- prometheus.Metric) {
+	now := time.Now()
+	for _, o := range t.objectives() {
+		st := o.status(now)
+		ch <- prometheus.MustNewConstMetric(sloTargetDesc, prometheus.GaugeValue, st.Target, st.Name)
+		ch <- prometheus.MustNewConstMetric(sloRatioDesc, prometheus.GaugeValue, st.Ratio, st.Name)
+		ch <- prometheus.MustNewConstMetric(sloBudgetDesc, prometheus.GaugeValue, st.ErrorBudgetRemaining, st.Name)
+	}
+	ch <- prometheus.MustNewConstMetric(sloP99Desc, prometheus.GaugeValue, t.p99().Seconds())
+}
+
+type SLOStatusResponse struct {
+	Window          string               `json:"window"`
+	Objectives      []SLOObjectiveStatus `json:"objectives"`
+	APILatencyP99Ms float64              `json:"apiLatencyP99Ms"`
+	AllMet          bool                 `json:"allMet"`
+}
+
+func getSLOStatus(c *gin.Context) {
+	now := time.Now()
+	resp := SLOStatusResponse{
+		Window:          slo.window.String(),
+		APILatencyP99Ms: float64(slo.p99().Microseconds()) / 1000,
+		AllMet:          true,
+	}
+	for _, o := range slo.objectives() {
+		st := o.status(now)
+		resp.AllMet = resp.AllMet && st.Met
+		resp.Objectives = append(resp.Objectives, st)
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+var sloRulesTemplate = template.Must(template.New("rules").Parse(`groups:
+  - name: meowview-slo
+    rules:
+{{- range .Objectives}}
+      - alert: MeowviewSLOBudgetLow_{{.Name}}
+        expr: meowview_slo_error_budget_remaining{slo="{{.Name}}"} < 0.25
+        for: 15m
+        labels:
+          severity: warning
+        annotations:
+          summary: "{{.Description}}: less than 25% of the error budget left"
+      - alert: MeowviewSLOBudgetExhausted_{{.Name}}
+        expr: meowview_slo_error_budget_remaining{slo="{{.Name}}"} <= 0
+        for: 5m
+        labels:
+          severity: critical
+        annotations:
+          summary: "{{.Description}}: error budget exhausted (target {{.Target}})"
+{{- end}}
+      - alert: MeowviewIngestLagging
+        expr: meowview_ingest_lag_seconds > {{.IngestLagSeconds}}
+        for: 5m
+        labels:
+          severity: warning
+        annotations:
+          summary: "jetstream ingestion is more than {{.IngestLagSeconds}}s behind"
+`))
+
+// getSLOAlertRules serves Prometheus alerting rules matching the configured
+// objectives, ready to be dropped into a rule_files entry.
+func getSLOAlertRules(c *gin.Context) {
+	now := time.Now()
+	var data struct {
+		Objectives       []SLOObjectiveStatus
+		IngestLagSeconds float64
+	}
+	for _, o := range slo.objectives() {
+		data.Objectives = append(data.Objectives, o.status(now))
+	}
+	data.IngestLagSeconds = slo.ingest.Threshold.Seconds()
+
+	c.Header("Content-Type", "application/yaml")
+	if err := sloRulesTemplate.Execute(c.Writer, data); err != nil {
+		c.Status(http.StatusInternalServerError)
+	}
+}
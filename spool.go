@@ -0,0 +1,526 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gocql/gocql"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// When Cassandra is unreachable, events read from jetstream are spooled to
+// disk in SPOOL_DIR instead of being lost, and replayed in order once it is
+// back. While anything is spooled, new events are spooled behind it too, so
+// they are still applied in the order jetstream delivered them.
+//
+// With SPOOL_JOURNAL=true the spool is a write-ahead log instead: every
+// event is journaled before it is applied and acknowledged after, and the
+// cursor only moves past an event once it is journaled. After a crash the
+// unacknowledged entries are replayed on startup and jetstream is resumed
+// from the last journaled event, so nothing read is lost. Entries are
+// fsynced every SPOOL_SYNC_INTERVAL, or each one with SPOOL_SYNC=always.
+//
+// The spool is a directory of segment files with one JSON event per line,
+// rotated at SPOOL_SEGMENT_BYTES and deleted once every entry in them is
+// acknowledged. The acknowledged position is kept in the file "ack". The
+// spool is capped at SPOOL_MAX_BYTES by dropping the oldest segment.
+//
+// PDS and relay subscriptions ingest through the spool too, from their own
+// goroutines. Events are applied one at a time so entries are acknowledged
+// in the order they were journaled, and only jetstream's events move the
+// cursor jetstream resumes from: the others keep their own seq.
+// Counters, meow_counts and the emotion alert counts among them, aren't
+// idempotent, so journal entries replayed after a crash that meows already
+// reflects are skipped rather than counted twice. An event that crashed
+// halfway through being applied may still be missing from some derived
+// tables.
+
+var (
+	spoolEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "meowview_spool_events_total",
+		Help: "Events written to the spool, by result (spooled, replayed, skipped, dropped).",
+	}, []string{"result"})
+
+	spoolBytes = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "meowview_spool_bytes",
+		Help: "Size of the on-disk event spool.",
+	})
+)
+
+type spoolSegment struct {
+	path   string
+	size   int64
+	events int
+	// acked entries, the first ones of the segment
+	acked int
+}
+
+type eventSpool struct {
+	dir          string
+	journal      bool
+	syncAlways   bool
+	maxBytes     int64
+	segmentBytes int64
+
+	mu       sync.Mutex
+	segments []*spoolSegment
+	// current is the last segment, open for appending, or nil
+	current *os.File
+	total   int64
+	// backlog is set while entries wait for the replayer; new events are
+	// only appended then
+	backlog bool
+	// lastTimeUS is the time_us of the newest entry from jetstream
+	lastTimeUS int64
+
+	// applying serializes ingest, see above
+	applying sync.Mutex
+}
+
+func newEventSpool() *eventSpool {
+	dir := envString("SPOOL_DIR", "")
+	if dir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		log.Fatal("spool dir:", err)
+	}
+	s := &eventSpool{
+		dir:          dir,
+		journal:      envBool("SPOOL_JOURNAL", false),
+		maxBytes:     int64(envInt("SPOOL_MAX_BYTES", 256<<20)),
+		segmentBytes: int64(envInt("SPOOL_SEGMENT_BYTES", 16<<20)),
+	}
+	switch mode := envString("SPOOL_SYNC", "interval"); mode {
+	case "always":
+		s.syncAlways = true
+	case "interval":
+	default:
+		log.Fatalf("SPOOL_SYNC must be always or interval, got %q", mode)
+	}
+	if err := s.recover(); err != nil {
+		log.Fatal("recover spool:", err)
+	}
+	return s
+}
+
+var spool = newEventSpool()
+
+// recover loads the segments a previous run left behind and skips what it
+// acknowledged. A line cut short by a crash is truncated away.
+func (s *eventSpool) recover() error {
+	paths, err := filepath.Glob(filepath.Join(s.dir, "*.wal"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(paths)
+	ackSegment, ackIndex := s.readAck()
+	for _, path := range paths {
+		name := filepath.Base(path)
+		if ackSegment != "" && name < ackSegment {
+			os.Remove(path)
+			continue
+		}
+		seg, last, err := scanSegment(path)
+		if err != nil {
+			return err
+		}
+		if name == ackSegment {
+			seg.acked = min(ackIndex, seg.events)
+		}
+		if last > 0 {
+			s.lastTimeUS = last
+		}
+		if seg.acked == seg.events {
+			os.Remove(path)
+			continue
+		}
+		s.segments = append(s.segments, seg)
+		s.total += seg.size
+	}
+	if len(s.segments) > 0 {
+		s.backlog = true
+		log.Printf("spool holds %d unacknowledged events from a previous run", s.unacked())
+	}
+	spoolBytes.Set(float64(s.total))
+	return nil
+}
+
+// scanSegment counts the entries of a segment and returns the time_us of
+// the last one from jetstream.
+func scanSegment(path string) (*spoolSegment, int64, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	if i := bytes.LastIndexByte(b, '\n'); i+1 < len(b) {
+		log.Printf("truncating partial entry at the end of %s", path)
+		b = b[:i+1]
+		if err := os.Truncate(path, int64(len(b))); err != nil {
+			return nil, 0, err
+		}
+	}
+	seg := &spoolSegment{path: path, size: int64(len(b)), events: bytes.Count(b, []byte{'\n'})}
+	var last int64
+	if seg.events > 0 {
+		lines := bytes.Split(bytes.TrimSuffix(b, []byte{'\n'}), []byte{'\n'})
+		for i := len(lines) - 1; i >= 0; i-- {
+			var ev meowEvent
+			if json.Unmarshal(lines[i], &ev) == nil && ev.Source == "" {
+				last = ev.TimeUS
+				break
+			}
+		}
+	}
+	return seg, last, nil
+}
+
+func (s *eventSpool) readAck() (string, int) {
+	b, err := os.ReadFile(filepath.Join(s.dir, "ack"))
+	if err != nil {
+		return "", 0
+	}
+	name, index, ok := strings.Cut(strings.TrimSpace(string(b)), " ")
+	n, err := strconv.Atoi(index)
+	if !ok || err != nil {
+		log.Println("ignoring malformed spool ack file")
+		return "", 0
+	}
+	return name, n
+}
+
+// writeAck persists the acknowledged position, after syncing the entries
+// it points into.
+func (s *eventSpool) writeAck() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.current != nil {
+		if err := s.current.Sync(); err != nil {
+			return err
+		}
+	}
+	if len(s.segments) == 0 {
+		return nil
+	}
+	seg := s.segments[0]
+	ack := fmt.Sprintf("%s %d\n", filepath.Base(seg.path), seg.acked)
+	tmp := filepath.Join(s.dir, "ack.tmp")
+	if err := os.WriteFile(tmp, []byte(ack), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(s.dir, "ack"))
+}
+
+// backlogged reports whether spooled events wait to be applied.
+func (s *eventSpool) backlogged() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.backlog
+}
+
+func (s *eventSpool) unacked() int {
+	n := 0
+	for _, seg := range s.segments {
+		n += seg.events - seg.acked
+	}
+	return n
+}
+
+// unavailable reports whether err means Cassandra couldn't be reached, as
+// opposed to rejecting the write.
+func unavailable(err error) bool {
+	var unavailable *gocql.RequestErrUnavailable
+	var writeTimeout *gocql.RequestErrWriteTimeout
+	var netErr net.Error
+	return errors.Is(err, gocql.ErrNoConnections) ||
+		errors.Is(err, gocql.ErrTimeoutNoResponse) ||
+		errors.Is(err, gocql.ErrConnectionClosed) ||
+		errors.As(err, &unavailable) ||
+		errors.As(err, &writeTimeout) ||
+		errors.As(err, &netErr)
+}
+
+// ingestEvent applies an event read from jetstream or a PDS or relay
+// subscription, through the spool when one is configured.
+func ingestEvent(session *gocql.Session, ev meowEvent) {
+	if spool == nil {
+		if err := processEvent(session, ev); err != nil {
+			log.Println("apply event error:", err)
+		}
+		return
+	}
+	spool.ingest(session, ev)
+}
+
+func (s *eventSpool) ingest(session *gocql.Session, ev meowEvent) {
+	s.applying.Lock()
+	defer s.applying.Unlock()
+	s.mu.Lock()
+	backlog := s.backlog
+	s.mu.Unlock()
+
+	if !s.journal && !backlog {
+		err := processEvent(session, ev)
+		if err == nil {
+			return
+		}
+		if !unavailable(err) {
+			log.Println("apply event error:", err)
+			return
+		}
+		log.Println("database unavailable, spooling events to", s.dir)
+		if _, err := s.append(ev, true); err != nil {
+			log.Println("spool event error:", err)
+		}
+		return
+	}
+
+	seg, err := s.append(ev, false)
+	if err != nil {
+		log.Println("spool event error:", err)
+		if !backlog {
+			// better applied unjournaled than not at all
+			if err := processEvent(session, ev); err != nil {
+				log.Println("apply event error:", err)
+			}
+		}
+		return
+	}
+	if seg == nil {
+		// behind the backlog, the replayer gets to it
+		return
+	}
+	if err := processEvent(session, ev); err != nil {
+		if unavailable(err) {
+			log.Println("database unavailable, replaying from the journal once it is back")
+			s.mu.Lock()
+			s.backlog = true
+			s.mu.Unlock()
+			return
+		}
+		log.Println("apply event error:", err)
+	}
+	s.ack(seg)
+}
+
+// append writes an event to the last segment. It returns the segment when
+// the caller is to apply the event and acknowledge it, or nil when the
+// event was queued behind the backlog, which stall starts.
+func (s *eventSpool) append(ev meowEvent, stall bool) (*spoolSegment, error) {
+	line, err := json.Marshal(ev)
+	if err != nil {
+		return nil, err
+	}
+	line = append(line, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.current == nil || s.segments[len(s.segments)-1].size >= s.segmentBytes {
+		if err := s.rotate(); err != nil {
+			return nil, err
+		}
+		path := filepath.Join(s.dir, fmt.Sprintf("%020d.wal", time.Now().UnixNano()))
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, err
+		}
+		s.current = f
+		s.segments = append(s.segments, &spoolSegment{path: path})
+	}
+	if _, err := s.current.Write(line); err != nil {
+		return nil, err
+	}
+	if s.syncAlways {
+		if err := s.current.Sync(); err != nil {
+			return nil, err
+		}
+	}
+	seg := s.segments[len(s.segments)-1]
+	seg.size += int64(len(line))
+	seg.events++
+	s.total += int64(len(line))
+	if ev.Source == "" {
+		s.lastTimeUS = ev.TimeUS
+	}
+	s.backlog = s.backlog || stall
+	if s.backlog {
+		spoolEvents.WithLabelValues("spooled").Inc()
+	}
+
+	// drop the oldest segment, unless it is the one being written to
+	for s.total > s.maxBytes && len(s.segments) > 1 {
+		oldest := s.segments[0]
+		log.Printf("spool over SPOOL_MAX_BYTES, dropping %s", oldest.path)
+		os.Remove(oldest.path)
+		spoolEvents.WithLabelValues("dropped").Add(float64(oldest.events - oldest.acked))
+		s.segments = s.segments[1:]
+		s.total -= oldest.size
+	}
+	spoolBytes.Set(float64(s.total))
+	if s.backlog {
+		return nil, nil
+	}
+	return seg, nil
+}
+
+// rotate closes the segment being written to, so the next event starts a
+// new one, and deletes it when everything in it was acknowledged. Called
+// with mu held.
+func (s *eventSpool) rotate() error {
+	if s.current == nil {
+		return nil
+	}
+	err := s.current.Close()
+	s.current = nil
+	s.prune()
+	return err
+}
+
+// prune deletes the fully acknowledged segments before the current one.
+// Called with mu held.
+func (s *eventSpool) prune() {
+	for len(s.segments) > 0 {
+		seg := s.segments[0]
+		if seg.acked < seg.events || (s.current != nil && len(s.segments) == 1) {
+			break
+		}
+		os.Remove(seg.path)
+		s.segments = s.segments[1:]
+		s.total -= seg.size
+	}
+	spoolBytes.Set(float64(s.total))
+}
+
+func (s *eventSpool) ack(seg *spoolSegment) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	seg.acked++
+	s.prune()
+}
+
+// resumeCursor is where jetstream continues after a restart when
+// journaling: the last journaled event, or 0 when unknown.
+func (s *eventSpool) resumeCursor() int64 {
+	if s == nil || !s.journal {
+		return 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lastTimeUS
+}
+
+// run replays the backlog every SPOOL_REPLAY_INTERVAL, and persists the
+// acknowledged position every SPOOL_SYNC_INTERVAL.
+func (s *eventSpool) run(session *gocql.Session) {
+	replay := time.NewTicker(envDuration("SPOOL_REPLAY_INTERVAL", 5*time.Second))
+	defer replay.Stop()
+	flush := time.NewTicker(envDuration("SPOOL_SYNC_INTERVAL", time.Second))
+	defer flush.Stop()
+	for {
+		select {
+		case <-replay.C:
+			s.replayBacklog(session)
+		case <-flush.C:
+			if err := s.writeAck(); err != nil {
+				log.Println("write spool ack:", err)
+			}
+		}
+	}
+}
+
+// replayBacklog applies unacknowledged entries in order until none are
+// left, or the database is unavailable again.
+func (s *eventSpool) replayBacklog(session *gocql.Session) {
+	for {
+		s.mu.Lock()
+		if !s.backlog {
+			s.mu.Unlock()
+			return
+		}
+		var seg *spoolSegment
+		var size int64
+		var events int
+		for _, sg := range s.segments {
+			if sg.acked < sg.events {
+				seg, size, events = sg, sg.size, sg.events
+				break
+			}
+		}
+		if seg == nil {
+			// caught up, new events are applied directly again
+			s.backlog = false
+			if !s.journal {
+				s.rotate()
+			}
+			s.prune()
+			s.mu.Unlock()
+			log.Println("spool replayed, ingesting directly again")
+			return
+		}
+		s.mu.Unlock()
+
+		if err := s.replay(session, seg, size, events); err != nil {
+			if !unavailable(err) {
+				log.Printf("replay %s: %v", seg.path, err)
+			}
+			return
+		}
+	}
+}
+
+// replay applies the unacknowledged entries among the first events of a
+// segment, which take up its first size bytes.
+func (s *eventSpool) replay(session *gocql.Session, seg *spoolSegment, size int64, events int) error {
+	f, err := os.Open(seg.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	s.mu.Lock()
+	start := seg.acked
+	s.mu.Unlock()
+
+	scanner := bufio.NewScanner(io.LimitReader(f, size))
+	scanner.Buffer(make([]byte, 64*1024), 4<<20)
+	for i := 0; i < events && scanner.Scan(); i++ {
+		if i < start {
+			continue
+		}
+		var ev meowEvent
+		if err := json.Unmarshal(scanner.Bytes(), &ev); err != nil {
+			log.Printf("skipping corrupt spool entry in %s: %v", seg.path, err)
+		} else if s.journal && alreadyApplied(session, ev) {
+			// applied before a crash, but not acknowledged
+			spoolEvents.WithLabelValues("skipped").Inc()
+		} else if err := processEvent(session, ev); err != nil {
+			if unavailable(err) {
+				return err
+			}
+			log.Println("apply spooled event error:", err)
+		}
+		s.ack(seg)
+		spoolEvents.WithLabelValues("replayed").Inc()
+	}
+	return scanner.Err()
+}
+
+// close persists the acknowledged position on shutdown.
+func (s *eventSpool) close() {
+	if err := s.writeAck(); err != nil {
+		log.Println("write spool ack:", err)
+	}
+}
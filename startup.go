@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+// Startup runs through these phases in order. The API starts serving once
+// the schema is verified, before the firehose is connected, and reports
+// itself as degraded until the last phase.
+const (
+	phaseWaitingForDatabase = "waiting_for_database"
+	phaseMigrating          = "migrating"
+	phaseVerifyingSchema    = "verifying_schema"
+	phaseConnectingFirehose = "connecting_firehose"
+	phaseReady              = "ready"
+)
+
+type startupState struct {
+	mu        sync.Mutex
+	phase     string
+	since     time.Time
+	attempts  int
+	lastError string
+	phases    []StartupPhase
+}
+
+type StartupPhase struct {
+	Phase      string    `json:"phase"`
+	StartedAt  time.Time `json:"startedAt"`
+	DurationMs int64     `json:"durationMs,omitempty"`
+}
+
+type StartupStatus struct {
+	Phase     string         `json:"phase"`
+	Attempts  int            `json:"attempts,omitempty"`
+	LastError string         `json:"lastError,omitempty"`
+	Phases    []StartupPhase `json:"phases"`
+}
+
+var startup = &startupState{phase: phaseWaitingForDatabase, since: startedAt}
+
+func (s *startupState) enter(phase string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	s.phases = append(s.phases, StartupPhase{Phase: s.phase, StartedAt: s.since, DurationMs: now.Sub(s.since).Milliseconds()})
+	log.Printf("startup: %s done after %s, now %s", s.phase, now.Sub(s.since).Round(time.Millisecond), phase)
+	s.phase, s.since, s.attempts, s.lastError = phase, now, 0, ""
+	sdNotify("STATUS=" + phase)
+}
+
+func (s *startupState) failed(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attempts++
+	s.lastError = err.Error()
+	log.Printf("startup: %s attempt %d failed: %v", s.phase, s.attempts, err)
+}
+
+func (s *startupState) status() StartupStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := StartupStatus{Phase: s.phase, Attempts: s.attempts, LastError: s.lastError}
+	st.Phases = append(st.Phases, s.phases...)
+	st.Phases = append(st.Phases, StartupPhase{Phase: s.phase, StartedAt: s.since})
+	return st
+}
+
+// retry calls fn until it succeeds, backing off exponentially from one
+// second up to STARTUP_MAX_BACKOFF. It gives up after timeout.
+func (s *startupState) retry(timeout time.Duration, fn func() error) error {
+	maxBackoff := envDuration("STARTUP_MAX_BACKOFF", 30*time.Second)
+	deadline := time.Now().Add(timeout)
+	backoff := time.Second
+	for {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+		s.failed(err)
+		if time.Now().Add(backoff).After(deadline) {
+			return fmt.Errorf("gave up after %s: %w", timeout, err)
+		}
+		time.Sleep(backoff)
+		backoff = min(backoff*2, maxBackoff)
+	}
+}
+
+// waitForDatabase opens a session, retrying for STARTUP_DATABASE_TIMEOUT
+// while Cassandra comes up.
+func waitForDatabase(cluster *gocql.ClusterConfig) (*gocql.Session, error) {
+	var session *gocql.Session
+	err := startup.retry(envDuration("STARTUP_DATABASE_TIMEOUT", 10*time.Minute), func() error {
+		var err error
+		session, err = cluster.CreateSession()
+		return err
+	})
+	return session, err
+}
+
+// migration creates or updates the tables of one feature. Migrations are
+// idempotent and all of them run on every start.
+type migration struct {
+	name   string
+	tables []string
+	run    func(*gocql.Session) error
+}
+
+// migrations in the order they run. Optional features only get their
+// tables when enabled.
+var migrations = []migration{
+	{"meows", []string{"meows"}, createMeowTables},
+	{"derived", []string{"meows_by_subject", "meows_by_emotion", "meows_by_actor", "meows_by_pair"}, createDerivedTables},
+	{"counts", []string{"meow_counts", "counted_meows"}, createCountTables},
+	{"emotion actors", []string{"actors_by_emotion"}, createEmotionActorTables},
+	{"actor subjects", []string{"subjects_by_actor", "subject_counts_by_actor"}, createActorSubjectTables},
+	{"actor emotions", []string{"emotion_counts_by_actor"}, createActorEmotionTables},
+	{"emotion histogram", []string{"emotion_histogram"}, createEmotionHistogramTables},
+	{"idempotency keys", []string{"idempotency_keys"}, createIdempotencyTables},
+	{"emotion vocabulary", []string{"emotion_vocabulary"}, createEmotionVocabularyTables},
+	{"actor handles", []string{"actor_handles"}, createActorHandleTables},
+	{"backfill", []string{"backfill_repos", "backfill_repos_by_state", "backfill_enumerations"}, createBackfillTables},
+	{"pending deletes", []string{"pending_deletes"}, createPendingDeleteTables},
+	{"pins", []string{"actor_pins"}, createPinTables},
+	{"events", []string{"meow_events", "meow_revs"}, createEventTables},
+	{"digest", []string{"digest_unsubscribes"}, createDigestTables},
+	{"bookmarks", []string{"bookmarks"}, createBookmarkTables},
+	{"preferences", []string{"preferences"}, createPreferenceTables},
+	{"drafts", []string{"drafts"}, createDraftTables},
+	{"api keys", []string{"api_keys", "api_keys_by_hash"}, createAPIKeyTables},
+	{"reports", []string{"reports", "reports_by_state", "reports_by_meow"}, createReportTables},
+	{"local echoes", []string{"local_echoes"}, createEchoTables},
+	{"rejections", []string{"rejected_meows"}, createRejectionTables},
+	{"moderation", []string{"meow_moderation", "actor_moderation"}, createModerationTables},
+	{"accounts", []string{"account_status"}, createAccountTables},
+	{"identities", []string{"identities", "identities_by_handle"}, createIdentityTables},
+	{"outbox", []string{"outbox"}, createOutboxTables},
+	{"timezones", []string{"actor_timezones", "meow_activity_by_offset"}, createTimezoneTables},
+	{"alerts", []string{"emotion_counts"}, createAlertTables},
+	{"ingest", []string{"ingest_state"}, createIngestTables},
+}
+
+func (m migration) enabled() bool {
+	switch m.name {
+	case "timezones":
+		return timezones != nil
+	case "alerts":
+		return alerts != nil
+	}
+	return true
+}
+
+func runMigrations(session *gocql.Session) error {
+	for _, m := range migrations {
+		if !m.enabled() {
+			continue
+		}
+		start := time.Now()
+		if err := m.run(session); err != nil {
+			return fmt.Errorf("%s: %w", m.name, err)
+		}
+		log.Printf("startup: migrated %s in %s", m.name, time.Since(start).Round(time.Millisecond))
+	}
+	return nil
+}
+
+// verifySchema checks that every table the enabled migrations create
+// exists in the cat keyspace, catching a schema change that hasn't
+// reached this node yet before the API starts using it.
+func verifySchema(session *gocql.Session) error {
+	iter := session.Query(`SELECT table_name FROM system_schema.tables WHERE keyspace_name = 'cat'`).Iter()
+	existing := map[string]bool{}
+	var name string
+	for iter.Scan(&name) {
+		existing[name] = true
+	}
+	if err := iter.Close(); err != nil {
+		return err
+	}
+	var missing []string
+	for _, m := range migrations {
+		if !m.enabled() {
+			continue
+		}
+		for _, t := range m.tables {
+			if !existing[t] {
+				missing = append(missing, t)
+			}
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("missing tables: %v", missing)
+	}
+	if err := session.AwaitSchemaAgreement(context.Background()); err != nil {
+		return fmt.Errorf("schema agreement: %w", err)
+	}
+	return nil
+}
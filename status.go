@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"html/template"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gocql/gocql"
+)
+
+var startedAt = time.Now()
+
+// firehoseState is what the ingest loop reports about the jetstream
+// connection, read by the status page.
+type firehoseState struct {
+	mu             sync.Mutex
+	connected      bool
+	connectedSince time.Time
+	lastEventAt    time.Time
+	lastEventUS    int64
+	lastError      string
+}
+
+var firehose = &firehoseState{}
+
+func (f *firehoseState) setConnected() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.connected = true
+	f.connectedSince = time.Now()
+	f.lastError = ""
+}
+
+func (f *firehoseState) setError(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.connected = false
+	f.lastError = err.Error()
+}
+
+func (f *firehoseState) event(timeUS int64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.lastEventAt = time.Now()
+	f.lastEventUS = timeUS
+}
+
+type FirehoseStatus struct {
+	Connected      bool       `json:"connected"`
+	ConnectedSince *time.Time `json:"connectedSince,omitempty"`
+	LastEventAt    *time.Time `json:"lastEventAt,omitempty"`
+	IngestLagMs    int64      `json:"ingestLagMs"`
+	// Endpoint is the jetstream host ingested from
+	Endpoint  string `json:"endpoint,omitempty"`
+	LastError string `json:"lastError,omitempty"`
+}
+
+func (f *firehoseState) status() FirehoseStatus {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	st := FirehoseStatus{Connected: f.connected, Endpoint: jetstreams.host(), LastError: f.lastError}
+	if f.connected {
+		since := f.connectedSince
+		st.ConnectedSince = &since
+	}
+	if !f.lastEventAt.IsZero() {
+		at := f.lastEventAt
+		st.LastEventAt = &at
+		st.IngestLagMs = time.Since(time.UnixMicro(f.lastEventUS)).Milliseconds()
+	}
+	return st
+}
+
+type DatabaseStatus struct {
+	Healthy   bool   `json:"healthy"`
+	LatencyMs int64  `json:"latencyMs"`
+	Error     string `json:"error,omitempty"`
+}
+
+type StatusResponse struct {
+	Status        string         `json:"status"`
+	UptimeSeconds int64          `json:"uptimeSeconds"`
+	Firehose      FirehoseStatus `json:"firehose"`
+	IngestMode    string         `json:"ingestMode"`
+	Maintenance   bool           `json:"maintenance"`
+	Database      DatabaseStatus `json:"database"`
+	Startup       StartupStatus  `json:"startup"`
+	Build         BuildInfo      `json:"build"`
+}
+
+func checkDatabase(ctx context.Context, session *gocql.Session) DatabaseStatus {
+	start := time.Now()
+	err := session.Query(`SELECT now() FROM system.local`).WithContext(ctx).Exec()
+	st := DatabaseStatus{Healthy: err == nil, LatencyMs: time.Since(start).Milliseconds()}
+	if err != nil {
+		st.Error = err.Error()
+	}
+	return st
+}
+
+var statusPage = template.Must(template.New("status").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>meowview status</title>
+<meta http-equiv="refresh" content="30">
+<style>body{font-family:sans-serif;max-width:40em;margin:2em auto;padding:0 1em}.ok{color:#2a7}.degraded{color:#c80}.down{color:#c33}td{padding:.2em .8em .2em 0}</style>
+</head>
+<body>
+<h1>meowview is <span class="{{.Status}}">{{.Status}}</span></h1>
+<table>
+{{if ne .Startup.Phase "ready"}}<tr><td>startup</td><td>{{.Startup.Phase}}{{if .Startup.LastError}} ({{.Startup.LastError}}){{end}}</td></tr>
+{{end}}<tr><td>firehose</td><td>{{if .Firehose.Connected}}connected to {{.Firehose.Endpoint}}{{else}}disconnected{{if .Firehose.LastError}} ({{.Firehose.LastError}}){{end}}{{end}}</td></tr>
+<tr><td>ingestion</td><td>{{.IngestMode}}</td></tr>
+<tr><td>api</td><td>{{if .Maintenance}}down for maintenance{{else}}serving{{end}}</td></tr>
+<tr><td>ingest lag</td><td>{{.Firehose.IngestLagMs}} ms</td></tr>
+<tr><td>database</td><td>{{if .Database.Healthy}}healthy ({{.Database.LatencyMs}} ms){{else}}unreachable ({{.Database.Error}}){{end}}</td></tr>
+<tr><td>uptime</td><td>{{.UptimeSeconds}} s</td></tr>
+<tr><td>version</td><td>{{.Build.Version}} ({{.Build.Commit}}, built {{.Build.BuildDate}})</td></tr>
+</table>
+</body>
+</html>
+`))
+
+// statusLagThreshold is how far behind ingestion may fall before the
+// service reports itself as degraded.
+var statusLagThreshold = envDuration("STATUS_LAG_THRESHOLD", 5*time.Minute)
+
+// getStatus serves the public status page as HTML, or JSON when asked for
+// with ?format=json or an Accept header.
+func getStatus(session *gocql.Session) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(c.Request.Context(), 2*time.Second)
+		defer cancel()
+
+		resp := StatusResponse{
+			Status:        "ok",
+			UptimeSeconds: int64(time.Since(startedAt).Seconds()),
+			Firehose:      firehose.status(),
+			IngestMode:    ingest.state().Mode,
+			Maintenance:   maintenance.status().Enabled,
+			Database:      checkDatabase(ctx, session),
+			Startup:       startup.status(),
+			Build:         buildInfo(),
+		}
+		// errors can quote connection strings and the like
+		resp.Database.Error = redact(resp.Database.Error)
+		resp.Firehose.LastError = redact(resp.Firehose.LastError)
+		resp.Startup.LastError = redact(resp.Startup.LastError)
+		switch {
+		case !resp.Database.Healthy:
+			resp.Status = "down"
+		case resp.Startup.Phase != phaseReady, resp.Maintenance, resp.IngestMode != ingestRunning, !resp.Firehose.Connected, time.Duration(resp.Firehose.IngestLagMs)*time.Millisecond > statusLagThreshold:
+			resp.Status = "degraded"
+		}
+
+		code := http.StatusOK
+		if resp.Status == "down" {
+			code = http.StatusServiceUnavailable
+		}
+
+		if c.Query("format") == "json" || strings.Contains(c.GetHeader("Accept"), "application/json") {
+			c.JSON(code, resp)
+			return
+		}
+		c.Status(code)
+		c.Header("Content-Type", "text/html; charset=utf-8")
+		statusPage.Execute(c.Writer, resp)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Streams are JSON by default, where field names make up much of every
+// change. With encoding=compact, subscribeMeows and /subscribe send each
+// change as a JSON array of its values instead, in the order announced by
+// a "fields" message when the stream starts, and without trailing empty
+// values. For a busy stream this roughly halves the bandwidth, which
+// matters to mobile clients; it stays JSON so any client can read it.
+
+const (
+	streamEncodingJSON    = "json"
+	streamEncodingCompact = "compact"
+)
+
+// changeFields is the order of the values of a compact subscribeMeows
+// change. IndexedAt is left out, it is time_us.
+var changeFields = []string{"op", "did", "rkey", "time_us", "cid", "emotion", "subject", "inferred_emotion", "labels", "lexicon_version"}
+
+// commitFields is the order of the values of a compact /subscribe commit.
+var commitFields = []string{"did", "time_us", "operation", "rkey", "rev", "cid", "record"}
+
+// parseStreamEncoding reads the encoding query parameter.
+func parseStreamEncoding(v string) (string, error) {
+	switch v {
+	case "", streamEncodingJSON:
+		return streamEncodingJSON, nil
+	case streamEncodingCompact:
+		return streamEncodingCompact, nil
+	}
+	return "", fmt.Errorf("encoding must be json or compact")
+}
+
+// compactChange is ch as changeFields values.
+func compactChange(ch MeowChange) []any {
+	var labels any
+	if len(ch.Labels) > 0 {
+		labels = ch.Labels
+	}
+	return trimValues([]any{
+		ch.Op, ch.DID, ch.Rkey, ch.TimeUS, ch.CID, ch.Emotion, ch.Subject,
+		ch.InferredEmotion, labels, ch.LexiconVersion,
+	})
+}
+
+// compactCommit is ev as commitFields values.
+func compactCommit(ev jetstreamEvent) []any {
+	var record any
+	if len(ev.Commit.Record) > 0 {
+		record = ev.Commit.Record
+	}
+	return trimValues([]any{
+		ev.DID, ev.TimeUS, ev.Commit.Operation, ev.Commit.Rkey, ev.Commit.Rev,
+		ev.Commit.CID, record,
+	})
+}
+
+// trimValues drops trailing empty values; the ones before stay in place
+// to keep the positions.
+func trimValues(values []any) []any {
+	n := len(values)
+	for n > 0 {
+		switch v := values[n-1].(type) {
+		case nil:
+		case string:
+			if v != "" {
+				return values[:n]
+			}
+		case int:
+			// lexicon_version
+			if v != 0 {
+				return values[:n]
+			}
+		case int64:
+			// time_us
+			if v != 0 {
+				return values[:n]
+			}
+		case json.RawMessage:
+			if len(v) > 0 {
+				return values[:n]
+			}
+		default:
+			return values[:n]
+		}
+		n--
+	}
+	return values[:n]
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/baphotex/meowview/didresolve"
+	"github.com/gin-gonic/gin"
+	"github.com/gocql/gocql"
+)
+
+// handleRegex matches an atproto handle, after lowercasing.
+var handleRegex = regexp.MustCompile(`^([a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?\.)+[a-z]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// normalizeSubject brings a subject into the one form it is stored and
+// queried in, so the same subject written differently isn't split across
+// partitions: whitespace is trimmed, DIDs are lowercased where their method
+// is case-insensitive, and handles, bare or as an AT-URI authority, are
+// resolved to their DID. It returns "" for a handle that doesn't resolve.
+func normalizeSubject(ctx context.Context, subject string) string {
+	subject = strings.TrimSpace(subject)
+	if rest, ok := cutPrefixFold(subject, "at://"); ok {
+		authority, path, hasPath := strings.Cut(rest, "/")
+		did := normalizeActor(ctx, authority)
+		if did == "" {
+			return ""
+		}
+		if !hasPath {
+			return "at://" + did
+		}
+		return "at://" + did + "/" + path
+	}
+	return normalizeActor(ctx, subject)
+}
+
+// normalizeActor normalizes a DID, or resolves a handle to one.
+func normalizeActor(ctx context.Context, actor string) string {
+	if rest, ok := cutPrefixFold(actor, "did:"); ok {
+		method, id, _ := strings.Cut(rest, ":")
+		method = strings.ToLower(method)
+		switch method {
+		case "plc", "web":
+			// plc identifiers are lowercase base32, web ones hostnames
+			id = strings.ToLower(id)
+		}
+		return "did:" + method + ":" + id
+	}
+
+	handle := strings.ToLower(strings.TrimPrefix(actor, "@"))
+	if !handleRegex.MatchString(handle) {
+		return actor
+	}
+	did, err := didresolve.ResolveHandle(ctx, outbound, handle)
+	if err != nil {
+		log.Printf("resolve handle %s: %v", handle, err)
+		return ""
+	}
+	// the handle only counts when the DID claims it back
+	doc, err := didResolver.Resolve(ctx, did)
+	if err != nil || strings.ToLower(doc.Handle()) != handle {
+		log.Printf("handle %s does not verify against %s", handle, did)
+		return ""
+	}
+	return did
+}
+
+func cutPrefixFold(s, prefix string) (string, bool) {
+	if len(s) < len(prefix) || !strings.EqualFold(s[:len(prefix)], prefix) {
+		return s, false
+	}
+	return s[len(prefix):], true
+}
+
+// NormalizeResult counts what a normalizeSubjects run did.
+type NormalizeResult struct {
+	Scanned    int `json:"scanned"`
+	Normalized int `json:"normalized"`
+	// Skipped rows still have a random id; run rekeyMeows first.
+	Skipped int `json:"skipped"`
+	// Unresolved rows have a handle subject that no longer resolves and
+	// are left as they are.
+	Unresolved int `json:"unresolved"`
+}
+
+// normalizeSubjects rewrites the subject of meows stored before subjects
+// were normalized, moving their derived rows along, so getSubjectMeows
+// finds them under the normalized subject. It is safe to run again.
+func normalizeSubjects(session *gocql.Session) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := c.Request.Context()
+		iter := session.Query(`
+			SELECT id, ` + meowColumns + `, WRITETIME(subject)
+			FROM meows`,
+		).WithContext(ctx).Iter()
+
+		var res NormalizeResult
+		var id gocql.UUID
+		var row meowRow
+		var written int64
+		dest := append([]any{&id}, append(row.dest(), &written)...)
+		for iter.Scan(dest...) {
+			res.Scanned++
+			m := row.meow()
+			subject := normalizeSubject(ctx, m.Subject)
+			switch {
+			case subject == m.Subject:
+				continue
+			case id != meowID(m.DID, m.Rkey):
+				res.Skipped++
+				continue
+			case subject == "":
+				res.Unresolved++
+				continue
+			}
+
+			// reindexed under the time_us it had, see derivedTimeUS
+			derivedTime := removeDerivedMeows(session, m.DID, m.Rkey)
+			// one microsecond past the old value, so a newer write wins
+			err := session.Query(`UPDATE meows USING TIMESTAMP ? SET subject = ? WHERE id = ?`,
+				written+1, subject, id,
+			).WithContext(ctx).Exec()
+			if err != nil {
+				iter.Close()
+				log.Printf("normalize subject of %s: %v", meowURI(m.DID, m.Rkey), err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "normalize failed", "result": res})
+				return
+			}
+			m.Subject = subject
+			if derivedTime != 0 {
+				m.TimeUS = derivedTime
+			}
+			indexDerivedMeow(session, m)
+			res.Normalized++
+		}
+		if err := iter.Close(); err != nil {
+			log.Println("normalize scan error:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "normalize failed", "result": res})
+			return
+		}
+		log.Printf("normalized %d of %d meow subjects", res.Normalized, res.Scanned)
+		c.JSON(http.StatusOK, res)
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gocql/gocql"
+)
+
+// Timezone enrichment is off unless ACTOR_TIMEZONE_ENRICHMENT=true.
+//
+// What it does and doesn't collect:
+//   - the only input is the timezone an actor declares themselves in the
+//     description of their public Bluesky profile, as an IANA zone name
+//     ("Europe/Berlin") or a UTC offset ("UTC+2"); IP addresses are never
+//     looked at
+//   - only the whole hour UTC offset is kept, not the zone name
+//   - stored offsets expire after ACTOR_TIMEZONE_TTL and are re-read from
+//     the profile, so removing the timezone from a profile removes it here
+//   - stats only ever expose meow counts per offset, never per actor
+
+var (
+	ianaZoneRegex  = regexp.MustCompile(`\b([A-Z][A-Za-z_]+/[A-Z][A-Za-z_]+(?:/[A-Z][A-Za-z_]+)?)\b`)
+	utcOffsetRegex = regexp.MustCompile(`\b(?:UTC|GMT)\s?([+-−])\s?(\d{1,2})(?::?(\d{2}))?\b`)
+)
+
+// declaredUTCOffset finds a declared timezone in profile text and returns
+// its current offset from UTC in whole hours.
+func declaredUTCOffset(text string) (int, bool) {
+	if m := utcOffsetRegex.FindStringSubmatch(text); m != nil {
+		hours, _ := strconv.Atoi(m[2])
+		if hours > 14 {
+			return 0, false
+		}
+		if m[1] != "+" {
+			hours = -hours
+		}
+		return hours, true
+	}
+	for _, m := range ianaZoneRegex.FindAllStringSubmatch(text, -1) {
+		loc, err := time.LoadLocation(m[1])
+		if err != nil {
+			continue
+		}
+		_, offset := time.Now().In(loc).Zone()
+		return int(offset / 3600), true
+	}
+	return 0, false
+}
+
+type actorTimezone struct {
+	offset   int
+	known    bool
+	resolved time.Time
+}
+
+// timezoneEnricher resolves actors' declared timezones in the background
+// and counts meows per UTC offset. A meow from an actor whose timezone
+// isn't resolved yet is not counted.
+type timezoneEnricher struct {
+	appview string
+	ttl     time.Duration
+
+	mu       sync.Mutex
+	actors   map[string]actorTimezone
+	inflight map[string]bool
+	sem      chan struct{}
+}
+
+func newTimezoneEnricher() *timezoneEnricher {
+	if !envBool("ACTOR_TIMEZONE_ENRICHMENT", false) {
+		return nil
+	}
+	return &timezoneEnricher{
+		appview:  envString("ACTOR_TIMEZONE_APPVIEW", "https://public.api.bsky.app"),
+		ttl:      envDuration("ACTOR_TIMEZONE_TTL", 7*24*time.Hour),
+		actors:   map[string]actorTimezone{},
+		inflight: map[string]bool{},
+		sem:      make(chan struct{}, 4),
+	}
+}
+
+var timezones = newTimezoneEnricher()
+
+func createTimezoneTables(session *gocql.Session) error {
+	err := session.Query(`
+		CREATE TABLE IF NOT EXISTS actor_timezones (
+			did TEXT PRIMARY KEY,
+			utc_offset INT
+		)`).Exec()
+	if err != nil {
+		return err
+	}
+
+	return session.Query(`
+		CREATE TABLE IF NOT EXISTS meow_activity_by_offset (
+			day TEXT,
+			utc_offset INT,
+			meows COUNTER,
+			PRIMARY KEY ((day), utc_offset)
+		)`).Exec()
+}
+
+// observe counts a newly created meow under its author's offset, and
+// starts resolving the author's timezone if it isn't known or is stale.
+func (tz *timezoneEnricher) observe(session *gocql.Session, did string, timeUS int64) {
+	tz.mu.Lock()
+	actor, ok := tz.actors[did]
+	stale := !ok || time.Since(actor.resolved) > tz.ttl
+	if stale && !tz.inflight[did] {
+		tz.inflight[did] = true
+		go tz.resolve(session, did)
+	}
+	tz.mu.Unlock()
+
+	if !ok || !actor.known {
+		return
+	}
+	err := session.Query(`
+		UPDATE meow_activity_by_offset SET meows = meows + 1
+		WHERE day = ? AND utc_offset = ?`,
+		eventDay(timeUS), actor.offset,
+	).Exec()
+	if err != nil {
+		log.Println("update meow_activity_by_offset error:", err)
+	}
+}
+
+func (tz *timezoneEnricher) resolve(session *gocql.Session, did string) {
+	tz.sem <- struct{}{}
+	defer func() { <-tz.sem }()
+
+	actor := actorTimezone{resolved: time.Now()}
+	ctx, cancel := context.WithTimeout(background(context.Background()), 10*time.Second)
+	defer cancel()
+	description, err := tz.profileDescription(ctx, did)
+	if errors.Is(err, errOutboundDeferred) {
+		// the appview is busy, try again on a later meow
+		actor.resolved = time.Now().Add(5*time.Minute - tz.ttl)
+	} else if err != nil {
+		log.Printf("resolve timezone for %s: %v", did, err)
+		// try again on a later meow, but not right away
+		actor.resolved = time.Now().Add(time.Hour - tz.ttl)
+	} else {
+		actor.offset, actor.known = declaredUTCOffset(description)
+		if actor.known {
+			err = session.Query(`INSERT INTO actor_timezones (did, utc_offset) VALUES (?, ?) USING TTL ?`,
+				did, actor.offset, int(tz.ttl.Seconds())).Exec()
+		} else {
+			err = session.Query(`DELETE FROM actor_timezones WHERE did = ?`, did).Exec()
+		}
+		if err != nil {
+			log.Println("store actor timezone error:", err)
+		}
+	}
+
+	tz.mu.Lock()
+	tz.actors[did] = actor
+	delete(tz.inflight, did)
+	tz.mu.Unlock()
+}
+
+func (tz *timezoneEnricher) profileDescription(ctx context.Context, did string) (string, error) {
+	u := tz.appview + "/xrpc/app.bsky.actor.getProfile?actor=" + url.QueryEscape(did)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := outbound.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusBadRequest {
+		// no bluesky profile
+		return "", nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("getProfile returned %s", resp.Status)
+	}
+	var profile struct {
+		Description string `json:"description"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&profile); err != nil {
+		return "", err
+	}
+	return profile.Description, nil
+}
+
+type TimezoneActivity struct {
+	UTCOffset int `json:"utc_offset"`
+	Meows     int `json:"meows"`
+}
+
+// getActivityByTimezone sums meows per UTC offset over the last ?days=
+// days (default 7, at most 30).
+func getActivityByTimezone(session *gocql.Session) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		days := 7
+		if v := c.Query("days"); v != "" {
+			d, err := strconv.Atoi(v)
+			if err != nil || d < 1 || d > 30 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "days must be between 1 and 30"})
+				return
+			}
+			days = d
+		}
+
+		totals := map[int]int{}
+		now := time.Now().UTC()
+		for i := 0; i < days; i++ {
+			day := now.AddDate(0, 0, -i).Format("2006-01-02")
+			iter := session.Query(`
+				SELECT utc_offset, meows FROM meow_activity_by_offset WHERE day = ?`,
+				day,
+			).WithContext(c.Request.Context()).Iter()
+			var offset, meows int
+			for iter.Scan(&offset, &meows) {
+				totals[offset] += meows
+			}
+			if err := iter.Close(); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+		}
+
+		activity := make([]TimezoneActivity, 0, len(totals))
+		for offset, meows := range totals {
+			activity = append(activity, TimezoneActivity{UTCOffset: offset, Meows: meows})
+		}
+		sort.Slice(activity, func(i, j int) bool { return activity[i].UTCOffset < activity[j].UTCOffset })
+		c.JSON(http.StatusOK, gin.H{"days": days, "activity": activity})
+	}
+}
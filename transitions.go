@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gocql/gocql"
+)
+
+// transitionHistoryLimit caps how much of an actor's history is walked.
+const transitionHistoryLimit = 1000
+
+type EmotionTransition struct {
+	From        string  `json:"from"`
+	To          string  `json:"to"`
+	Count       int     `json:"count"`
+	Probability float64 `json:"probability"`
+}
+
+type EmotionTransitionsResponse struct {
+	DID         string              `json:"did"`
+	Meows       int                 `json:"meows"`
+	Transitions []EmotionTransition `json:"transitions"`
+}
+
+// emotionTransitions counts how often each emotion is followed by another
+// in a chronologically ordered list of emotions. Probability is relative to
+// every transition leaving the same emotion.
+func emotionTransitions(emotions []string) []EmotionTransition {
+	counts := map[[2]string]int{}
+	outgoing := map[string]int{}
+	for i := 1; i < len(emotions); i++ {
+		pair := [2]string{emotions[i-1], emotions[i]}
+		counts[pair]++
+		outgoing[pair[0]]++
+	}
+
+	transitions := make([]EmotionTransition, 0, len(counts))
+	for pair, n := range counts {
+		transitions = append(transitions, EmotionTransition{
+			From:        pair[0],
+			To:          pair[1],
+			Count:       n,
+			Probability: float64(n) / float64(outgoing[pair[0]]),
+		})
+	}
+	sort.Slice(transitions, func(i, j int) bool {
+		a, b := transitions[i], transitions[j]
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		if a.From != b.From {
+			return a.From < b.From
+		}
+		return a.To < b.To
+	})
+	return transitions
+}
+
+func getEmotionTransitions(session *gocql.Session) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		did := c.Query("did")
+		validatedDid := validateDID(did)
+		if validatedDid == "" || validatedDid != did {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid did"})
+			return
+		}
+
+		// newest first from the table, reversed below
+		iter := session.Query(`
+			SELECT emotion, inferred_emotion
+			FROM cat.meows_by_actor
+			WHERE did = ?
+			LIMIT ?`,
+			validatedDid, transitionHistoryLimit,
+		).WithContext(c.Request.Context()).Iter()
+
+		var emotions []string
+		var row meowRow
+		for iter.Scan(&row.Emotion, &row.InferredEmotion) {
+			// meows without any emotion don't take part in the chain
+			if emotion, _ := effectiveEmotion(row.meow()); emotion != "" {
+				emotions = append(emotions, emotion)
+			}
+			row = meowRow{}
+		}
+		if err := iter.Close(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		for i, j := 0, len(emotions)-1; i < j; i, j = i+1, j-1 {
+			emotions[i], emotions[j] = emotions[j], emotions[i]
+		}
+
+		c.JSON(http.StatusOK, EmotionTransitionsResponse{
+			DID:         validatedDid,
+			Meows:       len(emotions),
+			Transitions: emotionTransitions(emotions),
+		})
+	}
+}
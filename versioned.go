@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gocql/gocql"
+)
+
+// Moderation state and preferences carry a version that every write bumps
+// with a lightweight transaction, so two moderators, or two of a viewer's
+// devices, can't overwrite each other's change unnoticed. A write naming
+// the version it was based on fails with 409 Conflict and the current
+// version when another write got in first; one without is retried on top
+// of the other. Rows from before versions, and missing rows, are at
+// version 0.
+
+// versionedWriteAttempts bounds the retries of writes without an expected
+// version.
+const versionedWriteAttempts = 5
+
+type conflictError struct {
+	current int
+}
+
+func (e *conflictError) Error() string {
+	return fmt.Sprintf("changed concurrently, now at version %d", e.current)
+}
+
+// versionCondition is the IF clause of a write on top of version v.
+func versionCondition(v int) (string, []any) {
+	if v == 0 {
+		return ` IF version = null`, nil
+	}
+	return ` IF version = ?`, []any{v}
+}
+
+// casExec runs a conditional write and reports whether it applied.
+func casExec(q *gocql.Query) (bool, error) {
+	return q.MapScanCAS(map[string]interface{}{})
+}
+
+// versionedWrite reads a row's version with read and writes on top of it
+// with write, which returns whether its condition held. With expected set
+// the write must be on top of that version. It returns the new version.
+func versionedWrite(expected *int, read func() (int, error), write func(current int) (bool, error)) (int, error) {
+	for attempt := 0; ; attempt++ {
+		current, err := read()
+		if err != nil {
+			return 0, err
+		}
+		if expected != nil && *expected != current {
+			return 0, &conflictError{current: current}
+		}
+		applied, err := write(current)
+		if err != nil {
+			return 0, err
+		}
+		if applied {
+			return current + 1, nil
+		}
+		if expected != nil || attempt+1 >= versionedWriteAttempts {
+			if current, err = read(); err != nil {
+				return 0, err
+			}
+			return 0, &conflictError{current: current}
+		}
+	}
+}
+
+// respondWriteError answers a failed versioned write, with 409 and the
+// current version on a conflict.
+func respondWriteError(c *gin.Context, err error, extra gin.H) {
+	body := gin.H{"error": err.Error()}
+	for k, v := range extra {
+		body[k] = v
+	}
+	status := http.StatusInternalServerError
+	if conflict, ok := err.(*conflictError); ok {
+		status = http.StatusConflict
+		body["version"] = conflict.current
+	}
+	c.JSON(status, body)
+}
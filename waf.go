@@ -0,0 +1,227 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// The firewall drops requests no client of ours sends before they reach a
+// handler or the database:
+//
+//   - traversal: a ".." segment or a NUL byte in the path or a query value,
+//     also percent-encoded, probing for files
+//   - url_length: a URL longer than WAF_MAX_URL_LENGTH (4096) bytes
+//   - param_length: a query value longer than WAF_MAX_PARAM_LENGTH (1024)
+//   - params: more than WAF_MAX_PARAMS (64) query values
+//   - body_size: a declared body over WAF_MAX_BODY_BYTES (1 MiB)
+//   - user_agent: a User-Agent containing one of WAF_BLOCKED_USER_AGENTS,
+//     scanners by default
+//
+// WAF_DISABLED_RULES switches rules off by name, and WAF_MODE=log only
+// counts what would have been dropped, to try new limits out. All of them
+// are reloaded with the config. meowview_waf_blocked_total counts the
+// requests each rule matched.
+//
+// With AUTH_REJECT_REPLAYED=true, service auth tokens carrying a jti nonce
+// are remembered until they expire and a token presented a second time is
+// refused, so a token captured from one request can't be replayed. Each
+// instance remembers its own tokens. Without it nothing is remembered.
+const (
+	wafBlock = "block"
+	wafLog   = "log"
+	wafOff   = "off"
+)
+
+var wafBlocked = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "meowview_waf_blocked_total",
+	Help: "Requests matched by a firewall rule, by rule and whether they were dropped (block) or only counted (log).",
+}, []string{"rule", "mode"})
+
+var defaultBlockedUserAgents = []string{
+	"sqlmap", "nikto", "nmap", "masscan", "zgrab", "nuclei",
+	"dirbuster", "gobuster", "wpscan", "acunetix", "netsparker",
+}
+
+type wafRules struct {
+	mode           string
+	maxURLLength   int
+	maxParamLength int
+	maxParams      int
+	maxBodyBytes   int64
+	userAgents     []string
+	disabled       map[string]bool
+}
+
+var waf atomic.Pointer[wafRules]
+
+func loadWAFRules() (*wafRules, error) {
+	r := &wafRules{
+		mode:           envString("WAF_MODE", wafBlock),
+		maxURLLength:   envInt("WAF_MAX_URL_LENGTH", 4096),
+		maxParamLength: envInt("WAF_MAX_PARAM_LENGTH", 1024),
+		maxParams:      envInt("WAF_MAX_PARAMS", 64),
+		maxBodyBytes:   int64(envInt("WAF_MAX_BODY_BYTES", 1<<20)),
+		userAgents:     defaultBlockedUserAgents,
+		disabled:       map[string]bool{},
+	}
+	if r.mode != wafBlock && r.mode != wafLog && r.mode != wafOff {
+		return nil, fmt.Errorf("WAF_MODE must be block, log or off, not %q", r.mode)
+	}
+	if getenv("WAF_BLOCKED_USER_AGENTS") != "" {
+		r.userAgents = nil
+		for _, ua := range envList("WAF_BLOCKED_USER_AGENTS") {
+			r.userAgents = append(r.userAgents, strings.ToLower(ua))
+		}
+	}
+	for _, rule := range envList("WAF_DISABLED_RULES") {
+		switch rule {
+		case "traversal", "url_length", "param_length", "params", "body_size", "user_agent":
+			r.disabled[rule] = true
+		default:
+			return nil, fmt.Errorf("WAF_DISABLED_RULES: unknown rule %q", rule)
+		}
+	}
+	return r, nil
+}
+
+func reloadWAF() (func(), error) {
+	r, err := loadWAFRules()
+	if err != nil {
+		return nil, err
+	}
+	return func() { waf.Store(r) }, nil
+}
+
+// match returns the rule a request breaks, and the status to drop it with.
+func (r *wafRules) match(req *http.Request) (string, int) {
+	check := func(rule string) bool { return !r.disabled[rule] }
+
+	if check("url_length") && len(req.URL.RequestURI()) > r.maxURLLength {
+		return "url_length", http.StatusRequestURITooLong
+	}
+	if check("body_size") && req.ContentLength > r.maxBodyBytes {
+		return "body_size", http.StatusRequestEntityTooLarge
+	}
+	if check("traversal") && suspiciousPath(req.URL.EscapedPath()) {
+		return "traversal", http.StatusBadRequest
+	}
+	query, err := url.ParseQuery(req.URL.RawQuery)
+	if err != nil {
+		query = req.URL.Query()
+	}
+	params := 0
+	for _, values := range query {
+		for _, v := range values {
+			params++
+			if check("param_length") && len(v) > r.maxParamLength {
+				return "param_length", http.StatusBadRequest
+			}
+			if check("traversal") && suspiciousPath(v) {
+				return "traversal", http.StatusBadRequest
+			}
+		}
+	}
+	if check("params") && params > r.maxParams {
+		return "params", http.StatusBadRequest
+	}
+	if check("user_agent") {
+		ua := strings.ToLower(req.UserAgent())
+		for _, bad := range r.userAgents {
+			if strings.Contains(ua, bad) {
+				return "user_agent", http.StatusForbidden
+			}
+		}
+	}
+	return "", 0
+}
+
+// suspiciousPath reports whether s, decoded up to twice, has a ".."
+// segment or a NUL byte. Dots elsewhere, as in "meh...", are fine.
+func suspiciousPath(s string) bool {
+	for i := 0; i < 3; i++ {
+		if strings.Contains(s, "\x00") || dotDotSegment(s) {
+			return true
+		}
+		decoded, err := url.PathUnescape(s)
+		if err != nil || decoded == s {
+			return false
+		}
+		s = decoded
+	}
+	return false
+}
+
+func dotDotSegment(s string) bool {
+	segments := strings.FieldsFunc(s, func(r rune) bool { return r == '/' || r == '\\' })
+	for _, seg := range segments {
+		if seg == ".." {
+			return true
+		}
+	}
+	return false
+}
+
+// firewall drops requests matching a rule, see above.
+func firewall() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		r := waf.Load()
+		if r == nil || r.mode == wafOff {
+			c.Next()
+			return
+		}
+		rule, status := r.match(c.Request)
+		if rule == "" {
+			c.Next()
+			return
+		}
+		wafBlocked.WithLabelValues(rule, r.mode).Inc()
+		if r.mode == wafLog {
+			c.Next()
+			return
+		}
+		c.AbortWithStatusJSON(status, gin.H{"error": "request blocked"})
+	}
+}
+
+var rejectReplayedTokens = envBool("AUTH_REJECT_REPLAYED", false)
+
+// seenTokens are the jti of service auth tokens until they expire.
+var seenTokens = struct {
+	sync.Mutex
+	expires map[string]time.Time
+	swept   time.Time
+}{expires: map[string]time.Time{}}
+
+// replayedToken records a token's jti, and reports whether it was seen
+// before while replay protection is on.
+func replayedToken(iss, jti string, exp int64) bool {
+	if !rejectReplayedTokens || jti == "" {
+		return false
+	}
+	key := iss + " " + jti
+	now := time.Now()
+	seenTokens.Lock()
+	defer seenTokens.Unlock()
+	if now.Sub(seenTokens.swept) > time.Minute {
+		for k, e := range seenTokens.expires {
+			if now.After(e) {
+				delete(seenTokens.expires, k)
+			}
+		}
+		seenTokens.swept = now
+	}
+	if e, ok := seenTokens.expires[key]; ok && now.Before(e) {
+		return true
+	}
+	seenTokens.expires[key] = time.Unix(exp, 0)
+	return false
+}